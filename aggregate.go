@@ -0,0 +1,162 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"math/bits"
+)
+
+// aggregates over many buffers, each a single pass over the words that
+// allocates only the result, as long as the longest input, shorter inputs
+// padded with off bits the same as Or() and Xor() treat them
+
+// a new buffer as long as the longest of bufs
+func newAggregate[W Word](bufs []*Bits[W]) *Bits[W] {
+	l := uint(0)
+	for _, b := range bufs {
+		l = max(l, b.byte_len)
+	}
+	return NewBits[W](l)
+}
+
+// word i of b, zero past its end
+func wordAt[W Word](b *Bits[W], i int) W {
+	if i < len(b.buff) {
+		return b.buff[i]
+	}
+	return 0
+}
+
+// returns a new buffer with the bits set in any of bufs
+func OrMany[W Word](bufs ...*Bits[W]) *Bits[W] {
+	r := newAggregate(bufs)
+	for _, b := range bufs {
+		for i, w := range b.buff {
+			r.buff[i] |= w
+		}
+	}
+	return r
+}
+
+// returns a new buffer with the bits set in an odd number of bufs
+func XorMany[W Word](bufs ...*Bits[W]) *Bits[W] {
+	r := newAggregate(bufs)
+	for _, b := range bufs {
+		for i, w := range b.buff {
+			r.buff[i] ^= w
+		}
+	}
+	return r
+}
+
+// returns a new buffer with the bits set in all of bufs, none for no bufs
+func AndMany[W Word](bufs ...*Bits[W]) *Bits[W] {
+	r := newAggregate(bufs)
+	if len(bufs) == 0 {
+		return r
+	}
+	for i := range r.buff {
+		w := ^W(0)
+		for _, b := range bufs {
+			if w &= wordAt(b, i); w == 0 {
+				break
+			}
+		}
+		r.buff[i] = w
+	}
+	return r
+}
+
+// returns a new buffer with the bits set in at least k of bufs
+// each word is counted with carry-save adders: inputs are taken three at a
+// time through a full adder, whose sum and carry go into a bit-sliced
+// counter, slice j holding bit j of the count of every bit position, that
+// is then compared with k a slice at a time
+func Threshold[W Word](k uint, bufs ...*Bits[W]) *Bits[W] {
+	n := uint(len(bufs))
+	switch {
+	case k == 0:
+		return newAggregate(bufs).SetOnAll()
+	case k == 1:
+		return OrMany(bufs...)
+	case k == n:
+		return AndMany(bufs...)
+	case k > n:
+		return newAggregate(bufs)
+	}
+
+	r := newAggregate(bufs)
+	depth := bits.Len(n)
+	var count [64]W
+	for i := range r.buff {
+		clear(count[:depth])
+		j := 0
+		for ; j+3 <= len(bufs); j += 3 {
+			a, b, c := wordAt(bufs[j], i), wordAt(bufs[j+1], i), wordAt(bufs[j+2], i)
+			u := a ^ b
+			addSlice(count[:depth], 0, u^c)
+			addSlice(count[:depth], 1, a&b|u&c)
+		}
+		for ; j < len(bufs); j++ {
+			addSlice(count[:depth], 0, wordAt(bufs[j], i))
+		}
+		r.buff[i] = atLeast(count[:depth], k)
+	}
+	return r
+}
+
+// adds x, of weight 2^at, to the bit-sliced counter
+func addSlice[W Word](count []W, at int, x W) {
+	for j := at; x != 0; j++ {
+		carry := count[j] & x
+		count[j] ^= x
+		x = carry
+	}
+}
+
+// bits whose count in the bit-sliced counter is at least k
+func atLeast[W Word](count []W, k uint) W {
+	var gt W
+	eq := ^W(0)
+	for j := len(count) - 1; j >= 0; j-- {
+		if k>>j&1 != 0 {
+			eq &= count[j]
+		} else {
+			gt |= eq & count[j]
+			eq &^= count[j]
+		}
+	}
+	return gt | eq
+}
+
+// returns a new buffer with the bits set in more than half of bufs, the
+// bundling operation of hyperdimensional computing
+// with an even number of bufs ties are off, pass an extra buffer, such as a
+// random one, to break them
+func Majority[W Word](bufs ...*Bits[W]) *Bits[W] {
+	return Threshold(uint(len(bufs))/2+1, bufs...)
+}
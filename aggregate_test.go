@@ -0,0 +1,149 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// n random buffers of up to 40 bytes
+func randomBufs[W Word](rnd *rand.Rand, n int) []*Bits[W] {
+	r := make([]*Bits[W], n)
+	for i := range r {
+		b := NewBits[W](uint(1 + rnd.Intn(40)))
+		// vary the density so counts spread over all thresholds
+		p := rnd.Float64()
+		for j := uint(0); j < b.LenBits(); j++ {
+			if rnd.Float64() < p {
+				b.Set(j)
+			}
+		}
+		r[i] = b
+	}
+	return r
+}
+
+// number of bufs with bit i set
+func naiveCount[W Word](bufs []*Bits[W], i uint) uint {
+	n := uint(0)
+	for _, b := range bufs {
+		if b.IsSet(i) {
+			n++
+		}
+	}
+	return n
+}
+
+func checkAggregate[W Word](t *testing.T, what string, got *Bits[W], bufs []*Bits[W], fn func(count uint) bool) {
+	t.Helper()
+	want := uint(KGROW_BYTES)
+	if len(bufs) > 0 {
+		want = 0
+		for _, b := range bufs {
+			want = max(want, b.LenBytes())
+		}
+	}
+	if got.LenBytes() != want {
+		t.Fatalf("%v of %v: %v bytes, want %v", what, len(bufs), got.LenBytes(), want)
+	}
+	for i := uint(0); i < got.LenBits(); i++ {
+		if got.IsSet(i) != fn(naiveCount(bufs, i)) {
+			t.Fatalf("%v of %v: bit %v is %v with count %v", what, len(bufs), i, got.IsSet(i), naiveCount(bufs, i))
+		}
+	}
+}
+
+func testAggregates[W Word](t *testing.T) {
+	rnd := rand.New(rand.NewSource(50))
+	for _, n := range []int{0, 1, 2, 3, 4, 5, 7, 8, 9, 16, 31, 40} {
+		bufs := randomBufs[W](rnd, n)
+		nn := uint(n)
+		checkAggregate(t, "OrMany", OrMany(bufs...), bufs, func(c uint) bool { return c > 0 })
+		checkAggregate(t, "AndMany", AndMany(bufs...), bufs, func(c uint) bool { return n > 0 && c == nn })
+		checkAggregate(t, "XorMany", XorMany(bufs...), bufs, func(c uint) bool { return c%2 == 1 })
+		checkAggregate(t, "Majority", Majority(bufs...), bufs, func(c uint) bool { return 2*c > nn })
+		for k := uint(0); k <= nn+1; k++ {
+			checkAggregate(t, fmt.Sprint("Threshold ", k), Threshold(k, bufs...), bufs, func(c uint) bool { return c >= k })
+		}
+	}
+}
+
+func TestAggregates(t *testing.T) {
+	t.Run("uint8", testAggregates[uint8])
+	t.Run("uint16", testAggregates[uint16])
+	t.Run("uint32", testAggregates[uint32])
+	t.Run("uint64", testAggregates[uint64])
+}
+
+func TestAggregatesAllocs(t *testing.T) {
+	rnd := rand.New(rand.NewSource(51))
+	many := randomBufs[uint64](rnd, 100)
+	few := many[:3]
+	for name, fn := range map[string]func(bufs []*BitBuffer){
+		"OrMany":    func(bufs []*BitBuffer) { OrMany(bufs...) },
+		"AndMany":   func(bufs []*BitBuffer) { AndMany(bufs...) },
+		"XorMany":   func(bufs []*BitBuffer) { XorMany(bufs...) },
+		"Threshold": func(bufs []*BitBuffer) { Threshold(2, bufs...) },
+		"Majority":  func(bufs []*BitBuffer) { Majority(bufs...) },
+	} {
+		// only the result is allocated, whatever the number of inputs, the
+		// count itself varies with the toolchain and the race detector
+		a := testing.AllocsPerRun(10, func() { fn(few) })
+		b := testing.AllocsPerRun(10, func() { fn(many) })
+		if a != b {
+			t.Errorf("%v: %v allocations for 3 inputs, %v for 100", name, a, b)
+		}
+	}
+}
+
+func BenchmarkThreshold(b *testing.B) {
+	rnd := rand.New(rand.NewSource(52))
+	bufs := make([]*BitBuffer, 256)
+	for i := range bufs {
+		bufs[i] = NewBitBuffer(1 << 13).FromUint64s(randomFingerprint(rnd, 1<<10))
+	}
+	b.Run("Majority", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			Majority(bufs...)
+		}
+	})
+	b.Run("OrMany", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			OrMany(bufs...)
+		}
+	})
+	b.Run("OrPairwise", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			r := bufs[0].Clone()
+			for _, x := range bufs[1:] {
+				r.Or(x)
+			}
+		}
+	})
+}
@@ -0,0 +1,130 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import "fmt"
+
+// elementary cellular automata: cell i of the buffer is bit i, its
+// neighbours are cells i-1 (left) and i+1 (right), and rule bit
+// 4*left + 2*cell + right gives the cell's next value, Wolfram's numbering
+// the automaton spans LenBits() cells
+
+// what lies past the first and last cells of an automaton
+type CABoundary int
+
+const (
+	// cells past the ends are off
+	KCA_ZERO CABoundary = iota
+	// cells past the ends are on
+	KCA_ONE
+	// the ends wrap around, a ring of cells
+	KCA_WRAP
+)
+
+// value of the cell past an end, other is the cell at the opposite end
+func (b CABoundary) cell(other bool) bool {
+	switch b {
+	case KCA_ZERO:
+		return false
+	case KCA_ONE:
+		return true
+	case KCA_WRAP:
+		return other
+	}
+	panic(fmt.Sprintf("mbits: unknown automaton boundary %v", int(b)))
+}
+
+// advances the buffer one generation of elementary automaton rule
+// every word is evaluated at once: the left and right neighbours are the
+// words shifted by one bit, and the rule is the OR of the neighbourhood
+// patterns it maps to 1
+// returns pointer to self
+func (m *Bits[W]) Step(rule uint8, boundary CABoundary) *Bits[W] {
+	m.mustWrite()
+	n := m.LenBits()
+	if n == 0 {
+		return m
+	}
+	wbits := m.WordBits()
+	// the cells past either end
+	left := boundary.cell(m.IsSet(n - 1))
+	right := boundary.cell(m.IsSet(0))
+
+	var prev W
+	last := uint(len(m.buff)) - 1
+	for i := uint(0); i <= last; i++ {
+		c := m.buff[i]
+		var next W
+		if i < last {
+			next = m.buff[i+1]
+		}
+		l := c<<1 | prev>>(wbits-1)
+		r := c>>1 | next<<(wbits-1)
+		if i == 0 && left {
+			l |= 1
+		}
+		if i == last && right {
+			r |= 1 << ((n - 1) % wbits)
+		}
+
+		var v W
+		for p := uint(0); p < 8; p++ {
+			if rule>>p&1 == 0 {
+				continue
+			}
+			t := ^W(0)
+			for _, s := range [3]struct {
+				bit  uint
+				word W
+			}{{4, l}, {2, c}, {1, r}} {
+				if p&s.bit != 0 {
+					t &= s.word
+				} else {
+					t &^= s.word
+				}
+			}
+			v |= t
+		}
+		m.buff[i] = v
+		prev = c
+	}
+	m.clearTail()
+	return m
+}
+
+// advances the buffer generations generations of elementary automaton rule
+// and returns the history, row 0 being the buffer as it was and row i the
+// buffer after i steps, generations+1 rows of LenBits() columns
+func (m *Bits[W]) Run(rule uint8, boundary CABoundary, generations uint) *BitMatrix {
+	h := NewBitMatrix(generations+1, m.LenBits())
+	copyWords(h.rowWords(0), m.buff)
+	for g := uint(1); g <= generations; g++ {
+		m.Step(rule, boundary)
+		copyWords(h.rowWords(g), m.buff)
+	}
+	return h
+}
@@ -0,0 +1,135 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func naiveCAStep(cells []bool, rule uint8, boundary CABoundary) []bool {
+	n := len(cells)
+	r := make([]bool, n)
+	for i := range cells {
+		var l, c, rt bool
+		c = cells[i]
+		if i > 0 {
+			l = cells[i-1]
+		} else {
+			l = boundary == KCA_ONE || boundary == KCA_WRAP && cells[n-1]
+		}
+		if i < n-1 {
+			rt = cells[i+1]
+		} else {
+			rt = boundary == KCA_ONE || boundary == KCA_WRAP && cells[0]
+		}
+		p := 0
+		if l {
+			p |= 4
+		}
+		if c {
+			p |= 2
+		}
+		if rt {
+			p |= 1
+		}
+		r[i] = rule>>p&1 != 0
+	}
+	return r
+}
+
+func testCAStep[W Word](t *testing.T) {
+	rng := rand.New(rand.NewSource(50))
+	for _, nbytes := range []uint{1, 3, 8, 9, 17} {
+		for _, boundary := range []CABoundary{KCA_ZERO, KCA_ONE, KCA_WRAP} {
+			for rule := 0; rule < 256; rule++ {
+				b := NewBits[W](nbytes)
+				for i := uint(0); i < b.LenBits(); i++ {
+					if rng.Intn(2) == 0 {
+						b.Set(i)
+					}
+				}
+				want := naiveCAStep(b.Bool(), uint8(rule), boundary)
+				b.Step(uint8(rule), boundary)
+				got := b.Bool()
+				for i := range want {
+					if got[i] != want[i] {
+						t.Fatalf("%v bytes, boundary %v, rule %v: cell %v is %v", nbytes, boundary, rule, i, got[i])
+					}
+				}
+				if b.CountBitsOn()+b.CountBitsOff() != b.LenBits() {
+					t.Fatalf("bits set past LenBits()")
+				}
+			}
+		}
+	}
+}
+
+func TestCAStep(t *testing.T) {
+	t.Run("uint8", testCAStep[uint8])
+	t.Run("uint16", testCAStep[uint16])
+	t.Run("uint32", testCAStep[uint32])
+	t.Run("uint64", testCAStep[uint64])
+}
+
+func TestCARun(t *testing.T) {
+	// rule 30 from a single cell, the centre column is Wolfram's random
+	// sequence
+	const width = 81
+	b := NewBitBuffer((width + 7) / 8)
+	b.Set(width / 2)
+	h := b.Run(30, KCA_ZERO, 19)
+	if h.Rows() != 20 || h.Cols() != b.LenBits() {
+		t.Fatalf("history is %vx%v", h.Rows(), h.Cols())
+	}
+	want := "11011100110001011001"
+	for g := uint(0); g < 20; g++ {
+		if got := h.Get(g, width/2); got != (want[g] == '1') {
+			t.Errorf("generation %v: centre %v", g, got)
+		}
+	}
+	// the buffer holds the last generation
+	for j := uint(0); j < b.LenBits(); j++ {
+		if b.IsSet(j) != h.Get(19, j) {
+			t.Fatalf("buffer differs from the last row at %v", j)
+		}
+	}
+
+	// rule 90 draws Pascal's triangle mod 2: cell centre+k at generation g
+	// is C(g, (g+k)/2) mod 2 when g+k is even
+	b = NewBitBuffer(16)
+	b.Set(64)
+	h = b.Run(90, KCA_WRAP, 32)
+	for g := uint(0); g <= 32; g++ {
+		for k := -int(g); k <= int(g); k++ {
+			want := (int(g)+k)%2 == 0 && uint(g)&uint((int(g)+k)/2) == uint((int(g)+k)/2)
+			if h.Get(g, uint(64+k)) != want {
+				t.Fatalf("rule 90 generation %v offset %v", g, k)
+			}
+		}
+	}
+}
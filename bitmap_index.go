@@ -0,0 +1,323 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"cmp"
+	"fmt"
+	"math/bits"
+	"slices"
+)
+
+// BitmapIndex indexes a column of values with one BitBuffer per distinct
+// value, bit r of a value's buffer being on when row r holds the value
+//
+// queries return a new selection, a BitBuffer with bit r on for every
+// selected row and every bit at or beyond Rows() off
+type BitmapIndex[T comparable] struct {
+	rows   uint
+	values map[T]*BitBuffer
+}
+
+// constructs an index of column and returns pointer to instance
+func NewBitmapIndex[T comparable](column []T) *BitmapIndex[T] {
+	x := &BitmapIndex[T]{values: map[T]*BitBuffer{}}
+	x.Append(column...)
+	return x
+}
+
+// adds a row per value, after the rows already indexed
+func (x *BitmapIndex[T]) Append(column ...T) {
+	for _, v := range column {
+		b := x.values[v]
+		if b == nil {
+			b = newSelection(x.rows + 1)
+			x.values[v] = b
+		}
+		b.Set(x.rows)
+		x.rows++
+	}
+}
+
+// number of rows
+func (x *BitmapIndex[T]) Rows() uint {
+	return x.rows
+}
+
+// number of distinct values
+func (x *BitmapIndex[T]) Cardinality() int {
+	return len(x.values)
+}
+
+// selects the rows holding v
+func (x *BitmapIndex[T]) Eq(v T) *BitBuffer {
+	return x.In(v)
+}
+
+// selects the rows holding any of values
+func (x *BitmapIndex[T]) In(values ...T) *BitBuffer {
+	r := newSelection(x.rows)
+	for _, v := range values {
+		if b := x.values[v]; b != nil {
+			r.Or(b)
+		}
+	}
+	return r
+}
+
+// selects the rows whose value satisfies fn, fn is called once per distinct
+// value
+func (x *BitmapIndex[T]) Where(fn func(v T) bool) *BitBuffer {
+	r := newSelection(x.rows)
+	for v, b := range x.values {
+		if fn(v) {
+			r.Or(b)
+		}
+	}
+	return r
+}
+
+// selects the rows sel doesn't
+func (x *BitmapIndex[T]) Not(sel *BitBuffer) *BitBuffer {
+	return notRows(sel, x.rows)
+}
+
+// an empty selection able to hold rows rows
+func newSelection(rows uint) *BitBuffer {
+	return NewBitBuffer((rows + KBITS_PER_BYTE - 1) / KBITS_PER_BYTE)
+}
+
+// complement of sel within the first rows bits
+func notRows(sel *BitBuffer, rows uint) *BitBuffer {
+	r := newSelection(rows)
+	r.SetRange(0, rows)
+	return r.AndNot(sel)
+}
+
+// IndexEncoding is how OrderedBitmapIndex lays out its bin buffers
+type IndexEncoding uint
+
+const (
+	// a buffer per bin holds the rows in it, range queries OR the bins they
+	// cover, appending sets one bit
+	KINDEX_EQUALITY IndexEncoding = iota
+	// a buffer per bin holds the rows in it or any lower bin, any range is
+	// one AND NOT of two buffers, appending sets a bit in every higher bin
+	KINDEX_RANGE
+)
+
+// OrderedBitmapIndex indexes a column of ordered values by bins, answering
+// range queries as well as equality
+//
+// without bin edges every distinct value gets its own bin and queries are
+// answered from the bin buffers alone, with edges the column is kept and
+// rows in the bins at either end of a range are checked against it, so
+// results are exact either way
+type OrderedBitmapIndex[T cmp.Ordered] struct {
+	rows     uint
+	encoding IndexEncoding
+	// bin edges, nil for a bin per value
+	edges []T
+	// distinct values in order, when not binned
+	keys []T
+	// a buffer per bin, in order
+	bins []*BitBuffer
+	// the values, when binned
+	column []T
+}
+
+// constructs an index of column and returns pointer to instance
+//
+// edges, if not nil, must be in increasing order and split values into
+// len(edges)+1 bins, bin i holding values v with edges[i-1] <= v < edges[i]
+func NewOrderedBitmapIndex[T cmp.Ordered](column []T, edges []T, encoding IndexEncoding) *OrderedBitmapIndex[T] {
+	if encoding > KINDEX_RANGE {
+		panic(fmt.Sprintf("mbits: unknown index encoding %v", encoding))
+	}
+	if !slices.IsSorted(edges) {
+		panic("mbits: bin edges out of order")
+	}
+	x := &OrderedBitmapIndex[T]{encoding: encoding}
+	if edges != nil {
+		x.edges = slices.Clone(edges)
+		x.bins = make([]*BitBuffer, len(edges)+1)
+		for i := range x.bins {
+			x.bins[i] = newSelection(uint(len(column)))
+		}
+	}
+	x.Append(column...)
+	return x
+}
+
+// number of rows
+func (x *OrderedBitmapIndex[T]) Rows() uint {
+	return x.rows
+}
+
+// number of bins, the number of distinct values when not binned
+func (x *OrderedBitmapIndex[T]) Bins() int {
+	return len(x.bins)
+}
+
+// encoding of the bin buffers
+func (x *OrderedBitmapIndex[T]) Encoding() IndexEncoding {
+	return x.encoding
+}
+
+// bin holding v, and whether it exists yet
+func (x *OrderedBitmapIndex[T]) binOf(v T) (int, bool) {
+	if x.edges != nil {
+		i, found := slices.BinarySearch(x.edges, v)
+		if found {
+			i++
+		}
+		return i, true
+	}
+	return slices.BinarySearch(x.keys, v)
+}
+
+// adds a row per value, after the rows already indexed
+func (x *OrderedBitmapIndex[T]) Append(column ...T) {
+	for _, v := range column {
+		i, ok := x.binOf(v)
+		if !ok {
+			b := newSelection(x.rows + 1)
+			if x.encoding == KINDEX_RANGE && i > 0 {
+				b.Or(x.bins[i-1])
+			}
+			x.keys = slices.Insert(x.keys, i, v)
+			x.bins = slices.Insert(x.bins, i, b)
+		}
+		if x.encoding == KINDEX_RANGE {
+			for _, b := range x.bins[i:] {
+				b.Set(x.rows)
+			}
+		} else {
+			x.bins[i].Set(x.rows)
+		}
+		if x.edges != nil {
+			x.column = append(x.column, v)
+		}
+		x.rows++
+	}
+}
+
+// rows in bins [a, b]
+func (x *OrderedBitmapIndex[T]) binRows(a, b int) *BitBuffer {
+	r := newSelection(x.rows)
+	if a > b {
+		return r
+	}
+	if x.encoding == KINDEX_RANGE {
+		r.Or(x.bins[b])
+		if a > 0 {
+			r.AndNot(x.bins[a-1])
+		}
+		return r
+	}
+	for _, bin := range x.bins[a : b+1] {
+		r.Or(bin)
+	}
+	return r
+}
+
+// rows in bins [a, b] whose values are in [lo, hi], unbounded at either end
+// when the matching has flag is false
+func (x *OrderedBitmapIndex[T]) span(a, b int, lo T, has_lo bool, hi T, has_hi bool) *BitBuffer {
+	if x.edges == nil || a > b {
+		return x.binRows(a, b)
+	}
+	// only the end bins may hold values out of range
+	r := x.binRows(a+1, b-1)
+	for _, e := range []int{a, b} {
+		for i, w := range x.binRows(e, e).buff {
+			for ; w != 0; w &= w - 1 {
+				row := uint(i)*64 + uint(bits.TrailingZeros64(w))
+				v := x.column[row]
+				if (!has_lo || v >= lo) && (!has_hi || v <= hi) {
+					r.Set(row)
+				}
+			}
+		}
+		if a == b {
+			break
+		}
+	}
+	return r
+}
+
+// first bin that may hold values >= v
+func (x *OrderedBitmapIndex[T]) lowBin(v T) int {
+	i, _ := x.binOf(v)
+	return i
+}
+
+// last bin that may hold values <= v
+func (x *OrderedBitmapIndex[T]) highBin(v T) int {
+	i, ok := x.binOf(v)
+	if !ok {
+		i--
+	}
+	return i
+}
+
+// selects the rows with lo <= value <= hi
+func (x *OrderedBitmapIndex[T]) Range(lo, hi T) *BitBuffer {
+	if hi < lo {
+		return newSelection(x.rows)
+	}
+	return x.span(x.lowBin(lo), x.highBin(hi), lo, true, hi, true)
+}
+
+// selects the rows with value >= v
+func (x *OrderedBitmapIndex[T]) AtLeast(v T) *BitBuffer {
+	return x.span(x.lowBin(v), len(x.bins)-1, v, true, v, false)
+}
+
+// selects the rows with value <= v
+func (x *OrderedBitmapIndex[T]) AtMost(v T) *BitBuffer {
+	return x.span(0, x.highBin(v), v, false, v, true)
+}
+
+// selects the rows holding v
+func (x *OrderedBitmapIndex[T]) Eq(v T) *BitBuffer {
+	return x.Range(v, v)
+}
+
+// selects the rows holding any of values
+func (x *OrderedBitmapIndex[T]) In(values ...T) *BitBuffer {
+	r := newSelection(x.rows)
+	for _, v := range values {
+		r.Or(x.Eq(v))
+	}
+	return r
+}
+
+// selects the rows sel doesn't
+func (x *OrderedBitmapIndex[T]) Not(sel *BitBuffer) *BitBuffer {
+	return notRows(sel, x.rows)
+}
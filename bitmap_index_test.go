@@ -0,0 +1,147 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// selection of the rows of column satisfying fn
+func naiveSelect[T any](column []T, fn func(T) bool) *BitBuffer {
+	r := newSelection(uint(len(column)))
+	for i, v := range column {
+		if fn(v) {
+			r.Set(uint(i))
+		}
+	}
+	return r
+}
+
+func checkSelection(t *testing.T, what string, got, want *BitBuffer, rows uint) {
+	t.Helper()
+	if got.LenBits() < rows || XorCount(got, want) != 0 {
+		t.Fatalf("%v: got %v, want %v", what, got, want)
+	}
+}
+
+func TestBitmapIndex(t *testing.T) {
+	rnd := rand.New(rand.NewSource(47))
+	colours := []string{"red", "green", "blue", "cyan", "black"}
+	var column []string
+	x := NewBitmapIndex[string](nil)
+	for round := 0; round < 4; round++ {
+		// append in uneven batches
+		batch := make([]string, rnd.Intn(300))
+		for i := range batch {
+			batch[i] = colours[rnd.Intn(len(colours)-1)]
+		}
+		column = append(column, batch...)
+		x.Append(batch...)
+		rows := uint(len(column))
+		if x.Rows() != rows {
+			t.Fatalf("Rows %v, want %v", x.Rows(), rows)
+		}
+
+		for _, c := range colours {
+			checkSelection(t, "Eq "+c, x.Eq(c), naiveSelect(column, func(v string) bool { return v == c }), rows)
+		}
+		checkSelection(t, "In", x.In("red", "blue", "black"), naiveSelect(column, func(v string) bool { return v == "red" || v == "blue" }), rows)
+		checkSelection(t, "Where", x.Where(func(v string) bool { return len(v) <= 4 }), naiveSelect(column, func(v string) bool { return len(v) <= 4 }), rows)
+		checkSelection(t, "Not", x.Not(x.Eq("red")), naiveSelect(column, func(v string) bool { return v != "red" }), rows)
+	}
+	if x.Cardinality() != 4 {
+		t.Fatalf("Cardinality %v, want 4", x.Cardinality())
+	}
+}
+
+func TestOrderedBitmapIndex(t *testing.T) {
+	rnd := rand.New(rand.NewSource(48))
+	for _, edges := range [][]int{nil, {-50, 0, 10, 11, 200}, {0}} {
+		for _, enc := range []IndexEncoding{KINDEX_EQUALITY, KINDEX_RANGE} {
+			name := fmt.Sprintf("edges %v encoding %v", edges, enc)
+			column := make([]int, 500)
+			for i := range column {
+				column[i] = rnd.Intn(400) - 150
+			}
+			x := NewOrderedBitmapIndex(column[:100], edges, enc)
+			x.Append(column[100:]...)
+			rows := uint(len(column))
+			if x.Rows() != rows || x.Encoding() != enc {
+				t.Fatalf("%v: %v rows", name, x.Rows())
+			}
+			if edges != nil && x.Bins() != len(edges)+1 {
+				t.Fatalf("%v: %v bins", name, x.Bins())
+			}
+
+			for i := 0; i < 100; i++ {
+				lo, hi := rnd.Intn(500)-250, rnd.Intn(500)-250
+				checkSelection(t, fmt.Sprintf("%v: Range(%v, %v)", name, lo, hi), x.Range(lo, hi),
+					naiveSelect(column, func(v int) bool { return v >= lo && v <= hi }), rows)
+				checkSelection(t, fmt.Sprintf("%v: AtLeast(%v)", name, lo), x.AtLeast(lo),
+					naiveSelect(column, func(v int) bool { return v >= lo }), rows)
+				checkSelection(t, fmt.Sprintf("%v: AtMost(%v)", name, lo), x.AtMost(lo),
+					naiveSelect(column, func(v int) bool { return v <= lo }), rows)
+				checkSelection(t, fmt.Sprintf("%v: Eq(%v)", name, lo), x.Eq(lo),
+					naiveSelect(column, func(v int) bool { return v == lo }), rows)
+				checkSelection(t, fmt.Sprintf("%v: In(%v, %v)", name, lo, hi), x.In(lo, hi),
+					naiveSelect(column, func(v int) bool { return v == lo || v == hi }), rows)
+			}
+			checkSelection(t, name+": Not", x.Not(x.AtLeast(0)), naiveSelect(column, func(v int) bool { return v < 0 }), rows)
+		}
+	}
+}
+
+func TestOrderedBitmapIndexFloats(t *testing.T) {
+	x := NewOrderedBitmapIndex([]float64{0.5, 2.25, -1, 2.25, 9}, []float64{0, 1, 5}, KINDEX_RANGE)
+	if got := x.Range(0.5, 2.25); got.Bytes()[0] != 0b01011 {
+		t.Fatalf("got %v", got)
+	}
+	if got := x.AtLeast(2.3); got.Bytes()[0] != 0b10000 {
+		t.Fatalf("got %v", got)
+	}
+	if got := x.Range(3, 1); got.CountBitsOn() != 0 {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func BenchmarkOrderedBitmapIndexRange(b *testing.B) {
+	rnd := rand.New(rand.NewSource(49))
+	column := make([]uint16, 1<<20)
+	for i := range column {
+		column[i] = uint16(rnd.Intn(1000))
+	}
+	for _, enc := range []IndexEncoding{KINDEX_EQUALITY, KINDEX_RANGE} {
+		x := NewOrderedBitmapIndex(column, nil, enc)
+		b.Run(fmt.Sprint("encoding ", enc), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				x.Range(100, 700)
+			}
+		})
+	}
+}
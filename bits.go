@@ -27,64 +27,179 @@ package mbits
 // OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 
 import (
-	"bytes"
-	"fmt"
-	"reflect" // using some structs to make magic
-	"unsafe"  // it's safe, trust me :)
+	"encoding/binary"
+	"math/bits"
+	"unsafe"
 )
 
 const (
 	KSZ_U8           = uint(unsafe.Sizeof(uint8(0)))
+	KSZ_U32          = uint(unsafe.Sizeof(uint32(0)))
 	KSZ_U64          = uint(unsafe.Sizeof(uint64(0)))
 	KBITS_PER_BYTE   = uint(8)
 	KWORD_SIZE_BYTES = uint(unsafe.Sizeof(uint(0)))
 	KWORD_SIZE_BITS  = KWORD_SIZE_BYTES * KBITS_PER_BYTE
+	// buffers grow in multiples of this many bytes, regardless of word size,
+	// so the same sequence of calls yields the same length on every platform
+	KGROW_BYTES = KSZ_U64
 )
 
-type BitBuffer struct {
-	// internal buffer
-	buff []uint
+// Word is the set of unsigned integer types Bits can be backed by
+type Word interface {
+	~uint8 | ~uint16 | ~uint32 | ~uint64
+}
+
+// Bits stores bits in W words using a canonical layout: bit i lives in byte
+// i/8 at position i%8 (least significant bit first), on every GOARCH and for
+// every W, so buffers of different word widths hold identical bytes.
+// Bits at or beyond LenBits() are always off.
+type Bits[W Word] struct {
+	// where the words live, heap by default
+	store Storage[W]
+	// internal buffer, the first words of store
+	buff []W
 	// number of bytes "wanted" from buffer
 	byte_len uint
+	// mutations panic with ErrReadOnly when set
+	readonly bool
 }
 
+// BitBuffer is backed by 64-bit words on every platform
+type BitBuffer = Bits[uint64]
+
 // constructs a BitBuffer with given length in bytes and returns pointer to instance
 func NewBitBuffer(length uint) *BitBuffer {
-	return (&BitBuffer{}).SetBufferLen(length)
+	return NewBits[uint64](length)
+}
+
+// constructs a Bits backed by W words with given length in bytes and returns pointer to instance
+func NewBits[W Word](length uint) *Bits[W] {
+	return (&Bits[W]{}).SetBufferLen(length)
+}
+
+// constructs a Bits on top of store, adopting its words and length as they are
+// a store with a ReadOnly() method returning true makes the Bits read-only
+// returns pointer to instance
+func NewBitsWithStorage[W Word](store Storage[W]) *Bits[W] {
+	return newBitsWithStorage(store, store.Len()*wordBytesOf[W]())
+}
+
+// constructs a Bits on top of store with a length of byte_len bytes
+// words beyond byte_len must be zero
+func newBitsWithStorage[W Word](store Storage[W], byte_len uint) *Bits[W] {
+	m := &Bits[W]{store: store}
+	m.buff = store.Words()[:m.wordsForBytes(byte_len)]
+	m.byte_len = byte_len
+	if ro, ok := store.(interface{ ReadOnly() bool }); ok {
+		m.readonly = ro.ReadOnly()
+	}
+	return m
+}
+
+// storage that keeps track of the buffer length, e.g. in a file header
+type lenRecorder interface {
+	recordLenBytes(byte_len uint)
+}
+
+// tells the storage about a new buffer length, if it cares
+func (m *Bits[W]) setLenBytes(byte_len uint) {
+	m.byte_len = byte_len
+	if r, ok := m.store.(lenRecorder); ok {
+		r.recordLenBytes(byte_len)
+	}
 }
 
-// set buffer length in bytes
+// panics if the buffer is read-only
+func (m *Bits[W]) mustWrite() {
+	if m.readonly {
+		panic(ErrReadOnly)
+	}
+}
+
+// returns true if mutating the buffer panics
+func (m *Bits[W]) ReadOnly() bool {
+	return m.readonly
+}
+
+// returns a copy of src backed by D words, the bytes and length are unchanged
+func ConvertBits[D, S Word](src *Bits[S]) *Bits[D] {
+	r := NewBits[D](src.byte_len)
+	copyWords(r.buff, src.buff)
+	return r
+}
+
+// set buffer length in bytes, a length of 0 means KGROW_BYTES
 // discards previous data if any
 // returns pointer to self
-func (m *BitBuffer) SetBufferLen(length uint) *BitBuffer {
-	m.byte_len = length
-	lbuff := m.byte_len/KWORD_SIZE_BYTES + 1
-	if m.byte_len == 0 {
-		m.byte_len = lbuff * KWORD_SIZE_BYTES
+func (m *Bits[W]) SetBufferLen(length uint) *Bits[W] {
+	m.mustWrite()
+	if length == 0 {
+		length = KGROW_BYTES
 	}
-	m.buff = make([]uint, lbuff)
+	l := m.wordsForBytes(length)
+	store := m.storage()
+	m.growStorage(l)
+	// words beyond buff are kept zero, so growing never has to clear
+	clear(store.Words())
+	m.buff = store.Words()[:l]
+	m.setLenBytes(length)
 	return m
 }
 
+// returns the storage, setting up heap storage on first use
+func (m *Bits[W]) storage() Storage[W] {
+	if m.store == nil {
+		m.store = NewHeapStorage[W](0)
+	}
+	return m.store
+}
+
+// grows the storage to at least l words
+// panics if the storage fails to grow
+func (m *Bits[W]) growStorage(l uint) {
+	store := m.storage()
+	if store.Len() >= l {
+		return
+	}
+	if err := store.Grow(l); err != nil {
+		panic(err)
+	}
+}
+
+// flushes the words to the storage's backing medium
+func (m *Bits[W]) Sync() error {
+	return m.storage().Sync()
+}
+
 // length of buffer in bits
-func (m *BitBuffer) LenBits() uint {
+func (m *Bits[W]) LenBits() uint {
 	return m.LenBytes() * KBITS_PER_BYTE
 }
 
 // length of buffer in bytes
-func (m *BitBuffer) LenBytes() uint {
+func (m *Bits[W]) LenBytes() uint {
 	return m.byte_len
 }
 
-// returns a copy of buffer as a byte slice
-func (m *BitBuffer) Bytes() []byte {
+// size of a word in bytes
+func (m *Bits[W]) WordBytes() uint {
+	return wordBytesOf[W]()
+}
+
+// size of a word in bits
+func (m *Bits[W]) WordBits() uint {
+	return wordBytesOf[W]() * KBITS_PER_BYTE
+}
+
+// returns a copy of buffer as a byte slice in canonical layout
+func (m *Bits[W]) Bytes() []byte {
 	r := make([]byte, m.LenBytes())
-	copy(r, m.MutableByteSlice())
+	m.readBytes(r)
 	return r
 }
 
 // returns a bool slice in which each item represents the state of a bit
-func (m *BitBuffer) Bool() []bool {
+func (m *Bits[W]) Bool() []bool {
 	l := m.LenBits()
 	r := make([]bool, l)
 	for i := uint(0); i < l; i++ {
@@ -94,223 +209,207 @@ func (m *BitBuffer) Bool() []bool {
 }
 
 // checks if bitIndex is out of bounds, if so, it grows the internal buffer
-func (m *BitBuffer) growIfNeeded(bitIndex uint) {
-	l := bitIndex/KWORD_SIZE_BITS + 1
+// to the next multiple of KGROW_BYTES that holds bitIndex
+func (m *Bits[W]) growIfNeeded(bitIndex uint) {
+	if bitIndex < m.LenBits() {
+		return
+	}
+	m.resize((bitIndex/KBITS_PER_BYTE/KGROW_BYTES + 1) * KGROW_BYTES)
+}
+
+// changes the buffer length in bytes, keeping the data that still fits
+func (m *Bits[W]) resize(byte_len uint) {
+	l := m.wordsForBytes(byte_len)
 	if uint(len(m.buff)) < l {
-		r := make([]uint, l)
-		copy(r, m.buff)
-		m.buff = r
-		m.byte_len = l * KWORD_SIZE_BYTES
+		m.growStorage(l)
+		m.buff = m.storage().Words()[:l]
+	} else if uint(len(m.buff)) > l {
+		clear(m.buff[l:])
+		m.buff = m.buff[:l]
 	}
+	m.setLenBytes(byte_len)
+	m.clearTail()
+}
+
+// turns off the bits of the last word that lie beyond LenBits()
+func (m *Bits[W]) clearTail() {
+	rem := m.byte_len % m.WordBytes()
+	if rem == 0 {
+		return
+	}
+	m.buff[len(m.buff)-1] &= W(1)<<(rem*KBITS_PER_BYTE) - 1
 }
 
 // copies the byte slice to the internal buffer
+// the byte slice is read in canonical layout
 // internal buffer will be reset
 // returns pointer to self
-func (m *BitBuffer) LoadBuffer(buffer []byte) *BitBuffer {
+func (m *Bits[W]) LoadBuffer(buffer []byte) *Bits[W] {
 	m.SetBufferLen(uint(len(buffer)))
-	copy(m.MutableByteSlice(), buffer)
+	m.writeBytes(buffer)
+	return m
+}
+
+// loads the buffer from 64-bit words, little-endian: bit i of the buffer is
+// bit i%64 of words[i/64], which matches the canonical byte layout
+// internal buffer will be reset
+// returns pointer to self
+func (m *Bits[W]) FromUint64s(words []uint64) *Bits[W] {
+	m.SetBufferLen(uint(len(words)) * KSZ_U64)
+	copyWords(m.buff, words)
 	return m
 }
 
+// loads the buffer from 32-bit words, little-endian: bit i of the buffer is
+// bit i%32 of words[i/32], which matches the canonical byte layout
+// internal buffer will be reset
+// returns pointer to self
+func (m *Bits[W]) FromUint32s(words []uint32) *Bits[W] {
+	m.SetBufferLen(uint(len(words)) * KSZ_U32)
+	copyWords(m.buff, words)
+	return m
+}
+
+// returns the buffer as 64-bit words, little-endian: bit i of the buffer is
+// bit i%64 of the i/64-th word, the last word is padded with off bits
+func (m *Bits[W]) ToUint64s() []uint64 {
+	r := make([]uint64, (m.byte_len+KSZ_U64-1)/KSZ_U64)
+	copyWords(r, m.buff)
+	return r
+}
+
+// returns the buffer as 32-bit words, little-endian: bit i of the buffer is
+// bit i%32 of the i/32-th word, the last word is padded with off bits
+func (m *Bits[W]) ToUint32s() []uint32 {
+	r := make([]uint32, (m.byte_len+KSZ_U32-1)/KSZ_U32)
+	copyWords(r, m.buff)
+	return r
+}
+
 // toggle bit state at index
 // returns pointer to self
-func (m *BitBuffer) Toggle(bitIndex uint) *BitBuffer {
+func (m *Bits[W]) Toggle(bitIndex uint) *Bits[W] {
+	m.mustWrite()
 	m.growIfNeeded(bitIndex)
-	m.buff[bitIndex/KWORD_SIZE_BITS] ^= 1 << (bitIndex % KWORD_SIZE_BITS)
+	wbits := m.WordBits()
+	m.buff[bitIndex/wbits] ^= 1 << (bitIndex % wbits)
 	return m
 }
 
 // turn bit on at index
 // returns pointer to self
-func (m *BitBuffer) Set(bitIndex uint) *BitBuffer {
+func (m *Bits[W]) Set(bitIndex uint) *Bits[W] {
+	m.mustWrite()
 	m.growIfNeeded(bitIndex)
-	m.buff[bitIndex/KWORD_SIZE_BITS] |= 1 << (bitIndex % KWORD_SIZE_BITS)
+	wbits := m.WordBits()
+	m.buff[bitIndex/wbits] |= 1 << (bitIndex % wbits)
 	return m
 }
 
 // set bit off
 // returns pointer to self
-func (m *BitBuffer) Clear(bitIndex uint) *BitBuffer {
+func (m *Bits[W]) Clear(bitIndex uint) *Bits[W] {
+	m.mustWrite()
 	m.growIfNeeded(bitIndex)
-	m.buff[bitIndex/KWORD_SIZE_BITS] &^= 1 << (bitIndex % KWORD_SIZE_BITS)
+	wbits := m.WordBits()
+	m.buff[bitIndex/wbits] &^= 1 << (bitIndex % wbits)
 	return m
 }
 
+// turn bits on in range [from, to)
 // returns pointer to self
-func (m *BitBuffer) SetAll(x uint) *BitBuffer {
-	// avoid calling len() in the loop
-	l := len(m.buff)
-
-	// fetch address of first uint in buff
-	p := uintptr(unsafe.Pointer(&m.buff[0]))
+func (m *Bits[W]) SetRange(from, to uint) *Bits[W] {
+	m.mustWrite()
+	if from >= to {
+		return m
+	}
+	m.growIfNeeded(to - 1)
+	m.eachRangeWord(from, to, func(i uint, mask W) {
+		m.buff[i] |= mask
+	})
+	return m
+}
 
-	// loop over all uint items in buff
-	for i := 0; i < l; i++ {
-		// cast current pointer to a pointer of our element type
-		v := (*uint)(unsafe.Pointer(p))
+// turn bits off in range [from, to)
+// returns pointer to self
+func (m *Bits[W]) ClearRange(from, to uint) *Bits[W] {
+	m.mustWrite()
+	if from >= to {
+		return m
+	}
+	m.growIfNeeded(to - 1)
+	m.eachRangeWord(from, to, func(i uint, mask W) {
+		m.buff[i] &^= mask
+	})
+	return m
+}
 
-		// set value
-		*v = x
+// calls fn with the index and mask of every word covering bits [from, to)
+func (m *Bits[W]) eachRangeWord(from, to uint, fn func(i uint, mask W)) {
+	wbits := m.WordBits()
+	for from < to {
+		lo := from % wbits
+		n := min(wbits-lo, to-from)
+		mask := ^W(0)
+		if n < wbits {
+			mask = (W(1)<<n - 1) << lo
+		}
+		fn(from/wbits, mask)
+		from += n
+	}
+}
 
-		// move to next element
-		p++
+// sets every word of the internal buffer to x
+// x is repeated every WordBits() bits, so the same x gives different bits
+// for different word widths
+// returns pointer to self
+func (m *Bits[W]) SetAll(x W) *Bits[W] {
+	m.mustWrite()
+	for i := range m.buff {
+		m.buff[i] = x
 	}
+	m.clearTail()
 	return m
 }
 
 // turns off all the bits
 // returns pointer to self
-func (m *BitBuffer) ClearAll() *BitBuffer {
+func (m *Bits[W]) ClearAll() *Bits[W] {
 	return m.SetAll(0)
 }
 
+// turns on all the bits
 // returns pointer to self
-func (m *BitBuffer) SetOnAll() *BitBuffer {
-	return m.SetAll(wordBitsOn)
+func (m *Bits[W]) SetOnAll() *Bits[W] {
+	return m.SetAll(^W(0))
 }
 
 // returns true if bit at index is set
-func (m *BitBuffer) IsSet(bitIndex uint) bool {
-	m.growIfNeeded(bitIndex)
-	return m.buff[bitIndex/KWORD_SIZE_BITS]&(1<<(bitIndex%KWORD_SIZE_BITS)) != 0
+// bits beyond LenBits() are off, reading them doesn't grow the buffer
+func (m *Bits[W]) IsSet(bitIndex uint) bool {
+	if bitIndex >= m.LenBits() {
+		return false
+	}
+	wbits := m.WordBits()
+	return m.buff[bitIndex/wbits]&(1<<(bitIndex%wbits)) != 0
 }
 
 // returns the count of on and off bits
-func (m *BitBuffer) CountBits() (on uint, off uint) {
-	// got any ideas as to how we can speed this up?
-
-	// counting ON bits -- fast -- is more challening than it seems
-	// use pre-computed lookup table
-	lookup := LookupByteBitsOn
-
-	// how many iterations can we perform given the buffer size in bytes
-	// and size of a pointer in bytes
-	l := m.byte_len / KWORD_SIZE_BYTES
-
-	// pointer to buffer
-	p := uintptr(unsafe.Pointer(&m.buff[0]))
-
-	// check pointer size only once, and then unroll the madness
-	switch KWORD_SIZE_BYTES {
-	case 2:
-		{
-			// 16-bit
-			for i := uint(0); i < l; i++ {
-				v := (*[2]byte)(unsafe.Pointer(p))
-				on += uint(lookup[(*v)[0]])
-				on += uint(lookup[(*v)[1]])
-				p++
-			}
-		}
-	case 4:
-		{
-			// 32-bit
-			for i := uint(0); i < l; i++ {
-				v := (*[4]byte)(unsafe.Pointer(p))
-				on += uint(lookup[(*v)[0]])
-				on += uint(lookup[(*v)[1]])
-				on += uint(lookup[(*v)[2]])
-				on += uint(lookup[(*v)[3]])
-				p++
-			}
-		}
-	case 8:
-		{
-			// 64-bit
-			for i := uint(0); i < l; i++ {
-				v := (*[8]byte)(unsafe.Pointer(p))
-				on += uint(lookup[(*v)[0]])
-				on += uint(lookup[(*v)[1]])
-				on += uint(lookup[(*v)[2]])
-				on += uint(lookup[(*v)[3]])
-				on += uint(lookup[(*v)[4]])
-				on += uint(lookup[(*v)[5]])
-				on += uint(lookup[(*v)[6]])
-				on += uint(lookup[(*v)[7]])
-				p++
-			}
-		}
-	}
-
-	// check if there are still unprocessed bytes left
-	rem := m.byte_len % KWORD_SIZE_BYTES
-	if rem > 0 {
-		// alright, count these ones
-		// increment pointer
-		p++
-
-		switch rem {
-		case 1:
-			{
-				v := (*byte)(unsafe.Pointer(p))
-				on += uint(lookup[*v])
-			}
-		case 2:
-			{
-				v := (*[2]byte)(unsafe.Pointer(p))
-				on += uint(lookup[(*v)[0]])
-				on += uint(lookup[(*v)[1]])
-			}
-		case 3:
-			{
-				v := (*[3]byte)(unsafe.Pointer(p))
-				on += uint(lookup[(*v)[0]])
-				on += uint(lookup[(*v)[1]])
-				on += uint(lookup[(*v)[2]])
-			}
-		case 4:
-			{
-				v := (*[4]byte)(unsafe.Pointer(p))
-				on += uint(lookup[(*v)[0]])
-				on += uint(lookup[(*v)[1]])
-				on += uint(lookup[(*v)[2]])
-				on += uint(lookup[(*v)[3]])
-			}
-		case 5:
-			{
-				v := (*[5]byte)(unsafe.Pointer(p))
-				on += uint(lookup[(*v)[0]])
-				on += uint(lookup[(*v)[1]])
-				on += uint(lookup[(*v)[2]])
-				on += uint(lookup[(*v)[3]])
-				on += uint(lookup[(*v)[4]])
-			}
-		case 6:
-			{
-				v := (*[6]byte)(unsafe.Pointer(p))
-				on += uint(lookup[(*v)[0]])
-				on += uint(lookup[(*v)[1]])
-				on += uint(lookup[(*v)[2]])
-				on += uint(lookup[(*v)[3]])
-				on += uint(lookup[(*v)[4]])
-				on += uint(lookup[(*v)[5]])
-			}
-		case 7:
-			{
-				v := (*[7]byte)(unsafe.Pointer(p))
-				on += uint(lookup[(*v)[0]])
-				on += uint(lookup[(*v)[1]])
-				on += uint(lookup[(*v)[2]])
-				on += uint(lookup[(*v)[3]])
-				on += uint(lookup[(*v)[4]])
-				on += uint(lookup[(*v)[5]])
-				on += uint(lookup[(*v)[6]])
-			}
-		default:
-			panic("unexpected word size")
-		}
+func (m *Bits[W]) CountBits() (on uint, off uint) {
+	// bits beyond LenBits() are always off, so whole words can be counted
+	for _, w := range m.buff {
+		on += uint(bits.OnesCount64(uint64(w)))
 	}
 
 	// these can be computed last
-	off = (m.byte_len * KBITS_PER_BYTE) - on
+	off = m.LenBits() - on
 
 	return
 }
 
 // returns the number of on bits
 // calls CountBits() internally
-func (m *BitBuffer) CountBitsOn() uint {
+func (m *Bits[W]) CountBitsOn() uint {
 	on, _ := m.CountBits()
 
 	return on
@@ -318,107 +417,242 @@ func (m *BitBuffer) CountBitsOn() uint {
 
 // returns the number of off bits
 // calls CountBits() internally
-func (m *BitBuffer) CountBitsOff() uint {
+func (m *Bits[W]) CountBitsOff() uint {
 	_, off := m.CountBits()
 
 	return off
 }
 
-// compares (this) buffer with (other) buffer
-func (m *BitBuffer) CmpWith(other *BitBuffer) int {
-	return bytes.Compare(m.MutableByteSlice(), other.MutableByteSlice())
+// (this) = (this) AND (other)
+// bits beyond other's length are turned off, the length is unchanged
+// returns pointer to self
+func (m *Bits[W]) And(other *Bits[W]) *Bits[W] {
+	m.mustWrite()
+	l := min(len(m.buff), len(other.buff))
+	for i := 0; i < l; i++ {
+		m.buff[i] &= other.buff[i]
+	}
+	clear(m.buff[l:])
+	return m
+}
+
+// (this) = (this) OR (other)
+// grows to other's length if needed
+// returns pointer to self
+func (m *Bits[W]) Or(other *Bits[W]) *Bits[W] {
+	m.mustWrite()
+	m.growTo(other.byte_len)
+	for i, w := range other.buff {
+		m.buff[i] |= w
+	}
+	return m
+}
+
+// (this) = (this) XOR (other)
+// grows to other's length if needed
+// returns pointer to self
+func (m *Bits[W]) Xor(other *Bits[W]) *Bits[W] {
+	m.mustWrite()
+	m.growTo(other.byte_len)
+	for i, w := range other.buff {
+		m.buff[i] ^= w
+	}
+	return m
+}
+
+// (this) = (this) AND NOT (other)
+// bits beyond other's length are left as they are, the length is unchanged
+// returns pointer to self
+func (m *Bits[W]) AndNot(other *Bits[W]) *Bits[W] {
+	m.mustWrite()
+	l := min(len(m.buff), len(other.buff))
+	for i := 0; i < l; i++ {
+		m.buff[i] &^= other.buff[i]
+	}
+	return m
+}
+
+// flips every bit within LenBits()
+// returns pointer to self
+func (m *Bits[W]) Not() *Bits[W] {
+	m.mustWrite()
+	for i := range m.buff {
+		m.buff[i] = ^m.buff[i]
+	}
+	m.clearTail()
+	return m
+}
+
+// grows the buffer to at least byte_len bytes
+func (m *Bits[W]) growTo(byte_len uint) {
+	if m.byte_len < byte_len {
+		m.resize(byte_len)
+	}
+}
+
+// compares (this) buffer with (other) buffer, byte by byte in canonical
+// layout, the same way bytes.Compare(m.Bytes(), other.Bytes()) would
+func (m *Bits[W]) CmpWith(other *Bits[W]) int {
+	l := min(m.byte_len, other.byte_len)
+	for i := uint(0); i < l; i++ {
+		a, b := m.byteAt(i), other.byteAt(i)
+		if a != b {
+			if a < b {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case m.byte_len < other.byte_len:
+		return -1
+	case m.byte_len > other.byte_len:
+		return 1
+	}
+	return 0
 }
 
 // copy internal buffer(and state) to (other)
-func (m *BitBuffer) CopyTo(other *BitBuffer) {
-	other.SetBufferLen(m.byte_len)
+func (m *Bits[W]) CopyTo(other *Bits[W]) {
+	if other == m {
+		return
+	}
+	other.mustWrite()
+	// through 0 rather than SetBufferLen(), which takes 0 for the default
+	// length, so an empty buffer copies as empty
+	other.resize(0)
+	other.resize(m.byte_len)
 	copy(other.buff, m.buff)
 }
 
 // copy internal buffer(and state) from (other)
 // returns pointer to self
-func (m *BitBuffer) CopyFrom(other *BitBuffer) *BitBuffer {
+func (m *Bits[W]) CopyFrom(other *Bits[W]) *Bits[W] {
 	other.CopyTo(m)
 	return m
 }
 
 // returns a clone (this)
-func (m *BitBuffer) Clone() *BitBuffer {
-	r := &BitBuffer{}
+func (m *Bits[W]) Clone() *Bits[W] {
+	r := &Bits[W]{}
 	m.CopyTo(r)
 	return r
 }
 
-// returns a mutable byte slice of internal buffer
+// returns a mutable byte slice of internal buffer in canonical layout
+// only a little-endian host (or 8-bit words) can provide such a view,
+// panics otherwise, use Bytes() and LoadBuffer() for portable code
 // use with care!
-func (m *BitBuffer) MutableByteSlice() []byte {
-	len_bytes := m.LenBytes()
-
-	return *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
-		Data: uintptr(unsafe.Pointer(&m.buff[0])),
-		Len:  int(len_bytes),
-	}))
+func (m *Bits[W]) MutableByteSlice() []byte {
+	if !nativeLittleEndian && m.WordBytes() > 1 {
+		panic("mbits: MutableByteSlice requires a little-endian host")
+	}
+	if len(m.buff) == 0 {
+		return []byte{}
+	}
+	return unsafe.Slice((*byte)(unsafe.Pointer(&m.buff[0])), m.LenBytes())
 }
 
 // returns a string of 1's and 0's representing the state of the bits
-func (m *BitBuffer) String() string {
-	// got any ideas as to how we can speed this up?
-
+func (m *Bits[W]) String() string {
 	// use pre-computed lookup table
 	lookup := LookupByteBinStr
 
 	// init locals
 	len_bytes := m.LenBytes()
 	len_bits := m.LenBits()
+	if len_bits == 0 {
+		return ""
+	}
 
 	// byte slice
 	r := make([]byte, len_bits)
 
-	// pointer to buffer
-	p := uintptr(unsafe.Pointer(&m.buff[0]))
+	// each entry of the lookup table spells a byte LSB first when stored
+	// little-endian, store it explicitly so the host byte order doesn't matter
+	for i := uint(0); i < len_bytes; i++ {
+		binary.LittleEndian.PutUint64(r[i*KBITS_PER_BYTE:], lookup[m.byteAt(i)])
+	}
 
-	// pointer to return buffer
-	rp := uintptr(unsafe.Pointer(&r[0]))
+	// avoids copying r's data into a string
+	return unsafe.String(&r[0], len(r))
+}
 
-	// itrate over all bytes
-	for i := uint(0); i < len_bytes; i++ {
-		// pointer to current byte
-		v := (*byte)(unsafe.Pointer(p))
+// returns the byte at index in canonical layout
+func (m *Bits[W]) byteAt(index uint) byte {
+	wbytes := m.WordBytes()
+	return byte(m.buff[index/wbytes] >> (index % wbytes * KBITS_PER_BYTE))
+}
 
-		// pointer to current return buffer as a 64-bit unsigned int
-		dr := (*uint64)(unsafe.Pointer(rp))
+// copies the buffer into dst in canonical layout
+func (m *Bits[W]) readBytes(dst []byte) {
+	m.readBytesAt(0, dst)
+}
 
-		// deref and set value
-		*dr = lookup[*v]
+// copies the buffer, starting at byte offset start, into dst in canonical
+// layout, start must be a multiple of the word size
+func (m *Bits[W]) readBytesAt(start uint, dst []byte) {
+	var tmp [8]byte
+	wbytes := m.WordBytes()
+	for i := start / wbytes; i < uint(len(m.buff)); i++ {
+		off := i*wbytes - start
+		if off >= uint(len(dst)) {
+			break
+		}
+		binary.LittleEndian.PutUint64(tmp[:], uint64(m.buff[i]))
+		copy(dst[off:], tmp[:wbytes])
+	}
+}
 
-		// increment pointer to return buffer
-		rp += uintptr(KSZ_U64)
+// copies src, in canonical layout, into the buffer
+func (m *Bits[W]) writeBytes(src []byte) {
+	m.writeBytesAt(0, src)
+}
 
-		// increment pointer to byte buffer
-		p += uintptr(KSZ_U8)
+// copies src, in canonical layout, into the buffer starting at byte offset
+// start, start must be a multiple of the word size
+func (m *Bits[W]) writeBytesAt(start uint, src []byte) {
+	wbytes := m.WordBytes()
+	for i := start / wbytes; i < uint(len(m.buff)); i++ {
+		off := i*wbytes - start
+		if off >= uint(len(src)) {
+			break
+		}
+		var tmp [8]byte
+		copy(tmp[:wbytes], src[off:])
+		m.buff[i] = W(binary.LittleEndian.Uint64(tmp[:]))
 	}
+	m.clearTail()
+}
 
-	// "convert" the []byte slice into a string with magic
-	// avoids copying r's data into a string
-	return *(*string)(unsafe.Pointer(&reflect.StringHeader{
-		Data: uintptr(unsafe.Pointer(&r[0])),
-		Len:  int(len_bits),
-	}))
+// number of words needed to hold length bytes
+func (m *Bits[W]) wordsForBytes(length uint) uint {
+	wbytes := m.WordBytes()
+	return (length + wbytes - 1) / wbytes
 }
 
-var wordBitsOn uint = 0
+// size of a W in bytes
+func wordBytesOf[W Word]() uint {
+	var w W
+	return uint(unsafe.Sizeof(w))
+}
 
-func init() {
-	x := uint(0xff)
-	switch KWORD_SIZE_BITS {
-	case 16:
-		x = uint(0xffff)
-	case 32:
-		x = uint(0xffffffff)
-	case 64:
-		x = uint(0xffffffffffffffff)
-	default:
-		panic(fmt.Sprintf("unexpected word size: %v", KWORD_SIZE_BITS))
+// ORs the bits of src into dst, bit i of src lands on bit i of dst
+// bits that don't fit in dst are dropped
+func copyWords[D, S Word](dst []D, src []S) {
+	dbits := wordBytesOf[D]() * KBITS_PER_BYTE
+	sbits := wordBytesOf[S]() * KBITS_PER_BYTE
+	for k, s := range src {
+		for off := uint(0); off < sbits; off += dbits {
+			bit := uint(k)*sbits + off
+			i := bit / dbits
+			if i >= uint(len(dst)) {
+				return
+			}
+			dst[i] |= D(s>>off) << (bit % dbits)
+		}
 	}
-	wordBitsOn = x
 }
+
+// true if the host stores words least significant byte first
+var nativeLittleEndian = binary.NativeEndian.Uint16([]byte{1, 0}) == 1
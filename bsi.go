@@ -0,0 +1,332 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"math/bits"
+)
+
+// BitSlicedIndex stores an unsigned integer per row as bit slices, slice i
+// holding bit i of every row's value, so a column of values up to 2^n
+// takes n buffers whatever its cardinality
+//
+// queries take an optional filter selection, nil meaning every row with a
+// value, and return a selection as BitmapIndex does
+//
+// comparisons, Min, Max and TopK follow O'Neil and Quass, "Improved query
+// performance with variant indexes", evaluating a slice at a time from the
+// most significant
+type BitSlicedIndex struct {
+	// rows with a value
+	exists *BitBuffer
+	slices []*BitBuffer
+}
+
+// constructs an empty index and returns pointer to instance
+func NewBitSlicedIndex() *BitSlicedIndex {
+	return &BitSlicedIndex{exists: NewBitBuffer(0)}
+}
+
+// constructs an index of column, row i holding column[i], and returns
+// pointer to instance
+func NewBitSlicedIndexFrom(column []uint64) *BitSlicedIndex {
+	x := NewBitSlicedIndex()
+	for i, v := range column {
+		x.Set(uint(i), v)
+	}
+	return x
+}
+
+// number of slices, enough for the largest value ever set
+func (x *BitSlicedIndex) BitDepth() uint {
+	return uint(len(x.slices))
+}
+
+// the rows with a value, shared with the index
+func (x *BitSlicedIndex) Exists() *BitBuffer {
+	return x.exists
+}
+
+// number of rows with a value
+func (x *BitSlicedIndex) Count() uint {
+	return x.exists.CountBitsOn()
+}
+
+func (x *BitSlicedIndex) growDepth(depth uint) {
+	for uint(len(x.slices)) < depth {
+		x.slices = append(x.slices, NewBitBuffer(0))
+	}
+}
+
+// turns bit row of b off, without growing b
+func clearIfWithin(b *BitBuffer, row uint) {
+	if row < b.LenBits() {
+		b.Clear(row)
+	}
+}
+
+// sets the value of row
+// returns pointer to self
+func (x *BitSlicedIndex) Set(row uint, v uint64) *BitSlicedIndex {
+	x.growDepth(uint(bits.Len64(v)))
+	for i, s := range x.slices {
+		if v>>i&1 != 0 {
+			s.Set(row)
+		} else {
+			clearIfWithin(s, row)
+		}
+	}
+	x.exists.Set(row)
+	return x
+}
+
+// removes the value of row
+// returns pointer to self
+func (x *BitSlicedIndex) Delete(row uint) *BitSlicedIndex {
+	for _, s := range x.slices {
+		clearIfWithin(s, row)
+	}
+	clearIfWithin(x.exists, row)
+	return x
+}
+
+// returns the value of row and whether it has one
+func (x *BitSlicedIndex) Get(row uint) (uint64, bool) {
+	if row >= x.exists.LenBits() || !x.exists.IsSet(row) {
+		return 0, false
+	}
+	v := uint64(0)
+	for i, s := range x.slices {
+		if row < s.LenBits() && s.IsSet(row) {
+			v |= 1 << i
+		}
+	}
+	return v, true
+}
+
+// rows with a value, within filter
+func (x *BitSlicedIndex) base(filter *BitBuffer) *BitBuffer {
+	r := x.exists.Clone()
+	if filter != nil {
+		r.And(filter)
+	}
+	return r
+}
+
+// rows within filter whose value is less than, equal to and greater than c
+func (x *BitSlicedIndex) compare(c uint64, filter *BitBuffer) (lt, eq, gt *BitBuffer) {
+	eq = x.base(filter)
+	lt = NewBitBuffer(0)
+	gt = NewBitBuffer(0)
+	if bits.Len64(c) > len(x.slices) {
+		return eq, lt, gt
+	}
+	tmp := NewBitBuffer(0)
+	for i := len(x.slices) - 1; i >= 0; i-- {
+		s := x.slices[i]
+		tmp.CopyFrom(eq)
+		if c>>i&1 != 0 {
+			lt.Or(tmp.AndNot(s))
+			eq.And(s)
+		} else {
+			gt.Or(tmp.And(s))
+			eq.AndNot(s)
+		}
+	}
+	return lt, eq, gt
+}
+
+// selects the rows within filter whose value is less than c
+func (x *BitSlicedIndex) Lt(c uint64, filter *BitBuffer) *BitBuffer {
+	lt, _, _ := x.compare(c, filter)
+	return lt
+}
+
+// selects the rows within filter whose value is at most c
+func (x *BitSlicedIndex) Le(c uint64, filter *BitBuffer) *BitBuffer {
+	lt, eq, _ := x.compare(c, filter)
+	return lt.Or(eq)
+}
+
+// selects the rows within filter whose value is c
+func (x *BitSlicedIndex) Eq(c uint64, filter *BitBuffer) *BitBuffer {
+	_, eq, _ := x.compare(c, filter)
+	return eq
+}
+
+// selects the rows within filter whose value isn't c
+func (x *BitSlicedIndex) Ne(c uint64, filter *BitBuffer) *BitBuffer {
+	lt, _, gt := x.compare(c, filter)
+	return lt.Or(gt)
+}
+
+// selects the rows within filter whose value is greater than c
+func (x *BitSlicedIndex) Gt(c uint64, filter *BitBuffer) *BitBuffer {
+	_, _, gt := x.compare(c, filter)
+	return gt
+}
+
+// selects the rows within filter whose value is at least c
+func (x *BitSlicedIndex) Ge(c uint64, filter *BitBuffer) *BitBuffer {
+	_, eq, gt := x.compare(c, filter)
+	return gt.Or(eq)
+}
+
+// selects the rows within filter whose value is in [lo, hi]
+func (x *BitSlicedIndex) Between(lo, hi uint64, filter *BitBuffer) *BitBuffer {
+	if hi < lo {
+		return NewBitBuffer(0)
+	}
+	return x.Ge(lo, filter).And(x.Le(hi, filter))
+}
+
+// returns the sum of the values of the rows within filter, modulo 2^64, and
+// how many there are, a popcount per slice
+func (x *BitSlicedIndex) Sum(filter *BitBuffer) (sum uint64, count uint) {
+	if filter == nil {
+		for i, s := range x.slices {
+			sum += uint64(AndCount(s, x.exists)) << i
+		}
+		return sum, x.Count()
+	}
+	f := x.base(filter)
+	for i, s := range x.slices {
+		sum += uint64(AndCount(s, f)) << i
+	}
+	return sum, f.CountBitsOn()
+}
+
+// returns the smallest value of the rows within filter, false if there are
+// none
+func (x *BitSlicedIndex) Min(filter *BitBuffer) (uint64, bool) {
+	return x.extreme(filter, false)
+}
+
+// returns the largest value of the rows within filter, false if there are
+// none
+func (x *BitSlicedIndex) Max(filter *BitBuffer) (uint64, bool) {
+	return x.extreme(filter, true)
+}
+
+// narrows the candidates a slice at a time to those with the wanted bit,
+// when any have it
+func (x *BitSlicedIndex) extreme(filter *BitBuffer, largest bool) (uint64, bool) {
+	cand := x.base(filter)
+	if cand.CountBitsOn() == 0 {
+		return 0, false
+	}
+	v := uint64(0)
+	tmp := NewBitBuffer(0)
+	for i := len(x.slices) - 1; i >= 0; i-- {
+		tmp.CopyFrom(cand)
+		if largest {
+			tmp.And(x.slices[i])
+		} else {
+			tmp.AndNot(x.slices[i])
+		}
+		if tmp.CountBitsOn() == 0 {
+			// every candidate has the other bit
+			if !largest {
+				v |= 1 << i
+			}
+			continue
+		}
+		if largest {
+			v |= 1 << i
+		}
+		cand, tmp = tmp, cand
+	}
+	return v, true
+}
+
+// selects the k rows within filter with the largest values, ties at the
+// k-th value broken by lowest row, fewer when there aren't k rows
+func (x *BitSlicedIndex) TopK(k uint, filter *BitBuffer) *BitBuffer {
+	// rows certainly in, and rows tied so far
+	in := NewBitBuffer(0)
+	tied := x.base(filter)
+	tmp := NewBitBuffer(0)
+	for i := len(x.slices) - 1; i >= 0 && k > 0; i-- {
+		s := x.slices[i]
+		tmp.CopyFrom(tied).And(s).Or(in)
+		n := tmp.CountBitsOn()
+		switch {
+		case n > k:
+			tied.And(s)
+		case n < k:
+			in, tmp = tmp, in
+			tied.AndNot(s)
+		default:
+			return tmp
+		}
+	}
+	// keep the lowest tied rows needed to make up k
+	need := k - min(k, in.CountBitsOn())
+	for i, w := range tied.buff {
+		for ; w != 0; w &= w - 1 {
+			if need == 0 {
+				return in
+			}
+			in.Set(uint(i)*64 + uint(bits.TrailingZeros64(w)))
+			need--
+		}
+	}
+	return in
+}
+
+// adds other's values to the values of the same rows, modulo 2^64, rows with
+// a value in only one of them keep it
+//
+// ripple-carry addition a slice at a time
+// returns pointer to self
+func (x *BitSlicedIndex) Add(other *BitSlicedIndex) *BitSlicedIndex {
+	depth := max(len(x.slices), len(other.slices))
+	x.growDepth(uint(depth))
+	carry := NewBitBuffer(0)
+	tmp := NewBitBuffer(0)
+	for i := 0; i < 64 && (i < depth || carry.CountBitsOn() != 0); i++ {
+		x.growDepth(uint(i + 1))
+		a := x.slices[i]
+		if i >= len(other.slices) {
+			// a + carry
+			tmp.CopyFrom(a).And(carry)
+			a.Xor(carry)
+			carry, tmp = tmp, carry
+			continue
+		}
+		b := other.slices[i]
+		// carry' = a&b | carry&(a^b)
+		tmp.CopyFrom(a).Xor(b)
+		a.And(b)
+		// a holds a&b, tmp a^b
+		next := tmp.Clone().And(carry).Or(a)
+		a.CopyFrom(tmp).Xor(carry)
+		carry = next
+	}
+	x.exists.Or(other.exists)
+	return x
+}
@@ -0,0 +1,218 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"math"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// a column with holes, and the index of it
+func randomBSI(rnd *rand.Rand, rows int, maxv uint64) (map[uint]uint64, *BitSlicedIndex) {
+	values := map[uint]uint64{}
+	x := NewBitSlicedIndex()
+	for r := uint(0); r < uint(rows); r++ {
+		if rnd.Intn(5) == 0 {
+			continue
+		}
+		v := uint64(rnd.Int63n(int64(maxv)))
+		values[r] = v
+		x.Set(r, v)
+	}
+	return values, x
+}
+
+func naiveBSISelect(values map[uint]uint64, filter *BitBuffer, fn func(v uint64) bool) *BitBuffer {
+	r := NewBitBuffer(0)
+	for row, v := range values {
+		if (filter == nil || row < filter.LenBits() && filter.IsSet(row)) && fn(v) {
+			r.Set(row)
+		}
+	}
+	return r
+}
+
+func TestBitSlicedIndexCompare(t *testing.T) {
+	rnd := rand.New(rand.NewSource(48))
+	values, x := randomBSI(rnd, 3000, 1000)
+	filter := NewBitBuffer(0)
+	for i := 0; i < 1500; i++ {
+		filter.Set(uint(rnd.Intn(3000)))
+	}
+	// overwrite and delete some rows
+	for i := 0; i < 200; i++ {
+		r := uint(rnd.Intn(3000))
+		if i%2 == 0 {
+			delete(values, r)
+			x.Delete(r)
+		} else {
+			values[r] = uint64(rnd.Intn(1000))
+			x.Set(r, values[r])
+		}
+	}
+	if x.Count() != uint(len(values)) || x.BitDepth() != 10 {
+		t.Fatalf("Count %v, BitDepth %v", x.Count(), x.BitDepth())
+	}
+	for r := uint(0); r < 3000; r++ {
+		v, ok := x.Get(r)
+		if want, has := values[r]; ok != has || v != want {
+			t.Fatalf("Get(%v) = %v %v, want %v %v", r, v, ok, want, has)
+		}
+	}
+
+	for _, f := range []*BitBuffer{nil, filter} {
+		for _, c := range []uint64{0, 1, 499, 500, 999, 1000, 1023, 1024, 1 << 40} {
+			for _, tc := range []struct {
+				name string
+				got  *BitBuffer
+				fn   func(v uint64) bool
+			}{
+				{"Lt", x.Lt(c, f), func(v uint64) bool { return v < c }},
+				{"Le", x.Le(c, f), func(v uint64) bool { return v <= c }},
+				{"Eq", x.Eq(c, f), func(v uint64) bool { return v == c }},
+				{"Ne", x.Ne(c, f), func(v uint64) bool { return v != c }},
+				{"Gt", x.Gt(c, f), func(v uint64) bool { return v > c }},
+				{"Ge", x.Ge(c, f), func(v uint64) bool { return v >= c }},
+				{"Between", x.Between(c/2, c, f), func(v uint64) bool { return v >= c/2 && v <= c }},
+			} {
+				if want := naiveBSISelect(values, f, tc.fn); XorCount(tc.got, want) != 0 {
+					t.Fatalf("%v(%v) filtered %v: got %v rows, want %v", tc.name, c, f != nil, tc.got.CountBitsOn(), want.CountBitsOn())
+				}
+			}
+		}
+	}
+	if x.Between(5, 4, nil).CountBitsOn() != 0 {
+		t.Fatal("empty Between selected rows")
+	}
+}
+
+func TestBitSlicedIndexAggregates(t *testing.T) {
+	rnd := rand.New(rand.NewSource(49))
+	values, x := randomBSI(rnd, 2000, 1<<20)
+	filter := NewBitBuffer(0)
+	for i := 0; i < 300; i++ {
+		filter.Set(uint(rnd.Intn(2000)))
+	}
+	for _, f := range []*BitBuffer{nil, filter, NewBitBuffer(0)} {
+		var sum uint64
+		var count uint
+		lo, hi := uint64(math.MaxUint64), uint64(0)
+		var rows []uint
+		for row, v := range values {
+			if f == nil || row < f.LenBits() && f.IsSet(row) {
+				sum += v
+				count++
+				lo, hi = min(lo, v), max(hi, v)
+				rows = append(rows, row)
+			}
+		}
+		if s, n := x.Sum(f); s != sum || n != count {
+			t.Fatalf("Sum = %v, %v, want %v, %v", s, n, sum, count)
+		}
+		if v, ok := x.Min(f); ok != (count > 0) || ok && v != lo {
+			t.Fatalf("Min = %v %v, want %v", v, ok, lo)
+		}
+		if v, ok := x.Max(f); ok != (count > 0) || ok && v != hi {
+			t.Fatalf("Max = %v %v, want %v", v, ok, hi)
+		}
+
+		// largest first, ties by lowest row
+		slices.SortFunc(rows, func(a, b uint) int {
+			if values[a] != values[b] {
+				if values[a] > values[b] {
+					return -1
+				}
+				return 1
+			}
+			return int(a) - int(b)
+		})
+		for _, k := range []uint{0, 1, 7, 100, 5000} {
+			want := NewBitBuffer(0)
+			for _, r := range rows[:min(int(k), len(rows))] {
+				want.Set(r)
+			}
+			if got := x.TopK(k, f); XorCount(got, want) != 0 {
+				t.Fatalf("TopK(%v): got %v rows, want %v", k, got.CountBitsOn(), want.CountBitsOn())
+			}
+		}
+	}
+}
+
+func TestBitSlicedIndexTopKTies(t *testing.T) {
+	x := NewBitSlicedIndexFrom([]uint64{5, 9, 5, 5, 9, 1, 5})
+	if got := x.TopK(4, nil); got.Bytes()[0] != 0b00010111 {
+		t.Fatalf("got %08b", got.Bytes()[0])
+	}
+	if got := x.TopK(2, nil); got.Bytes()[0] != 0b00010010 {
+		t.Fatalf("got %08b", got.Bytes()[0])
+	}
+}
+
+func TestBitSlicedIndexAdd(t *testing.T) {
+	rnd := rand.New(rand.NewSource(50))
+	va, a := randomBSI(rnd, 1000, 1<<30)
+	vb, b := randomBSI(rnd, 1500, 1<<12)
+	a.Add(b)
+	for r := uint(0); r < 1500; r++ {
+		x, hx := va[r]
+		y, hy := vb[r]
+		v, ok := a.Get(r)
+		if ok != (hx || hy) || v != x+y {
+			t.Fatalf("row %v: got %v %v, want %v", r, v, ok, x+y)
+		}
+	}
+
+	// carries past the deepest slice, and wrap at 2^64
+	c := NewBitSlicedIndexFrom([]uint64{math.MaxUint64, 255, 1})
+	c.Add(NewBitSlicedIndexFrom([]uint64{2, 1, 1}))
+	for r, want := range []uint64{1, 256, 2} {
+		if v, _ := c.Get(uint(r)); v != want {
+			t.Fatalf("row %v: got %v, want %v", r, v, want)
+		}
+	}
+}
+
+func BenchmarkBitSlicedIndex(b *testing.B) {
+	rnd := rand.New(rand.NewSource(51))
+	column := make([]uint64, 1<<20)
+	for i := range column {
+		column[i] = uint64(rnd.Int63n(1 << 32))
+	}
+	x := NewBitSlicedIndexFrom(column)
+	b.Run("Between", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			x.Between(1<<30, 1<<31, nil)
+		}
+	})
+	b.Run("Sum", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			x.Sum(nil)
+		}
+	})
+}
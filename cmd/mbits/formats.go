@@ -0,0 +1,266 @@
+package main
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/dorind/mbits"
+)
+
+// file formats, see usage
+const (
+	KFORMAT_AUTO    = "auto"
+	KFORMAT_RAW     = "raw"
+	KFORMAT_BIN     = "bin"
+	KFORMAT_ROARING = "roaring"
+	KFORMAT_JSON    = "json"
+)
+
+// json format, bits lists the indexes of set bits, a bare array of indexes
+// is accepted too
+type jsonBits struct {
+	LenBits uint   `json:"len_bits"`
+	Bits    []uint `json:"bits"`
+}
+
+func validFormat(f string, auto bool) error {
+	switch f {
+	case KFORMAT_RAW, KFORMAT_BIN, KFORMAT_ROARING, KFORMAT_JSON:
+		return nil
+	case KFORMAT_AUTO:
+		if auto {
+			return nil
+		}
+	}
+	return usageError(fmt.Sprintf("unknown format %q", f))
+}
+
+// guesses the format from the first bytes, raw when nothing else fits
+func detectFormat(data []byte) string {
+	if _, err := decode(data, KFORMAT_BIN); err == nil {
+		return KFORMAT_BIN
+	}
+	if len(data) >= 4 && (bytes.HasPrefix(data, []byte{0x3a, 0x30, 0, 0}) || bytes.HasPrefix(data[:2], []byte{0x3b, 0x30})) {
+		if _, err := decodeRoaring(data); err == nil {
+			return KFORMAT_ROARING
+		}
+	}
+	if t := bytes.TrimSpace(data); len(t) > 0 && (t[0] == '{' || t[0] == '[') && json.Valid(t) {
+		return KFORMAT_JSON
+	}
+	return KFORMAT_RAW
+}
+
+func decode(data []byte, format string) (*mbits.BitBuffer, error) {
+	b := mbits.NewBitBuffer(0)
+	switch format {
+	case KFORMAT_RAW:
+		b.LoadBuffer(data)
+	case KFORMAT_BIN:
+		if err := b.UnmarshalBinary(data); err != nil {
+			return nil, err
+		}
+	case KFORMAT_ROARING:
+		words, err := decodeRoaring(data)
+		if err != nil {
+			return nil, err
+		}
+		b.FromUint64s(words)
+	case KFORMAT_JSON:
+		var j jsonBits
+		if t := bytes.TrimSpace(data); len(t) > 0 && t[0] == '[' {
+			if err := json.Unmarshal(t, &j.Bits); err != nil {
+				return nil, err
+			}
+		} else if err := json.Unmarshal(t, &j); err != nil {
+			return nil, err
+		}
+		b.SetBufferLen((j.LenBits + mbits.KBITS_PER_BYTE - 1) / mbits.KBITS_PER_BYTE)
+		for _, i := range j.Bits {
+			b.Set(i)
+		}
+	}
+	return b, nil
+}
+
+func encode(b *mbits.BitBuffer, format string) ([]byte, error) {
+	switch format {
+	case KFORMAT_RAW:
+		return b.Bytes(), nil
+	case KFORMAT_BIN:
+		return b.MarshalBinary()
+	case KFORMAT_ROARING:
+		return encodeRoaring(b.ToUint64s())
+	case KFORMAT_JSON:
+		j := jsonBits{LenBits: b.LenBits(), Bits: []uint{}}
+		for i := uint(0); i < b.LenBits(); i++ {
+			if b.IsSet(i) {
+				j.Bits = append(j.Bits, i)
+			}
+		}
+		r, err := json.Marshal(j)
+		return append(r, '\n'), err
+	}
+	return nil, usageError(fmt.Sprintf("unknown format %q", format))
+}
+
+// reads a buffer from path, "-" is stdin, returns the format it was in
+func (c *cli) load(path, format string) (*mbits.BitBuffer, string, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(c.stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if format == KFORMAT_AUTO {
+		format = detectFormat(data)
+	}
+	b, err := decode(data, format)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", path, err)
+	}
+	return b, format, nil
+}
+
+// writes a buffer to path, "-" is stdout, files are replaced atomically
+func (c *cli) save(path, format string, b *mbits.BitBuffer) error {
+	data, err := encode(b, format)
+	if err != nil {
+		return err
+	}
+	if path == "-" {
+		_, err = c.stdout.Write(data)
+		return err
+	}
+
+	// CreateTemp makes the file 0600, keep the mode of the file replaced
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// largest bit index set, clear and toggle take, a span's end plus one fits
+// a uint and the buffer stays within 512 MiB
+const KMAX_INDEX = uint(math.MaxUint32 - 1)
+
+// an inclusive range of bit indexes
+type span struct {
+	from, to uint
+}
+
+// parses index lists such as "3", "4-9" or "1,4-6,15", ranges are inclusive
+func parseSpans(args []string) ([]span, error) {
+	var r []span
+	for _, arg := range args {
+		for _, f := range strings.Split(arg, ",") {
+			a, b, is_range := strings.Cut(f, "-")
+			from, err := strconv.ParseUint(a, 10, 0)
+			if err != nil {
+				return nil, usageError(fmt.Sprintf("bad index %q", f))
+			}
+			to := from
+			if is_range {
+				if to, err = strconv.ParseUint(b, 10, 0); err != nil || to < from {
+					return nil, usageError(fmt.Sprintf("bad range %q", f))
+				}
+			}
+			if to > uint64(KMAX_INDEX) {
+				return nil, usageError(fmt.Sprintf("index %q past %d", f, KMAX_INDEX))
+			}
+			r = append(r, span{uint(from), uint(to)})
+		}
+	}
+	if len(r) == 0 {
+		return nil, usageError("no indexes given")
+	}
+	return r, nil
+}
+
+// runs of set bits as inclusive spans
+func setSpans(b *mbits.BitBuffer) []span {
+	var r []span
+	len_bits := b.LenBits()
+	for i := uint(0); i < len_bits; i++ {
+		if !b.IsSet(i) {
+			continue
+		}
+		from := i
+		for i+1 < len_bits && b.IsSet(i+1) {
+			i++
+		}
+		r = append(r, span{from, i})
+	}
+	return r
+}
+
+// formats spans the way parseSpans reads them
+func formatSpans(spans []span) string {
+	var sb strings.Builder
+	for i, s := range spans {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(strconv.FormatUint(uint64(s.from), 10))
+		if s.to != s.from {
+			sb.WriteByte('-')
+			sb.WriteString(strconv.FormatUint(uint64(s.to), 10))
+		}
+	}
+	return sb.String()
+}
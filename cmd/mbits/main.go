@@ -0,0 +1,396 @@
+// Command mbits inspects and combines files holding bit buffers
+//
+// usage:
+//
+//	mbits <command> [flags] <args>
+//
+// run "mbits help" for the commands and formats, flags go before
+// the other arguments
+//
+// exit codes: 0 on success, 1 when diff finds differences, 2 on usage
+// errors, 3 on any other error
+package main
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/dorind/mbits"
+)
+
+const (
+	KEXIT_OK     = 0
+	KEXIT_DIFFER = 1
+	KEXIT_USAGE  = 2
+	KEXIT_ERROR  = 3
+)
+
+const kusage = `usage: mbits <command> [flags] <args>
+
+commands:
+  count FILE...                 print set and unset bits, tab separated
+  show [-as bits|hex|indices] FILE
+                                print the bits, the bytes in hex, or the
+                                indexes of set bits as ranges
+  and|or|xor|andnot FILE FILE...
+                                combine files left to right
+  set|clear|toggle FILE INDEX...
+                                change bits in place, INDEX is a list such
+                                as 3,5-9 with inclusive ranges
+  diff FILE FILE                print the indexes set only in the first (<)
+                                and only in the second (>), exit 1 if any
+  convert -to FORMAT FILE       rewrite in another format
+  stats FILE                    print length, counts, density and runs
+
+flags:
+  -f FORMAT    input format, auto (default), raw, bin, roaring or json
+  -to FORMAT   output format, defaults to the format of the first input
+  -o FILE      output file, defaults to stdout, or to FILE in place for
+               set, clear and toggle
+
+FILE may be - for stdin, or stdout with -o
+formats: raw is the bytes as they are, bin is mbits' binary format, roaring
+is the portable roaring bitmap format, json is {"len_bits":N,"bits":[...]}
+`
+
+// a bad command line, reported with exit code KEXIT_USAGE
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+// reported with exit code KEXIT_DIFFER
+var errDiffer = errors.New("buffers differ")
+
+type cli struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+type command func(c *cli, name string, args []string) error
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"count":   (*cli).count,
+		"show":    (*cli).show,
+		"and":     (*cli).combine,
+		"or":      (*cli).combine,
+		"xor":     (*cli).combine,
+		"andnot":  (*cli).combine,
+		"set":     (*cli).change,
+		"clear":   (*cli).change,
+		"toggle":  (*cli).change,
+		"diff":    (*cli).diff,
+		"convert": (*cli).convert,
+		"stats":   (*cli).stats,
+	}
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// runs the command line args, returns the exit code
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, kusage)
+		return KEXIT_USAGE
+	}
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, kusage)
+		return KEXIT_OK
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "mbits: unknown command %q, run 'mbits help'\n", args[0])
+		return KEXIT_USAGE
+	}
+
+	c := &cli{stdin: stdin, stdout: stdout, stderr: stderr}
+	err := cmd(c, args[0], args[1:])
+	var uerr usageError
+	switch {
+	case err == nil:
+		return KEXIT_OK
+	case errors.Is(err, errDiffer):
+		return KEXIT_DIFFER
+	case errors.Is(err, flag.ErrHelp):
+		return KEXIT_OK
+	case errors.As(err, &uerr):
+		fmt.Fprintf(stderr, "mbits %s: %v, run 'mbits help'\n", args[0], err)
+		return KEXIT_USAGE
+	}
+	fmt.Fprintf(stderr, "mbits %s: %v\n", args[0], err)
+	return KEXIT_ERROR
+}
+
+// flags shared by the commands, unused ones are left at their defaults
+type flags struct {
+	*flag.FlagSet
+	in  string
+	out string
+	to  string
+	as  string
+}
+
+// parses args, nargs is the minimum number of positional args, or the exact
+// number when exact is set
+func (c *cli) parse(name string, args []string, nargs int, exact bool, setup func(f *flags)) (*flags, error) {
+	f := &flags{FlagSet: flag.NewFlagSet(name, flag.ContinueOnError)}
+	f.SetOutput(c.stderr)
+	f.StringVar(&f.in, "f", KFORMAT_AUTO, "input format")
+	if setup != nil {
+		setup(f)
+	}
+	if err := f.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, err
+		}
+		return nil, usageError(err.Error())
+	}
+	if err := validFormat(f.in, true); err != nil {
+		return nil, err
+	}
+	if f.to != "" {
+		if err := validFormat(f.to, false); err != nil {
+			return nil, err
+		}
+	}
+	if f.NArg() < nargs || (exact && f.NArg() != nargs) {
+		return nil, usageError("wrong number of arguments")
+	}
+	return f, nil
+}
+
+func withOutput(f *flags) {
+	f.StringVar(&f.out, "o", "", "output file")
+	f.StringVar(&f.to, "to", "", "output format")
+}
+
+func (c *cli) count(name string, args []string) error {
+	f, err := c.parse(name, args, 1, false, nil)
+	if err != nil {
+		return err
+	}
+	for _, path := range f.Args() {
+		b, _, err := c.load(path, f.in)
+		if err != nil {
+			return err
+		}
+		on, off := b.CountBits()
+		if f.NArg() > 1 {
+			fmt.Fprintf(c.stdout, "%d\t%d\t%s\n", on, off, path)
+		} else {
+			fmt.Fprintf(c.stdout, "%d\t%d\n", on, off)
+		}
+	}
+	return nil
+}
+
+func (c *cli) show(name string, args []string) error {
+	f, err := c.parse(name, args, 1, true, func(f *flags) {
+		f.StringVar(&f.as, "as", "bits", "bits, hex or indices")
+	})
+	if err != nil {
+		return err
+	}
+	b, _, err := c.load(f.Arg(0), f.in)
+	if err != nil {
+		return err
+	}
+	switch f.as {
+	case "bits":
+		fmt.Fprintln(c.stdout, b.String())
+	case "hex":
+		fmt.Fprintf(c.stdout, "%x\n", b.Bytes())
+	case "indices":
+		fmt.Fprintln(c.stdout, formatSpans(setSpans(b)))
+	default:
+		return usageError(fmt.Sprintf("unknown -as %q", f.as))
+	}
+	return nil
+}
+
+func (c *cli) combine(name string, args []string) error {
+	f, err := c.parse(name, args, 2, false, withOutput)
+	if err != nil {
+		return err
+	}
+	res, format, err := c.load(f.Arg(0), f.in)
+	if err != nil {
+		return err
+	}
+	for _, path := range f.Args()[1:] {
+		b, _, err := c.load(path, f.in)
+		if err != nil {
+			return err
+		}
+		switch name {
+		case "and":
+			res.And(b)
+		case "or":
+			res.Or(b)
+		case "xor":
+			res.Xor(b)
+		case "andnot":
+			res.AndNot(b)
+		}
+	}
+	return c.save(or(f.out, "-"), or(f.to, format), res)
+}
+
+func (c *cli) change(name string, args []string) error {
+	f, err := c.parse(name, args, 2, false, withOutput)
+	if err != nil {
+		return err
+	}
+	spans, err := parseSpans(f.Args()[1:])
+	if err != nil {
+		return err
+	}
+	b, format, err := c.load(f.Arg(0), f.in)
+	if err != nil {
+		return err
+	}
+	for _, s := range spans {
+		switch name {
+		case "set":
+			b.SetRange(s.from, s.to+1)
+		case "clear":
+			b.ClearRange(s.from, s.to+1)
+		case "toggle":
+			for i := s.from; i <= s.to; i++ {
+				b.Toggle(i)
+			}
+		}
+	}
+	return c.save(or(f.out, f.Arg(0)), or(f.to, format), b)
+}
+
+func (c *cli) diff(name string, args []string) error {
+	f, err := c.parse(name, args, 2, true, nil)
+	if err != nil {
+		return err
+	}
+	a, _, err := c.load(f.Arg(0), f.in)
+	if err != nil {
+		return err
+	}
+	b, _, err := c.load(f.Arg(1), f.in)
+	if err != nil {
+		return err
+	}
+
+	only_a := a.Clone().AndNot(b)
+	only_b := b.Clone().AndNot(a)
+	differ := false
+	for _, d := range []struct {
+		mark string
+		bits *mbits.BitBuffer
+	}{{"<", only_a}, {">", only_b}} {
+		if spans := setSpans(d.bits); len(spans) > 0 {
+			fmt.Fprintf(c.stdout, "%s %s\n", d.mark, formatSpans(spans))
+			differ = true
+		}
+	}
+	if differ {
+		return errDiffer
+	}
+	return nil
+}
+
+func (c *cli) convert(name string, args []string) error {
+	f, err := c.parse(name, args, 1, true, withOutput)
+	if err != nil {
+		return err
+	}
+	if f.to == "" {
+		return usageError("-to is required")
+	}
+	b, _, err := c.load(f.Arg(0), f.in)
+	if err != nil {
+		return err
+	}
+	return c.save(or(f.out, "-"), f.to, b)
+}
+
+func (c *cli) stats(name string, args []string) error {
+	f, err := c.parse(name, args, 1, true, nil)
+	if err != nil {
+		return err
+	}
+	b, _, err := c.load(f.Arg(0), f.in)
+	if err != nil {
+		return err
+	}
+
+	on, off := b.CountBits()
+	spans := setSpans(b)
+	longest := uint(0)
+	first, last := int64(-1), int64(-1)
+	for _, s := range spans {
+		longest = max(longest, s.to-s.from+1)
+	}
+	if len(spans) > 0 {
+		first, last = int64(spans[0].from), int64(spans[len(spans)-1].to)
+	}
+	density := 0.0
+	if b.LenBits() > 0 {
+		density = float64(on) / float64(b.LenBits())
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "len_bits\t%d\n", b.LenBits())
+	fmt.Fprintf(&sb, "on\t%d\n", on)
+	fmt.Fprintf(&sb, "off\t%d\n", off)
+	fmt.Fprintf(&sb, "density\t%.6f\n", density)
+	fmt.Fprintf(&sb, "runs\t%d\n", len(spans))
+	fmt.Fprintf(&sb, "longest_run\t%d\n", longest)
+	fmt.Fprintf(&sb, "first\t%d\n", first)
+	fmt.Fprintf(&sb, "last\t%d\n", last)
+	_, err = io.WriteString(c.stdout, sb.String())
+	return err
+}
+
+// returns s, or def when s is empty
+func or(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
@@ -0,0 +1,242 @@
+package main
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/dorind/mbits"
+)
+
+// runs the command line, returns exit code, stdout and stderr
+func runCLI(stdin string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func writeBits(t *testing.T, dir, name, format string, bits ...uint) string {
+	t.Helper()
+	b := mbits.NewBitBuffer(8)
+	for _, i := range bits {
+		b.Set(i)
+	}
+	data, err := encode(b, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRoaringEncoding(t *testing.T) {
+	b := mbits.NewBitBuffer(0)
+	b.Set(1).Set(70000)
+	data, err := encodeRoaring(b.ToUint64s())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "3a300000" + "02000000" + "00000000" + "01000000" + "18000000" + "1a000000" + "0100" + "7011"
+	if got := hex.EncodeToString(data); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// run container holding 5..14, as written by CRoaring after
+	// runOptimize, no offsets with fewer than 4 containers
+	runs, _ := hex.DecodeString("3b300000" + "01" + "00000900" + "0100" + "05000900")
+	words, err := decodeRoaring(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(words) != 1 || words[0] != 0x7fe0 {
+		t.Errorf("got %x", words)
+	}
+
+	// array and bitmap containers, across chunks
+	b = mbits.NewBitBuffer(0)
+	b.SetRange(3, 5003).Set(65535).Set(1<<20).SetRange(1<<21, 1<<21+70000)
+	data, err = encodeRoaring(b.ToUint64s())
+	if err != nil {
+		t.Fatal(err)
+	}
+	words, err = decodeRoaring(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := mbits.NewBitBuffer(0).FromUint64s(words)
+	if got.CountBitsOn() != b.CountBitsOn() || got.Clone().Xor(b).CountBitsOn() != 0 {
+		t.Errorf("roundtrip lost bits, %d of %d", got.CountBitsOn(), b.CountBitsOn())
+	}
+
+	for _, bad := range []string{"", "3a30", "3a30000001000000", "3b30000001000009000100"} {
+		data, _ := hex.DecodeString(bad)
+		if _, err := decodeRoaring(data); err == nil {
+			t.Errorf("%q decoded", bad)
+		}
+	}
+}
+
+func TestFormats(t *testing.T) {
+	b := mbits.NewBitBuffer(3)
+	b.Set(0).Set(9).Set(23)
+	for _, format := range []string{KFORMAT_RAW, KFORMAT_BIN, KFORMAT_ROARING, KFORMAT_JSON} {
+		data, err := encode(b, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := detectFormat(data); got != format {
+			t.Errorf("%s detected as %s", format, got)
+		}
+		got, err := decode(data, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format != KFORMAT_ROARING && got.CmpWith(b) != 0 {
+			t.Errorf("%s: got %s, want %s", format, got, b)
+		}
+		if got.CountBitsOn() != 3 || !got.IsSet(23) {
+			t.Errorf("%s: got %s", format, got)
+		}
+	}
+
+	got, err := decode([]byte(" [1, 5] "), KFORMAT_JSON)
+	if err != nil || got.CountBitsOn() != 2 || !got.IsSet(5) {
+		t.Errorf("bare array: %v %v", got, err)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	dir := t.TempDir()
+	a := writeBits(t, dir, "a.bin", KFORMAT_BIN, 0, 1, 2, 10)
+	b := writeBits(t, dir, "b.raw", KFORMAT_RAW, 2, 3, 10, 63)
+
+	for _, tc := range []struct {
+		args []string
+		code int
+		out  string
+	}{
+		{[]string{"count", a}, KEXIT_OK, "4\t60\n"},
+		{[]string{"count", a, b}, KEXIT_OK, "4\t60\t" + a + "\n4\t60\t" + b + "\n"},
+		{[]string{"show", "-as", "indices", a}, KEXIT_OK, "0-2,10\n"},
+		{[]string{"show", "-as", "hex", a}, KEXIT_OK, "0704000000000000\n"},
+		{[]string{"show", a}, KEXIT_OK, "1110000000100000000000000000000000000000000000000000000000000000\n"},
+		{[]string{"and", "-to", "json", a, b}, KEXIT_OK, `{"len_bits":64,"bits":[2,10]}` + "\n"},
+		{[]string{"or", "-to", "json", a, b}, KEXIT_OK, `{"len_bits":64,"bits":[0,1,2,3,10,63]}` + "\n"},
+		{[]string{"xor", "-to", "json", a, b}, KEXIT_OK, `{"len_bits":64,"bits":[0,1,3,63]}` + "\n"},
+		{[]string{"andnot", "-to", "json", a, b}, KEXIT_OK, `{"len_bits":64,"bits":[0,1]}` + "\n"},
+		{[]string{"diff", a, b}, KEXIT_DIFFER, "< 0-1\n> 3,63\n"},
+		{[]string{"diff", a, a}, KEXIT_OK, ""},
+		{[]string{"stats", b}, KEXIT_OK, "len_bits\t64\non\t4\noff\t60\ndensity\t0.062500\nruns\t3\nlongest_run\t2\nfirst\t2\nlast\t63\n"},
+		{[]string{"nope"}, KEXIT_USAGE, ""},
+		{[]string{"count"}, KEXIT_USAGE, ""},
+		{[]string{"count", "-f", "gif", a}, KEXIT_USAGE, ""},
+		{[]string{"set", a, "x"}, KEXIT_USAGE, ""},
+		{[]string{"set", a, "5-2"}, KEXIT_USAGE, ""},
+		{[]string{"convert", a}, KEXIT_USAGE, ""},
+		{[]string{"count", filepath.Join(dir, "missing")}, KEXIT_ERROR, ""},
+		{[]string{"count", "-f", "bin", b}, KEXIT_ERROR, ""},
+	} {
+		code, out, _ := runCLI("", tc.args...)
+		if code != tc.code || out != tc.out {
+			t.Errorf("%v: got %d %q, want %d %q", tc.args, code, out, tc.code, tc.out)
+		}
+	}
+}
+
+func TestChangeAndConvert(t *testing.T) {
+	dir := t.TempDir()
+	a := writeBits(t, dir, "a.bin", KFORMAT_BIN, 0)
+
+	for _, args := range [][]string{
+		{"set", a, "4-6,20"},
+		{"clear", a, "5"},
+		{"toggle", a, "0-1"},
+	} {
+		if code, _, errs := runCLI("", args...); code != KEXIT_OK {
+			t.Fatalf("%v: exit %d %s", args, code, errs)
+		}
+	}
+	if _, out, _ := runCLI("", "show", "-as", "indices", a); out != "1,4,6,20\n" {
+		t.Errorf("got %q", out)
+	}
+
+	r := filepath.Join(dir, "a.roaring")
+	if code, _, errs := runCLI("", "convert", "-to", "roaring", "-o", r, a); code != KEXIT_OK {
+		t.Fatalf("convert: exit %d %s", code, errs)
+	}
+	if _, out, _ := runCLI("", "show", "-as", "indices", r); out != "1,4,6,20\n" {
+		t.Errorf("roaring got %q", out)
+	}
+
+	// stdin and stdout
+	code, out, _ := runCLI(`[3, 4]`, "convert", "-to", "json", "-")
+	if code != KEXIT_OK || out != `{"len_bits":64,"bits":[3,4]}`+"\n" {
+		t.Errorf("got %d %q", code, out)
+	}
+	code, out, _ = runCLI("\x01", "set", "-f", "raw", "-to", "raw", "-", "1")
+	if code != KEXIT_OK || out != "\x03" {
+		t.Errorf("got %d %q", code, out)
+	}
+	// indexes that would overflow or exhaust memory
+	for _, idx := range []string{"4294967295", "0-4294967295", "18446744073709551615", "99999999999999999999"} {
+		if code, _, errs := runCLI("", "toggle", a, idx); code != KEXIT_USAGE {
+			t.Errorf("%v: exit %d %s", idx, code, errs)
+		}
+	}
+}
+
+func TestChangeKeepsMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("modes are unix permissions")
+	}
+	dir := t.TempDir()
+	a := writeBits(t, dir, "a.bin", KFORMAT_BIN, 0)
+	if err := os.Chmod(a, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if code, _, errs := runCLI("", "set", a, "3"); code != KEXIT_OK {
+		t.Fatalf("exit %d %s", code, errs)
+	}
+	b := filepath.Join(dir, "b.bin")
+	if code, _, errs := runCLI("", "set", "-o", b, a, "4"); code != KEXIT_OK {
+		t.Fatalf("exit %d %s", code, errs)
+	}
+	for path, want := range map[string]os.FileMode{a: 0640, b: 0644} {
+		if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != want {
+			t.Errorf("%s: mode %v, want %v", path, fi.Mode().Perm(), want)
+		}
+	}
+}
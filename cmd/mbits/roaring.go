@@ -0,0 +1,221 @@
+package main
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// portable roaring format, as written by the CRoaring, Java and Go
+// implementations, all fields little-endian:
+//
+//	cookie      uint32 12346, then uint32 container count
+//	            or uint16 12347, uint16 count-1, then a bitset of the
+//	            containers holding runs
+//	keys        per container uint16 high bits, uint16 cardinality-1
+//	offsets     per container uint32 offset, absent with runs and fewer
+//	            than 4 containers
+//	containers  array: cardinality uint16 low bits
+//	            bitmap: 1024 uint64, when cardinality > 4096
+//	            run: uint16 count, then uint16 start, length-1 pairs
+//
+// every container covers 65536 values, bit i of a bitmap container is bit
+// i%64 of word i/64, the same as the canonical layout
+const (
+	kroaringCookieNoRuns = 12346
+	kroaringCookieRuns   = 12347
+	kroaringNoOffsets    = 4
+	kroaringArrayMax     = 4096
+	kroaringWords        = 1024
+	kroaringMaxWords     = 1 << 26
+)
+
+var errBadRoaring = errors.New("not a roaring bitmap")
+
+// encodes 64-bit words of a buffer as a roaring bitmap, without runs
+func encodeRoaring(words []uint64) ([]byte, error) {
+	if len(words) > kroaringMaxWords {
+		return nil, fmt.Errorf("roaring holds 32-bit values, the buffer has %d bits", uint64(len(words))*64)
+	}
+
+	type container struct {
+		key   uint16
+		card  int
+		words []uint64
+	}
+	var cs []container
+	for k := 0; k*kroaringWords < len(words); k++ {
+		chunk := words[k*kroaringWords : min((k+1)*kroaringWords, len(words))]
+		card := 0
+		for _, w := range chunk {
+			card += bits.OnesCount64(w)
+		}
+		if card > 0 {
+			cs = append(cs, container{uint16(k), card, chunk})
+		}
+	}
+
+	size := 0
+	for _, c := range cs {
+		if c.card > kroaringArrayMax {
+			size += kroaringWords * 8
+		} else {
+			size += c.card * 2
+		}
+	}
+	head := 8 + 8*len(cs)
+	r := make([]byte, head, head+size)
+	binary.LittleEndian.PutUint32(r[0:], kroaringCookieNoRuns)
+	binary.LittleEndian.PutUint32(r[4:], uint32(len(cs)))
+	for i, c := range cs {
+		binary.LittleEndian.PutUint16(r[8+4*i:], c.key)
+		binary.LittleEndian.PutUint16(r[8+4*i+2:], uint16(c.card-1))
+	}
+	for i, c := range cs {
+		binary.LittleEndian.PutUint32(r[8+4*len(cs)+4*i:], uint32(len(r)))
+		if c.card > kroaringArrayMax {
+			for j := range kroaringWords {
+				w := uint64(0)
+				if j < len(c.words) {
+					w = c.words[j]
+				}
+				r = binary.LittleEndian.AppendUint64(r, w)
+			}
+			continue
+		}
+		for j, w := range c.words {
+			for w != 0 {
+				r = binary.LittleEndian.AppendUint16(r, uint16(j*64+bits.TrailingZeros64(w)))
+				w &= w - 1
+			}
+		}
+	}
+	return r, nil
+}
+
+// decodes a roaring bitmap to 64-bit words, as many as needed to hold the
+// largest value
+func decodeRoaring(data []byte) ([]uint64, error) {
+	if len(data) < 4 {
+		return nil, errBadRoaring
+	}
+	var size int
+	var runs []byte
+	p := 4
+	cookie := binary.LittleEndian.Uint32(data)
+	switch {
+	case cookie == kroaringCookieNoRuns:
+		if len(data) < 8 {
+			return nil, errBadRoaring
+		}
+		size = int(binary.LittleEndian.Uint32(data[4:]))
+		p = 8
+	case cookie&0xffff == kroaringCookieRuns:
+		size = int(cookie>>16) + 1
+		n := (size + 7) / 8
+		if len(data) < p+n {
+			return nil, errBadRoaring
+		}
+		runs = data[p : p+n]
+		p += n
+	default:
+		return nil, errBadRoaring
+	}
+	if size > 1<<16 || len(data) < p+4*size {
+		return nil, errBadRoaring
+	}
+	keys := data[p : p+4*size]
+	p += 4 * size
+	if runs == nil || size >= kroaringNoOffsets {
+		p += 4 * size
+	}
+
+	var words []uint64
+	set := func(key uint16, low uint) {
+		v := uint(key)<<16 | low
+		if need := int(v/64) + 1; need > len(words) {
+			words = append(words, make([]uint64, need-len(words))...)
+		}
+		words[v/64] |= 1 << (v % 64)
+	}
+	take := func(n int) ([]byte, error) {
+		if n < 0 || len(data) < p+n {
+			return nil, errBadRoaring
+		}
+		b := data[p : p+n]
+		p += n
+		return b, nil
+	}
+
+	for i := range size {
+		key := binary.LittleEndian.Uint16(keys[4*i:])
+		card := int(binary.LittleEndian.Uint16(keys[4*i+2:])) + 1
+		switch {
+		case runs != nil && runs[i/8]&(1<<(i%8)) != 0:
+			b, err := take(2)
+			if err != nil {
+				return nil, err
+			}
+			b, err = take(4 * int(binary.LittleEndian.Uint16(b)))
+			if err != nil {
+				return nil, err
+			}
+			for ; len(b) > 0; b = b[4:] {
+				start := uint(binary.LittleEndian.Uint16(b))
+				end := start + uint(binary.LittleEndian.Uint16(b[2:]))
+				if end > 0xffff {
+					return nil, errBadRoaring
+				}
+				for v := start; v <= end; v++ {
+					set(key, v)
+				}
+			}
+		case card > kroaringArrayMax:
+			b, err := take(kroaringWords * 8)
+			if err != nil {
+				return nil, err
+			}
+			for j := range kroaringWords {
+				for w := binary.LittleEndian.Uint64(b[8*j:]); w != 0; w &= w - 1 {
+					set(key, uint(j*64+bits.TrailingZeros64(w)))
+				}
+			}
+		default:
+			b, err := take(2 * card)
+			if err != nil {
+				return nil, err
+			}
+			for ; len(b) > 0; b = b[2:] {
+				set(key, uint(binary.LittleEndian.Uint16(b)))
+			}
+		}
+	}
+	return words, nil
+}
@@ -0,0 +1,410 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// collection file format, all fixed size fields little-endian:
+//
+//	header  magic "MBITCOLL", version uint32, reserved uint32
+//	blobs   every bitmap in the binary format, back to back
+//	index   entry count, then for each entry: key length, key, blob offset,
+//	        blob size, all counts and offsets as uvarints, and CRC-32C of
+//	        the blob uint32, sorted by key
+//	footer  index offset uint64, index size uint64, CRC-32C of the index
+//	        uint32, reserved uint32
+//
+// the footer lets a reader find the index without reading any blob, so
+// bitmaps can be loaded one at a time
+// version 1 files, without blob checksums, are still read
+const (
+	// size of the header at the start of a collection file
+	KCOLL_HEADER_BYTES = uint(16)
+	// size of the footer at the end of a collection file
+	KCOLL_FOOTER_BYTES = uint(24)
+	// format version written in the header
+	KCOLL_VERSION = uint32(2)
+)
+
+var (
+	// returned when a key isn't in the collection
+	ErrNoKey = errors.New("mbits: no such key")
+	// returned when reading something that isn't a collection file
+	ErrBadCollection = errors.New("mbits: not a collection file")
+)
+
+// first bytes of every collection file
+var kcollMagic = [8]byte{'M', 'B', 'I', 'T', 'C', 'O', 'L', 'L'}
+
+// Collection maps string keys to BitBuffers, a collection opened from a file
+// loads each bitmap on first use
+// not safe for concurrent use, Get() may load from the file
+type Collection struct {
+	entries map[string]*collectionEntry
+	// file the unloaded entries live in, nil if all are in memory
+	src *os.File
+}
+
+type collectionEntry struct {
+	// nil until loaded from src
+	bits *BitBuffer
+	// where the blob is in src
+	off, size int64
+	// CRC-32C of the blob, unless read from a version 1 file
+	crc     uint32
+	has_crc bool
+}
+
+// constructs an empty in-memory Collection and returns pointer to instance
+func NewCollection() *Collection {
+	return &Collection{entries: map[string]*collectionEntry{}}
+}
+
+// opens a collection file, only the index is read, bitmaps are loaded when
+// first needed, so the file stays open until Close()
+func OpenCollection(path string) (*Collection, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := readCollectionIndex(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func readCollectionIndex(f *os.File) (*Collection, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size < int64(KCOLL_HEADER_BYTES+KCOLL_FOOTER_BYTES) {
+		return nil, ErrBadCollection
+	}
+
+	hdr := make([]byte, KCOLL_HEADER_BYTES)
+	if _, err := f.ReadAt(hdr, 0); err != nil {
+		return nil, err
+	}
+	version := binary.LittleEndian.Uint32(hdr[8:])
+	if [8]byte(hdr[:8]) != kcollMagic || version < 1 || version > KCOLL_VERSION {
+		return nil, ErrBadCollection
+	}
+
+	footer := make([]byte, KCOLL_FOOTER_BYTES)
+	if _, err := f.ReadAt(footer, size-int64(KCOLL_FOOTER_BYTES)); err != nil {
+		return nil, err
+	}
+	index_off := int64(binary.LittleEndian.Uint64(footer))
+	index_size := int64(binary.LittleEndian.Uint64(footer[8:]))
+	blobs_end := size - int64(KCOLL_FOOTER_BYTES)
+	if index_off < int64(KCOLL_HEADER_BYTES) || index_size < 0 || index_off > blobs_end-index_size {
+		return nil, ErrBadCollection
+	}
+	index := make([]byte, index_size)
+	if _, err := f.ReadAt(index, index_off); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(index, kcrc32c) != binary.LittleEndian.Uint32(footer[16:]) {
+		return nil, ErrBadCollection
+	}
+
+	c := NewCollection()
+	c.src = f
+	count, index := uvarint(index)
+	for i := uint64(0); i < count && index != nil; i++ {
+		var klen, off, bsize uint64
+		klen, index = uvarint(index)
+		if uint64(len(index)) < klen {
+			return nil, ErrBadCollection
+		}
+		key := string(index[:klen])
+		off, index = uvarint(index[klen:])
+		bsize, index = uvarint(index)
+		if index == nil || off < uint64(KCOLL_HEADER_BYTES) || off > uint64(index_off) || bsize > uint64(index_off)-off {
+			return nil, ErrBadCollection
+		}
+		e := &collectionEntry{off: int64(off), size: int64(bsize)}
+		if version >= 2 {
+			if len(index) < 4 {
+				return nil, ErrBadCollection
+			}
+			e.crc, e.has_crc = binary.LittleEndian.Uint32(index), true
+			index = index[4:]
+		}
+		c.entries[key] = e
+	}
+	if index == nil || len(index) != 0 || uint64(len(c.entries)) != count {
+		return nil, ErrBadCollection
+	}
+	return c, nil
+}
+
+// decodes a uvarint, rest is nil if data is too short
+func uvarint(data []byte) (v uint64, rest []byte) {
+	v, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, nil
+	}
+	return v, data[n:]
+}
+
+// closes the file the collection was opened from, bitmaps that weren't
+// loaded can't be loaded afterwards
+func (c *Collection) Close() error {
+	if c.src == nil {
+		return nil
+	}
+	err := c.src.Close()
+	c.src = nil
+	return err
+}
+
+// returns the bitmap stored under key, loading it if needed
+// the bitmap is shared with the collection, changes to it are kept
+func (c *Collection) Get(key string) (*BitBuffer, error) {
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrNoKey, key)
+	}
+	if e.bits == nil {
+		if c.src == nil {
+			return nil, ErrClosed
+		}
+		blob := make([]byte, e.size)
+		if _, err := c.src.ReadAt(blob, e.off); err != nil {
+			return nil, fmt.Errorf("mbits: loading %q: %w", key, err)
+		}
+		if e.has_crc && crc32.Checksum(blob, kcrc32c) != e.crc {
+			return nil, fmt.Errorf("%w: %q fails its checksum", ErrBadCollection, key)
+		}
+		b := &BitBuffer{}
+		if err := b.UnmarshalBinary(blob); err != nil {
+			return nil, fmt.Errorf("mbits: loading %q: %w", key, err)
+		}
+		e.bits = b
+	}
+	return e.bits, nil
+}
+
+// stores b under key, replacing what was there
+// b is shared with the collection, not copied
+func (c *Collection) Put(key string, b *BitBuffer) {
+	c.entries[key] = &collectionEntry{bits: b}
+}
+
+// removes key, returns false if it wasn't there
+func (c *Collection) Delete(key string) bool {
+	_, ok := c.entries[key]
+	delete(c.entries, key)
+	return ok
+}
+
+// returns true if key is in the collection
+func (c *Collection) Has(key string) bool {
+	_, ok := c.entries[key]
+	return ok
+}
+
+// number of keys
+func (c *Collection) Len() int {
+	return len(c.entries)
+}
+
+// returns the keys starting with prefix, sorted, an empty prefix lists all
+func (c *Collection) List(prefix string) []string {
+	r := []string{}
+	for k := range c.entries {
+		if strings.HasPrefix(k, prefix) {
+			r = append(r, k)
+		}
+	}
+	slices.Sort(r)
+	return r
+}
+
+// returns a new bitmap holding the OR of the bitmaps under keys
+// e.g. c.Or(c.List("2026-10-")...)
+func (c *Collection) Or(keys ...string) (*BitBuffer, error) {
+	return c.reduce(keys, (*BitBuffer).Or)
+}
+
+// returns a new bitmap holding the AND of the bitmaps under keys
+func (c *Collection) And(keys ...string) (*BitBuffer, error) {
+	return c.reduce(keys, (*BitBuffer).And)
+}
+
+// returns a new bitmap holding the XOR of the bitmaps under keys
+func (c *Collection) Xor(keys ...string) (*BitBuffer, error) {
+	return c.reduce(keys, (*BitBuffer).Xor)
+}
+
+// folds op over the bitmaps under keys into a new bitmap, no keys give an
+// empty bitmap
+func (c *Collection) reduce(keys []string, op func(m, other *BitBuffer) *BitBuffer) (*BitBuffer, error) {
+	if len(keys) == 0 {
+		return NewBitBuffer(0), nil
+	}
+	var r *BitBuffer
+	for _, k := range keys {
+		b, err := c.Get(k)
+		if err != nil {
+			return nil, err
+		}
+		if r == nil {
+			r = b.Clone()
+		} else {
+			op(r, b)
+		}
+	}
+	return r, nil
+}
+
+// writes the collection to w in the collection file format
+// bitmaps that weren't loaded are copied from the source file as they are,
+// checking their checksum on the way
+// implements io.WriterTo
+func (c *Collection) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+
+	hdr := make([]byte, KCOLL_HEADER_BYTES)
+	copy(hdr, kcollMagic[:])
+	binary.LittleEndian.PutUint32(hdr[8:], KCOLL_VERSION)
+	cw.Write(hdr)
+
+	keys := c.List("")
+	index := binary.AppendUvarint(nil, uint64(len(keys)))
+	for _, k := range keys {
+		off := cw.n
+		e := c.entries[k]
+		h := crc32.New(kcrc32c)
+		out := io.MultiWriter(cw, h)
+		if e.bits != nil {
+			e.bits.WriteTo(out)
+		} else if c.src == nil {
+			return cw.n, ErrClosed
+		} else {
+			n, err := io.Copy(out, io.NewSectionReader(c.src, e.off, e.size))
+			if cw.err != nil {
+				return cw.n, cw.err
+			}
+			if err == nil && n != e.size {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				return cw.n, fmt.Errorf("mbits: copying %q: %w", k, err)
+			}
+			if e.has_crc && h.Sum32() != e.crc {
+				return cw.n, fmt.Errorf("%w: %q fails its checksum", ErrBadCollection, k)
+			}
+		}
+		if cw.err != nil {
+			return cw.n, cw.err
+		}
+		index = binary.AppendUvarint(index, uint64(len(k)))
+		index = append(index, k...)
+		index = binary.AppendUvarint(index, uint64(off))
+		index = binary.AppendUvarint(index, uint64(cw.n-off))
+		index = binary.LittleEndian.AppendUint32(index, h.Sum32())
+	}
+
+	index_off := cw.n
+	cw.Write(index)
+	footer := make([]byte, KCOLL_FOOTER_BYTES)
+	binary.LittleEndian.PutUint64(footer, uint64(index_off))
+	binary.LittleEndian.PutUint64(footer[8:], uint64(len(index)))
+	binary.LittleEndian.PutUint32(footer[16:], crc32.Checksum(index, kcrc32c))
+	cw.Write(footer)
+	if cw.err == nil {
+		cw.err = cw.w.(*bufio.Writer).Flush()
+	}
+	return cw.n, cw.err
+}
+
+// writes the collection to path through a temporary file and a rename, so
+// saving over the file the collection was opened from is fine
+// the file keeps the mode of the one it replaces, a new one is 0644
+func (c *Collection) SaveFile(path string) error {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = c.WriteTo(f)
+	if err == nil {
+		// CreateTemp makes it 0600
+		err = f.Chmod(mode)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// counts the bytes written and remembers the first error, later writes are
+// dropped
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
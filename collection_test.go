@@ -0,0 +1,272 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+)
+
+func testCollection() *Collection {
+	c := NewCollection()
+	c.Put("2026-09-30", NewBitBuffer(0).Set(1).Set(2))
+	c.Put("2026-10-01", NewBitBuffer(0).Set(3).Set(4))
+	c.Put("2026-10-02", NewBitBuffer(0).Set(4).Set(100))
+	c.Put("2026-10-03", NewBitBuffer(0).Set(4).Set(5))
+	return c
+}
+
+func TestCollectionBasics(t *testing.T) {
+	c := testCollection()
+
+	keys := c.List("2026-10-")
+	if !slices.Equal(keys, []string{"2026-10-01", "2026-10-02", "2026-10-03"}) {
+		t.Fatalf("List fail, %v", keys)
+	}
+	if c.Len() != 4 || len(c.List("")) != 4 {
+		t.Fatalf("Len fail, %v", c.Len())
+	}
+
+	b, err := c.Get("2026-09-30")
+	if err != nil || !b.IsSet(2) {
+		t.Fatalf("Get fail, %v", err)
+	}
+	if _, err := c.Get("nope"); !errors.Is(err, ErrNoKey) {
+		t.Fatalf("Expected ErrNoKey, found %v", err)
+	}
+
+	if !c.Delete("2026-09-30") || c.Delete("2026-09-30") || c.Has("2026-09-30") {
+		t.Fatal("Delete fail")
+	}
+}
+
+func TestCollectionOps(t *testing.T) {
+	c := testCollection()
+	keys := c.List("2026-10-")
+
+	or, err := c.Or(keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := NewBitBuffer(0).Set(3).Set(4).Set(5).Set(100)
+	if or.CmpWith(expected) != 0 {
+		t.Fatalf("Or fail, %v", or)
+	}
+
+	and, _ := c.And(keys...)
+	if and.CountBitsOn() != 1 || !and.IsSet(4) {
+		t.Fatalf("And fail, %v", and)
+	}
+
+	xor, _ := c.Xor(keys...)
+	if xor.CountBitsOn() != 4 || !xor.IsSet(4) || !xor.IsSet(100) {
+		t.Fatalf("Xor fail, %v", xor)
+	}
+
+	// the stored bitmaps are left alone
+	first, _ := c.Get("2026-10-01")
+	if first.CountBitsOn() != 2 {
+		t.Fatal("Op modified an input")
+	}
+
+	if _, err := c.Or("2026-10-01", "missing"); !errors.Is(err, ErrNoKey) {
+		t.Fatalf("Expected ErrNoKey, found %v", err)
+	}
+}
+
+func TestCollectionFileLazy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coll")
+	if err := testCollection().SaveFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := OpenCollection(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.Len() != 4 {
+		t.Fatalf("Expected 4 keys, found %v", c.Len())
+	}
+	for _, e := range c.entries {
+		if e.bits != nil {
+			t.Fatal("Open loaded a bitmap")
+		}
+	}
+
+	b, err := c.Get("2026-10-02")
+	if err != nil || !b.IsSet(100) || b.CountBitsOn() != 2 {
+		t.Fatalf("Lazy Get fail, %v", err)
+	}
+	if c.entries["2026-10-01"].bits != nil {
+		t.Fatal("Get loaded another bitmap")
+	}
+
+	// modify one, add one, save over the file being read from
+	b.Set(7)
+	c.Put("2026-10-04", NewBitBuffer(0).Set(9))
+	if err := c.SaveFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := OpenCollection(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	for _, k := range c.List("") {
+		x, _ := c.Get(k)
+		y, err := d.Get(k)
+		if err != nil || x.CmpWith(y) != 0 {
+			t.Fatalf("Round trip fail for %v, %v", k, err)
+		}
+	}
+}
+
+func TestCollectionFileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("modes are unix permissions")
+	}
+	path := filepath.Join(t.TempDir(), "coll")
+	if err := testCollection().SaveFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0644 {
+		t.Fatalf("New file mode %v", fi.Mode().Perm())
+	}
+	os.Chmod(path, 0640)
+	if err := testCollection().SaveFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0640 {
+		t.Fatalf("Replaced file mode %v", fi.Mode().Perm())
+	}
+}
+
+func TestCollectionBadFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "coll")
+	testCollection().SaveFile(path)
+	data, _ := os.ReadFile(path)
+
+	// flip a byte in the index
+	damaged := append([]byte{}, data...)
+	damaged[len(damaged)-int(KCOLL_FOOTER_BYTES)-3] ^= 0xff
+	os.WriteFile(path, damaged, 0644)
+	if _, err := OpenCollection(path); err != ErrBadCollection {
+		t.Fatalf("Expected ErrBadCollection, found %v", err)
+	}
+
+	os.WriteFile(path, data[:20], 0644)
+	if _, err := OpenCollection(path); err != ErrBadCollection {
+		t.Fatalf("Expected ErrBadCollection, found %v", err)
+	}
+}
+
+func TestCollectionBlobChecksum(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "coll")
+	testCollection().SaveFile(path)
+	data, _ := os.ReadFile(path)
+
+	// flip a bit in the last word of the first blob, which still decodes
+	c, _ := OpenCollection(path)
+	first := c.entries["2026-09-30"]
+	c.Close()
+	damaged := append([]byte{}, data...)
+	damaged[first.off+first.size-1] ^= 0x80
+	os.WriteFile(path, damaged, 0644)
+
+	c, err := OpenCollection(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Get("2026-09-30"); !errors.Is(err, ErrBadCollection) {
+		t.Fatalf("Expected ErrBadCollection, found %v", err)
+	}
+	if _, err := c.Get("2026-10-01"); err != nil {
+		t.Fatal(err)
+	}
+	// a damaged blob isn't copied on
+	if err := c.SaveFile(filepath.Join(dir, "copy")); !errors.Is(err, ErrBadCollection) {
+		t.Fatalf("Expected ErrBadCollection, found %v", err)
+	}
+}
+
+func TestCollectionShortSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coll")
+	testCollection().SaveFile(path)
+	c, err := OpenCollection(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the file loses its blobs after the index was read
+	os.Truncate(path, int64(KCOLL_HEADER_BYTES)+4)
+	if _, err := c.WriteTo(io.Discard); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Expected io.ErrUnexpectedEOF, found %v", err)
+	}
+}
+
+func TestCollectionVersion1(t *testing.T) {
+	// header, one blob, index without checksums, footer
+	blob, _ := NewBitBuffer(0).Set(7).MarshalBinary()
+	data := append([]byte("MBITCOLL"), 1, 0, 0, 0, 0, 0, 0, 0)
+	data = append(data, blob...)
+	index := binary.AppendUvarint(nil, 1)
+	index = binary.AppendUvarint(index, 1)
+	index = append(index, 'k')
+	index = binary.AppendUvarint(index, uint64(KCOLL_HEADER_BYTES))
+	index = binary.AppendUvarint(index, uint64(len(blob)))
+	index_off := len(data)
+	data = append(data, index...)
+	data = binary.LittleEndian.AppendUint64(data, uint64(index_off))
+	data = binary.LittleEndian.AppendUint64(data, uint64(len(index)))
+	data = binary.LittleEndian.AppendUint32(data, crc32.Checksum(index, kcrc32c))
+	data = append(data, 0, 0, 0, 0)
+
+	path := filepath.Join(t.TempDir(), "coll")
+	os.WriteFile(path, data, 0644)
+	c, err := OpenCollection(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	b, err := c.Get("k")
+	if err != nil || !b.IsSet(7) {
+		t.Fatalf("Get fail, %v", err)
+	}
+}
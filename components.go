@@ -0,0 +1,266 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"fmt"
+	"image"
+	"math/bits"
+)
+
+// which neighbours of a cell are connected to it
+type Connectivity int
+
+const (
+	// north, south, east and west
+	KCONNECT_4 Connectivity = 4
+	// the 4 above and the diagonals
+	KCONNECT_8 Connectivity = 8
+)
+
+// a maximal run of cells that are on, [X0, X1) of row Y
+type gridRun struct {
+	y, x0, x1 uint
+}
+
+// returns the index of the first bit in [from, limit) that equals want, or
+// limit
+func nextBit(words []uint64, from, limit uint, want bool) uint {
+	for from < limit {
+		wi := from / kmatrixWordBits
+		w := words[wi]
+		if !want {
+			w = ^w
+		}
+		if w >>= from % kmatrixWordBits; w != 0 {
+			return min(from+uint(bits.TrailingZeros64(w)), limit)
+		}
+		from = (wi + 1) * kmatrixWordBits
+	}
+	return limit
+}
+
+// returns the start of the run of set bits holding bit x
+func runStart(words []uint64, x uint) uint {
+	for {
+		wi, bi := x/kmatrixWordBits, x%kmatrixWordBits
+		// clear bits at or below bi
+		w := ^words[wi] << (kmatrixWordBits - 1 - bi)
+		if w != 0 {
+			return x + 1 - uint(bits.LeadingZeros64(w))
+		}
+		if wi == 0 {
+			return 0
+		}
+		x = wi*kmatrixWordBits - 1
+	}
+}
+
+// calls fn with every run of cells that are on in row y, left to right
+func (g *BitGrid) eachRun(y uint, fn func(x0, x1 uint)) {
+	words := g.m.rowWords(y)
+	width := g.m.cols
+	for x := uint(0); x < width; {
+		x0 := nextBit(words, x, width, true)
+		if x0 == width {
+			return
+		}
+		x1 := nextBit(words, x0, width, false)
+		fn(x0, x1)
+		x = x1
+	}
+}
+
+// how far runs of adjacent rows may be apart and still touch
+func (c Connectivity) reach() uint {
+	switch c {
+	case KCONNECT_4:
+		return 0
+	case KCONNECT_8:
+		return 1
+	}
+	panic(fmt.Sprintf("mbits: connectivity must be 4 or 8, got %v", int(c)))
+}
+
+// returns the region of cells that are on and connected to (x, y), as a
+// new grid, empty if (x, y) is off
+// works a run at a time, filling whole runs and searching the rows above
+// and below only within each run's reach
+// edges don't wrap, even on a torus
+func (g *BitGrid) FloodFill(x, y uint, conn Connectivity) *BitGrid {
+	d := conn.reach()
+	r := NewBitGrid(g.Width(), g.Height(), g.edges)
+	if !g.Get(x, y) {
+		return r
+	}
+	width := g.m.cols
+	stack := [][2]uint{{x, y}}
+	for len(stack) > 0 {
+		p := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		px, py := p[0], p[1]
+		if r.Get(px, py) {
+			continue
+		}
+		src := g.m.rowWords(py)
+		x0 := runStart(src, px)
+		x1 := nextBit(src, px, width, false)
+		r.m.Row(py).SetRange(x0, x1)
+
+		for _, ny := range []uint{py - 1, py + 1} {
+			// py - 1 wraps to a huge value on the first row
+			if ny >= g.Height() {
+				continue
+			}
+			words := g.m.rowWords(ny)
+			hi := min(x1+d, width)
+			for s := nextBit(words, x0-min(x0, d), hi, true); s < hi; {
+				stack = append(stack, [2]uint{s, ny})
+				s = nextBit(words, nextBit(words, s, width, false), hi, true)
+			}
+		}
+	}
+	return r
+}
+
+// Components labels the connected regions of a grid
+type Components struct {
+	width, height uint
+	// label of every cell, row after row, 0 for cells that are off,
+	// components are numbered from 1 in the order their first cell appears
+	Labels []uint32
+	// bounding box of component i+1
+	Boxes []image.Rectangle
+	// number of cells of component i+1, counted on its mask
+	Counts []uint
+	// runs of component i+1
+	runs [][]gridRun
+}
+
+// finds the connected regions of cells that are on
+// runs of set cells are found a word at a time, runs of adjacent rows that
+// touch are merged with union-find, so the work grows with the number of
+// runs rather than cells
+// each component is counted with CountBits on its mask, cropped to its
+// bounding box so counting all of them costs no more than their boxes
+// edges don't wrap, even on a torus
+func (g *BitGrid) ConnectedComponents(conn Connectivity) *Components {
+	d := conn.reach()
+
+	var runs []gridRun
+	parent := []uint{}
+	find := func(i uint) uint {
+		for parent[i] != i {
+			parent[i] = parent[parent[i]]
+			i = parent[i]
+		}
+		return i
+	}
+
+	prev_first, prev_last := 0, 0
+	for y := uint(0); y < g.Height(); y++ {
+		first := len(runs)
+		p := prev_first
+		g.eachRun(y, func(x0, x1 uint) {
+			i := uint(len(runs))
+			runs = append(runs, gridRun{y, x0, x1})
+			parent = append(parent, i)
+			// runs of the previous row are sorted, skip those that end
+			// before this one can reach them
+			for p < prev_last && runs[p].x1+d <= x0 {
+				p++
+			}
+			for q := p; q < prev_last && runs[q].x0 < x1+d; q++ {
+				if a, b := find(uint(q)), find(i); a != b {
+					// the older root wins, keeping labels in raster order
+					parent[max(a, b)] = min(a, b)
+				}
+			}
+		})
+		prev_first, prev_last = first, len(runs)
+	}
+
+	c := &Components{width: g.Width(), height: g.Height(), Labels: make([]uint32, g.Width()*g.Height())}
+	label := make([]uint32, len(runs))
+	for i, run := range runs {
+		root := find(uint(i))
+		if uint(i) == root {
+			c.Boxes = append(c.Boxes, image.Rect(int(run.x0), int(run.y), int(run.x1), int(run.y)+1))
+			c.Counts = append(c.Counts, 0)
+			c.runs = append(c.runs, nil)
+			label[i] = uint32(len(c.Boxes))
+		} else {
+			label[i] = label[root]
+		}
+		l := label[i]
+		c.Boxes[l-1] = c.Boxes[l-1].Union(image.Rect(int(run.x0), int(run.y), int(run.x1), int(run.y)+1))
+		c.runs[l-1] = append(c.runs[l-1], run)
+		row := c.Labels[run.y*c.width:]
+		for x := run.x0; x < run.x1; x++ {
+			row[x] = l
+		}
+	}
+
+	// one mask reused for every component, resizing it through 0 clears it
+	mask := &BitBuffer{}
+	for i, box := range c.Boxes {
+		w := uint(box.Dx())
+		mask.resize(0)
+		mask.resize((w*uint(box.Dy()) + KBITS_PER_BYTE - 1) / KBITS_PER_BYTE)
+		for _, run := range c.runs[i] {
+			off := (run.y - uint(box.Min.Y)) * w
+			mask.SetRange(off+run.x0-uint(box.Min.X), off+run.x1-uint(box.Min.X))
+		}
+		c.Counts[i], _ = mask.CountBits()
+	}
+	return c
+}
+
+// number of components
+func (c *Components) Len() int {
+	return len(c.Counts)
+}
+
+// returns the label of cell (x, y), 0 if it's off
+func (c *Components) Label(x, y uint) uint32 {
+	if x >= c.width || y >= c.height {
+		panic(fmt.Sprintf("mbits: cell %v,%v out of range for %vx%v grid", x, y, c.width, c.height))
+	}
+	return c.Labels[y*c.width+x]
+}
+
+// returns the cells of component label as a new bounded grid
+func (c *Components) Mask(label uint32) *BitGrid {
+	if label == 0 || int(label) > len(c.runs) {
+		panic(fmt.Sprintf("mbits: no component %v, there are %v", label, len(c.runs)))
+	}
+	r := NewBitGrid(c.width, c.height, KGRID_BOUNDED)
+	for _, run := range c.runs[label-1] {
+		r.m.Row(run.y).SetRange(run.x0, run.x1)
+	}
+	return r
+}
@@ -0,0 +1,146 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"image"
+	"math/rand"
+	"testing"
+)
+
+// labels by breadth-first search cell by cell, in raster order
+func naiveLabels(g *BitGrid, conn Connectivity) ([]uint32, int) {
+	w, h := int(g.Width()), int(g.Height())
+	labels := make([]uint32, w*h)
+	n := uint32(0)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if !g.Get(uint(x), uint(y)) || labels[y*w+x] != 0 {
+				continue
+			}
+			n++
+			labels[y*w+x] = n
+			queue := [][2]int{{x, y}}
+			for len(queue) > 0 {
+				p := queue[0]
+				queue = queue[1:]
+				for dy := -1; dy <= 1; dy++ {
+					for dx := -1; dx <= 1; dx++ {
+						if dx == 0 && dy == 0 || conn == KCONNECT_4 && dx != 0 && dy != 0 {
+							continue
+						}
+						nx, ny := p[0]+dx, p[1]+dy
+						if nx < 0 || ny < 0 || nx >= w || ny >= h || !g.Get(uint(nx), uint(ny)) || labels[ny*w+nx] != 0 {
+							continue
+						}
+						labels[ny*w+nx] = n
+						queue = append(queue, [2]int{nx, ny})
+					}
+				}
+			}
+		}
+	}
+	return labels, int(n)
+}
+
+func TestConnectedComponentsSmall(t *testing.T) {
+	g := mustParseGrid(t, `
+##..#
+#..#.
+...##
+##...`, KGRID_BOUNDED)
+
+	c := g.ConnectedComponents(KCONNECT_4)
+	if c.Len() != 4 {
+		t.Fatalf("4-connected: %v components", c.Len())
+	}
+	if c.Label(0, 0) != 1 || c.Label(4, 0) != 2 || c.Label(3, 1) != 3 || c.Label(4, 2) != 3 || c.Label(1, 3) != 4 || c.Label(2, 0) != 0 {
+		t.Errorf("labels %v", c.Labels)
+	}
+	if c.Counts[0] != 3 || c.Boxes[0] != image.Rect(0, 0, 2, 2) || c.Boxes[2] != image.Rect(3, 1, 5, 3) {
+		t.Errorf("counts %v boxes %v", c.Counts, c.Boxes)
+	}
+
+	// the diagonal joins the pieces on the right
+	c = g.ConnectedComponents(KCONNECT_8)
+	if c.Len() != 3 || c.Label(4, 0) != c.Label(3, 2) || c.Counts[1] != 4 {
+		t.Errorf("8-connected: %v components, counts %v", c.Len(), c.Counts)
+	}
+}
+
+func TestConnectedComponentsRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(40))
+	for _, width := range []uint{1, 13, 64, 70, 130} {
+		for _, conn := range []Connectivity{KCONNECT_4, KCONNECT_8} {
+			g := randomGrid(rng, width, 40, KGRID_BOUNDED, 0.45)
+			c := g.ConnectedComponents(conn)
+			want, n := naiveLabels(g, conn)
+			if c.Len() != n {
+				t.Fatalf("width %v conn %v: %v components, want %v", width, conn, c.Len(), n)
+			}
+			for i := range want {
+				if c.Labels[i] != want[i] {
+					t.Fatalf("width %v conn %v: label of cell %v is %v, want %v", width, conn, i, c.Labels[i], want[i])
+				}
+			}
+			total := uint(0)
+			for l := 1; l <= c.Len(); l++ {
+				mask := c.Mask(uint32(l))
+				if mask.Count() != c.Counts[l-1] {
+					t.Errorf("component %v: mask has %v cells, count %v", l, mask.Count(), c.Counts[l-1])
+				}
+				total += c.Counts[l-1]
+
+				// the mask is what flood filling from any of its cells gives
+				box := c.Boxes[l-1]
+				var fx, fy uint
+				for x := box.Min.X; x < box.Max.X; x++ {
+					if c.Label(uint(x), uint(box.Min.Y)) == uint32(l) {
+						fx, fy = uint(x), uint(box.Min.Y)
+						break
+					}
+				}
+				if fill := g.FloodFill(fx, fy, conn); !fill.Equal(mask) {
+					t.Fatalf("width %v conn %v: flood fill from %v,%v differs from component %v", width, conn, fx, fy, l)
+				}
+			}
+			if total != g.Count() {
+				t.Errorf("components hold %v cells of %v", total, g.Count())
+			}
+		}
+	}
+}
+
+func TestFloodFillOffCell(t *testing.T) {
+	g := mustParseGrid(t, "#.#", KGRID_BOUNDED)
+	if g.FloodFill(1, 0, KCONNECT_8).Count() != 0 {
+		t.Error("flood fill from an off cell isn't empty")
+	}
+	if got := g.FloodFill(2, 0, KCONNECT_8).String(); got != "..#\n" {
+		t.Errorf("got %q", got)
+	}
+}
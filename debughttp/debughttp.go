@@ -0,0 +1,471 @@
+// Package debughttp serves the BitBuffers a program registers over HTTP, in
+// the spirit of expvar and net/http/pprof
+//
+// importing it registers a handler on http.DefaultServeMux under
+// /debug/mbits/, which lists the registered bitmaps, and renders one under
+// /debug/mbits/<name> as text (default), ?format=png or ?format=json, the
+// json lists the ranges of set bits
+//
+// a request renders a window of at most KMAX_RENDER_BITS bits, starting at
+// ?offset= (default 0) and ?len= bits long (default as many as allowed),
+// larger bitmaps are viewed a window at a time
+//
+// mutations through POST are disabled until AllowMutations is called
+package debughttp
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dorind/mbits"
+)
+
+const (
+	// bits per row of the text and png renderings
+	KDEFAULT_WIDTH = 64
+	KMAX_WIDTH     = 1 << 16
+	// pixels per bit of the png rendering
+	KMAX_SCALE = 16
+	// bits rendered per request
+	KMAX_RENDER_BITS = 1 << 20
+	// pixels of the png rendering
+	KMAX_PIXELS = 1 << 24
+)
+
+// Registry is an http.Handler serving a set of named BitBuffers
+type Registry struct {
+	mu      sync.RWMutex
+	entries map[string]entry
+	// nil when mutations are disabled
+	authorize func(*http.Request) error
+}
+
+type entry struct {
+	bits *mbits.BitBuffer
+	// held while the bitmap is read or written, may be nil
+	mu sync.Locker
+}
+
+// the registry behind Register and /debug/mbits/
+var Default = NewRegistry()
+
+func init() {
+	http.Handle("/debug/mbits/", http.StripPrefix("/debug/mbits", Default))
+}
+
+// constructs an empty Registry and returns pointer to instance
+func NewRegistry() *Registry {
+	return &Registry{entries: map[string]entry{}}
+}
+
+// registers b under name in the Default registry
+func Register(name string, b *mbits.BitBuffer, mu sync.Locker) {
+	Default.Register(name, b, mu)
+}
+
+// returns the Default registry's handler, for muxes other than
+// http.DefaultServeMux, paths are relative to where it is mounted
+func Handler() http.Handler {
+	return Default
+}
+
+// registers b under name, replacing any previous one
+// BitBuffers aren't safe for concurrent use, when b is used by other
+// goroutines pass the mutex guarding it as mu, the handler holds it while
+// reading or writing b
+func (r *Registry) Register(name string, b *mbits.BitBuffer, mu sync.Locker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[name] = entry{bits: b, mu: mu}
+}
+
+// removes the bitmap registered under name
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.entries, name)
+}
+
+// enables mutations through POST, authorize is called for every one and
+// rejects it with 403 Forbidden by returning an error, nil disables them
+// again
+// mutations are limited to bits within the buffer's current length
+func (r *Registry) AllowMutations(authorize func(*http.Request) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.authorize = authorize
+}
+
+func (r *Registry) lookup(name string) (entry, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e, ok := r.entries[name]
+	return e, ok
+}
+
+func (e entry) lock() {
+	if e.mu != nil {
+		e.mu.Lock()
+	}
+}
+
+func (e entry) unlock() {
+	if e.mu != nil {
+		e.mu.Unlock()
+	}
+}
+
+// summary of a registered bitmap
+type Info struct {
+	Name    string `json:"name"`
+	LenBits uint   `json:"len_bits"`
+	Count   uint   `json:"count"`
+}
+
+// bitmap with the set bits of its [Offset, Offset+Len) window as [from, to)
+// ranges
+type Ranges struct {
+	Info
+	Offset uint      `json:"offset"`
+	Len    uint      `json:"len"`
+	Ranges [][2]uint `json:"ranges"`
+}
+
+// summaries of all registered bitmaps, sorted by name
+func (r *Registry) List() []Info {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.entries))
+	for name := range r.entries {
+		names = append(names, name)
+	}
+	r.mu.RUnlock()
+	slices.Sort(names)
+
+	infos := make([]Info, 0, len(names))
+	for _, name := range names {
+		if e, ok := r.lookup(name); ok {
+			e.lock()
+			infos = append(infos, Info{Name: name, LenBits: e.bits.LenBits(), Count: e.bits.CountBitsOn()})
+			e.unlock()
+		}
+	}
+	return infos
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name, err := url.PathUnescape(strings.TrimPrefix(req.URL.EscapedPath(), "/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if name == "" {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		r.serveList(w, req)
+		return
+	}
+
+	e, ok := r.lookup(name)
+	if !ok {
+		http.Error(w, "no bitmap named "+strconv.Quote(name), http.StatusNotFound)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		r.serveBits(w, req, name, e)
+	case http.MethodPost:
+		r.serveMutation(w, req, e)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *Registry) serveList(w http.ResponseWriter, req *http.Request) {
+	infos := r.List()
+	if req.URL.Query().Get("format") == "json" {
+		writeJSON(w, infos)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, info := range infos {
+		fmt.Fprintf(w, "%s\tlen_bits=%d\tcount=%d\n", info.Name, info.LenBits, info.Count)
+	}
+}
+
+// parses an optional positive integer query parameter
+func queryUint(req *http.Request, key string, def, max uint) (uint, error) {
+	s := req.URL.Query().Get(key)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 0)
+	if err != nil || n == 0 || uint(n) > max {
+		return 0, fmt.Errorf("%s must be within [1, %d]", key, max)
+	}
+	return uint(n), nil
+}
+
+// copy of the [offset, offset+n) window of a bitmap
+type window struct {
+	offset, n uint
+	bits      *mbits.BitBuffer
+}
+
+// copies at most n bits from offset, the lock is held only for the window
+// rather than the whole bitmap
+func snapshot(e entry, offset, n uint) (Info, window, error) {
+	e.lock()
+	defer e.unlock()
+	len_bits := e.bits.LenBits()
+	if offset > len_bits {
+		return Info{}, window{}, fmt.Errorf("offset must be within [0, %d]", len_bits)
+	}
+	n = min(n, len_bits-offset)
+	v := window{offset: offset, n: n, bits: mbits.NewBitBuffer(max((n+mbits.KBITS_PER_BYTE-1)/mbits.KBITS_PER_BYTE, 1))}
+	for i := uint(0); i < n; i++ {
+		if e.bits.IsSet(offset + i) {
+			v.bits.Set(i)
+		}
+	}
+	return Info{LenBits: len_bits, Count: e.bits.CountBitsOn()}, v, nil
+}
+
+func (r *Registry) serveBits(w http.ResponseWriter, req *http.Request, name string, e entry) {
+	width, err := queryUint(req, "width", KDEFAULT_WIDTH, KMAX_WIDTH)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n, err := queryUint(req, "len", KMAX_RENDER_BITS, KMAX_RENDER_BITS)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	offset := uint(0)
+	if s := req.URL.Query().Get("offset"); s != "" {
+		v, err := strconv.ParseUint(s, 10, 0)
+		if err != nil {
+			http.Error(w, "offset: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		offset = uint(v)
+	}
+
+	// render from a snapshot, so the lock isn't held while writing
+	info, v, err := snapshot(e, offset, n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	info.Name = name
+
+	switch format := req.URL.Query().Get("format"); format {
+	case "", "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeText(w, &v, width)
+		if v.offset > 0 || v.offset+v.n < info.LenBits {
+			fmt.Fprintf(w, "bits [%d, %d) of %d, see offset and len\n", v.offset, v.offset+v.n, info.LenBits)
+		}
+	case "json":
+		writeJSON(w, Ranges{Info: info, Offset: v.offset, Len: v.n, Ranges: setRanges(&v)})
+	case "png":
+		scale, err := queryUint(req, "scale", 1, KMAX_SCALE)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rows := max((v.n+width-1)/width, 1)
+		// uint64, the product doesn't fit 32 bits
+		if uint64(width*scale)*uint64(rows*scale) > KMAX_PIXELS {
+			http.Error(w, fmt.Sprintf("image exceeds %d pixels, lower width, scale or len", KMAX_PIXELS), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, renderImage(&v, width, scale))
+	default:
+		http.Error(w, "unknown format "+strconv.Quote(format), http.StatusBadRequest)
+	}
+}
+
+// one row of width bits per line, prefixed by the index of its first bit
+func writeText(w http.ResponseWriter, v *window, width uint) {
+	digits := len(strconv.FormatUint(uint64(v.offset+v.n), 10))
+	row := make([]byte, 0, width+1)
+	for i := uint(0); i < v.n; i += width {
+		row = row[:0]
+		for j := i; j < min(i+width, v.n); j++ {
+			if v.bits.IsSet(j) {
+				row = append(row, '1')
+			} else {
+				row = append(row, '0')
+			}
+		}
+		fmt.Fprintf(w, "%*d %s\n", digits, v.offset+i, row)
+	}
+}
+
+// [from, to) ranges of set bits, in order, as indices into the bitmap
+func setRanges(v *window) [][2]uint {
+	ranges := [][2]uint{}
+	for i := uint(0); i < v.n; i++ {
+		if !v.bits.IsSet(i) {
+			continue
+		}
+		from := i
+		for i < v.n && v.bits.IsSet(i) {
+			i++
+		}
+		ranges = append(ranges, [2]uint{v.offset + from, v.offset + i})
+	}
+	return ranges
+}
+
+var palette = color.Palette{color.White, color.Black}
+
+// set bits are black, rows of width bits, scale pixels per bit
+func renderImage(v *window, width, scale uint) image.Image {
+	rows := max((v.n+width-1)/width, 1)
+	img := image.NewPaletted(image.Rect(0, 0, int(width*scale), int(rows*scale)), palette)
+	for i := uint(0); i < v.n; i++ {
+		if !v.bits.IsSet(i) {
+			continue
+		}
+		x, y := (i%width)*scale, (i/width)*scale
+		for dy := uint(0); dy < scale; dy++ {
+			for dx := uint(0); dx < scale; dx++ {
+				img.SetColorIndex(int(x+dx), int(y+dy), 1)
+			}
+		}
+	}
+	return img
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+var errOutOfRange = errors.New("bit index out of range")
+
+// POST op=set|clear|toggle with bit=i, or op=set_range|clear_range with
+// from=i&to=j for [from, to)
+func (r *Registry) serveMutation(w http.ResponseWriter, req *http.Request, e entry) {
+	r.mu.RLock()
+	authorize := r.authorize
+	r.mu.RUnlock()
+	if authorize == nil {
+		http.Error(w, "mutations are disabled", http.StatusForbidden)
+		return
+	}
+	if err := authorize(req); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	e.lock()
+	err := mutate(e.bits, req.PostForm)
+	info := Info{LenBits: e.bits.LenBits(), Count: e.bits.CountBitsOn()}
+	e.unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, info)
+}
+
+func mutate(b *mbits.BitBuffer, form url.Values) error {
+	if b.ReadOnly() {
+		return mbits.ErrReadOnly
+	}
+	len_bits := b.LenBits()
+	index := func(key string) (uint, error) {
+		n, err := strconv.ParseUint(form.Get(key), 10, 0)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", key, err)
+		}
+		return uint(n), nil
+	}
+
+	switch op := form.Get("op"); op {
+	case "set", "clear", "toggle":
+		i, err := index("bit")
+		if err != nil {
+			return err
+		}
+		if i >= len_bits {
+			return errOutOfRange
+		}
+		switch op {
+		case "set":
+			b.Set(i)
+		case "clear":
+			b.Clear(i)
+		default:
+			b.Toggle(i)
+		}
+	case "set_range", "clear_range":
+		from, err := index("from")
+		if err != nil {
+			return err
+		}
+		to, err := index("to")
+		if err != nil {
+			return err
+		}
+		if from > to || to > len_bits {
+			return errOutOfRange
+		}
+		if op == "set_range" {
+			b.SetRange(from, to)
+		} else {
+			b.ClearRange(from, to)
+		}
+	default:
+		return fmt.Errorf("unknown op %q", op)
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package debughttp
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dorind/mbits"
+)
+
+func newTestRegistry() (*Registry, *mbits.BitBuffer) {
+	r := NewRegistry()
+	b := mbits.NewBitBuffer(8)
+	b.Set(1).SetRange(4, 7).Set(15)
+	r.Register("flags", b, &sync.Mutex{})
+	r.Register("empty", mbits.NewBitBuffer(8), nil)
+	return r, b
+}
+
+func get(t *testing.T, h http.Handler, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec
+}
+
+func post(h http.Handler, target string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestList(t *testing.T) {
+	r, _ := newTestRegistry()
+
+	rec := get(t, r, "/")
+	want := "empty\tlen_bits=64\tcount=0\nflags\tlen_bits=64\tcount=5\n"
+	if rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("got %d %q, want %q", rec.Code, rec.Body.String(), want)
+	}
+
+	var infos []Info
+	rec = get(t, r, "/?format=json")
+	if err := json.Unmarshal(rec.Body.Bytes(), &infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[1] != (Info{Name: "flags", LenBits: 64, Count: 5}) {
+		t.Errorf("got %+v", infos)
+	}
+}
+
+func TestRender(t *testing.T) {
+	r, _ := newTestRegistry()
+
+	rec := get(t, r, "/flags?width=32")
+	want := " 0 01001110000000010000000000000000\n32 00000000000000000000000000000000\n"
+	if rec.Body.String() != want {
+		t.Errorf("text got %q, want %q", rec.Body.String(), want)
+	}
+
+	var ranges Ranges
+	rec = get(t, r, "/flags?format=json")
+	if err := json.Unmarshal(rec.Body.Bytes(), &ranges); err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges.Ranges) != 3 || ranges.Ranges[0] != [2]uint{1, 2} || ranges.Ranges[1] != [2]uint{4, 7} || ranges.Ranges[2] != [2]uint{15, 16} {
+		t.Errorf("json got %+v", ranges)
+	}
+
+	rec = get(t, r, "/flags?format=png&width=8&scale=2")
+	img, err := png.Decode(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 16 || b.Dy() != 16 {
+		t.Errorf("png bounds %v", b)
+	}
+	for _, p := range []struct {
+		x, y int
+		on   bool
+	}{{0, 0, false}, {2, 0, true}, {3, 1, true}, {14, 2, true}, {15, 3, true}, {0, 4, false}} {
+		r, _, _, _ := img.At(p.x, p.y).RGBA()
+		if (r == 0) != p.on {
+			t.Errorf("pixel (%d, %d) on = %v, want %v", p.x, p.y, r == 0, p.on)
+		}
+	}
+
+	for _, target := range []string{
+		"/nope", "/flags?format=gif", "/flags?width=0", "/flags?format=png&scale=100",
+		"/flags?offset=65", "/flags?offset=-1", "/flags?len=0",
+	} {
+		if rec := get(t, r, target); rec.Code == http.StatusOK {
+			t.Errorf("%s: got %d", target, rec.Code)
+		}
+	}
+}
+
+func TestRenderWindow(t *testing.T) {
+	r, _ := newTestRegistry()
+
+	rec := get(t, r, "/flags?offset=4&len=12&width=8")
+	want := " 4 11100000\n12 0001\nbits [4, 16) of 64, see offset and len\n"
+	if rec.Body.String() != want {
+		t.Errorf("text got %q, want %q", rec.Body.String(), want)
+	}
+
+	var ranges Ranges
+	rec = get(t, r, "/flags?format=json&offset=5&len=11")
+	if err := json.Unmarshal(rec.Body.Bytes(), &ranges); err != nil {
+		t.Fatal(err)
+	}
+	if ranges.Count != 5 || ranges.LenBits != 64 || ranges.Offset != 5 || ranges.Len != 11 ||
+		len(ranges.Ranges) != 2 || ranges.Ranges[0] != [2]uint{5, 7} || ranges.Ranges[1] != [2]uint{15, 16} {
+		t.Errorf("json got %+v", ranges)
+	}
+
+	// the end of the bitmap clamps len
+	if rec := get(t, r, "/flags?format=json&offset=64"); rec.Code != http.StatusOK || !bytes.Contains(rec.Body.Bytes(), []byte(`"len":0,"ranges":[]`)) {
+		t.Errorf("got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRenderLimits(t *testing.T) {
+	r := NewRegistry()
+	b := mbits.NewBitBuffer(KMAX_RENDER_BITS / 4)
+	b.Set(KMAX_RENDER_BITS + 1)
+	r.Register("big", b, nil)
+
+	var ranges Ranges
+	rec := get(t, r, "/big?format=json")
+	if err := json.Unmarshal(rec.Body.Bytes(), &ranges); err != nil {
+		t.Fatal(err)
+	}
+	if ranges.LenBits != 2*KMAX_RENDER_BITS || ranges.Count != 1 || ranges.Len != KMAX_RENDER_BITS || len(ranges.Ranges) != 0 {
+		t.Errorf("json got %+v", ranges.Info)
+	}
+	rec = get(t, r, fmt.Sprintf("/big?format=json&offset=%d", KMAX_RENDER_BITS))
+	if !bytes.Contains(rec.Body.Bytes(), []byte(fmt.Sprintf(`"ranges":[[%d,%d]]`, KMAX_RENDER_BITS+1, KMAX_RENDER_BITS+2))) {
+		t.Errorf("json got %s", rec.Body.String())
+	}
+
+	for _, target := range []string{
+		fmt.Sprintf("/big?len=%d", KMAX_RENDER_BITS+1),
+		fmt.Sprintf("/big?format=png&width=%d&scale=%d", KMAX_WIDTH, KMAX_SCALE),
+		fmt.Sprintf("/big?format=png&width=1&scale=%d", KMAX_SCALE),
+	} {
+		if rec := get(t, r, target); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d", target, rec.Code)
+		}
+	}
+	if rec := get(t, r, "/big?format=png&width=1024&len=4096&scale=16"); rec.Code != http.StatusOK {
+		t.Errorf("got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestMutations(t *testing.T) {
+	r, b := newTestRegistry()
+
+	if rec := post(r, "/flags", url.Values{"op": {"set"}, "bit": {"0"}}); rec.Code != http.StatusForbidden {
+		t.Errorf("mutation allowed by default, got %d", rec.Code)
+	}
+
+	r.AllowMutations(func(req *http.Request) error {
+		if req.Header.Get("X-Debug-Token") != "secret" {
+			return errors.New("bad token")
+		}
+		return nil
+	})
+	if rec := post(r, "/flags", url.Values{"op": {"set"}, "bit": {"0"}}); rec.Code != http.StatusForbidden {
+		t.Errorf("unauthorized mutation allowed, got %d", rec.Code)
+	}
+
+	do := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/flags", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Debug-Token", "secret")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+	for _, form := range []url.Values{
+		{"op": {"set"}, "bit": {"0"}},
+		{"op": {"clear"}, "bit": {"1"}},
+		{"op": {"toggle"}, "bit": {"2"}},
+		{"op": {"set_range"}, "from": {"8"}, "to": {"12"}},
+		{"op": {"clear_range"}, "from": {"4"}, "to": {"6"}},
+	} {
+		if rec := do(form); rec.Code != http.StatusOK {
+			t.Errorf("%v: got %d %s", form, rec.Code, rec.Body.String())
+		}
+	}
+	want := mbits.NewBitBuffer(8)
+	want.Set(0).Set(2).Set(6).SetRange(8, 12).Set(15)
+	if b.CmpWith(want) != 0 {
+		t.Errorf("got %s, want %s", b, want)
+	}
+
+	for _, form := range []url.Values{
+		{"op": {"set"}, "bit": {"64"}},
+		{"op": {"set_range"}, "from": {"8"}, "to": {"65"}},
+		{"op": {"set_range"}, "from": {"9"}, "to": {"8"}},
+		{"op": {"flip"}, "bit": {"1"}},
+		{"op": {"set"}},
+	} {
+		if rec := do(form); rec.Code != http.StatusBadRequest {
+			t.Errorf("%v: got %d", form, rec.Code)
+		}
+	}
+	if b.LenBits() != 64 {
+		t.Errorf("buffer grew to %d bits", b.LenBits())
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/flags", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE got %d", rec.Code)
+	}
+}
+
+func TestDefaultMux(t *testing.T) {
+	b := mbits.NewBitBuffer(8)
+	b.Set(3)
+	Register("default/test", b, nil)
+	defer Default.Unregister("default/test")
+
+	rec := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/mbits/default%2Ftest?format=json", nil))
+	if rec.Code != http.StatusOK || !bytes.Contains(rec.Body.Bytes(), []byte(`"ranges":[[3,4]]`)) {
+		t.Errorf("got %d %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,166 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// binary format, all fields little-endian:
+//
+//	[0:4)   magic "MBIT"
+//	[4]     version
+//	[5:8)   reserved, zero
+//	[8:16)  length in bytes
+//	[16:)   the bytes in canonical layout
+//
+// the format doesn't depend on the word width, any Bits[W] reads what any
+// other Bits[W] wrote
+const (
+	// size of the header ahead of the bytes
+	KBIN_HEADER_BYTES = uint(16)
+	// format version written in the header
+	KBIN_VERSION = byte(1)
+)
+
+// returned when decoding something that isn't in the binary format
+var ErrBadFormat = errors.New("mbits: not a serialized bit buffer")
+
+// first bytes of every serialized buffer
+var kbinMagic = [4]byte{'M', 'B', 'I', 'T'}
+
+// bytes are streamed in chunks of this size by WriteTo() and ReadFrom()
+const kbinChunkBytes = 64 << 10
+
+// encodes the buffer in the binary format
+func (m *Bits[W]) MarshalBinary() ([]byte, error) {
+	r := make([]byte, KBIN_HEADER_BYTES+m.byte_len)
+	m.encodeBinHeader(r)
+	m.readBytes(r[KBIN_HEADER_BYTES:])
+	return r, nil
+}
+
+// decodes the buffer from the binary format, replacing its contents
+func (m *Bits[W]) UnmarshalBinary(data []byte) error {
+	byte_len, err := decodeBinHeader(data)
+	if err != nil {
+		return err
+	}
+	if uint64(len(data))-uint64(KBIN_HEADER_BYTES) != byte_len {
+		return fmt.Errorf("%w: expected %v bytes, found %v", ErrBadFormat, byte_len, uint(len(data))-KBIN_HEADER_BYTES)
+	}
+	m.LoadBuffer(data[KBIN_HEADER_BYTES:])
+	if byte_len == 0 {
+		// LoadBuffer() takes an empty buffer for the default length
+		m.resize(0)
+	}
+	return nil
+}
+
+// writes the buffer to w in the binary format, without an intermediate copy
+// of the whole buffer, implements io.WriterTo
+func (m *Bits[W]) WriteTo(w io.Writer) (int64, error) {
+	hdr := make([]byte, KBIN_HEADER_BYTES)
+	m.encodeBinHeader(hdr)
+	n, err := w.Write(hdr)
+	total := int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	chunk := make([]byte, min(m.byte_len, kbinChunkBytes))
+	for off := uint(0); off < m.byte_len; off += kbinChunkBytes {
+		c := chunk[:min(m.byte_len-off, kbinChunkBytes)]
+		m.readBytesAt(off, c)
+		n, err = w.Write(c)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// reads one buffer in the binary format from r, replacing the contents
+// reads exactly the encoded bytes and nothing more, implements io.ReaderFrom
+func (m *Bits[W]) ReadFrom(r io.Reader) (int64, error) {
+	hdr := make([]byte, KBIN_HEADER_BYTES)
+	n, err := io.ReadFull(r, hdr)
+	total := int64(n)
+	if err != nil {
+		return total, err
+	}
+	byte_len, err := decodeBinHeader(hdr)
+	if err != nil {
+		return total, err
+	}
+
+	// reading the length from the stream, so don't trust it with one big
+	// allocation, grow as the bytes actually arrive
+	m.SetBufferLen(uint(min(byte_len, kbinChunkBytes)))
+	if byte_len == 0 {
+		// SetBufferLen() takes 0 for the default length
+		m.resize(0)
+	}
+	chunk := make([]byte, min(byte_len, kbinChunkBytes))
+	for off := uint64(0); off < byte_len; off += kbinChunkBytes {
+		c := chunk[:min(byte_len-off, kbinChunkBytes)]
+		n, err = io.ReadFull(r, c)
+		total += int64(n)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return total, err
+		}
+		m.resize(uint(off) + uint(len(c)))
+		m.writeBytesAt(uint(off), c)
+	}
+	return total, nil
+}
+
+// writes the header for the buffer into hdr
+func (m *Bits[W]) encodeBinHeader(hdr []byte) {
+	copy(hdr, kbinMagic[:])
+	hdr[4] = KBIN_VERSION
+	hdr[5], hdr[6], hdr[7] = 0, 0, 0
+	binary.LittleEndian.PutUint64(hdr[8:], uint64(m.byte_len))
+}
+
+// returns the length in bytes stored in the header
+func decodeBinHeader(data []byte) (uint64, error) {
+	if uint(len(data)) < KBIN_HEADER_BYTES || [4]byte(data[:4]) != kbinMagic {
+		return 0, ErrBadFormat
+	}
+	if data[4] != KBIN_VERSION {
+		return 0, fmt.Errorf("%w: unknown version %v", ErrBadFormat, data[4])
+	}
+	return binary.LittleEndian.Uint64(data[8:]), nil
+}
@@ -0,0 +1,124 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestBinaryRoundTrip(t *testing.T) {
+	b := NewBits[uint16](13)
+	b.Set(0).
+		Set(50).
+		Set(103)
+
+	data, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint(len(data)) != KBIN_HEADER_BYTES+13 || string(data[:4]) != "MBIT" {
+		t.Fatalf("Marshal fail, %x", data)
+	}
+
+	// the format doesn't depend on the word width
+	r := NewBitBuffer(0)
+	if err := r.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if r.LenBytes() != 13 || !bytes.Equal(r.Bytes(), b.Bytes()) {
+		t.Fatalf("Unmarshal fail, %x", r.Bytes())
+	}
+
+	if err := r.UnmarshalBinary(data[:len(data)-1]); !errors.Is(err, ErrBadFormat) {
+		t.Fatalf("Expected ErrBadFormat, found %v", err)
+	}
+	if err := r.UnmarshalBinary([]byte("nope")); !errors.Is(err, ErrBadFormat) {
+		t.Fatalf("Expected ErrBadFormat, found %v", err)
+	}
+}
+
+func TestBinaryStream(t *testing.T) {
+	// a few chunks worth, with an odd tail
+	b := NewBitBuffer(3*kbinChunkBytes + 5)
+	for i := uint(0); i < b.LenBits(); i += 997 {
+		b.Set(i)
+	}
+
+	var w bytes.Buffer
+	n, err := b.WriteTo(&w)
+	if err != nil || n != int64(w.Len()) {
+		t.Fatalf("WriteTo fail, %v, %v", n, err)
+	}
+	data, _ := b.MarshalBinary()
+	if !bytes.Equal(w.Bytes(), data) {
+		t.Fatal("WriteTo differs from MarshalBinary")
+	}
+
+	// trailing data must be left alone
+	w.WriteString("tail")
+	r := NewBits[uint32](0)
+	n, err = r.ReadFrom(&w)
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("ReadFrom fail, %v, %v", n, err)
+	}
+	if !bytes.Equal(r.Bytes(), b.Bytes()) {
+		t.Fatal("ReadFrom differs")
+	}
+	if w.String() != "tail" {
+		t.Fatalf("ReadFrom read too much, %q left", w.String())
+	}
+
+	_, err = r.ReadFrom(bytes.NewReader(data[:len(data)/2]))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected io.ErrUnexpectedEOF, found %v", err)
+	}
+}
+
+func TestBinaryEmpty(t *testing.T) {
+	b := NewBitBuffer(0)
+	b.resize(0)
+	data, _ := b.MarshalBinary()
+
+	r := NewBits[uint16](3).Set(1)
+	if err := r.UnmarshalBinary(data); err != nil || r.LenBytes() != 0 || r.CountBitsOn() != 0 {
+		t.Fatalf("Unmarshal fail, %v bytes, %v", r.LenBytes(), err)
+	}
+
+	s := NewBits[uint16](3).Set(1)
+	if _, err := s.ReadFrom(bytes.NewReader(data)); err != nil || s.LenBytes() != 0 || s.CountBitsOn() != 0 {
+		t.Fatalf("ReadFrom fail, %v bytes, %v", s.LenBytes(), err)
+	}
+
+	// and grows again from nothing
+	s.Set(9)
+	if s.LenBytes() == 0 || !s.IsSet(9) {
+		t.Fatal("Set after empty decode fail")
+	}
+}
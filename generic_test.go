@@ -0,0 +1,129 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// applies the same random sequence of operations to a Bits[W]
+func randomOps[W Word](seed int64) *Bits[W] {
+	rnd := rand.New(rand.NewSource(seed))
+	b := NewBits[W](uint(rnd.Intn(9)))
+	for i := 0; i < 300; i++ {
+		bit := uint(rnd.Intn(500))
+		switch rnd.Intn(3) {
+		case 0:
+			b.Set(bit)
+		case 1:
+			b.Clear(bit)
+		case 2:
+			b.Toggle(bit)
+		}
+	}
+	return b
+}
+
+func TestBitsWordWidths(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		b64 := randomOps[uint64](seed)
+		b32 := randomOps[uint32](seed)
+		b16 := randomOps[uint16](seed)
+		b8 := randomOps[uint8](seed)
+
+		raw := b64.Bytes()
+		for _, other := range [][]byte{b32.Bytes(), b16.Bytes(), b8.Bytes()} {
+			if !bytes.Equal(raw, other) {
+				t.Fatalf("Bytes differ across word widths,\n%x\n%x", raw, other)
+			}
+		}
+
+		s := b64.String()
+		if s != b32.String() || s != b16.String() || s != b8.String() {
+			t.Fatal("String differs across word widths")
+		}
+
+		on := b64.CountBitsOn()
+		if on != b32.CountBitsOn() || on != b16.CountBitsOn() || on != b8.CountBitsOn() {
+			t.Fatal("CountBits differs across word widths")
+		}
+	}
+}
+
+func TestBitsConvert(t *testing.T) {
+	src := NewBits[uint8](11)
+	src.Set(0).
+		Set(17).
+		Set(87)
+
+	b32 := ConvertBits[uint32](src)
+	if b32.LenBytes() != 11 || !bytes.Equal(b32.Bytes(), src.Bytes()) {
+		t.Fatalf("Convert fail, expected %x, found %x", src.Bytes(), b32.Bytes())
+	}
+
+	back := ConvertBits[uint8](ConvertBits[uint64](b32))
+	if back.CmpWith(src) != 0 {
+		t.Fatalf("Round trip fail, expected %x, found %x", src.Bytes(), back.Bytes())
+	}
+
+	w := b32.ToUint32s()
+	if len(w) != 3 || w[0] != 1|1<<17 || w[2] != 1<<23 {
+		t.Fatalf("ToUint32s fail, found %x", w)
+	}
+}
+
+func TestBitsSetOps(t *testing.T) {
+	left := NewBits[uint16](4).LoadBuffer([]byte{0xf0, 0x0f, 0xff, 0x00})
+	right := NewBits[uint16](6).LoadBuffer([]byte{0xcc, 0xcc, 0x0f, 0xf0, 0x01, 0x80})
+
+	cases := []struct {
+		name     string
+		result   *Bits[uint16]
+		expected []byte
+	}{
+		{"And", left.Clone().And(right), []byte{0xc0, 0x0c, 0x0f, 0x00}},
+		{"Or", left.Clone().Or(right), []byte{0xfc, 0xcf, 0xff, 0xf0, 0x01, 0x80}},
+		{"Xor", left.Clone().Xor(right), []byte{0x3c, 0xc3, 0xf0, 0xf0, 0x01, 0x80}},
+		{"AndNot", left.Clone().AndNot(right), []byte{0x30, 0x03, 0xf0, 0x00}},
+		{"Not", left.Clone().Not(), []byte{0x0f, 0xf0, 0x00, 0xff}},
+		{"AndShort", right.Clone().And(left), []byte{0xc0, 0x0c, 0x0f, 0x00, 0x00, 0x00}},
+	}
+	for _, c := range cases {
+		if !bytes.Equal(c.result.Bytes(), c.expected) {
+			t.Fatalf("%v fail, expected %x, found %x", c.name, c.expected, c.result.Bytes())
+		}
+	}
+}
+
+func TestBitsNotOddLength(t *testing.T) {
+	b := NewBits[uint64](3).Not()
+	if b.CountBitsOn() != 24 {
+		t.Fatalf("Not fail, %v bits on", b.CountBitsOn())
+	}
+}
@@ -0,0 +1,350 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// linear algebra over GF(2), where adding is XOR and multiplying is AND
+// vectors are BitBuffers, bit i being element i
+
+var (
+	// returned by Inverse for matrices without an inverse
+	ErrSingular = errors.New("mbits: matrix is singular")
+	// returned by Solve when no vector satisfies the system
+	ErrNoSolution = errors.New("mbits: system has no solution")
+)
+
+// columns per block of the Method of Four Russians, each block builds a
+// table of 2^k row combinations
+const kfourRussiansK = 8
+
+// below this many bits eliminating one column at a time is as fast
+const kfourRussiansMinBits = 1 << 14
+
+// constructs the n x n identity matrix and returns pointer to instance
+func NewIdentityMatrix(n uint) *BitMatrix {
+	m := NewBitMatrix(n, n)
+	for i := uint(0); i < n; i++ {
+		m.Set(i, i)
+	}
+	return m
+}
+
+// panics unless the matrix is square
+func (m *BitMatrix) checkSquare() {
+	if m.rows != m.cols {
+		panic(fmt.Sprintf("mbits: %vx%v matrix isn't square", m.rows, m.cols))
+	}
+}
+
+// returns k <= 64 bits of row i starting at column c, bit 0 being column c
+func (m *BitMatrix) rowBits(i, c, k uint) uint64 {
+	w := m.rowWords(i)
+	wi, shift := c/kmatrixWordBits, c%kmatrixWordBits
+	v := w[wi] >> shift
+	if shift+k > kmatrixWordBits && wi+1 < m.stride {
+		v |= w[wi+1] << (kmatrixWordBits - shift)
+	}
+	if k < kmatrixWordBits {
+		v &= 1<<k - 1
+	}
+	return v
+}
+
+func (m *BitMatrix) swapRows(i, j uint) {
+	if i == j {
+		return
+	}
+	a, b := m.rowWords(i), m.rowWords(j)
+	for k := range a {
+		a[k], b[k] = b[k], a[k]
+	}
+}
+
+// row i ^= row j, from word from onwards
+func (m *BitMatrix) xorRow(i, j, from uint) {
+	a, b := m.rowWords(i)[from:], m.rowWords(j)[from:]
+	for k := range a {
+		a[k] ^= b[k]
+	}
+}
+
+func xorWords(dst, src []uint64) {
+	for k := range dst {
+		dst[k] ^= src[k]
+	}
+}
+
+func orWords(dst, src []uint64) {
+	for k := range dst {
+		dst[k] |= src[k]
+	}
+}
+
+// column block size worth using for a matrix this large
+func (m *BitMatrix) fourRussiansK() uint {
+	if m.rows*m.cols < kfourRussiansMinBits {
+		return 1
+	}
+	return kfourRussiansK
+}
+
+// reduces the first ncols columns of the matrix in place to reduced row
+// echelon form, returns the pivot column of each of the first len(pivots)
+// rows
+// columns are taken k at a time, the Method of Four Russians: the block's
+// pivots are found and reduced among themselves, then every other row is
+// cleared of the block with a single XOR from a table of all 2^k
+// combinations of the pivot rows, k = 1 is plain Gauss-Jordan elimination
+func (m *BitMatrix) eliminate(ncols, k uint) []uint {
+	var pivots []uint
+	table := make([]uint64, (1<<k)*m.stride)
+	r := uint(0)
+	for c := uint(0); c < ncols && r < m.rows; c += k {
+		kb := min(k, ncols-c)
+		from := c / kmatrixWordBits
+
+		// pivot j of the block sits in row r+j at column c+offs[j]
+		var offs []uint
+		for t := uint(0); t < kb && r+uint(len(offs)) < m.rows; t++ {
+			pr := r + uint(len(offs))
+			found := false
+			for i := pr; i < m.rows && !found; i++ {
+				// the row's block bits once reduced by the pivots so far
+				pat := m.rowBits(i, c, kb)
+				for j, o := range offs {
+					if pat>>o&1 != 0 {
+						pat ^= m.rowBits(r+uint(j), c, kb)
+					}
+				}
+				if pat>>t&1 != 0 {
+					m.swapRows(i, pr)
+					found = true
+				}
+			}
+			if !found {
+				continue
+			}
+			for j, o := range offs {
+				if m.rowBits(pr, c+o, 1) != 0 {
+					m.xorRow(pr, r+uint(j), from)
+				}
+			}
+			for j := range offs {
+				if m.rowBits(r+uint(j), c+t, 1) != 0 {
+					m.xorRow(r+uint(j), pr, from)
+				}
+			}
+			offs = append(offs, t)
+		}
+		kk := uint(len(offs))
+		if kk == 0 {
+			continue
+		}
+
+		// entry x XORs together the pivot rows of the bits of x
+		width := m.stride - from
+		clear(table[:width])
+		for x := uint(1); x < 1<<kk; x++ {
+			entry := table[x*width : (x+1)*width]
+			copy(entry, table[(x&(x-1))*width:])
+			xorWords(entry, m.rowWords(r + uint(bits.TrailingZeros(x)))[from:])
+		}
+		for i := uint(0); i < m.rows; i++ {
+			if i >= r && i < r+kk {
+				continue
+			}
+			pat := m.rowBits(i, c, kb)
+			x := uint(0)
+			for j, o := range offs {
+				x |= uint(pat>>o&1) << j
+			}
+			if x != 0 {
+				xorWords(m.rowWords(i)[from:], table[x*width:(x+1)*width])
+			}
+		}
+
+		for _, o := range offs {
+			pivots = append(pivots, c+o)
+		}
+		r += kk
+	}
+	return pivots
+}
+
+// number of linearly independent rows
+func (m *BitMatrix) Rank() uint {
+	return uint(len(m.Clone().eliminate(m.cols, m.fourRussiansK())))
+}
+
+// determinant of a square matrix, 0 or 1
+func (m *BitMatrix) Determinant() uint {
+	m.checkSquare()
+	if m.Rank() == m.rows {
+		return 1
+	}
+	return 0
+}
+
+// returns the inverse of a square matrix, or ErrSingular
+func (m *BitMatrix) Inverse() (*BitMatrix, error) {
+	m.checkSquare()
+	n := m.rows
+	// [m | I], reduced to [I | m^-1]
+	aug := NewBitMatrix(n, 2*n)
+	for i := uint(0); i < n; i++ {
+		w := aug.rowWords(i)
+		copy(w, m.rowWords(i))
+		off := n + i
+		w[off/kmatrixWordBits] |= 1 << (off % kmatrixWordBits)
+	}
+	if uint(len(aug.eliminate(n, aug.fourRussiansK()))) < n {
+		return nil, ErrSingular
+	}
+	r := NewBitMatrix(n, n)
+	for i := uint(0); i < n; i++ {
+		for j := uint(0); j < n; j += kmatrixWordBits {
+			k := min(kmatrixWordBits, n-j)
+			r.rowWords(i)[j/kmatrixWordBits] = aug.rowBits(i, n+j, k)
+		}
+	}
+	return r, nil
+}
+
+// returns a vector x with m*x = b, b holds Rows() bits, x holds Cols()
+// bits rounded up to whole bytes, free variables are 0, returns
+// ErrNoSolution when the system is inconsistent
+func (m *BitMatrix) Solve(b *BitBuffer) (*BitBuffer, error) {
+	// [m | b]
+	aug := NewBitMatrix(m.rows, m.cols+1)
+	for i := uint(0); i < m.rows; i++ {
+		copy(aug.rowWords(i), m.rowWords(i))
+		if i < b.LenBits() && b.IsSet(i) {
+			aug.Set(i, m.cols)
+		}
+	}
+	pivots := aug.eliminate(m.cols, aug.fourRussiansK())
+	for i := uint(len(pivots)); i < m.rows; i++ {
+		if aug.Get(i, m.cols) {
+			return nil, ErrNoSolution
+		}
+	}
+	x := NewBitBuffer((m.cols + KBITS_PER_BYTE - 1) / KBITS_PER_BYTE)
+	for i, p := range pivots {
+		if aug.Get(uint(i), m.cols) {
+			x.Set(p)
+		}
+	}
+	return x, nil
+}
+
+// returns a basis of the vectors x with m*x = 0, one per row, Cols() - Rank()
+// rows of Cols() bits
+func (m *BitMatrix) NullSpace() *BitMatrix {
+	red := m.Clone()
+	pivots := red.eliminate(m.cols, red.fourRussiansK())
+	is_pivot := make([]bool, m.cols)
+	for _, p := range pivots {
+		is_pivot[p] = true
+	}
+
+	r := NewBitMatrix(m.cols-uint(len(pivots)), m.cols)
+	row := uint(0)
+	for f := uint(0); f < m.cols; f++ {
+		if is_pivot[f] {
+			continue
+		}
+		// free variable f set, pivot variables follow from their rows
+		r.Set(row, f)
+		for i, p := range pivots {
+			if red.Get(uint(i), f) {
+				r.Set(row, p)
+			}
+		}
+		row++
+	}
+	return r
+}
+
+// returns the product m * x over GF(2), x holds Cols() bits, the result
+// holds Rows() bits rounded up to whole bytes
+func (m *BitMatrix) MulVec(x *BitBuffer) *BitBuffer {
+	xw := make([]uint64, m.stride)
+	copy(xw, x.ToUint64s())
+	r := NewBitBuffer((m.rows + KBITS_PER_BYTE - 1) / KBITS_PER_BYTE)
+	for i := uint(0); i < m.rows; i++ {
+		p := 0
+		for k, w := range m.rowWords(i) {
+			p += bits.OnesCount64(w & xw[k])
+		}
+		if p&1 != 0 {
+			r.Set(i)
+		}
+	}
+	return r
+}
+
+// returns the product m * other over GF(2), m.Cols() must equal
+// other.Rows()
+func (m *BitMatrix) Mul(other *BitMatrix) *BitMatrix {
+	return m.mulFourRussians(other, false)
+}
+
+// product of m and other, sums are XOR, or OR when or is set
+// rows of other are combined k at a time from tables of all 2^k
+// combinations, the Method of Four Russians
+func (m *BitMatrix) mulFourRussians(other *BitMatrix, or bool) *BitMatrix {
+	if m.cols != other.rows {
+		panic(fmt.Sprintf("mbits: can't multiply %vx%v by %vx%v matrix", m.rows, m.cols, other.rows, other.cols))
+	}
+	combine := xorWords
+	if or {
+		combine = orWords
+	}
+	r := NewBitMatrix(m.rows, other.cols)
+	k := m.fourRussiansK()
+	width := other.stride
+	table := make([]uint64, (1<<k)*width)
+	for c := uint(0); c < m.cols; c += k {
+		kb := min(k, m.cols-c)
+		for x := uint(1); x < 1<<kb; x++ {
+			entry := table[x*width : (x+1)*width]
+			copy(entry, table[(x&(x-1))*width:])
+			combine(entry, other.rowWords(c+uint(bits.TrailingZeros(x))))
+		}
+		for i := uint(0); i < m.rows; i++ {
+			if x := uint(m.rowBits(i, c, kb)); x != 0 {
+				combine(r.rowWords(i), table[x*width:(x+1)*width])
+			}
+		}
+	}
+	return r
+}
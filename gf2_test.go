@@ -0,0 +1,222 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// textbook row by column product over GF(2)
+func naiveMul(a, b *BitMatrix) *BitMatrix {
+	r := NewBitMatrix(a.Rows(), b.Cols())
+	for i := uint(0); i < a.Rows(); i++ {
+		for j := uint(0); j < b.Cols(); j++ {
+			p := false
+			for k := uint(0); k < a.Cols(); k++ {
+				p = p != (a.Get(i, k) && b.Get(k, j))
+			}
+			if p {
+				r.Set(i, j)
+			}
+		}
+	}
+	return r
+}
+
+func vecFromMatrixRow(m *BitMatrix, i uint) *BitBuffer {
+	return m.Row(i).Clone()
+}
+
+func TestGF2Mul(t *testing.T) {
+	rng := rand.New(rand.NewSource(10))
+	for _, shape := range [][3]uint{{1, 1, 1}, {7, 9, 5}, {70, 130, 65}, {200, 150, 90}} {
+		a := randomMatrix(rng, shape[0], shape[1], 0.5)
+		b := randomMatrix(rng, shape[1], shape[2], 0.5)
+		if !matrixEqual(a.Mul(b), naiveMul(a, b)) {
+			t.Errorf("%v: Mul doesn't match the naive product", shape)
+		}
+
+		x := randomMatrix(rng, 1, shape[1], 0.5)
+		want := naiveMul(a, x.Transpose())
+		y := a.MulVec(vecFromMatrixRow(x, 0))
+		for i := uint(0); i < shape[0]; i++ {
+			if y.IsSet(i) != want.Get(i, 0) {
+				t.Fatalf("%v: MulVec mismatch at %v", shape, i)
+			}
+		}
+	}
+}
+
+func TestGF2EliminateBlockSizes(t *testing.T) {
+	rng := rand.New(rand.NewSource(11))
+	for _, shape := range [][3]uint{{10, 10, 4}, {100, 80, 30}, {150, 200, 150}, {300, 70, 70}} {
+		// rank at most shape[2]
+		m := randomMatrix(rng, shape[0], shape[2], 0.5).Mul(randomMatrix(rng, shape[2], shape[1], 0.5))
+		plain, russian := m.Clone(), m.Clone()
+		p1 := plain.eliminate(m.Cols(), 1)
+		p8 := russian.eliminate(m.Cols(), kfourRussiansK)
+		if len(p1) != len(p8) || len(p1) > int(shape[2]) {
+			t.Fatalf("%v: rank %v vs %v", shape, len(p1), len(p8))
+		}
+		// the reduced row echelon form is unique
+		if !matrixEqual(plain, russian) {
+			t.Errorf("%v: block sizes disagree on the reduced form", shape)
+		}
+		if m.Rank() != uint(len(p1)) {
+			t.Errorf("%v: Rank() = %v, want %v", shape, m.Rank(), len(p1))
+		}
+	}
+}
+
+func TestGF2Inverse(t *testing.T) {
+	rng := rand.New(rand.NewSource(12))
+	for _, n := range []uint{1, 5, 64, 100, 200} {
+		inverted := 0
+		for range 6 {
+			m := randomMatrix(rng, n, n, 0.5)
+			inv, err := m.Inverse()
+			if err != nil {
+				if !errors.Is(err, ErrSingular) || m.Determinant() != 0 {
+					t.Fatalf("n=%v: %v, determinant %v", n, err, m.Determinant())
+				}
+				continue
+			}
+			inverted++
+			if m.Determinant() != 1 {
+				t.Errorf("n=%v: invertible with determinant 0", n)
+			}
+			id := NewIdentityMatrix(n)
+			if !matrixEqual(m.Mul(inv), id) || !matrixEqual(inv.Mul(m), id) {
+				t.Errorf("n=%v: m * m^-1 isn't the identity", n)
+			}
+		}
+		if inverted == 0 && n > 1 {
+			t.Errorf("n=%v: no random matrix was invertible", n)
+		}
+	}
+
+	m := NewBitMatrix(3, 3)
+	m.Set(0, 0).Set(1, 1).Set(2, 0).Set(2, 1)
+	if _, err := m.Inverse(); !errors.Is(err, ErrSingular) {
+		t.Errorf("singular matrix inverted: %v", err)
+	}
+}
+
+func TestGF2Solve(t *testing.T) {
+	rng := rand.New(rand.NewSource(13))
+	for _, shape := range [][2]uint{{5, 5}, {150, 120}, {90, 200}} {
+		a := randomMatrix(rng, shape[0], shape[1], 0.5)
+		x0 := vecFromMatrixRow(randomMatrix(rng, 1, shape[1], 0.5), 0)
+		b := a.MulVec(x0)
+		x, err := a.Solve(b)
+		if err != nil {
+			t.Fatalf("%v: %v", shape, err)
+		}
+		if a.MulVec(x).CmpWith(b) != 0 {
+			t.Errorf("%v: a * x != b", shape)
+		}
+	}
+
+	// x0 + x1 = 1 and x0 + x1 = 0
+	a := NewBitMatrix(2, 2)
+	a.Set(0, 0).Set(0, 1).Set(1, 0).Set(1, 1)
+	b := NewBitBuffer(1)
+	b.Set(0)
+	if _, err := a.Solve(b); !errors.Is(err, ErrNoSolution) {
+		t.Errorf("inconsistent system solved: %v", err)
+	}
+}
+
+// pressing a light of the 5x5 Lights Out board toggles it and its
+// neighbours, the well known press matrix has rank 23
+func TestGF2LightsOut(t *testing.T) {
+	const n = 5
+	a := NewBitMatrix(n*n, n*n)
+	for i := uint(0); i < n; i++ {
+		for j := uint(0); j < n; j++ {
+			p := i*n + j
+			a.Set(p, p)
+			if i > 0 {
+				a.Set(p, p-n)
+			}
+			if i < n-1 {
+				a.Set(p, p+n)
+			}
+			if j > 0 {
+				a.Set(p, p-1)
+			}
+			if j < n-1 {
+				a.Set(p, p+1)
+			}
+		}
+	}
+	if r := a.Rank(); r != 23 {
+		t.Fatalf("Rank() = %v, want 23", r)
+	}
+	if a.Determinant() != 0 {
+		t.Error("determinant of a singular matrix isn't 0")
+	}
+
+	// turning off a fully lit board
+	lit := NewBitBuffer(4).SetRange(0, n*n)
+	presses, err := a.Solve(lit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.MulVec(presses).CmpWith(lit) != 0 {
+		t.Error("presses don't turn the board off")
+	}
+
+	null := a.NullSpace()
+	if null.Rows() != 2 {
+		t.Fatalf("null space has %v vectors, want 2", null.Rows())
+	}
+	for i := uint(0); i < null.Rows(); i++ {
+		if a.MulVec(vecFromMatrixRow(null, i)).CountBitsOn() != 0 {
+			t.Errorf("null space vector %v isn't a quiet pattern", i)
+		}
+	}
+}
+
+func TestGF2NullSpace(t *testing.T) {
+	rng := rand.New(rand.NewSource(14))
+	for _, shape := range [][3]uint{{4, 9, 4}, {60, 150, 40}, {200, 180, 100}} {
+		m := randomMatrix(rng, shape[0], shape[2], 0.5).Mul(randomMatrix(rng, shape[2], shape[1], 0.5))
+		null := m.NullSpace()
+		if null.Rows() != m.Cols()-m.Rank() {
+			t.Errorf("%v: %v null space vectors, rank %v", shape, null.Rows(), m.Rank())
+		}
+		if null.Rows() > 0 && null.Rank() != null.Rows() {
+			t.Errorf("%v: null space basis isn't independent", shape)
+		}
+		if prod := m.Mul(null.Transpose()); prod.Rank() != 0 {
+			t.Errorf("%v: m * null space isn't zero", shape)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// graphs as square adjacency matrices: bit (i, j) is an edge from node i to
+// node j, so row i holds the successors of i
+
+// returns the product m * other over the boolean semiring, bit (i, j) is
+// set when some k has both (i, k) in m and (k, j) in other, for adjacency
+// matrices the pairs joined by a path of one edge from each
+// m.Cols() must equal other.Rows()
+func (m *BitMatrix) BoolMul(other *BitMatrix) *BitMatrix {
+	return m.mulFourRussians(other, true)
+}
+
+// returns the transitive closure of a square adjacency matrix: bit (i, j)
+// is set when a path of one or more edges leads from i to j, so (i, i) is
+// set only for nodes on a cycle
+// bit-parallel Warshall: node k at a time, every row reaching k takes
+// k's row, O(n^3 / 64) word operations at worst, less for sparse graphs
+func (m *BitMatrix) TransitiveClosure() *BitMatrix {
+	m.checkSquare()
+	r := m.Clone()
+	for k := uint(0); k < r.rows; k++ {
+		w, mask := k/kmatrixWordBits, uint64(1)<<(k%kmatrixWordBits)
+		row_k := r.rowWords(k)
+		for i := uint(0); i < r.rows; i++ {
+			if row := r.rowWords(i); row[w]&mask != 0 {
+				orWords(row, row_k)
+			}
+		}
+	}
+	return r
+}
+
+// breadth-first search of a square adjacency matrix from the nodes set in
+// sources, one level at a time: each frontier is the OR of the rows of the
+// previous frontier's nodes, minus the nodes already visited
+// calls fn with every frontier, starting with the sources at depth 0, until
+// fn returns false or nothing new is reached, the frontier is only valid
+// during the call and mustn't be modified
+// returns the visited nodes, Rows() bits rounded up to whole bytes
+func (m *BitMatrix) BFS(sources *BitBuffer, fn func(depth uint, frontier *BitBuffer) bool) *BitBuffer {
+	m.checkSquare()
+	frontier := make([]uint64, m.stride)
+	copy(frontier, sources.ToUint64s())
+	if n := m.rows % kmatrixWordBits; n != 0 && m.stride > 0 {
+		frontier[m.stride-1] &= 1<<n - 1
+	}
+	visited := append([]uint64(nil), frontier...)
+	next := make([]uint64, m.stride)
+	byte_len := (m.rows + KBITS_PER_BYTE - 1) / KBITS_PER_BYTE
+
+	for depth := uint(0); ; depth++ {
+		if fn != nil && !fn(depth, newBitsWithStorage[uint64](&fixedStorage{words: frontier}, byte_len)) {
+			break
+		}
+		clear(next)
+		for k, w := range frontier {
+			for ; w != 0; w &= w - 1 {
+				orWords(next, m.rowWords(uint(k)*kmatrixWordBits+uint(bits.TrailingZeros64(w))))
+			}
+		}
+		reached := uint64(0)
+		for k := range next {
+			next[k] &^= visited[k]
+			visited[k] |= next[k]
+			reached |= next[k]
+		}
+		if reached == 0 {
+			break
+		}
+		frontier, next = next, frontier
+	}
+	r := NewBitBuffer(0).FromUint64s(visited)
+	r.resize(byte_len)
+	return r
+}
+
+// returns the nodes reachable from node from, including itself
+func (m *BitMatrix) Reachable(from uint) *BitBuffer {
+	if from >= m.rows {
+		panic(fmt.Sprintf("mbits: node %v out of range for %vx%v matrix", from, m.rows, m.cols))
+	}
+	sources := NewBitBuffer(0)
+	sources.Set(from)
+	return m.BFS(sources, nil)
+}
@@ -0,0 +1,161 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func naiveBoolMul(a, b *BitMatrix) *BitMatrix {
+	r := NewBitMatrix(a.Rows(), b.Cols())
+	for i := uint(0); i < a.Rows(); i++ {
+		for j := uint(0); j < b.Cols(); j++ {
+			for k := uint(0); k < a.Cols(); k++ {
+				if a.Get(i, k) && b.Get(k, j) {
+					r.Set(i, j)
+					break
+				}
+			}
+		}
+	}
+	return r
+}
+
+// nodes reachable from i through one or more edges, by depth-first search
+func naiveReach(m *BitMatrix, i uint) []bool {
+	seen := make([]bool, m.Rows())
+	stack := []uint{i}
+	for len(stack) > 0 {
+		u := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for v := uint(0); v < m.Cols(); v++ {
+			if m.Get(u, v) && !seen[v] {
+				seen[v] = true
+				stack = append(stack, v)
+			}
+		}
+	}
+	return seen
+}
+
+func TestBoolMul(t *testing.T) {
+	rng := rand.New(rand.NewSource(20))
+	for _, shape := range [][3]uint{{1, 1, 1}, {9, 13, 70}, {150, 140, 130}} {
+		a := randomMatrix(rng, shape[0], shape[1], 0.05)
+		b := randomMatrix(rng, shape[1], shape[2], 0.05)
+		if !matrixEqual(a.BoolMul(b), naiveBoolMul(a, b)) {
+			t.Errorf("%v: BoolMul doesn't match the naive product", shape)
+		}
+	}
+}
+
+func TestTransitiveClosure(t *testing.T) {
+	rng := rand.New(rand.NewSource(21))
+	for _, n := range []uint{1, 10, 150} {
+		m := randomMatrix(rng, n, n, 1.5/float64(n))
+		c := m.TransitiveClosure()
+		for i := uint(0); i < n; i++ {
+			reach := naiveReach(m, i)
+			for j := uint(0); j < n; j++ {
+				if c.Get(i, j) != reach[j] {
+					t.Fatalf("n=%v: closure (%v, %v) = %v", n, i, j, c.Get(i, j))
+				}
+			}
+		}
+		// closed under one more step
+		if !matrixEqual(c.Clone().Or(c.BoolMul(c)), c) {
+			t.Errorf("n=%v: closure isn't transitive", n)
+		}
+	}
+}
+
+func TestBFS(t *testing.T) {
+	// 0 -> 1 -> 2 -> 3 -> 1, 4 -> 0, 5 alone
+	m := NewBitMatrix(6, 6)
+	m.Set(0, 1).Set(1, 2).Set(2, 3).Set(3, 1).Set(4, 0)
+
+	var levels []string
+	sources := NewBitBuffer(1)
+	sources.Set(0)
+	visited := m.BFS(sources, func(depth uint, frontier *BitBuffer) bool {
+		if uint(len(levels)) != depth {
+			t.Errorf("depth %v after %v levels", depth, len(levels))
+		}
+		levels = append(levels, frontier.String()[:6])
+		return true
+	})
+	want := []string{"100000", "010000", "001000", "000100"}
+	if len(levels) != len(want) {
+		t.Fatalf("levels %v, want %v", levels, want)
+	}
+	for i := range want {
+		if levels[i] != want[i] {
+			t.Errorf("level %v = %v, want %v", i, levels[i], want[i])
+		}
+	}
+	if visited.String() != "11110000" {
+		t.Errorf("visited %s", visited)
+	}
+
+	// stopping early
+	n := 0
+	visited = m.BFS(sources, func(uint, *BitBuffer) bool {
+		n++
+		return n < 2
+	})
+	if n != 2 || visited.String() != "11000000" {
+		t.Errorf("stopped after %v levels, visited %s", n, visited)
+	}
+
+	if got := m.Reachable(4).String(); got != "11111000" {
+		t.Errorf("Reachable(4) = %s", got)
+	}
+}
+
+func TestBFSLargeGraph(t *testing.T) {
+	// a ring with chords, big enough to hold tens of thousands of nodes
+	const n = 20000
+	rng := rand.New(rand.NewSource(22))
+	m := NewBitMatrix(n, n)
+	for i := uint(0); i < n; i++ {
+		m.Set(i, (i+1)%n)
+		m.Set(i, uint(rng.Intn(n)))
+	}
+	depths := 0
+	visited := m.BFS(NewBitBuffer(1).Set(0), func(uint, *BitBuffer) bool {
+		depths++
+		return true
+	})
+	if visited.CountBitsOn() != n {
+		t.Errorf("visited %v of %v nodes", visited.CountBitsOn(), n)
+	}
+	// random chords make the diameter logarithmic rather than n
+	if depths > 100 {
+		t.Errorf("%v levels", depths)
+	}
+}
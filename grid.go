@@ -0,0 +1,422 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// BitGrid is a width x height grid of cells, on or off, for cellular
+// automata and binary morphology
+// cell (x, y) is bit (y, x) of the underlying BitMatrix, rows run along x
+// and y grows downwards, as in images
+type BitGrid struct {
+	m     *BitMatrix
+	edges GridEdges
+	// scratch rows for shifting
+	tmp []uint64
+}
+
+// what lies past the edges of a grid
+type GridEdges int
+
+const (
+	// cells past the edges are off
+	KGRID_BOUNDED GridEdges = iota
+	// edges wrap around, the grid is a torus
+	KGRID_TORUS
+)
+
+// birth and survival conditions of a Life-like automaton, bit n is set when
+// n live neighbours cause birth or survival
+type LifeRule struct {
+	Birth   uint16
+	Survive uint16
+}
+
+// Conway's Game of Life, B3/S23
+var KLIFE_CONWAY = LifeRule{Birth: 1 << 3, Survive: 1<<2 | 1<<3}
+
+// parses a rule in B/S notation, such as "B3/S23" or "B36/S23"
+func ParseLifeRule(s string) (LifeRule, error) {
+	var r LifeRule
+	b, surv, ok := strings.Cut(strings.ToUpper(s), "/")
+	if !ok || !strings.HasPrefix(b, "B") || !strings.HasPrefix(surv, "S") {
+		return r, fmt.Errorf("mbits: bad life rule %q, want something like B3/S23", s)
+	}
+	for _, part := range []struct {
+		digits string
+		mask   *uint16
+	}{{b[1:], &r.Birth}, {surv[1:], &r.Survive}} {
+		for _, c := range part.digits {
+			if c < '0' || c > '8' {
+				return r, fmt.Errorf("mbits: bad life rule %q, neighbour counts are 0 to 8", s)
+			}
+			*part.mask |= 1 << (c - '0')
+		}
+	}
+	return r, nil
+}
+
+// returns the rule in B/S notation
+func (r LifeRule) String() string {
+	var sb strings.Builder
+	sb.WriteByte('B')
+	for n := 0; n <= 8; n++ {
+		if r.Birth>>n&1 != 0 {
+			sb.WriteByte(byte('0' + n))
+		}
+	}
+	sb.WriteString("/S")
+	for n := 0; n <= 8; n++ {
+		if r.Survive>>n&1 != 0 {
+			sb.WriteByte(byte('0' + n))
+		}
+	}
+	return sb.String()
+}
+
+// constructs an empty grid and returns pointer to instance
+func NewBitGrid(width, height uint, edges GridEdges) *BitGrid {
+	return &BitGrid{m: NewBitMatrix(height, width), edges: edges}
+}
+
+// parses a grid drawn one row per line, '#', '*', 'O' or '1' for cells that
+// are on and '.', ' ' or '0' for cells that are off, short rows are padded
+// with off cells, handy for tests and structuring elements
+func ParseBitGrid(s string, edges GridEdges) (*BitGrid, error) {
+	lines := strings.Split(strings.Trim(s, "\n"), "\n")
+	width := 0
+	for _, l := range lines {
+		width = max(width, len(l))
+	}
+	g := NewBitGrid(uint(width), uint(len(lines)), edges)
+	for y, l := range lines {
+		for x, c := range []byte(l) {
+			switch c {
+			case '#', '*', 'O', '1':
+				g.Set(uint(x), uint(y))
+			case '.', ' ', '0':
+			default:
+				return nil, fmt.Errorf("mbits: unexpected %q at %v,%v", c, x, y)
+			}
+		}
+	}
+	return g, nil
+}
+
+// number of cells per row
+func (g *BitGrid) Width() uint {
+	return g.m.cols
+}
+
+// number of rows
+func (g *BitGrid) Height() uint {
+	return g.m.rows
+}
+
+// what lies past the edges
+func (g *BitGrid) Edges() GridEdges {
+	return g.edges
+}
+
+// returns the cells as a matrix sharing the grid's memory, cell (x, y)
+// being bit (y, x)
+func (g *BitGrid) Matrix() *BitMatrix {
+	return g.m
+}
+
+// returns true if cell (x, y) is on
+func (g *BitGrid) Get(x, y uint) bool {
+	return g.m.Get(y, x)
+}
+
+// turn cell (x, y) on
+// returns pointer to self
+func (g *BitGrid) Set(x, y uint) *BitGrid {
+	g.m.Set(y, x)
+	return g
+}
+
+// turn cell (x, y) off
+// returns pointer to self
+func (g *BitGrid) Clear(x, y uint) *BitGrid {
+	g.m.Clear(y, x)
+	return g
+}
+
+// number of cells that are on
+func (g *BitGrid) Count() uint {
+	on, _ := g.m.CountBits()
+	return on
+}
+
+// returns a copy of (this)
+func (g *BitGrid) Clone() *BitGrid {
+	return &BitGrid{m: g.m.Clone(), edges: g.edges}
+}
+
+// returns true if both grids have the same size and cells
+func (g *BitGrid) Equal(other *BitGrid) bool {
+	if g.m.rows != other.m.rows || g.m.cols != other.m.cols {
+		return false
+	}
+	for k, w := range g.m.words {
+		if other.m.words[k] != w {
+			return false
+		}
+	}
+	return true
+}
+
+// draws the grid one row per line, '#' for on and '.' for off
+func (g *BitGrid) String() string {
+	var sb strings.Builder
+	for y := uint(0); y < g.Height(); y++ {
+		for x := uint(0); x < g.Width(); x++ {
+			if g.Get(x, y) {
+				sb.WriteByte('#')
+			} else {
+				sb.WriteByte('.')
+			}
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// dst = src moved n bits up, towards higher x
+func shlWords(dst, src []uint64, n uint) {
+	ws, bs := int(n/64), n%64
+	for i := len(dst) - 1; i >= 0; i-- {
+		v := uint64(0)
+		if j := i - ws; j >= 0 {
+			v = src[j] << bs
+			if bs > 0 && j > 0 {
+				v |= src[j-1] >> (64 - bs)
+			}
+		}
+		dst[i] = v
+	}
+}
+
+// dst = src moved n bits down, towards lower x
+func shrWords(dst, src []uint64, n uint) {
+	ws, bs := int(n/64), n%64
+	for i := range dst {
+		v := uint64(0)
+		if j := i + ws; j < len(src) {
+			v = src[j] >> bs
+			if bs > 0 && j+1 < len(src) {
+				v |= src[j+1] << (64 - bs)
+			}
+		}
+		dst[i] = v
+	}
+}
+
+// clears the bits of a row past the width
+func (g *BitGrid) maskRow(row []uint64) {
+	if n := g.m.cols % kmatrixWordBits; n != 0 {
+		row[len(row)-1] &= 1<<n - 1
+	}
+}
+
+// dst = src moved dx cells along x, wrapping around on a torus
+func (g *BitGrid) shiftRow(dst, src []uint64, dx int) {
+	width := int(g.m.cols)
+	if g.edges == KGRID_TORUS && width > 0 {
+		s := uint(((dx % width) + width) % width)
+		if len(g.tmp) != len(dst) {
+			g.tmp = make([]uint64, len(dst))
+		}
+		shlWords(dst, src, s)
+		shrWords(g.tmp, src, uint(width)-s)
+		orWords(dst, g.tmp)
+	} else if dx >= 0 {
+		shlWords(dst, src, uint(dx))
+	} else {
+		shrWords(dst, src, uint(-dx))
+	}
+	g.maskRow(dst)
+}
+
+// row y+dy with the edges applied, nil when it lies past a bounded edge
+func (g *BitGrid) rowAt(y uint, dy int) []uint64 {
+	height := int(g.m.rows)
+	sy := int(y) + dy
+	if g.edges == KGRID_TORUS {
+		sy = ((sy % height) + height) % height
+	} else if sy < 0 || sy >= height {
+		return nil
+	}
+	return g.m.rowWords(uint(sy))
+}
+
+// returns a copy of the grid moved by (dx, dy): cell (x, y) of the result
+// is cell (x-dx, y-dy), so (1, 0) moves everything one cell east and
+// (0, -1) one cell north, cells moving past a bounded edge are lost
+func (g *BitGrid) Shift(dx, dy int) *BitGrid {
+	r := NewBitGrid(g.Width(), g.Height(), g.edges)
+	for y := uint(0); y < g.Height(); y++ {
+		if src := g.rowAt(y, -dy); src != nil {
+			g.shiftRow(r.m.rowWords(y), src, dx)
+		}
+	}
+	return r
+}
+
+// advances the grid one generation of the Life-like automaton rule
+// the eight neighbours are counted for 64 cells at a time, as 4 bit-sliced
+// counter planes built with word-wide adders
+// returns pointer to self
+func (g *BitGrid) Step(rule LifeRule) *BitGrid {
+	stride := g.m.stride
+	next := make([]uint64, len(g.m.words))
+	// neighbour rows: above, own and below, each moved east and west
+	var nb [8][]uint64
+	for k := range nb {
+		nb[k] = make([]uint64, stride)
+	}
+	zero := make([]uint64, stride)
+
+	for y := uint(0); y < g.Height(); y++ {
+		k := 0
+		for _, dy := range []int{-1, 0, 1} {
+			src := g.rowAt(y, dy)
+			if src == nil {
+				src = zero
+			}
+			if dy != 0 {
+				copy(nb[k], src)
+				k++
+			}
+			g.shiftRow(nb[k], src, 1)
+			g.shiftRow(nb[k+1], src, -1)
+			k += 2
+		}
+
+		alive := g.m.rowWords(y)
+		out := next[y*stride : (y+1)*stride]
+		for w := uint(0); w < stride; w++ {
+			var s0, s1, s2, s3 uint64
+			for _, row := range nb {
+				c := row[w]
+				t := s0 & c
+				s0 ^= c
+				c, t = t, s1&t
+				s1 ^= c
+				c, t = t, s2&t
+				s2 ^= c
+				s3 |= t
+			}
+			v := uint64(0)
+			for n := uint(0); n <= 8; n++ {
+				born, survive := rule.Birth>>n&1 != 0, rule.Survive>>n&1 != 0
+				if !born && !survive {
+					continue
+				}
+				eq := ^uint64(0)
+				for b, plane := range [4]uint64{s0, s1, s2, s3} {
+					if n>>b&1 != 0 {
+						eq &= plane
+					} else {
+						eq &^= plane
+					}
+				}
+				if born {
+					v |= eq &^ alive[w]
+				}
+				if survive {
+					v |= eq & alive[w]
+				}
+			}
+			out[w] = v
+		}
+		g.maskRow(out)
+	}
+	g.m.words = next
+	return g
+}
+
+// offsets of the cells of a structuring element from its origin, the
+// center cell (Width()/2, Height()/2)
+func structOffsets(se *BitGrid) [][2]int {
+	var r [][2]int
+	cx, cy := int(se.Width()/2), int(se.Height()/2)
+	for y := uint(0); y < se.Height(); y++ {
+		for x := uint(0); x < se.Width(); x++ {
+			if se.Get(x, y) {
+				r = append(r, [2]int{int(x) - cx, int(y) - cy})
+			}
+		}
+	}
+	return r
+}
+
+// returns the dilation of the grid by the structuring element se, the
+// union of the grid moved by every cell of se relative to its center
+func (g *BitGrid) Dilate(se *BitGrid) *BitGrid {
+	r := NewBitGrid(g.Width(), g.Height(), g.edges)
+	for _, o := range structOffsets(se) {
+		orWords(r.m.words, g.Shift(o[0], o[1]).m.words)
+	}
+	return r
+}
+
+// returns the erosion of the grid by the structuring element se, the cells
+// where every cell of se, centered there, is on, cells past a bounded edge
+// count as off
+func (g *BitGrid) Erode(se *BitGrid) *BitGrid {
+	r := NewBitGrid(g.Width(), g.Height(), g.edges)
+	for k := range r.m.words {
+		r.m.words[k] = ^uint64(0)
+	}
+	for y := uint(0); y < r.Height(); y++ {
+		r.maskRow(r.m.rowWords(y))
+	}
+	for _, o := range structOffsets(se) {
+		s := g.Shift(-o[0], -o[1])
+		for k, w := range s.m.words {
+			r.m.words[k] &= w
+		}
+	}
+	return r
+}
+
+// returns the opening, erosion then dilation, which removes specks smaller
+// than se
+func (g *BitGrid) Open(se *BitGrid) *BitGrid {
+	return g.Erode(se).Dilate(se)
+}
+
+// returns the closing, dilation then erosion, which fills holes smaller
+// than se
+func (g *BitGrid) Close(se *BitGrid) *BitGrid {
+	return g.Dilate(se).Erode(se)
+}
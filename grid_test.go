@@ -0,0 +1,236 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func mustParseGrid(t *testing.T, s string, edges GridEdges) *BitGrid {
+	t.Helper()
+	g, err := ParseBitGrid(s, edges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func randomGrid(rng *rand.Rand, width, height uint, edges GridEdges, density float64) *BitGrid {
+	g := NewBitGrid(width, height, edges)
+	for y := uint(0); y < height; y++ {
+		for x := uint(0); x < width; x++ {
+			if rng.Float64() < density {
+				g.Set(x, y)
+			}
+		}
+	}
+	return g
+}
+
+// cell (x+dx, y+dy) with the edges applied
+func naiveCell(g *BitGrid, x, y uint, dx, dy int) bool {
+	w, h := int(g.Width()), int(g.Height())
+	nx, ny := int(x)+dx, int(y)+dy
+	if g.Edges() == KGRID_TORUS {
+		nx, ny = ((nx%w)+w)%w, ((ny%h)+h)%h
+	} else if nx < 0 || ny < 0 || nx >= w || ny >= h {
+		return false
+	}
+	return g.Get(uint(nx), uint(ny))
+}
+
+func naiveStep(g *BitGrid, rule LifeRule) *BitGrid {
+	r := NewBitGrid(g.Width(), g.Height(), g.Edges())
+	for y := uint(0); y < g.Height(); y++ {
+		for x := uint(0); x < g.Width(); x++ {
+			n := 0
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					if (dx != 0 || dy != 0) && naiveCell(g, x, y, dx, dy) {
+						n++
+					}
+				}
+			}
+			mask := rule.Birth
+			if g.Get(x, y) {
+				mask = rule.Survive
+			}
+			if mask>>n&1 != 0 {
+				r.Set(x, y)
+			}
+		}
+	}
+	return r
+}
+
+func TestLifeRule(t *testing.T) {
+	r, err := ParseLifeRule("b36/s23")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.String() != "B36/S23" || KLIFE_CONWAY.String() != "B3/S23" {
+		t.Errorf("got %v and %v", r, KLIFE_CONWAY)
+	}
+	for _, bad := range []string{"", "B3", "S23/B3", "B9/S23", "B3/Sx"} {
+		if _, err := ParseLifeRule(bad); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+}
+
+func TestBitGridShift(t *testing.T) {
+	rng := rand.New(rand.NewSource(30))
+	for _, edges := range []GridEdges{KGRID_BOUNDED, KGRID_TORUS} {
+		for _, width := range []uint{5, 64, 70, 130} {
+			g := randomGrid(rng, width, 7, edges, 0.4)
+			for _, d := range [][2]int{{1, 0}, {-1, 0}, {0, 1}, {0, -1}, {1, 1}, {-1, -1}, {1, -1}, {-1, 1}, {67, 3}, {-66, -9}} {
+				s := g.Shift(d[0], d[1])
+				for y := uint(0); y < 7; y++ {
+					for x := uint(0); x < width; x++ {
+						if s.Get(x, y) != naiveCell(g, x, y, -d[0], -d[1]) {
+							t.Fatalf("edges %v width %v shift %v: mismatch at %v,%v", edges, width, d, x, y)
+						}
+					}
+				}
+				if s.Matrix().Flatten().CountBitsOn() != s.Count() {
+					t.Fatalf("edges %v width %v shift %v: bits past the width", edges, width, d)
+				}
+			}
+		}
+	}
+}
+
+func TestBitGridLife(t *testing.T) {
+	blinker := mustParseGrid(t, `
+.....
+..#..
+..#..
+..#..
+.....`, KGRID_BOUNDED)
+	want := mustParseGrid(t, `
+.....
+.....
+.###.
+.....
+.....`, KGRID_BOUNDED)
+	g := blinker.Clone().Step(KLIFE_CONWAY)
+	if !g.Equal(want) {
+		t.Errorf("blinker:\n%v", g)
+	}
+	if !g.Step(KLIFE_CONWAY).Equal(blinker) {
+		t.Errorf("blinker didn't oscillate:\n%v", g)
+	}
+
+	// a glider on a torus comes back after 4 generations, one cell down
+	// and to the right, having wrapped around
+	glider := mustParseGrid(t, `
+.#......
+..#.....
+###.....
+........
+........
+........`, KGRID_TORUS)
+	g = glider.Clone()
+	for range 4 * 8 {
+		g.Step(KLIFE_CONWAY)
+	}
+	if !g.Equal(glider.Shift(8, 8)) {
+		t.Errorf("glider:\n%v", g)
+	}
+
+	rng := rand.New(rand.NewSource(31))
+	highlife, _ := ParseLifeRule("B36/S23")
+	for _, edges := range []GridEdges{KGRID_BOUNDED, KGRID_TORUS} {
+		for _, width := range []uint{3, 64, 100} {
+			g := randomGrid(rng, width, 20, edges, 0.35)
+			for gen := range 5 {
+				for _, rule := range []LifeRule{KLIFE_CONWAY, highlife} {
+					want := naiveStep(g, rule)
+					if got := g.Clone().Step(rule); !got.Equal(want) {
+						t.Fatalf("edges %v width %v gen %v rule %v: got\n%v\nwant\n%v", edges, width, gen, rule, got, want)
+					}
+				}
+				g.Step(KLIFE_CONWAY)
+			}
+		}
+	}
+}
+
+func TestBitGridMorphology(t *testing.T) {
+	cross := mustParseGrid(t, `
+.#.
+###
+.#.`, KGRID_BOUNDED)
+	// structuring element off center
+	corner := mustParseGrid(t, `
+##
+#.`, KGRID_BOUNDED)
+
+	rng := rand.New(rand.NewSource(32))
+	for _, edges := range []GridEdges{KGRID_BOUNDED, KGRID_TORUS} {
+		g := randomGrid(rng, 70, 9, edges, 0.5)
+		for _, se := range []*BitGrid{cross, corner} {
+			offs := structOffsets(se)
+			dil, ero := g.Dilate(se), g.Erode(se)
+			for y := uint(0); y < g.Height(); y++ {
+				for x := uint(0); x < g.Width(); x++ {
+					some, all := false, true
+					for _, o := range offs {
+						some = some || naiveCell(g, x, y, -o[0], -o[1])
+						all = all && naiveCell(g, x, y, o[0], o[1])
+					}
+					if dil.Get(x, y) != some || ero.Get(x, y) != all {
+						t.Fatalf("edges %v: mismatch at %v,%v", edges, x, y)
+					}
+				}
+			}
+		}
+	}
+
+	// opening removes specks, closing fills holes
+	g := mustParseGrid(t, `
+.........
+.#.......
+.........
+....###..
+....#.#..
+....###..
+.........`, KGRID_BOUNDED)
+	square := mustParseGrid(t, `
+###
+###
+###`, KGRID_BOUNDED)
+	closed := g.Close(square)
+	if !closed.Get(5, 4) || closed.Count() != 9+1 {
+		t.Errorf("closing:\n%v", closed)
+	}
+	opened := closed.Open(square)
+	if opened.Get(1, 1) || opened.Count() != 9 {
+		t.Errorf("opening:\n%v", opened)
+	}
+}
@@ -0,0 +1,396 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"slices"
+)
+
+// HammingIndex finds the fingerprints nearest to a query by Hamming
+// distance, using multi-index hashing: fingerprints are cut into 16-bit
+// substrings, each with its own hash table, and since fingerprints within
+// distance r of the query must match it within r/m bits on one of the m
+// substrings, only the buckets near the query's substrings are checked
+//
+// small indexes, and searches that would probe more buckets than there are
+// fingerprints, fall back to a linear popcount scan
+//
+// searches may run concurrently with each other, but not with Add or Remove
+type HammingIndex struct {
+	nbits uint
+	// words per fingerprint
+	nwords uint
+	ids    []uint64
+	// fingerprints back to back, nwords each, in the order of ids
+	words []uint64
+	// entry of every id
+	pos map[uint64]uint32
+	// per substring, entries by substring value
+	tables []map[uint16][]uint32
+}
+
+// a fingerprint found by a search
+type HammingResult struct {
+	ID       uint64
+	Distance uint
+}
+
+// binary format, all fields little-endian:
+//
+//	[0:4)    magic "MBHX"
+//	[4]      version
+//	[5:8)    reserved, zero
+//	[8:16)   fingerprint width in bits
+//	[16:24)  number of fingerprints
+//	[24:)    per fingerprint: id uint64, then its 64-bit words
+//
+// the hash tables are rebuilt when decoding
+const (
+	// size of the header ahead of the fingerprints
+	KHAMMING_HEADER_BYTES = uint(24)
+	// format version written in the header
+	KHAMMING_VERSION = byte(1)
+	// widest fingerprint an index takes
+	KHAMMING_MAX_BITS = uint(1 << 16)
+)
+
+// returned when decoding something that isn't a serialized HammingIndex
+var ErrBadHammingIndex = errors.New("mbits: not a serialized hamming index")
+
+var khammingMagic = [4]byte{'M', 'B', 'H', 'X'}
+
+const (
+	// bits per substring
+	khammingSubBits = 16
+	// below this many fingerprints scanning them all is as fast
+	khammingLinearMax = 1024
+)
+
+// constructs an empty index of nbits-bit fingerprints and returns pointer to
+// instance, nbits must be 1 to KHAMMING_MAX_BITS
+func NewHammingIndex(nbits uint) *HammingIndex {
+	if nbits == 0 || nbits > KHAMMING_MAX_BITS {
+		panic(fmt.Sprintf("mbits: fingerprints need 1 to %v bits, not %v", KHAMMING_MAX_BITS, nbits))
+	}
+	h := &HammingIndex{
+		nbits:  nbits,
+		nwords: (nbits + 63) / 64,
+		pos:    map[uint64]uint32{},
+		tables: make([]map[uint16][]uint32, (nbits+khammingSubBits-1)/khammingSubBits),
+	}
+	for i := range h.tables {
+		h.tables[i] = map[uint16][]uint32{}
+	}
+	return h
+}
+
+// fingerprint width in bits
+func (h *HammingIndex) Bits() uint {
+	return h.nbits
+}
+
+// number of fingerprints
+func (h *HammingIndex) Len() int {
+	return len(h.ids)
+}
+
+// the first nbits bits of fp as words, zero padded
+func (h *HammingIndex) fingerprint(fp *BitBuffer) []uint64 {
+	w := make([]uint64, h.nwords)
+	copy(w, fp.ToUint64s())
+	if rem := h.nbits % 64; rem != 0 {
+		w[h.nwords-1] &= 1<<rem - 1
+	}
+	return w
+}
+
+// bits of substring i, and its width
+func (h *HammingIndex) substring(w []uint64, i uint) (uint16, uint) {
+	bit := i * khammingSubBits
+	width := min(khammingSubBits, h.nbits-bit)
+	return uint16(w[bit/64] >> (bit % 64) & (1<<width - 1)), width
+}
+
+func (h *HammingIndex) entryWords(e uint32) []uint64 {
+	return h.words[uint(e)*h.nwords : uint(e+1)*h.nwords]
+}
+
+func hammingWords(a, b []uint64) uint {
+	n := 0
+	for i, w := range a {
+		n += bits.OnesCount64(w ^ b[i])
+	}
+	return uint(n)
+}
+
+// adds the first Bits() bits of fp under id, replacing the fingerprint id
+// had, shorter fingerprints are padded with off bits
+func (h *HammingIndex) Add(id uint64, fp *BitBuffer) {
+	h.Remove(id)
+	e := uint32(len(h.ids))
+	h.ids = append(h.ids, id)
+	h.words = append(h.words, h.fingerprint(fp)...)
+	h.pos[id] = e
+	h.link(e)
+}
+
+// adds entry e to the hash tables
+func (h *HammingIndex) link(e uint32) {
+	w := h.entryWords(e)
+	for i, t := range h.tables {
+		key, _ := h.substring(w, uint(i))
+		t[key] = append(t[key], e)
+	}
+}
+
+// replaces entry from with to in the hash tables, removing it if to is
+// negative
+func (h *HammingIndex) relink(from uint32, to int64) {
+	w := h.entryWords(from)
+	for i, t := range h.tables {
+		key, _ := h.substring(w, uint(i))
+		b := t[key]
+		k := slices.Index(b, from)
+		switch {
+		case to >= 0:
+			b[k] = uint32(to)
+		case len(b) == 1:
+			delete(t, key)
+		default:
+			b[k] = b[len(b)-1]
+			t[key] = b[:len(b)-1]
+		}
+	}
+}
+
+// removes id, returns false if it wasn't there
+func (h *HammingIndex) Remove(id uint64) bool {
+	e, ok := h.pos[id]
+	if !ok {
+		return false
+	}
+	h.relink(e, -1)
+	delete(h.pos, id)
+
+	// the last entry takes e's place
+	last := uint32(len(h.ids) - 1)
+	if e != last {
+		h.relink(last, int64(e))
+		h.ids[e] = h.ids[last]
+		copy(h.entryWords(e), h.entryWords(last))
+		h.pos[h.ids[e]] = e
+	}
+	h.ids = h.ids[:last]
+	h.words = h.words[:uint(last)*h.nwords]
+	return true
+}
+
+// number of values within distance r of a width-bit substring
+func neighbourhood(width, r uint) uint {
+	n, c := uint(0), uint(1)
+	for i := uint(0); i <= r && i <= width; i++ {
+		n += c
+		c = c * (width - i) / (i + 1)
+	}
+	return n
+}
+
+// true when probing every substring's buckets within radius r costs more
+// than scanning all fingerprints
+func (h *HammingIndex) scanIsCheaper(r uint) bool {
+	return len(h.ids) <= khammingLinearMax ||
+		uint(len(h.tables))*neighbourhood(khammingSubBits, r) >= uint(len(h.ids))
+}
+
+// calls fn with every entry within distance exactly r of the query on
+// substring i, entries may repeat across substrings
+func (h *HammingIndex) probe(q []uint64, i, r uint, fn func(e uint32)) {
+	key, width := h.substring(q, i)
+	t := h.tables[i]
+	if r > width {
+		return
+	}
+	if r == 0 {
+		for _, e := range t[key] {
+			fn(e)
+		}
+		return
+	}
+	// every width-bit mask with r bits set, in increasing order
+	for mask := uint32(1)<<r - 1; mask < 1<<width; {
+		for _, e := range t[key^uint16(mask)] {
+			fn(e)
+		}
+		c := mask & -mask
+		n := mask + c
+		mask = ((n ^ mask) >> 2 / c) | n
+	}
+}
+
+func compareResults(a, b HammingResult) int {
+	if c := cmp.Compare(a.Distance, b.Distance); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.ID, b.ID)
+}
+
+// returns every fingerprint within distance r of query, nearest first, ties
+// by id
+func (h *HammingIndex) RadiusSearch(query *BitBuffer, r uint) []HammingResult {
+	q := h.fingerprint(query)
+	var res []HammingResult
+	check := func(e uint32) {
+		if d := hammingWords(q, h.entryWords(e)); d <= r {
+			res = append(res, HammingResult{h.ids[e], d})
+		}
+	}
+
+	sub_r := r / uint(len(h.tables))
+	if h.scanIsCheaper(sub_r) {
+		for e := range h.ids {
+			check(uint32(e))
+		}
+	} else {
+		seen := NewBitBuffer(uint(len(h.ids)+7) / 8)
+		for i := range h.tables {
+			for d := uint(0); d <= sub_r; d++ {
+				h.probe(q, uint(i), d, func(e uint32) {
+					if !seen.IsSet(uint(e)) {
+						seen.Set(uint(e))
+						check(e)
+					}
+				})
+			}
+		}
+	}
+	slices.SortFunc(res, compareResults)
+	return res
+}
+
+// returns the k fingerprints nearest to query, nearest first, ties by id
+// probes substrings at growing radius until no fingerprint left unseen can
+// be nearer than the k found
+func (h *HammingIndex) Search(query *BitBuffer, k int) []HammingResult {
+	if k <= 0 || len(h.ids) == 0 {
+		return nil
+	}
+	k = min(k, len(h.ids))
+	q := h.fingerprint(query)
+	// the best k so far, sorted
+	best := make([]HammingResult, 0, k+1)
+	check := func(e uint32) {
+		r := HammingResult{h.ids[e], hammingWords(q, h.entryWords(e))}
+		if len(best) == k && compareResults(r, best[k-1]) > 0 {
+			return
+		}
+		i, _ := slices.BinarySearchFunc(best, r, compareResults)
+		best = slices.Insert(best, i, r)
+		if len(best) > k {
+			best = best[:k]
+		}
+	}
+
+	m := uint(len(h.tables))
+	seen := NewBitBuffer(uint(len(h.ids)+7) / 8)
+	for d := uint(0); ; d++ {
+		if h.scanIsCheaper(d) {
+			for e := range h.ids {
+				if !seen.IsSet(uint(e)) {
+					check(uint32(e))
+				}
+			}
+			break
+		}
+		for i := uint(0); i < m; i++ {
+			h.probe(q, i, d, func(e uint32) {
+				if !seen.IsSet(uint(e)) {
+					seen.Set(uint(e))
+					check(e)
+				}
+			})
+		}
+		// everything within m*(d+1)-1 has been seen, and everything once
+		// every substring value has been probed
+		if len(best) == k && best[k-1].Distance < m*(d+1) || d >= khammingSubBits {
+			break
+		}
+	}
+	return best
+}
+
+// encodes the index in its binary format
+func (h *HammingIndex) MarshalBinary() ([]byte, error) {
+	r := make([]byte, KHAMMING_HEADER_BYTES, KHAMMING_HEADER_BYTES+uint(len(h.ids))*(8+h.nwords*8))
+	copy(r, khammingMagic[:])
+	r[4] = KHAMMING_VERSION
+	binary.LittleEndian.PutUint64(r[8:], uint64(h.nbits))
+	binary.LittleEndian.PutUint64(r[16:], uint64(len(h.ids)))
+	for e, id := range h.ids {
+		r = binary.LittleEndian.AppendUint64(r, id)
+		for _, w := range h.entryWords(uint32(e)) {
+			r = binary.LittleEndian.AppendUint64(r, w)
+		}
+	}
+	return r, nil
+}
+
+// decodes the index from its binary format, replacing its contents
+func (h *HammingIndex) UnmarshalBinary(data []byte) error {
+	if uint(len(data)) < KHAMMING_HEADER_BYTES || [4]byte(data[:4]) != khammingMagic {
+		return ErrBadHammingIndex
+	}
+	if data[4] != KHAMMING_VERSION {
+		return fmt.Errorf("%w: unknown version %v", ErrBadHammingIndex, data[4])
+	}
+	nbits := binary.LittleEndian.Uint64(data[8:])
+	count := binary.LittleEndian.Uint64(data[16:])
+	body := uint64(len(data)) - uint64(KHAMMING_HEADER_BYTES)
+	if nbits == 0 || nbits > uint64(KHAMMING_MAX_BITS) {
+		return fmt.Errorf("%w: bad fingerprint width %v", ErrBadHammingIndex, nbits)
+	}
+	entry := 8 + (nbits+63)/64*8
+	if body%entry != 0 || body/entry != count {
+		return fmt.Errorf("%w: %v bytes for %v fingerprints", ErrBadHammingIndex, body, count)
+	}
+
+	r := NewHammingIndex(uint(nbits))
+	p := data[KHAMMING_HEADER_BYTES:]
+	fp := make([]uint64, r.nwords)
+	for ; len(p) > 0; p = p[entry:] {
+		for i := range fp {
+			fp[i] = binary.LittleEndian.Uint64(p[8+8*i:])
+		}
+		r.Add(binary.LittleEndian.Uint64(p), NewBitBuffer(0).FromUint64s(fp))
+	}
+	*h = *r
+	return nil
+}
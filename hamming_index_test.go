@@ -0,0 +1,244 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+func randomFingerprint(rnd *rand.Rand, nwords int) []uint64 {
+	w := make([]uint64, nwords)
+	for i := range w {
+		w[i] = rnd.Uint64()
+	}
+	return w
+}
+
+// flips n random bits of w
+func perturb(rnd *rand.Rand, w []uint64, n int) []uint64 {
+	r := slices.Clone(w)
+	for i := 0; i < n; i++ {
+		b := rnd.Intn(len(w) * 64)
+		r[b/64] ^= 1 << (b % 64)
+	}
+	return r
+}
+
+// builds an index of clusters of near fingerprints, returns it and the
+// fingerprints by id
+func clusteredIndex(rnd *rand.Rand, nbits uint, n int) (*HammingIndex, map[uint64]*BitBuffer) {
+	h := NewHammingIndex(nbits)
+	fps := map[uint64]*BitBuffer{}
+	nwords := int(nbits+63) / 64
+	var centre []uint64
+	for id := uint64(0); id < uint64(n); id++ {
+		if id%50 == 0 {
+			centre = randomFingerprint(rnd, nwords)
+		}
+		fp := NewBitBuffer(0).FromUint64s(perturb(rnd, centre, rnd.Intn(12)))
+		h.Add(id*7, fp)
+		fps[id*7] = fp
+	}
+	return h, fps
+}
+
+func naiveSearch(h *HammingIndex, fps map[uint64]*BitBuffer, q *BitBuffer) []HammingResult {
+	qw := h.fingerprint(q)
+	var r []HammingResult
+	for id, fp := range fps {
+		r = append(r, HammingResult{id, hammingWords(qw, h.fingerprint(fp))})
+	}
+	slices.SortFunc(r, compareResults)
+	return r
+}
+
+func TestHammingIndexSearch(t *testing.T) {
+	rnd := rand.New(rand.NewSource(44))
+	for _, tc := range []struct {
+		nbits uint
+		n     int
+	}{{256, 100}, {256, 5000}, {1024, 3000}, {200, 2500}} {
+		h, fps := clusteredIndex(rnd, tc.nbits, tc.n)
+		if h.Len() != tc.n {
+			t.Fatalf("Len %v, want %v", h.Len(), tc.n)
+		}
+		for i := 0; i < 30; i++ {
+			// queries near an entry, and far from everything
+			q := fps[uint64(rnd.Intn(tc.n))*7]
+			qw := perturb(rnd, h.fingerprint(q), rnd.Intn(6))
+			if i%10 == 9 {
+				qw = randomFingerprint(rnd, int(h.nwords))
+			}
+			q = NewBitBuffer(0).FromUint64s(qw)
+			want := naiveSearch(h, fps, q)
+
+			for _, k := range []int{1, 5, 40} {
+				got := h.Search(q, k)
+				if !slices.Equal(got, want[:k]) {
+					t.Fatalf("%v bits, %v entries: Search k=%v got %v, want %v", tc.nbits, tc.n, k, got, want[:k])
+				}
+			}
+			for _, r := range []uint{0, 4, 16, 40, 100} {
+				got := h.RadiusSearch(q, r)
+				n, _ := slices.BinarySearchFunc(want, HammingResult{^uint64(0), r}, compareResults)
+				if !slices.Equal(got, want[:n]) {
+					t.Fatalf("%v bits, %v entries: RadiusSearch r=%v got %v results, want %v", tc.nbits, tc.n, r, len(got), n)
+				}
+			}
+		}
+	}
+}
+
+func TestHammingIndexRemove(t *testing.T) {
+	rnd := rand.New(rand.NewSource(45))
+	h, fps := clusteredIndex(rnd, 256, 3000)
+	for id := range fps {
+		if rnd.Intn(3) == 0 {
+			if !h.Remove(id) {
+				t.Fatalf("Remove(%v) = false", id)
+			}
+			delete(fps, id)
+		}
+	}
+	// asking for more than there are gives them all
+	if got := h.Search(NewBitBuffer(32), h.Len()+10); len(got) != h.Len() {
+		t.Fatalf("Search for %v of %v got %v", h.Len()+10, h.Len(), len(got))
+	}
+	if h.Remove(1) {
+		t.Fatal("removed an id never added")
+	}
+	// replacing keeps one entry per id
+	for id := range fps {
+		fp := NewBitBuffer(0).FromUint64s(randomFingerprint(rnd, 4))
+		h.Add(id, fp)
+		fps[id] = fp
+		break
+	}
+	if h.Len() != len(fps) {
+		t.Fatalf("Len %v, want %v", h.Len(), len(fps))
+	}
+	for id, fp := range fps {
+		got := h.Search(fp, 1)
+		if len(got) != 1 || got[0].Distance != 0 {
+			t.Fatalf("Search for %v got %v", id, got)
+		}
+		if r := h.RadiusSearch(fp, 0); !slices.ContainsFunc(r, func(r HammingResult) bool { return r.ID == id }) {
+			t.Fatalf("RadiusSearch for %v got %v", id, r)
+		}
+	}
+	for id := range fps {
+		h.Remove(id)
+	}
+	if h.Len() != 0 || h.Search(NewBitBuffer(32), 3) != nil {
+		t.Fatal("index not empty after removing everything")
+	}
+	for _, t2 := range h.tables {
+		if len(t2) != 0 {
+			t.Fatal("buckets left after removing everything")
+		}
+	}
+}
+
+func TestHammingIndexShortFingerprints(t *testing.T) {
+	h := NewHammingIndex(100)
+	a := NewBitBuffer(8)
+	a.Set(3)
+	b := NewBitBuffer(32)
+	b.Set(3)
+	// bits past the width are ignored
+	b.Set(150)
+	h.Add(1, a)
+	if r := h.Search(b, 1); len(r) != 1 || r[0] != (HammingResult{1, 0}) {
+		t.Fatalf("got %v", r)
+	}
+}
+
+func TestHammingIndexMarshal(t *testing.T) {
+	rnd := rand.New(rand.NewSource(46))
+	h, fps := clusteredIndex(rnd, 320, 2000)
+	data, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[:4], []byte("MBHX")) || uint(len(data)) != KHAMMING_HEADER_BYTES+2000*(8+5*8) {
+		t.Fatalf("unexpected encoding of %v bytes", len(data))
+	}
+	var r HammingIndex
+	if err := r.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if r.Bits() != 320 || r.Len() != 2000 {
+		t.Fatalf("decoded %v fingerprints of %v bits", r.Len(), r.Bits())
+	}
+	for i := 0; i < 20; i++ {
+		q := fps[uint64(rnd.Intn(2000))*7]
+		if !slices.Equal(r.Search(q, 10), h.Search(q, 10)) {
+			t.Fatal("decoded index answers differently")
+		}
+	}
+
+	for _, bad := range [][]byte{nil, data[:10], data[:len(data)-1], append([]byte("XBHX"), data[4:]...)} {
+		if err := r.UnmarshalBinary(bad); !errors.Is(err, ErrBadHammingIndex) {
+			t.Fatalf("got %v, want ErrBadHammingIndex", err)
+		}
+	}
+	data[4] = 9
+	if err := r.UnmarshalBinary(data); !errors.Is(err, ErrBadHammingIndex) {
+		t.Fatalf("got %v, want ErrBadHammingIndex", err)
+	}
+
+	// an empty index claiming huge fingerprints is rejected before allocating
+	empty, _ := NewHammingIndex(64).MarshalBinary()
+	binary.LittleEndian.PutUint64(empty[8:], 1<<40)
+	if err := r.UnmarshalBinary(empty); !errors.Is(err, ErrBadHammingIndex) {
+		t.Fatalf("got %v, want ErrBadHammingIndex", err)
+	}
+}
+
+func BenchmarkHammingIndex(b *testing.B) {
+	rnd := rand.New(rand.NewSource(47))
+	h, fps := clusteredIndex(rnd, 256, 200000)
+	q := fps[7*1234]
+	b.Run("Search", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			h.Search(q, 10)
+		}
+	})
+	b.Run("Linear", func(b *testing.B) {
+		qw := h.fingerprint(q)
+		for i := 0; i < b.N; i++ {
+			for e := range h.ids {
+				hammingWords(qw, h.entryWords(uint32(e)))
+			}
+		}
+	})
+}
@@ -0,0 +1,349 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+)
+
+// 2D bitmaps are stored row by row: pixel (x, y) of an image width pixels
+// wide is bit y*stride + x, stride is width unless ImageLayout says
+// otherwise, bits in the canonical LSB first order unless ImageLayout asks
+// for MSB first, and set bits are black, as in netpbm
+// the height is however many rows LenBits() holds, rounded up, pixels past
+// LenBits() are white, padding bits between rows are ignored when reading a
+// buffer and left off when writing one
+
+// ImageLayout describes how rows are laid out in the buffer, the zero value
+// is rows of exactly width bits, LSB first
+type ImageLayout struct {
+	// bits from the start of one row to the next, at least the width, 0
+	// means the width, a multiple of 8 keeps every row byte aligned
+	Stride int
+	// bit 0 of each byte is the most significant one, the order of P4 and
+	// most 1 bit framebuffers
+	MSBFirst bool
+}
+
+// netpbm bitmap formats
+type PBMFormat int
+
+const (
+	// P1, ASCII 0s and 1s
+	KPBM_PLAIN PBMFormat = iota
+	// P4, rows packed MSB first, each padded to whole bytes
+	KPBM_RAW
+)
+
+// returned when reading something that isn't a PBM image
+var ErrBadPBM = errors.New("mbits: malformed pbm image")
+
+// returned by ReadPBMWith when the layout's stride is narrower than the image
+var ErrBadStride = errors.New("mbits: stride narrower than image width")
+
+// largest width*height ReadPBM accepts
+const kpbmMaxPixels = math.MaxInt32
+
+// pixels per line of a P1 image, netpbm keeps lines within 70 characters
+const kpbmPlainLinePixels = 35
+
+var kimagePalette = color.Palette{color.White, color.Black}
+
+// returns the stride for images width pixels wide
+// panics on a width that isn't positive, or a stride narrower than it
+func (l ImageLayout) stride(width int) uint {
+	if width <= 0 {
+		panic(fmt.Sprintf("mbits: image width must be positive, got %v", width))
+	}
+	if l.Stride == 0 {
+		return uint(width)
+	}
+	if l.Stride < width {
+		panic(fmt.Errorf("%w: %v < %v", ErrBadStride, l.Stride, width))
+	}
+	return uint(l.Stride)
+}
+
+// index of the buffer bit holding the p-th bit of the layout
+func (l ImageLayout) bit(p uint) uint {
+	if l.MSBFirst {
+		return p ^ (KBITS_PER_BYTE - 1)
+	}
+	return p
+}
+
+// number of rows needed to hold the buffer, stride bits per row
+func (m *Bits[W]) imageRows(stride uint) int {
+	return int((m.LenBits() + stride - 1) / stride)
+}
+
+// renders the buffer as an image width pixels wide, as a copy, see above
+// for the layout, the image is a 2 color image.Paletted, white and black
+func (m *Bits[W]) ToImage(width int) image.Image {
+	return m.ToImageWith(width, ImageLayout{})
+}
+
+// ToImage() with rows laid out as l describes
+func (m *Bits[W]) ToImageWith(width int, l ImageLayout) image.Image {
+	stride := l.stride(width)
+	height := m.imageRows(stride)
+	img := image.NewPaletted(image.Rect(0, 0, width, height), kimagePalette)
+	len_bits := m.LenBits()
+	for y := 0; y < height; y++ {
+		base := uint(y) * stride
+		for x := 0; x < width && base+uint(x) < len_bits; x++ {
+			if m.IsSet(l.bit(base + uint(x))) {
+				img.Pix[y*img.Stride+x] = 1
+			}
+		}
+	}
+	return img
+}
+
+// loads the buffer from img, a pixel is set when its luminance is below
+// threshold, fully transparent pixels are never set
+// the buffer is resized to hold width*height bits, rounded up to bytes
+// internal buffer will be reset
+// returns pointer to self
+func (m *Bits[W]) FromImage(img image.Image, threshold uint8) *Bits[W] {
+	return m.FromImageWith(img, threshold, ImageLayout{})
+}
+
+// FromImage() with rows laid out as l describes, the buffer holds
+// stride*height bits, rounded up to bytes
+// returns pointer to self
+func (m *Bits[W]) FromImageWith(img image.Image, threshold uint8, l ImageLayout) *Bits[W] {
+	r := img.Bounds()
+	width, height := r.Dx(), r.Dy()
+	stride := uint(width)
+	if width > 0 {
+		stride = l.stride(width)
+	}
+	len_bytes := (stride*uint(height) + KBITS_PER_BYTE - 1) / KBITS_PER_BYTE
+	if len_bytes == 0 {
+		// SetBufferLen() takes 0 for the default length, an empty image
+		// loads as an empty buffer
+		m.mustWrite()
+		m.resize(0)
+		return m
+	}
+	m.SetBufferLen(len_bytes)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		base := uint(y-r.Min.Y) * stride
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c := img.At(x, y)
+			if _, _, _, a := c.RGBA(); a != 0 && color.GrayModel.Convert(c).(color.Gray).Y < threshold {
+				m.Set(l.bit(base + uint(x-r.Min.X)))
+			}
+		}
+	}
+	return m
+}
+
+// writes the buffer as a PBM image width pixels wide in format
+func (m *Bits[W]) WritePBM(w io.Writer, width int, format PBMFormat) error {
+	return m.WritePBMWith(w, width, format, ImageLayout{})
+}
+
+// WritePBM() reading rows from the buffer as l describes, the PBM itself is
+// always packed as the format says
+func (m *Bits[W]) WritePBMWith(w io.Writer, width int, format PBMFormat, l ImageLayout) error {
+	stride := l.stride(width)
+	height := m.imageRows(stride)
+	bw := bufio.NewWriter(w)
+	magic := "P4"
+	if format == KPBM_PLAIN {
+		magic = "P1"
+	}
+	fmt.Fprintf(bw, "%s\n%d %d\n", magic, width, height)
+
+	len_bits := m.LenBits()
+	row := make([]byte, 0, max((width+7)/8, 2*width))
+	for y := 0; y < height; y++ {
+		row = row[:0]
+		base := uint(y) * stride
+		for x := 0; x < width; x++ {
+			p := base + uint(x)
+			on := p < len_bits && m.IsSet(l.bit(p))
+			switch {
+			case format == KPBM_PLAIN:
+				c, sep := byte('0'), byte(' ')
+				if on {
+					c = '1'
+				}
+				if (x+1)%kpbmPlainLinePixels == 0 || x == width-1 {
+					sep = '\n'
+				}
+				row = append(row, c, sep)
+			case x%8 == 0:
+				row = append(row, 0)
+				fallthrough
+			default:
+				if on {
+					row[len(row)-1] |= 0x80 >> (x % 8)
+				}
+			}
+		}
+		bw.Write(row)
+	}
+	return bw.Flush()
+}
+
+// reads a P1 or P4 image from r, replacing the contents
+// when r isn't an io.ByteReader it's buffered, and may be read past the end
+// of the image
+func (m *Bits[W]) ReadPBM(r io.Reader) (width, height int, err error) {
+	return m.ReadPBMWith(r, ImageLayout{})
+}
+
+// ReadPBM() laying rows out in the buffer as l describes, returns
+// ErrBadStride when l.Stride is set and narrower than the image
+func (m *Bits[W]) ReadPBMWith(r io.Reader, l ImageLayout) (width, height int, err error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	var magic [2]byte
+	for i := range magic {
+		if magic[i], err = br.ReadByte(); err != nil {
+			return 0, 0, pbmError(err)
+		}
+	}
+	if magic[0] != 'P' || (magic[1] != '1' && magic[1] != '4') {
+		return 0, 0, ErrBadPBM
+	}
+	if width, err = pbmInt(br); err != nil {
+		return 0, 0, err
+	}
+	if height, err = pbmInt(br); err != nil {
+		return 0, 0, err
+	}
+	if width == 0 || height == 0 || height > kpbmMaxPixels/width {
+		return 0, 0, fmt.Errorf("%w: bad size %vx%v", ErrBadPBM, width, height)
+	}
+	if l.Stride != 0 && l.Stride < width {
+		return 0, 0, fmt.Errorf("%w: %v < %v", ErrBadStride, l.Stride, width)
+	}
+	stride := l.stride(width)
+
+	m.SetBufferLen((stride*uint(height) + KBITS_PER_BYTE - 1) / KBITS_PER_BYTE)
+	if magic[1] == '1' {
+		for y := 0; y < height; y++ {
+			base := uint(y) * stride
+			for x := 0; x < width; x++ {
+				c, err := pbmSkip(br)
+				if err != nil {
+					return 0, 0, pbmError(err)
+				}
+				switch c {
+				case '1':
+					m.Set(l.bit(base + uint(x)))
+				case '0':
+				default:
+					return 0, 0, fmt.Errorf("%w: unexpected %q", ErrBadPBM, c)
+				}
+			}
+		}
+		return width, height, nil
+	}
+
+	for y := 0; y < height; y++ {
+		base := uint(y) * stride
+		var c byte
+		for x := 0; x < width; x++ {
+			if x%8 == 0 {
+				if c, err = br.ReadByte(); err != nil {
+					return 0, 0, pbmError(err)
+				}
+			}
+			if c&(0x80>>(x%8)) != 0 {
+				m.Set(l.bit(base + uint(x)))
+			}
+		}
+	}
+	return width, height, nil
+}
+
+// reads the next byte that isn't whitespace or part of a comment
+func pbmSkip(br io.ByteReader) (byte, error) {
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch c {
+		case ' ', '\t', '\n', '\v', '\f', '\r':
+		case '#':
+			for c != '\n' && c != '\r' {
+				if c, err = br.ReadByte(); err != nil {
+					return 0, err
+				}
+			}
+		default:
+			return c, nil
+		}
+	}
+}
+
+// reads a header number, and the single whitespace ending it
+func pbmInt(br io.ByteReader) (int, error) {
+	c, err := pbmSkip(br)
+	if err != nil {
+		return 0, pbmError(err)
+	}
+	n := 0
+	for {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("%w: unexpected %q", ErrBadPBM, c)
+		}
+		n = n*10 + int(c-'0')
+		if n > kpbmMaxPixels {
+			return 0, fmt.Errorf("%w: size too large", ErrBadPBM)
+		}
+		if c, err = br.ReadByte(); err != nil {
+			return 0, pbmError(err)
+		}
+		switch c {
+		case ' ', '\t', '\n', '\v', '\f', '\r':
+			return n, nil
+		}
+	}
+}
+
+func pbmError(err error) error {
+	if err == io.EOF {
+		return fmt.Errorf("%w: %w", ErrBadPBM, io.ErrUnexpectedEOF)
+	}
+	return err
+}
@@ -0,0 +1,236 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// 8x3 glyph of an arrow, plus a pixel in the last row
+func testGlyph() *BitBuffer {
+	b := NewBitBuffer(3)
+	for _, i := range []uint{2, 8, 9, 10, 11, 12, 13, 14, 18, 23} {
+		b.Set(i)
+	}
+	return b
+}
+
+func TestImageRoundTripPNG(t *testing.T) {
+	b := testGlyph()
+	img := b.ToImage(8)
+	if r := img.Bounds(); r.Dx() != 8 || r.Dy() != 3 {
+		t.Fatalf("bounds %v", r)
+	}
+	if img.At(2, 0) != color.Black || img.At(3, 0) != color.White || img.At(7, 2) != color.Black {
+		t.Errorf("pixels don't follow the layout")
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := NewBitBuffer(0).FromImage(decoded, 128)
+	if got.CmpWith(b) != 0 {
+		t.Errorf("got %s, want %s", got, b)
+	}
+
+	// rows past LenBits() are white, widths that don't divide it round up
+	img = b.ToImage(5)
+	if r := img.Bounds(); r.Dx() != 5 || r.Dy() != 5 {
+		t.Errorf("bounds %v", r)
+	}
+}
+
+func TestFromImageThreshold(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(10, 10, 13, 11))
+	img.Set(10, 10, color.Gray{Y: 40})
+	img.Set(11, 10, color.Gray{Y: 200})
+	img.Set(12, 10, color.NRGBA{})
+	b := NewBitBuffer(0).FromImage(img, 100)
+	if b.LenBytes() != 1 || !b.IsSet(0) || b.IsSet(1) || b.IsSet(2) {
+		t.Errorf("got %s", b)
+	}
+	if b = NewBitBuffer(0).FromImage(img, 255); !b.IsSet(1) || b.IsSet(2) {
+		t.Errorf("got %s", b)
+	}
+}
+
+func TestImageEmpty(t *testing.T) {
+	for _, r := range []image.Rectangle{image.Rect(0, 0, 0, 0), image.Rect(0, 0, 5, 0), image.Rect(0, 0, 0, 5)} {
+		b := testGlyph().FromImage(image.NewGray(r), 128)
+		if b.LenBytes() != 0 || b.CountBitsOn() != 0 {
+			t.Errorf("%v: got %s", r, b)
+		}
+		if img := b.ToImage(8); !img.Bounds().Empty() {
+			t.Errorf("%v: rendered as %v", r, img.Bounds())
+		}
+	}
+}
+
+func TestImageLayout(t *testing.T) {
+	// a 5x3 glyph in rows padded to bytes, MSB first as font bitmaps are,
+	// with the padding of the last row set
+	l := ImageLayout{Stride: 8, MSBFirst: true}
+	b := NewBitBuffer(0).LoadBuffer([]byte{0xa8, 0x70, 0xff})
+	want := []byte{0xa8, 0x70, 0xf8}
+
+	img := b.ToImageWith(5, l)
+	if r := img.Bounds(); r.Dx() != 5 || r.Dy() != 3 {
+		t.Fatalf("bounds %v", r)
+	}
+	if img.At(0, 0) != color.Black || img.At(1, 0) != color.White || img.At(0, 1) != color.White || img.At(4, 2) != color.Black {
+		t.Errorf("pixels don't follow the layout")
+	}
+
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	decoded, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := NewBitBuffer(0).FromImageWith(decoded, 128, l); !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("FromImageWith got %x, want %x", got.Bytes(), want)
+	}
+	// the same rows LSB first
+	if got := NewBitBuffer(0).FromImageWith(decoded, 128, ImageLayout{Stride: 8}); !bytes.Equal(got.Bytes(), []byte{0x15, 0x0e, 0x1f}) {
+		t.Errorf("FromImageWith LSB got %x", got.Bytes())
+	}
+
+	buf.Reset()
+	if err := b.WritePBMWith(&buf, 5, KPBM_PLAIN, l); err != nil {
+		t.Fatal(err)
+	}
+	if want := "P1\n5 3\n1 0 1 0 1\n0 1 1 1 0\n1 1 1 1 1\n"; buf.String() != want {
+		t.Errorf("P1 got %q, want %q", buf.String(), want)
+	}
+	for _, format := range []PBMFormat{KPBM_PLAIN, KPBM_RAW} {
+		buf.Reset()
+		b.WritePBMWith(&buf, 5, format, l)
+		got := NewBitBuffer(0)
+		if w, h, err := got.ReadPBMWith(&buf, l); err != nil || w != 5 || h != 3 || !bytes.Equal(got.Bytes(), want) {
+			t.Errorf("format %v: got %vx%v %x, %v", format, w, h, got.Bytes(), err)
+		}
+	}
+
+	if _, _, err := NewBitBuffer(0).ReadPBMWith(strings.NewReader("P1\n5 1\n10101"), ImageLayout{Stride: 4}); !errors.Is(err, ErrBadStride) {
+		t.Errorf("Expected ErrBadStride, found %v", err)
+	}
+	defer func() {
+		if r, _ := recover().(error); !errors.Is(r, ErrBadStride) {
+			t.Fatalf("Expected ErrBadStride panic, found %v", r)
+		}
+	}()
+	b.ToImageWith(5, ImageLayout{Stride: 4})
+}
+
+func TestPBM(t *testing.T) {
+	b := testGlyph()
+
+	var buf bytes.Buffer
+	if err := b.WritePBM(&buf, 8, KPBM_PLAIN); err != nil {
+		t.Fatal(err)
+	}
+	want := "P1\n8 3\n0 0 1 0 0 0 0 0\n1 1 1 1 1 1 1 0\n0 0 1 0 0 0 0 1\n"
+	if buf.String() != want {
+		t.Errorf("P1 got %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	if err := b.WritePBM(&buf, 8, KPBM_RAW); err != nil {
+		t.Fatal(err)
+	}
+	if want := "P4\n8 3\n\x20\xfe\x21"; buf.String() != want {
+		t.Errorf("P4 got %q, want %q", buf.String(), want)
+	}
+
+	// rows padded to whole bytes
+	buf.Reset()
+	if err := b.WritePBM(&buf, 12, KPBM_RAW); err != nil {
+		t.Fatal(err)
+	}
+	if want := "P4\n12 2\n\x20\xf0\xe2\x10"; buf.String() != want {
+		t.Errorf("P4 got %q, want %q", buf.String(), want)
+	}
+
+	for _, format := range []PBMFormat{KPBM_PLAIN, KPBM_RAW} {
+		for _, width := range []int{1, 5, 8, 12, 24, 35, 36, 100} {
+			buf.Reset()
+			if err := b.WritePBM(&buf, width, format); err != nil {
+				t.Fatal(err)
+			}
+			if format == KPBM_PLAIN {
+				// netpbm's limit
+				for _, line := range strings.Split(buf.String(), "\n") {
+					if len(line) > 70 {
+						t.Errorf("width %v: line of %v characters", width, len(line))
+					}
+				}
+			}
+			got := NewBitBuffer(0)
+			w, h, err := got.ReadPBM(&buf)
+			if err != nil {
+				t.Fatalf("format %v width %v: %v", format, width, err)
+			}
+			if w != width || h != b.imageRows(uint(width)) {
+				t.Errorf("got %vx%v", w, h)
+			}
+			if got.CountBitsOn() != b.CountBitsOn() || got.Clone().Xor(b).CountBitsOn() != 0 {
+				t.Errorf("format %v width %v: got %s, want %s", format, width, got, b)
+			}
+		}
+	}
+}
+
+func TestReadPBMSyntax(t *testing.T) {
+	got := NewBitBuffer(0)
+	w, h, err := got.ReadPBM(strings.NewReader("P1\n# a comment\n3 # width\n2\n101\n  0 1\n0\n"))
+	if err != nil || w != 3 || h != 2 {
+		t.Fatalf("got %vx%v %v", w, h, err)
+	}
+	if got.String() != "10101000" {
+		t.Errorf("got %s", got)
+	}
+
+	for _, bad := range []string{
+		"", "P2\n1 1\n0", "P1\n0 1\n", "P1\n-1 1\n", "P1\n2 1\n1", "P1\n1 1\n2",
+		"P4\n8 2\n\x00", "P1\n99999999999 1\n",
+	} {
+		if _, _, err := NewBitBuffer(0).ReadPBM(strings.NewReader(bad)); !errors.Is(err, ErrBadPBM) {
+			t.Errorf("%q: got %v", bad, err)
+		}
+	}
+}
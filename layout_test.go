@@ -0,0 +1,193 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+)
+
+// these tests must pass unchanged under GOARCH=386 and GOARCH=amd64
+
+func TestLayoutCanonicalBytes(t *testing.T) {
+	b := NewBitBuffer(3)
+	b.Set(0).
+		Set(9).
+		Set(23)
+
+	expected := []byte{0x01, 0x02, 0x80}
+	if !bytes.Equal(b.Bytes(), expected) {
+		t.Fatalf("Layout fail, expected %x, found %x", expected, b.Bytes())
+	}
+
+	s := "100000000100000000000001"
+	if b.String() != s {
+		t.Fatalf("String fail,\nexpected: %v\nfound: %v", s, b.String())
+	}
+}
+
+func TestLayoutGrowth(t *testing.T) {
+	b := NewBitBuffer(0)
+	if b.LenBytes() != KGROW_BYTES {
+		t.Fatalf("Expected %v bytes, found %v", KGROW_BYTES, b.LenBytes())
+	}
+
+	b.Set(64)
+	if b.LenBytes() != 2*KGROW_BYTES {
+		t.Fatalf("Expected %v bytes, found %v", 2*KGROW_BYTES, b.LenBytes())
+	}
+
+	b = NewBitBuffer(5)
+	b.Set(45)
+	if b.LenBytes() != KGROW_BYTES || b.CountBitsOn() != 1 {
+		t.Fatalf("Growth fail, %v bytes, %v bits on", b.LenBytes(), b.CountBitsOn())
+	}
+}
+
+func TestLayoutTailBitsOff(t *testing.T) {
+	b := NewBitBuffer(10)
+	b.SetOnAll()
+
+	on, off := b.CountBits()
+	if on != 80 || off != 0 {
+		t.Fatalf("SetOnAll fail, on: %v, off: %v", on, off)
+	}
+
+	b.LoadBuffer([]byte{0xff, 0xff, 0xff})
+	if b.CountBitsOn() != 24 {
+		t.Fatalf("LoadBuffer fail, %v bits on", b.CountBitsOn())
+	}
+}
+
+func TestLayoutUint64s(t *testing.T) {
+	words := []uint64{0x8000000000000001, 0x00000000ffff0000}
+	b := NewBitBuffer(0).FromUint64s(words)
+
+	raw := make([]byte, 16)
+	binary.LittleEndian.PutUint64(raw, words[0])
+	binary.LittleEndian.PutUint64(raw[8:], words[1])
+	if !bytes.Equal(b.Bytes(), raw) {
+		t.Fatalf("FromUint64s fail, expected %x, found %x", raw, b.Bytes())
+	}
+
+	if !b.IsSet(0) || !b.IsSet(63) || !b.IsSet(64+16) || b.IsSet(64) {
+		t.Fatal("FromUint64s bit order error")
+	}
+
+	r := b.ToUint64s()
+	if len(r) != 2 || r[0] != words[0] || r[1] != words[1] {
+		t.Fatalf("ToUint64s fail, expected %x, found %x", words, r)
+	}
+}
+
+func TestLayoutUint32s(t *testing.T) {
+	words := []uint32{0x80000001, 0x0000ff00, 0x00000010}
+	b := NewBitBuffer(0).FromUint32s(words)
+
+	if b.LenBytes() != 12 {
+		t.Fatalf("Expected 12 bytes, found %v", b.LenBytes())
+	}
+
+	raw := make([]byte, 12)
+	for i, w := range words {
+		binary.LittleEndian.PutUint32(raw[i*4:], w)
+	}
+	if !bytes.Equal(b.Bytes(), raw) {
+		t.Fatalf("FromUint32s fail, expected %x, found %x", raw, b.Bytes())
+	}
+
+	r := b.ToUint32s()
+	for i := range words {
+		if r[i] != words[i] {
+			t.Fatalf("ToUint32s fail, expected %x, found %x", words, r)
+		}
+	}
+
+	r64 := b.ToUint64s()
+	if len(r64) != 2 || r64[0] != 0x0000ff0080000001 || r64[1] != 0x10 {
+		t.Fatalf("ToUint64s fail, found %x", r64)
+	}
+}
+
+func TestLayoutCmpWith(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		x := make([]byte, 1+rnd.Intn(20))
+		y := make([]byte, 1+rnd.Intn(20))
+		rnd.Read(x)
+		rnd.Read(y)
+		if i%3 == 0 {
+			copy(y, x)
+		}
+
+		left := NewBitBuffer(0).LoadBuffer(x)
+		right := NewBitBuffer(0).LoadBuffer(y)
+		if left.CmpWith(right) != bytes.Compare(x, y) {
+			t.Fatalf("CmpWith fail for %x and %x", x, y)
+		}
+	}
+}
+
+func TestLayoutSimulatedBigEndian(t *testing.T) {
+	raw := []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x10}
+	b := NewBitBuffer(0).LoadBuffer(raw)
+	s := b.String()
+
+	// a big-endian host stores the same word values with the bytes reversed,
+	// reinterpreting that memory as bytes is what we must not depend upon
+	words := b.ToUint64s()
+	mem := make([]byte, 8*len(words))
+	for i, w := range words {
+		binary.BigEndian.PutUint64(mem[i*8:], w)
+	}
+	if bytes.Equal(mem[:len(raw)], raw) {
+		t.Fatal("Simulated big-endian memory should differ from canonical layout")
+	}
+
+	saved := nativeLittleEndian
+	nativeLittleEndian = false
+	defer func() { nativeLittleEndian = saved }()
+
+	if !bytes.Equal(b.Bytes(), raw) {
+		t.Fatalf("Bytes fail, expected %x, found %x", raw, b.Bytes())
+	}
+	if b.String() != s {
+		t.Fatal("String depends on host byte order")
+	}
+	if b.CmpWith(NewBitBuffer(0).LoadBuffer(raw)) != 0 {
+		t.Fatal("CmpWith depends on host byte order")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("MutableByteSlice should panic on big-endian hosts")
+		}
+	}()
+	b.MutableByteSlice()
+}
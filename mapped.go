@@ -0,0 +1,88 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// MapFlags control how OpenMappedBitBuffer opens a file
+type MapFlags uint
+
+const (
+	// open the file read-only, mutations panic with ErrReadOnly
+	KMAP_READ_ONLY MapFlags = 1 << iota
+	// msync the mapping before Close unmaps it
+	KMAP_SYNC_ON_CLOSE
+	// on Close, unmap the file and release its address range instead of
+	// replacing the mapping with zero pages, stale MutableByteSlice views
+	// then fault when touched
+	KMAP_UNMAP_ON_CLOSE
+)
+
+const (
+	// size of the header ahead of the words in a mapped file
+	KMAP_HEADER_BYTES = uint(64)
+	// file format version written in the header
+	KMAP_VERSION = uint32(1)
+)
+
+// returned when a file doesn't hold a valid header
+var ErrBadHeader = errors.New("mbits: not a mapped bit buffer file")
+
+// first bytes of every mapped file
+var kmapMagic = [8]byte{'M', 'B', 'I', 'T', 'S', 'M', 'A', 'P'}
+
+// header layout, all fields little-endian:
+//
+//	[0:8)   magic
+//	[8:12)  version
+//	[12:16) word size in bytes
+//	[16:24) length in bits
+//	[24:64) reserved, zero
+func encodeMapHeader(hdr []byte, len_bits uint) {
+	copy(hdr, kmapMagic[:])
+	binary.LittleEndian.PutUint32(hdr[8:], KMAP_VERSION)
+	binary.LittleEndian.PutUint32(hdr[12:], uint32(KSZ_U64))
+	binary.LittleEndian.PutUint64(hdr[16:], uint64(len_bits))
+}
+
+// returns the length in bits stored in the header
+func decodeMapHeader(hdr []byte) (uint, error) {
+	if uint(len(hdr)) < KMAP_HEADER_BYTES || [8]byte(hdr[:8]) != kmapMagic {
+		return 0, ErrBadHeader
+	}
+	if binary.LittleEndian.Uint32(hdr[8:]) != KMAP_VERSION || binary.LittleEndian.Uint32(hdr[12:]) != uint32(KSZ_U64) {
+		return 0, ErrBadHeader
+	}
+	len_bits := binary.LittleEndian.Uint64(hdr[16:])
+	if len_bits%uint64(KBITS_PER_BYTE) != 0 {
+		return 0, ErrBadHeader
+	}
+	return uint(len_bits), nil
+}
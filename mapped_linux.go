@@ -0,0 +1,160 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"encoding/binary"
+	"os"
+)
+
+// MappedBitBuffer is a BitBuffer living in a memory-mapped file that starts
+// with a KMAP_HEADER_BYTES header, the bits follow in canonical layout
+// the header length is updated as the buffer grows, Sync() makes everything
+// durable
+type MappedBitBuffer struct {
+	*BitBuffer
+	store *mappedStorage
+	flags MapFlags
+}
+
+// file storage that keeps the header's length up to date
+type mappedStorage struct {
+	*FileStorage[uint64]
+}
+
+func (s *mappedStorage) recordLenBytes(byte_len uint) {
+	if s.data != nil {
+		binary.LittleEndian.PutUint64(s.data[16:], uint64(byte_len*KBITS_PER_BYTE))
+	}
+}
+
+// opens or creates the file at path and maps it
+// a new file gets room for nbits bits (KGROW_BYTES if 0), an existing file
+// keeps its bits and grows to nbits if shorter, unless read-only
+func OpenMappedBitBuffer(path string, nbits uint, flags MapFlags) (*MappedBitBuffer, error) {
+	writable := flags&KMAP_READ_ONLY == 0
+	flag := os.O_RDONLY
+	if writable {
+		flag = os.O_RDWR | os.O_CREATE
+	}
+	f, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	m, err := openMapped(f, nbits, flags)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func openMapped(f *os.File, nbits uint, flags MapFlags) (*MappedBitBuffer, error) {
+	writable := flags&KMAP_READ_ONLY == 0
+	byte_len := (nbits + KBITS_PER_BYTE - 1) / KBITS_PER_BYTE
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() == 0 && writable {
+		// brand new file, the header goes in before the file is mapped
+		if byte_len == 0 {
+			byte_len = KGROW_BYTES
+		}
+		hdr := make([]byte, KMAP_HEADER_BYTES)
+		encodeMapHeader(hdr, byte_len*KBITS_PER_BYTE)
+		if _, err := f.WriteAt(hdr, 0); err != nil {
+			return nil, err
+		}
+		nwords := (byte_len + KSZ_U64 - 1) / KSZ_U64
+		if err := f.Truncate(int64(KMAP_HEADER_BYTES + nwords*KSZ_U64)); err != nil {
+			return nil, err
+		}
+	}
+
+	fs, err := newFileStorage[uint64](f, KMAP_HEADER_BYTES, writable)
+	if err != nil {
+		return nil, err
+	}
+	len_bits, err := decodeMapHeader(fs.data)
+	if err == nil && len_bits > fs.Len()*KSZ_U64*KBITS_PER_BYTE {
+		// the file was cut short
+		err = ErrBadHeader
+	}
+	if err != nil {
+		fs.munmap()
+		return nil, err
+	}
+
+	store := &mappedStorage{fs}
+	len_bytes := len_bits / KBITS_PER_BYTE
+	m := &MappedBitBuffer{store: store, flags: flags}
+	if writable {
+		// bits past the recorded length are leftovers from a shrink that
+		// didn't make it to disk, drop them
+		clear(fs.words[(len_bytes+KSZ_U64-1)/KSZ_U64:])
+		m.BitBuffer = newBitsWithStorage[uint64](store, len_bytes)
+		m.clearTail()
+		m.growTo(byte_len)
+	} else {
+		m.BitBuffer = newBitsWithStorage[uint64](store, len_bytes)
+	}
+	return m, nil
+}
+
+// returns the flags the buffer was opened with
+func (m *MappedBitBuffer) Flags() MapFlags {
+	return m.flags
+}
+
+// closes the file, syncing first with KMAP_SYNC_ON_CLOSE
+// outstanding MutableByteSlice views read zeros from then on and writing to
+// them no longer reaches the file, the address range they cover stays
+// reserved, opened with KMAP_UNMAP_ON_CLOSE it's released instead and
+// touching them faults
+// the buffer is empty afterwards and growing it panics with ErrClosed
+func (m *MappedBitBuffer) Close() error {
+	if m.store.file == nil {
+		return ErrClosed
+	}
+	var err error
+	if m.flags&KMAP_SYNC_ON_CLOSE != 0 && m.flags&KMAP_READ_ONLY == 0 {
+		err = m.store.Sync()
+	}
+	if m.flags&KMAP_UNMAP_ON_CLOSE == 0 {
+		if ierr := m.store.invalidate(); err == nil {
+			err = ierr
+		}
+	}
+	if cerr := m.store.FileStorage.Close(); err == nil {
+		err = cerr
+	}
+	m.buff = nil
+	m.byte_len = 0
+	return err
+}
@@ -0,0 +1,263 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMappedBitBufferReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mapped")
+
+	m, err := OpenMappedBitBuffer(path, 100, KMAP_SYNC_ON_CLOSE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.LenBits() != 104 {
+		t.Fatalf("Expected 104 bits, found %v", m.LenBits())
+	}
+	m.Set(1).
+		Set(99).
+		Set(500)
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = OpenMappedBitBuffer(path, 0, KMAP_READ_ONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if m.LenBits() != 512 || m.CountBitsOn() != 3 || !m.IsSet(500) {
+		t.Fatalf("Reopen fail, %v bits, %v on", m.LenBits(), m.CountBitsOn())
+	}
+}
+
+func TestMappedBitBufferGrowOnOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mapped")
+
+	m, err := OpenMappedBitBuffer(path, 8, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Set(3)
+	m.Close()
+
+	m, err = OpenMappedBitBuffer(path, 1<<16, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if m.LenBits() != 1<<16 || !m.IsSet(3) {
+		t.Fatalf("Grow on open fail, %v bits", m.LenBits())
+	}
+}
+
+func TestMappedBitBufferReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mapped")
+
+	if _, err := OpenMappedBitBuffer(path, 8, KMAP_READ_ONLY); err == nil {
+		t.Fatal("Opening a missing file read-only should fail")
+	}
+
+	m, err := OpenMappedBitBuffer(path, 8, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+
+	m, err = OpenMappedBitBuffer(path, 0, KMAP_READ_ONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if !m.ReadOnly() {
+		t.Fatal("Expected a read-only buffer")
+	}
+
+	defer func() {
+		if r := recover(); r != ErrReadOnly {
+			t.Fatalf("Expected ErrReadOnly panic, found %v", r)
+		}
+	}()
+	m.Set(0)
+}
+
+func TestMappedBitBufferBadHeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "garbage")
+	if err := os.WriteFile(path, make([]byte, 128), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenMappedBitBuffer(path, 0, 0); err != ErrBadHeader {
+		t.Fatalf("Expected ErrBadHeader, found %v", err)
+	}
+}
+
+func TestMappedBitBufferCloseInvalidatesViews(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mapped")
+
+	// the default, without KMAP_UNMAP_ON_CLOSE
+	m, err := OpenMappedBitBuffer(path, 64, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Set(0)
+	view := m.MutableByteSlice()
+	if view[0] != 0x01 {
+		t.Fatalf("View fail, %x", view)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != ErrClosed {
+		t.Fatalf("Expected ErrClosed, found %v", err)
+	}
+
+	// must neither fault nor reach the file
+	view[1] = 0xff
+	if view[0] != 0 || view[1] != 0xff {
+		t.Fatalf("Stale view fail, %x", view)
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw[KMAP_HEADER_BYTES] != 0x01 || raw[KMAP_HEADER_BYTES+1] != 0 {
+		t.Fatalf("File fail, %x", raw[KMAP_HEADER_BYTES:])
+	}
+
+	if m.LenBits() != 0 || m.IsSet(0) {
+		t.Fatal("Closed buffer should be empty")
+	}
+	defer func() {
+		if r := recover(); r != ErrClosed {
+			t.Fatalf("Expected ErrClosed panic, found %v", r)
+		}
+	}()
+	m.Set(0)
+}
+
+func TestMappedBitBufferUnmapOnClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mapped")
+
+	m, err := OpenMappedBitBuffer(path, 64, KMAP_UNMAP_ON_CLOSE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Set(3)
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m, err = OpenMappedBitBuffer(path, 0, KMAP_READ_ONLY|KMAP_UNMAP_ON_CLOSE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.IsSet(3) {
+		t.Fatal("Reopen fail")
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sets bits 0, 1, 2, ... growing the file as it goes, syncing every so often
+// and reporting the number of synced bits on stdout, until killed
+func TestMappedBitBufferCrashWriter(t *testing.T) {
+	path := os.Getenv("MBITS_CRASH_PATH")
+	if path == "" {
+		t.Skip("helper process for TestMappedBitBufferCrashConsistency")
+	}
+	m, err := OpenMappedBitBuffer(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint(0); i < 1<<24; i++ {
+		m.Set(i)
+		if i%512 == 511 {
+			if err := m.Sync(); err != nil {
+				t.Fatal(err)
+			}
+			fmt.Printf("synced %v\n", i+1)
+		}
+	}
+}
+
+func TestMappedBitBufferCrashConsistency(t *testing.T) {
+	if testing.Short() {
+		t.Skip("spawns writer processes")
+	}
+	for _, kill_after := range []uint{512, 4096, 20480} {
+		path := filepath.Join(t.TempDir(), "crash")
+
+		cmd := exec.Command(os.Args[0], "-test.run=^TestMappedBitBufferCrashWriter$")
+		cmd.Env = append(os.Environ(), "MBITS_CRASH_PATH="+path)
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		synced := uint(0)
+		scanner := bufio.NewScanner(out)
+		for synced < kill_after && scanner.Scan() {
+			if n, ok := strings.CutPrefix(scanner.Text(), "synced "); ok {
+				v, _ := strconv.ParseUint(n, 10, 64)
+				synced = uint(v)
+			}
+		}
+		// mid-update, likely while growing the file
+		cmd.Process.Kill()
+		cmd.Wait()
+		if synced < kill_after {
+			t.Fatalf("Writer died early after %v bits", synced)
+		}
+
+		m, err := OpenMappedBitBuffer(path, 0, KMAP_READ_ONLY)
+		if err != nil {
+			t.Fatalf("Reopen after crash fail, %v", err)
+		}
+		on := m.CountBitsOn()
+		if on < synced || on > m.LenBits() {
+			t.Fatalf("Lost bits, %v synced, %v on, %v long", synced, on, m.LenBits())
+		}
+		// the writer went in order, so the on bits must be a prefix
+		if on > 0 && (!m.IsSet(on-1) || m.IsSet(on)) {
+			t.Fatalf("Bits not a prefix, %v on", on)
+		}
+		m.Close()
+	}
+}
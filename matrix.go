@@ -0,0 +1,371 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// BitMatrix is a dense rows x cols matrix of bits
+// each row starts on a 64-bit word boundary, so rows can be viewed as
+// BitBuffers and combined a word at a time, bits past Cols() in a row are
+// always zero
+type BitMatrix struct {
+	rows, cols uint
+	// words per row
+	stride uint
+	// rows*stride words, row i at word i*stride
+	words []uint64
+}
+
+// binary format, all fields little-endian:
+//
+//	[0:4)    magic "MBMX"
+//	[4]      version
+//	[5:8)    reserved, zero
+//	[8:16)   rows
+//	[16:24)  cols
+//	[24:)    the bits row after row, bit (i, j) at index i*cols + j, as a
+//	         BitBuffer in the binary format
+//
+// so the flat buffer can be read on its own with BitBuffer.UnmarshalBinary
+const (
+	// size of the header ahead of the flat buffer
+	KMATRIX_HEADER_BYTES = uint(24)
+	// format version written in the header
+	KMATRIX_VERSION = byte(1)
+)
+
+// returned when decoding something that isn't a serialized BitMatrix
+var ErrBadMatrix = errors.New("mbits: not a serialized bit matrix")
+
+// rows are made of 64-bit words on every platform
+const kmatrixWordBits = KSZ_U64 * KBITS_PER_BYTE
+
+// first bytes of every serialized matrix
+var kmatrixMagic = [4]byte{'M', 'B', 'M', 'X'}
+
+// storage over a fixed slice of words, such as a matrix row
+type fixedStorage struct {
+	words []uint64
+}
+
+// returned when growing a view past the words it covers
+var errFixedStorage = errors.New("mbits: can't grow a fixed size view")
+
+func (s *fixedStorage) Words() []uint64 {
+	return s.words
+}
+
+func (s *fixedStorage) Len() uint {
+	return uint(len(s.words))
+}
+
+func (s *fixedStorage) Grow(nwords uint) error {
+	if nwords > uint(len(s.words)) {
+		return errFixedStorage
+	}
+	return nil
+}
+
+func (s *fixedStorage) Sync() error {
+	return nil
+}
+
+// constructs a zero matrix and returns pointer to instance
+func NewBitMatrix(rows, cols uint) *BitMatrix {
+	stride := (cols + kmatrixWordBits - 1) / kmatrixWordBits
+	return &BitMatrix{rows: rows, cols: cols, stride: stride, words: make([]uint64, rows*stride)}
+}
+
+// constructs a matrix from a flat buffer holding bit (i, j) at index
+// i*cols + j, bits past rows*cols are ignored
+func NewBitMatrixFrom(b *BitBuffer, rows, cols uint) *BitMatrix {
+	m := NewBitMatrix(rows, cols)
+	n := min(rows*cols, b.LenBits())
+	for k := uint(0); k < n; k++ {
+		if b.IsSet(k) {
+			m.Set(k/cols, k%cols)
+		}
+	}
+	return m
+}
+
+// number of rows
+func (m *BitMatrix) Rows() uint {
+	return m.rows
+}
+
+// number of columns
+func (m *BitMatrix) Cols() uint {
+	return m.cols
+}
+
+// panics if (i, j) is outside the matrix
+func (m *BitMatrix) check(i, j uint) {
+	m.checkRow(i)
+	m.checkCol(j)
+}
+
+// panics if i isn't a row of the matrix
+func (m *BitMatrix) checkRow(i uint) {
+	if i >= m.rows {
+		panic(fmt.Sprintf("mbits: row %v out of range for %vx%v matrix", i, m.rows, m.cols))
+	}
+}
+
+// panics if j isn't a column of the matrix
+func (m *BitMatrix) checkCol(j uint) {
+	if j >= m.cols {
+		panic(fmt.Sprintf("mbits: column %v out of range for %vx%v matrix", j, m.rows, m.cols))
+	}
+}
+
+// panics if other isn't the same shape
+func (m *BitMatrix) checkShape(other *BitMatrix) {
+	if m.rows != other.rows || m.cols != other.cols {
+		panic(fmt.Sprintf("mbits: %vx%v matrix combined with %vx%v", m.rows, m.cols, other.rows, other.cols))
+	}
+}
+
+// returns true if bit (i, j) is set
+func (m *BitMatrix) Get(i, j uint) bool {
+	m.check(i, j)
+	return m.words[i*m.stride+j/kmatrixWordBits]&(1<<(j%kmatrixWordBits)) != 0
+}
+
+// turn bit (i, j) on
+// returns pointer to self
+func (m *BitMatrix) Set(i, j uint) *BitMatrix {
+	m.check(i, j)
+	m.words[i*m.stride+j/kmatrixWordBits] |= 1 << (j % kmatrixWordBits)
+	return m
+}
+
+// set bit (i, j) off
+// returns pointer to self
+func (m *BitMatrix) Clear(i, j uint) *BitMatrix {
+	m.check(i, j)
+	m.words[i*m.stride+j/kmatrixWordBits] &^= 1 << (j % kmatrixWordBits)
+	return m
+}
+
+// words of row i
+func (m *BitMatrix) rowWords(i uint) []uint64 {
+	return m.words[i*m.stride : (i+1)*m.stride : (i+1)*m.stride]
+}
+
+// returns row i as a BitBuffer sharing the matrix's memory, changes through
+// either show in the other, its length is Cols() rounded up to whole bytes
+// the view can't grow, setting bits past its words panics, and bits at
+// Cols() and beyond must be left off
+func (m *BitMatrix) Row(i uint) *BitBuffer {
+	m.checkRow(i)
+	byte_len := (m.cols + KBITS_PER_BYTE - 1) / KBITS_PER_BYTE
+	return newBitsWithStorage[uint64](&fixedStorage{words: m.rowWords(i)}, byte_len)
+}
+
+// returns a copy of column j, Rows() bits long rounded up to whole bytes
+func (m *BitMatrix) Col(j uint) *BitBuffer {
+	m.checkCol(j)
+	r := NewBitBuffer((m.rows + KBITS_PER_BYTE - 1) / KBITS_PER_BYTE)
+	w, mask := j/kmatrixWordBits, uint64(1)<<(j%kmatrixWordBits)
+	for i := uint(0); i < m.rows; i++ {
+		if m.words[i*m.stride+w]&mask != 0 {
+			r.Set(i)
+		}
+	}
+	return r
+}
+
+// (this) = (this) AND (other), both must be the same shape
+// returns pointer to self
+func (m *BitMatrix) And(other *BitMatrix) *BitMatrix {
+	m.checkShape(other)
+	for k, w := range other.words {
+		m.words[k] &= w
+	}
+	return m
+}
+
+// (this) = (this) OR (other), both must be the same shape
+// returns pointer to self
+func (m *BitMatrix) Or(other *BitMatrix) *BitMatrix {
+	m.checkShape(other)
+	for k, w := range other.words {
+		m.words[k] |= w
+	}
+	return m
+}
+
+// number of set bits in row i
+func (m *BitMatrix) CountRow(i uint) uint {
+	m.checkRow(i)
+	n := 0
+	for _, w := range m.rowWords(i) {
+		n += bits.OnesCount64(w)
+	}
+	return uint(n)
+}
+
+// number of set bits in column j
+func (m *BitMatrix) CountCol(j uint) uint {
+	m.checkCol(j)
+	n := uint(0)
+	w, shift := j/kmatrixWordBits, j%kmatrixWordBits
+	for i := uint(0); i < m.rows; i++ {
+		n += uint(m.words[i*m.stride+w]>>shift) & 1
+	}
+	return n
+}
+
+// number of set bits of every row
+func (m *BitMatrix) RowCounts() []uint {
+	r := make([]uint, m.rows)
+	for i := range r {
+		r[i] = m.CountRow(uint(i))
+	}
+	return r
+}
+
+// number of set bits of every column, in one pass over the matrix
+func (m *BitMatrix) ColCounts() []uint {
+	r := make([]uint, m.cols)
+	for i := uint(0); i < m.rows; i++ {
+		for k, w := range m.rowWords(i) {
+			for ; w != 0; w &= w - 1 {
+				r[uint(k)*kmatrixWordBits+uint(bits.TrailingZeros64(w))]++
+			}
+		}
+	}
+	return r
+}
+
+// number of set and unset bits in the whole matrix
+func (m *BitMatrix) CountBits() (on uint, off uint) {
+	for _, w := range m.words {
+		on += uint(bits.OnesCount64(w))
+	}
+	return on, m.rows*m.cols - on
+}
+
+// returns a copy of (this)
+func (m *BitMatrix) Clone() *BitMatrix {
+	r := *m
+	r.words = append([]uint64(nil), m.words...)
+	return &r
+}
+
+// returns the cols x rows transpose, a 64x64 block at a time
+func (m *BitMatrix) Transpose() *BitMatrix {
+	t := NewBitMatrix(m.cols, m.rows)
+	var block [64]uint64
+	for bi := uint(0); bi < m.rows; bi += kmatrixWordBits {
+		for bj := uint(0); bj < m.stride; bj++ {
+			// rows bi.. of word column bj, zero past the last row
+			n := min(kmatrixWordBits, m.rows-bi)
+			for k := uint(0); k < n; k++ {
+				block[k] = m.words[(bi+k)*m.stride+bj]
+			}
+			clear(block[n:])
+			transpose64(&block)
+			// word k is now column bj*64+k, bits are rows bi..
+			cols := min(kmatrixWordBits, m.cols-bj*kmatrixWordBits)
+			for k := uint(0); k < cols; k++ {
+				t.words[(bj*kmatrixWordBits+k)*t.stride+bi/kmatrixWordBits] = block[k]
+			}
+		}
+	}
+	return t
+}
+
+// transposes a 64x64 block in place, bit j of word i swaps with bit i of
+// word j, by swapping off-diagonal blocks of halving size
+func transpose64(a *[64]uint64) {
+	mask := uint64(0x00000000ffffffff)
+	for j := uint(32); j != 0; j >>= 1 {
+		for k := uint(0); k < 64; k = (k + j + 1) &^ j {
+			t := (a[k]>>j ^ a[k+j]) & mask
+			a[k] ^= t << j
+			a[k+j] ^= t
+		}
+		mask ^= mask << (j >> 1)
+	}
+}
+
+// returns the bits as a flat buffer, bit (i, j) at index i*cols + j
+func (m *BitMatrix) Flatten() *BitBuffer {
+	r := NewBitBuffer((m.rows*m.cols + KBITS_PER_BYTE - 1) / KBITS_PER_BYTE)
+	for i := uint(0); i < m.rows; i++ {
+		for k, w := range m.rowWords(i) {
+			for ; w != 0; w &= w - 1 {
+				r.Set(i*m.cols + uint(k)*kmatrixWordBits + uint(bits.TrailingZeros64(w)))
+			}
+		}
+	}
+	return r
+}
+
+// encodes the matrix in its binary format
+func (m *BitMatrix) MarshalBinary() ([]byte, error) {
+	flat, err := m.Flatten().MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	r := make([]byte, KMATRIX_HEADER_BYTES, KMATRIX_HEADER_BYTES+uint(len(flat)))
+	copy(r, kmatrixMagic[:])
+	r[4] = KMATRIX_VERSION
+	binary.LittleEndian.PutUint64(r[8:], uint64(m.rows))
+	binary.LittleEndian.PutUint64(r[16:], uint64(m.cols))
+	return append(r, flat...), nil
+}
+
+// decodes the matrix from its binary format, replacing its contents
+func (m *BitMatrix) UnmarshalBinary(data []byte) error {
+	if uint(len(data)) < KMATRIX_HEADER_BYTES || [4]byte(data[:4]) != kmatrixMagic {
+		return ErrBadMatrix
+	}
+	if data[4] != KMATRIX_VERSION {
+		return fmt.Errorf("%w: unknown version %v", ErrBadMatrix, data[4])
+	}
+	rows := binary.LittleEndian.Uint64(data[8:])
+	cols := binary.LittleEndian.Uint64(data[16:])
+	flat := NewBitBuffer(0)
+	if err := flat.UnmarshalBinary(data[KMATRIX_HEADER_BYTES:]); err != nil {
+		return err
+	}
+	// the flat buffer bounds the size, so a bad header can't cause a huge
+	// allocation
+	if cols != 0 && rows > uint64(flat.LenBits())/cols {
+		return fmt.Errorf("%w: %vx%v doesn't fit in %v bits", ErrBadMatrix, rows, cols, flat.LenBits())
+	}
+	*m = *NewBitMatrixFrom(flat, uint(rows), uint(cols))
+	return nil
+}
@@ -0,0 +1,208 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func randomMatrix(rng *rand.Rand, rows, cols uint, density float64) *BitMatrix {
+	m := NewBitMatrix(rows, cols)
+	for i := uint(0); i < rows; i++ {
+		for j := uint(0); j < cols; j++ {
+			if rng.Float64() < density {
+				m.Set(i, j)
+			}
+		}
+	}
+	return m
+}
+
+func matrixEqual(a, b *BitMatrix) bool {
+	if a.Rows() != b.Rows() || a.Cols() != b.Cols() {
+		return false
+	}
+	for i := uint(0); i < a.Rows(); i++ {
+		for j := uint(0); j < a.Cols(); j++ {
+			if a.Get(i, j) != b.Get(i, j) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestBitMatrixGetSet(t *testing.T) {
+	m := NewBitMatrix(3, 70)
+	m.Set(0, 0).Set(1, 69).Set(2, 64).Set(2, 3)
+	m.Clear(2, 3)
+	if !m.Get(0, 0) || !m.Get(1, 69) || !m.Get(2, 64) || m.Get(2, 3) || m.Get(1, 68) {
+		t.Error("Get doesn't match Set")
+	}
+	if on, off := m.CountBits(); on != 3 || off != 207 {
+		t.Errorf("CountBits() = %v, %v", on, off)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Set out of range didn't panic")
+		}
+	}()
+	m.Set(0, 70)
+}
+
+func TestBitMatrixRowCol(t *testing.T) {
+	m := NewBitMatrix(4, 100)
+	m.Set(1, 2).Set(1, 99).Set(3, 2)
+
+	row := m.Row(1)
+	if row.LenBits() != 104 || !row.IsSet(2) || !row.IsSet(99) || row.CountBitsOn() != 2 {
+		t.Errorf("row view %s", row)
+	}
+	// views share memory both ways
+	row.Set(50)
+	m.Set(1, 7)
+	if !m.Get(1, 50) || !row.IsSet(7) || m.CountRow(1) != 4 {
+		t.Error("row view doesn't share the matrix's memory")
+	}
+	row.ClearRange(0, 100)
+	if m.CountRow(1) != 0 || m.CountRow(3) != 1 {
+		t.Error("clearing the view touched other rows")
+	}
+
+	col := m.Col(2)
+	if col.LenBits() != 8 || !col.IsSet(3) || col.IsSet(1) || col.CountBitsOn() != 1 {
+		t.Errorf("column %s", col)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("growing a row view didn't panic")
+		}
+	}()
+	row.Set(128)
+}
+
+func TestBitMatrixCounts(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	m := randomMatrix(rng, 37, 130, 0.3)
+	cols := m.ColCounts()
+	rows := m.RowCounts()
+	for i := uint(0); i < m.Rows(); i++ {
+		if rows[i] != m.Row(i).CountBitsOn() {
+			t.Errorf("row %v: %v", i, rows[i])
+		}
+	}
+	for j := uint(0); j < m.Cols(); j++ {
+		if cols[j] != m.CountCol(j) || cols[j] != m.Col(j).CountBitsOn() {
+			t.Errorf("col %v: %v", j, cols[j])
+		}
+	}
+}
+
+func TestBitMatrixAndOr(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	a := randomMatrix(rng, 9, 77, 0.5)
+	b := randomMatrix(rng, 9, 77, 0.5)
+	and := a.Clone().And(b)
+	or := a.Clone().Or(b)
+	for i := uint(0); i < 9; i++ {
+		for j := uint(0); j < 77; j++ {
+			if and.Get(i, j) != (a.Get(i, j) && b.Get(i, j)) || or.Get(i, j) != (a.Get(i, j) || b.Get(i, j)) {
+				t.Fatalf("mismatch at (%v, %v)", i, j)
+			}
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("combining different shapes didn't panic")
+		}
+	}()
+	a.And(NewBitMatrix(9, 78))
+}
+
+func TestBitMatrixTranspose(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	for _, shape := range [][2]uint{{1, 1}, {64, 64}, {3, 200}, {130, 65}, {200, 7}, {0, 5}} {
+		m := randomMatrix(rng, shape[0], shape[1], 0.4)
+		tr := m.Transpose()
+		if tr.Rows() != m.Cols() || tr.Cols() != m.Rows() {
+			t.Fatalf("%v: transpose is %vx%v", shape, tr.Rows(), tr.Cols())
+		}
+		for i := uint(0); i < m.Rows(); i++ {
+			for j := uint(0); j < m.Cols(); j++ {
+				if m.Get(i, j) != tr.Get(j, i) {
+					t.Fatalf("%v: mismatch at (%v, %v)", shape, i, j)
+				}
+			}
+		}
+		if !matrixEqual(tr.Transpose(), m) {
+			t.Errorf("%v: transposing twice changed the matrix", shape)
+		}
+	}
+}
+
+func TestBitMatrixBinary(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	m := randomMatrix(rng, 13, 21, 0.5)
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got BitMatrix
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !matrixEqual(&got, m) {
+		t.Error("round trip changed the matrix")
+	}
+
+	// the payload is a plain BitBuffer, indexed row*cols + col
+	flat := NewBitBuffer(0)
+	if err := flat.UnmarshalBinary(data[KMATRIX_HEADER_BYTES:]); err != nil {
+		t.Fatal(err)
+	}
+	for i := uint(0); i < 13; i++ {
+		for j := uint(0); j < 21; j++ {
+			if flat.IsSet(i*21+j) != m.Get(i, j) {
+				t.Fatalf("flat mismatch at (%v, %v)", i, j)
+			}
+		}
+	}
+
+	data[8] = 200
+	if err := got.UnmarshalBinary(data); !errors.Is(err, ErrBadMatrix) {
+		t.Errorf("oversized header: got %v", err)
+	}
+	if err := got.UnmarshalBinary(data[:10]); !errors.Is(err, ErrBadMatrix) {
+		t.Errorf("short data: got %v", err)
+	}
+}
@@ -158,6 +158,30 @@ func TestBitBufferCmpWith(t *testing.T) {
 	}
 }
 
+func TestCopyEmpty(t *testing.T) {
+	empty := NewBitBuffer(0)
+	empty.resize(0)
+
+	if c := empty.Clone(); c.LenBytes() != 0 {
+		t.Fatalf("Clone fail, %v bytes", c.LenBytes())
+	}
+	b := NewBitBuffer(4).SetOnAll()
+	empty.CopyTo(b)
+	if b.LenBytes() != 0 || b.CountBitsOn() != 0 {
+		t.Fatalf("CopyTo fail, %v bytes", b.LenBytes())
+	}
+	// and grows from nothing afterwards
+	b.Set(40)
+	if b.LenBytes() != KGROW_BYTES || b.CountBitsOn() != 1 {
+		t.Fatalf("Set after CopyTo fail, %v bytes, %v on", b.LenBytes(), b.CountBitsOn())
+	}
+
+	src := NewBitBuffer(2).Set(3)
+	if b.CopyFrom(src); b.LenBytes() != 2 || b.CountBitsOn() != 1 || !b.IsSet(3) {
+		t.Fatalf("CopyFrom fail, %v", b)
+	}
+}
+
 func TestBitBufferString(t *testing.T) {
 	b := NewBitBuffer(0)
 	b.Set(0).
@@ -274,3 +298,25 @@ func BenchmarkBitBufferNew4096CountBits(t *testing.B) {
 	}
 	t.StopTimer()
 }
+
+func TestBitBufferSetRange(t *testing.T) {
+	b := NewBitBuffer(0)
+	b.SetRange(3, 140)
+
+	if b.LenBytes() != 24 || b.CountBitsOn() != 137 {
+		t.Fatalf("SetRange fail, %v bytes, %v bits on", b.LenBytes(), b.CountBitsOn())
+	}
+	if b.IsSet(2) || !b.IsSet(3) || !b.IsSet(139) || b.IsSet(140) {
+		t.Fatal("SetRange bounds error")
+	}
+
+	b.ClearRange(60, 70)
+	if b.CountBitsOn() != 127 || !b.IsSet(59) || b.IsSet(60) || b.IsSet(69) || !b.IsSet(70) {
+		t.Fatal("ClearRange error")
+	}
+
+	b.SetRange(5, 5)
+	if b.CountBitsOn() != 127 {
+		t.Fatal("Empty range error")
+	}
+}
@@ -0,0 +1,337 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"math/bits"
+	"slices"
+)
+
+// MinHashSignature is a MinHash of the set bits of a buffer, the fraction of
+// positions at which two signatures agree estimates the Jaccard index of the
+// buffers
+type MinHashSignature []uint32
+
+// value of every position in the signature of an empty buffer
+const KMINHASH_EMPTY = math.MaxUint32
+
+// returns the k-value MinHash signature of the set bits of b, signatures are
+// only comparable when made with the same k and seed
+//
+// uses one-permutation hashing, a single pass hashes every set bit index
+// into one of k bins keeping the minimum per bin, and bins left empty copy
+// the value of a non-empty bin chosen by a hash of their position (optimal
+// densification), so the cost doesn't grow with k
+func MinHash[W Word](b *Bits[W], k uint, seed uint64) MinHashSignature {
+	if k == 0 || k > math.MaxUint32 {
+		panic(fmt.Sprintf("mbits: MinHash needs 1 to 2^32 values, not %v", k))
+	}
+	sig := make(MinHashSignature, k)
+	// empty bins, until densified
+	empty := NewBitBuffer((k + KBITS_PER_BYTE - 1) / KBITS_PER_BYTE)
+	empty.SetRange(0, k)
+	nempty := k
+
+	wbits := uint64(b.WordBits())
+	for i, w := range b.buff {
+		for x := uint64(w); x != 0; x &= x - 1 {
+			v := chainHash(seed ^ (uint64(i)*wbits + uint64(bits.TrailingZeros64(x))))
+			bin := uint((v >> 32) * uint64(k) >> 32)
+			if empty.IsSet(bin) {
+				empty.Clear(bin)
+				nempty--
+				sig[bin] = uint32(v)
+			} else {
+				sig[bin] = min(sig[bin], uint32(v))
+			}
+		}
+	}
+
+	if nempty == k {
+		for i := range sig {
+			sig[i] = KMINHASH_EMPTY
+		}
+		return sig
+	}
+	if nempty == 0 {
+		return sig
+	}
+	for bin := uint(0); bin < k; bin++ {
+		if !empty.IsSet(bin) {
+			continue
+		}
+		for attempt := uint64(1); ; attempt++ {
+			v := chainHash(seed ^ uint64(bin)<<32 ^ attempt)
+			from := uint((v >> 32) * uint64(k) >> 32)
+			if !empty.IsSet(from) {
+				sig[bin] = sig[from]
+				break
+			}
+		}
+	}
+	return sig
+}
+
+// estimates the Jaccard index of the buffers a and b were made from, 1 when
+// both are empty, panics unless a and b have the same length
+func EstimateJaccard(a, b MinHashSignature) float64 {
+	if len(a) != len(b) {
+		panic(fmt.Sprintf("mbits: comparing MinHash signatures of %v and %v values", len(a), len(b)))
+	}
+	same := 0
+	for i, v := range a {
+		if v == b[i] {
+			same++
+		}
+	}
+	return float64(same) / float64(len(a))
+}
+
+// BBitSignature keeps the lowest b bits of every value of a MinHash
+// signature, packed back to back in a BitBuffer, value i taking bits
+// [i*b, (i+1)*b), b being a power of two so values never straddle words
+type BBitSignature struct {
+	b    uint
+	k    uint
+	bits *BitBuffer
+}
+
+// returns the b-bit compression of s, b one of 1, 2, 4, 8, 16 or 32
+func (s MinHashSignature) Compress(b uint) *BBitSignature {
+	if b == 0 || b > 32 || b&(b-1) != 0 {
+		panic(fmt.Sprintf("mbits: b-bit MinHash needs b a power of two up to 32, not %v", b))
+	}
+	k := uint(len(s))
+	words := make([]uint64, (k*b+63)/64)
+	for i, v := range s {
+		bit := uint(i) * b
+		words[bit/64] |= uint64(v) & (1<<b - 1) << (bit % 64)
+	}
+	return &BBitSignature{b: b, k: k, bits: NewBitBuffer(0).FromUint64s(words)}
+}
+
+// bits kept per value
+func (s *BBitSignature) B() uint {
+	return s.b
+}
+
+// number of values
+func (s *BBitSignature) Len() uint {
+	return s.k
+}
+
+// returns value i
+func (s *BBitSignature) Get(i uint) uint32 {
+	if i >= s.k {
+		panic(fmt.Sprintf("mbits: value %v out of range for %v values", i, s.k))
+	}
+	bit := i * s.b
+	return uint32(s.bits.buff[bit/64] >> (bit % 64) & (1<<s.b - 1))
+}
+
+// the packed values, shared with s
+func (s *BBitSignature) Bits() *BitBuffer {
+	return s.bits
+}
+
+// estimates the Jaccard index of the buffers a and b were made from,
+// correcting for the 2^-b chance that unrelated values agree on their low
+// b bits, panics unless a and b have the same b and length
+//
+// values are compared a word at a time: XOR, then OR each b-bit field down
+// into its lowest bit and count the fields left with that bit on
+func EstimateJaccardBBit(a, b *BBitSignature) float64 {
+	if a.b != b.b || a.k != b.k {
+		panic(fmt.Sprintf("mbits: comparing %v-bit signature of %v values with %v-bit of %v", a.b, a.k, b.b, b.k))
+	}
+	// lowest bit of every field
+	low := ^uint64(0) / (1<<a.b - 1)
+	differ := 0
+	for i, w := range a.bits.buff {
+		x := w ^ b.bits.buff[i]
+		for s := uint(1); s < a.b; s <<= 1 {
+			x |= x >> s
+		}
+		differ += bits.OnesCount64(x & low)
+	}
+	p := float64(a.k-uint(differ)) / float64(a.k)
+	chance := math.Ldexp(1, -int(a.b))
+	return max(0, (p-chance)/(1-chance))
+}
+
+// LSHIndex finds signatures likely to have a Jaccard index above a
+// threshold by banding: signatures are cut into bands of rows values, each
+// band hashed into its own table, and signatures sharing a bucket in any
+// band are candidates
+//
+// a pair with Jaccard index s becomes a candidate with probability
+// 1-(1-s^rows)^bands, LSHParams picks bands and rows for a threshold
+type LSHIndex struct {
+	bands uint
+	rows  uint
+	sigs  map[uint64]MinHashSignature
+	// per band, ids by band hash
+	tables []map[uint64][]uint64
+}
+
+// a pair of signatures found by LSHIndex.Pairs
+type LSHPair struct {
+	A, B     uint64
+	Estimate float64
+}
+
+// returns the bands and rows, bands*rows <= k, whose candidate probability
+// crosses 1/2 closest to threshold, (1/bands)^(1/rows) being where it does
+func LSHParams(k uint, threshold float64) (bands, rows uint) {
+	best := math.Inf(1)
+	for r := uint(1); r <= k; r++ {
+		b := k / r
+		if d := math.Abs(math.Pow(1/float64(b), 1/float64(r)) - threshold); d < best {
+			best, bands, rows = d, b, r
+		}
+	}
+	return
+}
+
+// constructs an empty index of signatures with at least bands*rows values
+// and returns pointer to instance
+func NewLSHIndex(bands, rows uint) *LSHIndex {
+	if bands == 0 || rows == 0 {
+		panic("mbits: LSH needs at least 1 band of 1 row")
+	}
+	l := &LSHIndex{
+		bands:  bands,
+		rows:   rows,
+		sigs:   map[uint64]MinHashSignature{},
+		tables: make([]map[uint64][]uint64, bands),
+	}
+	for i := range l.tables {
+		l.tables[i] = map[uint64][]uint64{}
+	}
+	return l
+}
+
+// number of signatures
+func (l *LSHIndex) Len() int {
+	return len(l.sigs)
+}
+
+func (l *LSHIndex) bandHash(sig MinHashSignature, band uint) uint64 {
+	if uint(len(sig)) < l.bands*l.rows {
+		panic(fmt.Sprintf("mbits: %v-value signature for %v bands of %v rows", len(sig), l.bands, l.rows))
+	}
+	h := uint64(band)
+	for _, v := range sig[band*l.rows : (band+1)*l.rows] {
+		h = chainHash(h ^ uint64(v))
+	}
+	return h
+}
+
+// adds sig under id, replacing the signature id had
+func (l *LSHIndex) Add(id uint64, sig MinHashSignature) {
+	l.Remove(id)
+	for band, t := range l.tables {
+		h := l.bandHash(sig, uint(band))
+		t[h] = append(t[h], id)
+	}
+	l.sigs[id] = sig
+}
+
+// removes id, returns false if it wasn't there
+func (l *LSHIndex) Remove(id uint64) bool {
+	sig, ok := l.sigs[id]
+	if !ok {
+		return false
+	}
+	for band, t := range l.tables {
+		h := l.bandHash(sig, uint(band))
+		b := t[h]
+		i := slices.Index(b, id)
+		if len(b) == 1 {
+			delete(t, h)
+		} else {
+			b[i] = b[len(b)-1]
+			t[h] = b[:len(b)-1]
+		}
+	}
+	delete(l.sigs, id)
+	return true
+}
+
+// returns the ids sharing a bucket with sig in any band whose estimated
+// Jaccard index with sig is at least threshold, sorted
+// each candidate is estimated once, however many bands it shares
+func (l *LSHIndex) Query(sig MinHashSignature, threshold float64) []uint64 {
+	var r []uint64
+	seen := map[uint64]bool{}
+	for band, t := range l.tables {
+		for _, id := range t[l.bandHash(sig, uint(band))] {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			if EstimateJaccard(sig, l.sigs[id]) >= threshold {
+				r = append(r, id)
+			}
+		}
+	}
+	slices.Sort(r)
+	return r
+}
+
+// returns every pair of signatures sharing a bucket in any band whose
+// estimated Jaccard index is at least threshold, A < B, sorted by A then B
+func (l *LSHIndex) Pairs(threshold float64) []LSHPair {
+	seen := map[[2]uint64]bool{}
+	var r []LSHPair
+	for _, t := range l.tables {
+		for _, b := range t {
+			for i, x := range b {
+				for _, y := range b[i+1:] {
+					p := [2]uint64{min(x, y), max(x, y)}
+					if seen[p] {
+						continue
+					}
+					seen[p] = true
+					if e := EstimateJaccard(l.sigs[x], l.sigs[y]); e >= threshold {
+						r = append(r, LSHPair{p[0], p[1], e})
+					}
+				}
+			}
+		}
+	}
+	slices.SortFunc(r, func(a, b LSHPair) int {
+		if c := cmp.Compare(a.A, b.A); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.B, b.B)
+	})
+	return r
+}
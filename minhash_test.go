@@ -0,0 +1,210 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// two buffers of nbits bits whose set bits have Jaccard index close to j
+func jaccardPair(rnd *rand.Rand, nbits uint, nset int, j float64) (*BitBuffer, *BitBuffer) {
+	a := NewBitBuffer(nbits / 8)
+	b := NewBitBuffer(nbits / 8)
+	// shared / (shared + 2*only) = j
+	shared := int(j * float64(nset))
+	only := nset - shared
+	pick := func() uint {
+		for {
+			i := uint(rnd.Int63n(int64(nbits)))
+			if !a.IsSet(i) && !b.IsSet(i) {
+				return i
+			}
+		}
+	}
+	for i := 0; i < shared; i++ {
+		x := pick()
+		a.Set(x)
+		b.Set(x)
+	}
+	for i := 0; i < only/2; i++ {
+		a.Set(pick())
+		b.Set(pick())
+	}
+	return a, b
+}
+
+func TestMinHashEstimate(t *testing.T) {
+	rnd := rand.New(rand.NewSource(46))
+	for _, tc := range []struct {
+		nbits uint
+		nset  int
+		k     uint
+	}{
+		{1 << 20, 20000, 1024},
+		// fewer set bits than bins, most bins densified
+		{1 << 16, 200, 1024},
+		{4096, 50, 64},
+	} {
+		for _, j := range []float64{0, 0.2, 0.5, 0.9, 1} {
+			a, b := jaccardPair(rnd, tc.nbits, tc.nset, j)
+			exact := Jaccard(a, b)
+			got := EstimateJaccard(MinHash(a, tc.k, 7), MinHash(b, tc.k, 7))
+			if tol := 5 / math.Sqrt(float64(tc.k)) * 0.5; math.Abs(got-exact) > tol {
+				t.Errorf("%v bits, %v set, k=%v: estimate %.3f, exact %.3f", tc.nbits, tc.nset, tc.k, got, exact)
+			}
+		}
+	}
+}
+
+func TestMinHashEdges(t *testing.T) {
+	a := NewBitBuffer(64)
+	b := NewBitBuffer(16)
+	sa := MinHash(a, 128, 1)
+	for _, v := range sa {
+		if v != KMINHASH_EMPTY {
+			t.Fatal("empty buffer has a non-empty signature")
+		}
+	}
+	if e := EstimateJaccard(sa, MinHash(b, 128, 1)); e != 1 {
+		t.Fatalf("two empty buffers estimate %v, want 1", e)
+	}
+	b.Set(5)
+	sb := MinHash(b, 128, 1)
+	if e := EstimateJaccard(sa, sb); e != 0 {
+		t.Fatalf("empty and non-empty estimate %v, want 0", e)
+	}
+	// a single set bit densifies into every bin
+	for _, v := range sb {
+		if v != sb[0] {
+			t.Fatal("single set bit gives differing values")
+		}
+	}
+	// length and word width don't matter, only the set bits do
+	a.Set(5)
+	if e := EstimateJaccard(MinHash(a, 128, 1), sb); e != 1 {
+		t.Fatalf("same set bits estimate %v, want 1", e)
+	}
+	c := NewBits[uint8](3)
+	c.Set(5)
+	if e := EstimateJaccard(MinHash(c, 128, 1), sb); e != 1 {
+		t.Fatalf("uint8 words estimate %v, want 1", e)
+	}
+	if e := EstimateJaccard(MinHash(a, 128, 2), sb); e == 1 {
+		t.Fatal("different seeds give equal signatures")
+	}
+}
+
+func TestBBitMinHash(t *testing.T) {
+	rnd := rand.New(rand.NewSource(47))
+	a, b := jaccardPair(rnd, 1<<20, 20000, 0.6)
+	exact := Jaccard(a, b)
+	sa, sb := MinHash(a, 2048, 3), MinHash(b, 2048, 3)
+	for _, bb := range []uint{1, 2, 4, 8, 16, 32} {
+		ca, cb := sa.Compress(bb), sb.Compress(bb)
+		if ca.Len() != 2048 || ca.B() != bb || ca.Bits().LenBits() != (2048*bb+63)/64*64 {
+			t.Fatalf("b=%v: %v values in %v bits", bb, ca.Len(), ca.Bits().LenBits())
+		}
+		for i := uint(0); i < ca.Len(); i++ {
+			if ca.Get(i) != sa[i]&uint32(1<<bb-1) {
+				t.Fatalf("b=%v: value %v is %v, want %v", bb, i, ca.Get(i), sa[i]&uint32(1<<bb-1))
+			}
+		}
+		got := EstimateJaccardBBit(ca, cb)
+		if math.Abs(got-exact) > 0.08 {
+			t.Errorf("b=%v: estimate %.3f, exact %.3f", bb, got, exact)
+		}
+		if e := EstimateJaccardBBit(ca, ca); e != 1 {
+			t.Errorf("b=%v: self estimate %v", bb, e)
+		}
+	}
+	// odd k leaves part of the last word unused
+	s := MinHash(a, 37, 3).Compress(4)
+	if e := EstimateJaccardBBit(s, MinHash(a, 37, 3).Compress(4)); e != 1 {
+		t.Errorf("k=37 self estimate %v", e)
+	}
+}
+
+func TestLSHIndex(t *testing.T) {
+	rnd := rand.New(rand.NewSource(48))
+	const k = 128
+	bands, rows := LSHParams(k, 0.7)
+	if bands*rows > k || bands < 2 || rows < 2 {
+		t.Fatalf("LSHParams gave %v bands of %v rows", bands, rows)
+	}
+	l := NewLSHIndex(bands, rows)
+
+	// pairs (2i, 2i+1) are near duplicates, everything else unrelated
+	bufs := map[uint64]*BitBuffer{}
+	for i := uint64(0); i < 100; i++ {
+		a, b := jaccardPair(rnd, 1<<16, 500, 0.9)
+		bufs[2*i], bufs[2*i+1] = a, b
+	}
+	for id, b := range bufs {
+		l.Add(id, MinHash(b, k, 9))
+	}
+	if l.Len() != 200 {
+		t.Fatalf("Len %v", l.Len())
+	}
+	pairs := l.Pairs(0.7)
+	if len(pairs) < 95 {
+		t.Fatalf("found %v of 100 near-duplicate pairs", len(pairs))
+	}
+	for _, p := range pairs {
+		if p.A%2 != 0 || p.B != p.A+1 || p.Estimate < 0.7 {
+			t.Fatalf("unexpected pair %+v", p)
+		}
+	}
+	if q := l.Query(MinHash(bufs[10], k, 9), 0.7); len(q) != 2 || q[0] != 10 || q[1] != 11 {
+		t.Fatalf("Query got %v", q)
+	}
+
+	if !l.Remove(11) || l.Remove(11) {
+		t.Fatal("Remove")
+	}
+	if q := l.Query(MinHash(bufs[10], k, 9), 0.7); len(q) != 1 || q[0] != 10 {
+		t.Fatalf("Query after Remove got %v", q)
+	}
+	for id := range bufs {
+		l.Remove(id)
+	}
+	for _, tb := range l.tables {
+		if len(tb) != 0 {
+			t.Fatal("buckets left after removing everything")
+		}
+	}
+}
+
+func BenchmarkMinHash(b *testing.B) {
+	rnd := rand.New(rand.NewSource(49))
+	buf, _ := jaccardPair(rnd, 1<<24, 1<<18, 0.5)
+	b.SetBytes(int64(buf.LenBytes()))
+	for i := 0; i < b.N; i++ {
+		MinHash(buf, 256, 1)
+	}
+}
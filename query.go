@@ -0,0 +1,514 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// query grammar, operators from loosest to tightest binding:
+//
+//	expr    = xor { "|" xor }
+//	xor     = and { "^" and }
+//	and     = unary { "&" unary }
+//	unary   = "!" unary | primary
+//	primary = name | "0" | "1" | "(" expr ")"
+//
+// a name is a run of letters, digits and any of _-.:/ or a double-quoted
+// string with Go escapes, 0 is the empty bitmap and 1 the full one
+//
+// queries are evaluated over the length of the longest bitmap they name,
+// shorter ones padded with off bits, so !x and 1 are relative to that length
+
+// returned, wrapped in a QueryError, for queries that don't parse
+var ErrQuerySyntax = errors.New("mbits: query syntax error")
+
+// QueryError reports where a query failed to parse
+type QueryError struct {
+	// byte offset into the query
+	Pos int
+	Msg string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("mbits: query syntax error at %v: %v", e.Pos, e.Msg)
+}
+
+func (e *QueryError) Unwrap() error {
+	return ErrQuerySyntax
+}
+
+type queryOp uint8
+
+const (
+	kqueryName queryOp = iota
+	kqueryConst
+	kqueryNot
+	kqueryAnd
+	kqueryXor
+	kqueryOr
+)
+
+// a node of the parsed query, And, Xor and Or nodes are flattened to hold
+// all their operands
+type queryNode struct {
+	op    queryOp
+	name  string
+	value bool
+	kids  []*queryNode
+}
+
+// Query is a parsed boolean expression over named bitmaps, safe for
+// concurrent use
+type Query struct {
+	root *queryNode
+	src  string
+}
+
+// parses a query
+func ParseQuery(s string) (*Query, error) {
+	p := &queryParser{src: s}
+	p.next()
+	root := p.expr()
+	if p.err == nil && p.tok != kqueryEOF {
+		p.fail(p.pos, "unexpected %v", p.describe())
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return &Query{root: root, src: s}, nil
+}
+
+// the query as written
+func (q *Query) Source() string {
+	return q.src
+}
+
+// the query in canonical form, fully parenthesised, names quoted where needed
+func (q *Query) String() string {
+	var sb strings.Builder
+	q.root.format(&sb)
+	return sb.String()
+}
+
+func (n *queryNode) format(sb *strings.Builder) {
+	switch n.op {
+	case kqueryName:
+		if isQueryName(n.name) {
+			sb.WriteString(n.name)
+		} else {
+			sb.WriteString(strconv.Quote(n.name))
+		}
+	case kqueryConst:
+		if n.value {
+			sb.WriteByte('1')
+		} else {
+			sb.WriteByte('0')
+		}
+	case kqueryNot:
+		sb.WriteByte('!')
+		n.kids[0].format(sb)
+	default:
+		sep := map[queryOp]string{kqueryAnd: " & ", kqueryXor: " ^ ", kqueryOr: " | "}[n.op]
+		sb.WriteByte('(')
+		for i, k := range n.kids {
+			if i > 0 {
+				sb.WriteString(sep)
+			}
+			k.format(sb)
+		}
+		sb.WriteByte(')')
+	}
+}
+
+// the names the query refers to, sorted, without repeats
+func (q *Query) Names() []string {
+	var r []string
+	var walk func(n *queryNode)
+	walk = func(n *queryNode) {
+		if n.op == kqueryName {
+			r = append(r, n.name)
+		}
+		for _, k := range n.kids {
+			walk(k)
+		}
+	}
+	walk(q.root)
+	slices.Sort(r)
+	return slices.Compact(r)
+}
+
+// true if s can be written as a name without quotes
+func isQueryName(s string) bool {
+	if s == "" || s == "0" || s == "1" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isQueryNameByte(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isQueryNameByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("_-.:/", c) >= 0
+}
+
+type queryToken uint8
+
+const (
+	kqueryEOF queryToken = iota
+	kqueryTokName
+	kqueryTokConst
+	kqueryTokOp
+)
+
+type queryParser struct {
+	src string
+	// offset of the next byte to lex
+	off int
+	// current token, where it starts, and its text or value
+	tok  queryToken
+	pos  int
+	text string
+	err  error
+}
+
+func (p *queryParser) fail(pos int, format string, args ...any) {
+	if p.err == nil {
+		p.err = &QueryError{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+	}
+	p.tok = kqueryEOF
+}
+
+func (p *queryParser) describe() string {
+	switch p.tok {
+	case kqueryEOF:
+		return "end of query"
+	case kqueryTokName:
+		return fmt.Sprintf("name %q", p.text)
+	}
+	return fmt.Sprintf("'%v'", p.text)
+}
+
+// lexes the next token
+func (p *queryParser) next() {
+	if p.err != nil {
+		return
+	}
+	for p.off < len(p.src) && strings.IndexByte(" \t\r\n", p.src[p.off]) >= 0 {
+		p.off++
+	}
+	p.pos = p.off
+	if p.off == len(p.src) {
+		p.tok, p.text = kqueryEOF, ""
+		return
+	}
+	c := p.src[p.off]
+	switch {
+	case strings.IndexByte("&|^!()", c) >= 0:
+		p.tok, p.text = kqueryTokOp, p.src[p.off:p.off+1]
+		p.off++
+	case c == '"':
+		end := p.off + 1
+		for end < len(p.src) && p.src[end] != '"' {
+			if p.src[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(p.src) {
+			p.fail(p.pos, "unterminated quoted name")
+			return
+		}
+		s, err := strconv.Unquote(p.src[p.off : end+1])
+		if err != nil {
+			p.fail(p.pos, "bad quoted name")
+			return
+		}
+		p.tok, p.text = kqueryTokName, s
+		p.off = end + 1
+	case isQueryNameByte(c):
+		end := p.off
+		for end < len(p.src) && isQueryNameByte(p.src[end]) {
+			end++
+		}
+		p.tok, p.text = kqueryTokName, p.src[p.off:end]
+		if p.text == "0" || p.text == "1" {
+			p.tok = kqueryTokConst
+		}
+		p.off = end
+	default:
+		p.fail(p.pos, "unexpected character %q", c)
+	}
+}
+
+// parses operands joined by op, flattening nested nodes of the same op
+func (p *queryParser) binary(op queryOp, sym string, operand func() *queryNode) *queryNode {
+	n := operand()
+	for p.tok == kqueryTokOp && p.text == sym {
+		p.next()
+		k := operand()
+		if n.op != op {
+			n = &queryNode{op: op, kids: []*queryNode{n}}
+		}
+		if k.op == op {
+			n.kids = append(n.kids, k.kids...)
+		} else {
+			n.kids = append(n.kids, k)
+		}
+	}
+	return n
+}
+
+func (p *queryParser) expr() *queryNode {
+	return p.binary(kqueryOr, "|", p.xor)
+}
+
+func (p *queryParser) xor() *queryNode {
+	return p.binary(kqueryXor, "^", p.and)
+}
+
+func (p *queryParser) and() *queryNode {
+	return p.binary(kqueryAnd, "&", p.unary)
+}
+
+func (p *queryParser) unary() *queryNode {
+	if p.tok == kqueryTokOp && p.text == "!" {
+		p.next()
+		k := p.unary()
+		switch k.op {
+		case kqueryNot:
+			return k.kids[0]
+		case kqueryConst:
+			return &queryNode{op: kqueryConst, value: !k.value}
+		}
+		return &queryNode{op: kqueryNot, kids: []*queryNode{k}}
+	}
+	return p.primary()
+}
+
+func (p *queryParser) primary() *queryNode {
+	var n *queryNode
+	switch {
+	case p.tok == kqueryTokName:
+		n = &queryNode{op: kqueryName, name: p.text}
+	case p.tok == kqueryTokConst:
+		n = &queryNode{op: kqueryConst, value: p.text == "1"}
+	case p.tok == kqueryTokOp && p.text == "(":
+		open := p.pos
+		p.next()
+		n = p.expr()
+		if p.err != nil {
+			return n
+		}
+		if p.tok != kqueryTokOp || p.text != ")" {
+			p.fail(p.pos, "expected ')' to close '(' at %v, got %v", open, p.describe())
+			return n
+		}
+	default:
+		p.fail(p.pos, "expected a name, constant or '(', got %v", p.describe())
+		return &queryNode{op: kqueryConst}
+	}
+	p.next()
+	return n
+}
+
+// evaluates the query, resolve returns the bitmap for a name and is called
+// once per distinct name, the bitmaps are only read
+//
+// AND operands are applied smallest first by CountBits estimate, stopping
+// as soon as the result is empty, !name operands are applied as AND NOT
+// without materialising the complement, and temporaries are reused, so the
+// only allocations are one buffer per nesting level
+func (q *Query) Eval(resolve func(name string) (*BitBuffer, error)) (*BitBuffer, error) {
+	e := &queryEval{bufs: map[string]*BitBuffer{}, counts: map[string]uint{}}
+	for _, name := range q.Names() {
+		b, err := resolve(name)
+		if err != nil {
+			return nil, err
+		}
+		e.bufs[name] = b
+		e.byte_len = max(e.byte_len, b.LenBytes())
+	}
+	return e.eval(q.root), nil
+}
+
+// evaluates the query over the bitmaps of the collection
+func (c *Collection) Query(expr string) (*BitBuffer, error) {
+	q, err := ParseQuery(expr)
+	if err != nil {
+		return nil, err
+	}
+	return q.Eval(c.Get)
+}
+
+type queryEval struct {
+	// length of every result
+	byte_len uint
+	bufs     map[string]*BitBuffer
+	counts   map[string]uint
+	// temporaries free for reuse
+	free []*BitBuffer
+}
+
+// an empty temporary of the result length
+func (e *queryEval) temp() *BitBuffer {
+	if n := len(e.free); n > 0 {
+		t := e.free[n-1]
+		e.free = e.free[:n-1]
+		return t.SetBufferLen(e.byte_len)
+	}
+	return NewBitBuffer(e.byte_len)
+}
+
+func (e *queryEval) release(t *BitBuffer) {
+	e.free = append(e.free, t)
+}
+
+// number of bits in a result
+func (e *queryEval) universe() uint {
+	if e.byte_len == 0 {
+		return KGROW_BYTES * KBITS_PER_BYTE
+	}
+	return e.byte_len * KBITS_PER_BYTE
+}
+
+// estimated number of bits set in the result of n, exact for names
+func (e *queryEval) estimate(n *queryNode) uint {
+	switch n.op {
+	case kqueryName:
+		c, ok := e.counts[n.name]
+		if !ok {
+			c = e.bufs[n.name].CountBitsOn()
+			e.counts[n.name] = c
+		}
+		return c
+	case kqueryConst:
+		if n.value {
+			return e.universe()
+		}
+		return 0
+	case kqueryNot:
+		return e.universe() - min(e.universe(), e.estimate(n.kids[0]))
+	case kqueryAnd:
+		r := e.universe()
+		for _, k := range n.kids {
+			r = min(r, e.estimate(k))
+		}
+		return r
+	}
+	r := uint(0)
+	for _, k := range n.kids {
+		r += e.estimate(k)
+	}
+	return min(r, e.universe())
+}
+
+// true when no bit of b is on
+func isEmpty(b *BitBuffer) bool {
+	for _, w := range b.buff {
+		if w != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// evaluates n into a temporary owned by the caller
+func (e *queryEval) eval(n *queryNode) *BitBuffer {
+	switch n.op {
+	case kqueryName:
+		return e.temp().Or(e.bufs[n.name])
+	case kqueryConst:
+		t := e.temp()
+		if n.value {
+			t.SetOnAll()
+		}
+		return t
+	case kqueryNot:
+		return e.eval(n.kids[0]).Not()
+	case kqueryAnd:
+		return e.evalAnd(n.kids)
+	}
+
+	acc := e.eval(n.kids[0])
+	for _, k := range n.kids[1:] {
+		b := e.bufs[k.name]
+		if k.op != kqueryName {
+			b = e.eval(k)
+		}
+		if n.op == kqueryOr {
+			acc.Or(b)
+		} else {
+			acc.Xor(b)
+		}
+		if k.op != kqueryName {
+			e.release(b)
+		}
+	}
+	return acc
+}
+
+func (e *queryEval) evalAnd(kids []*queryNode) *BitBuffer {
+	order := slices.Clone(kids)
+	est := make(map[*queryNode]uint, len(order))
+	for _, k := range order {
+		est[k] = e.estimate(k)
+	}
+	slices.SortStableFunc(order, func(a, b *queryNode) int {
+		return cmp.Compare(est[a], est[b])
+	})
+
+	acc := e.eval(order[0])
+	for _, k := range order[1:] {
+		if isEmpty(acc) {
+			break
+		}
+		switch {
+		case k.op == kqueryName:
+			acc.And(e.bufs[k.name])
+		case k.op == kqueryNot && k.kids[0].op == kqueryName:
+			acc.AndNot(e.bufs[k.kids[0].name])
+		case k.op == kqueryConst:
+			if !k.value {
+				acc.ClearAll()
+			}
+		default:
+			t := e.eval(k)
+			acc.And(t)
+			e.release(t)
+		}
+	}
+	return acc
+}
@@ -0,0 +1,222 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// a random expression over names, and a function giving its value at bit i
+func randomQuery(rnd *rand.Rand, names []string, bufs map[string]*BitBuffer, depth int) (string, func(i uint) bool) {
+	if depth == 0 || rnd.Intn(4) == 0 {
+		switch rnd.Intn(10) {
+		case 0:
+			return "0", func(uint) bool { return false }
+		case 1:
+			return "1", func(uint) bool { return true }
+		}
+		n := names[rnd.Intn(len(names))]
+		b := bufs[n]
+		return n, func(i uint) bool { return i < b.LenBits() && b.IsSet(i) }
+	}
+	if rnd.Intn(4) == 0 {
+		s, f := randomQuery(rnd, names, bufs, depth-1)
+		return "!" + s, func(i uint) bool { return !f(i) }
+	}
+	l, fl := randomQuery(rnd, names, bufs, depth-1)
+	r, fr := randomQuery(rnd, names, bufs, depth-1)
+	switch rnd.Intn(3) {
+	case 0:
+		return "(" + l + " & " + r + ")", func(i uint) bool { return fl(i) && fr(i) }
+	case 1:
+		return "(" + l + "|" + r + ")", func(i uint) bool { return fl(i) || fr(i) }
+	}
+	return "(" + l + " ^" + r + ")", func(i uint) bool { return fl(i) != fr(i) }
+}
+
+func TestQueryEval(t *testing.T) {
+	rnd := rand.New(rand.NewSource(49))
+	names := []string{"active", "premium", "trial", "churned", "2026-10-01", "empty"}
+	bufs := map[string]*BitBuffer{}
+	for i, n := range names {
+		b := NewBitBuffer(uint(16 + 8*i))
+		if n != "empty" {
+			for j := 0; j < 40*(i+1); j++ {
+				b.Set(uint(rnd.Intn(int(b.LenBits()))))
+			}
+		}
+		bufs[n] = b
+	}
+	calls := 0
+	resolve := func(name string) (*BitBuffer, error) {
+		calls++
+		return bufs[name], nil
+	}
+
+	for n := 0; n < 500; n++ {
+		s, want := randomQuery(rnd, names, bufs, 5)
+		q, err := ParseQuery(s)
+		if err != nil {
+			t.Fatalf("%v: %v", s, err)
+		}
+		calls = 0
+		got, err := q.Eval(resolve)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if calls != len(q.Names()) {
+			t.Fatalf("%v: resolved %v times for %v names", s, calls, len(q.Names()))
+		}
+		// the longest bitmap named, the default length for none
+		universe := uint(0)
+		for _, name := range q.Names() {
+			universe = max(universe, bufs[name].LenBits())
+		}
+		if universe == 0 {
+			universe = KGROW_BYTES * KBITS_PER_BYTE
+		}
+		if got.LenBits() != universe {
+			t.Fatalf("%v: result of %v bits, want %v", s, got.LenBits(), universe)
+		}
+		for i := uint(0); i < universe; i++ {
+			if got.IsSet(i) != want(i) {
+				t.Fatalf("%v: bit %v is %v", s, i, got.IsSet(i))
+			}
+		}
+		// the canonical form parses to the same query
+		if q2, err := ParseQuery(q.String()); err != nil || q2.String() != q.String() {
+			t.Fatalf("%v: canonical form %v doesn't round trip: %v", s, q, err)
+		}
+	}
+
+	// operands are only read
+	for _, n := range names {
+		b := bufs[n].Clone()
+		q, _ := ParseQuery("!" + n + " & 1 | " + n)
+		q.Eval(resolve)
+		if XorCount(b, bufs[n]) != 0 {
+			t.Fatalf("%v changed by evaluation", n)
+		}
+	}
+
+	errResolve := errors.New("no such bitmap")
+	q, _ := ParseQuery("a & b")
+	if _, err := q.Eval(func(string) (*BitBuffer, error) { return nil, errResolve }); err != errResolve {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestQueryParse(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"(active & premium) | (trial & !churned)", "((active & premium) | (trial & !churned))"},
+		{"a | b ^ c & d", "(a | (b ^ (c & d)))"},
+		{"a & b & (c & d) & !!e", "(a & b & c & d & e)"},
+		{"!(a | b)", "!(a | b)"},
+		{"!1 | !0", "(0 | 1)"},
+		{`"has space" & "0" & x_y-z.w:v/u`, `("has space" & "0" & x_y-z.w:v/u)`},
+		{"  ( ( a ) )  ", "a"},
+	} {
+		q, err := ParseQuery(tc.in)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.in, err)
+		}
+		if q.String() != tc.want || q.Source() != tc.in {
+			t.Fatalf("%v parsed as %v, want %v", tc.in, q, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		in  string
+		pos int
+		msg string
+	}{
+		{"", 0, "expected a name"},
+		{"a &", 3, "got end of query"},
+		{"(a | b", 6, "expected ')' to close '(' at 0"},
+		{"a b", 2, `unexpected name "b"`},
+		{"a & )", 4, "got ')'"},
+		{"a + b", 2, "unexpected character '+'"},
+		{`a | "abc`, 4, "unterminated"},
+		{`a | "\q"`, 4, "bad quoted name"},
+		{"a)", 1, "unexpected ')'"},
+	} {
+		_, err := ParseQuery(tc.in)
+		var qe *QueryError
+		if !errors.As(err, &qe) || !errors.Is(err, ErrQuerySyntax) {
+			t.Fatalf("%q: got %v, want a QueryError", tc.in, err)
+		}
+		if qe.Pos != tc.pos || !strings.Contains(qe.Msg, tc.msg) {
+			t.Fatalf("%q: got %v, want %q at %v", tc.in, err, tc.msg, tc.pos)
+		}
+	}
+}
+
+func TestCollectionQuery(t *testing.T) {
+	c := NewCollection()
+	for i, n := range []string{"active", "premium", "trial", "churned"} {
+		b := NewBitBuffer(1)
+		b.SetAll(uint64(0x55 << (i % 2)))
+		if i >= 2 {
+			b.SetAll(uint64(0x0f << (4 * (i % 2))))
+		}
+		c.Put(n, b)
+	}
+	got, err := c.Query("(active & premium) | (trial & !churned)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Bytes()[0] != 0x0f {
+		t.Fatalf("got %08b", got.Bytes()[0])
+	}
+	if _, err := c.Query("active & missing"); !errors.Is(err, ErrNoKey) {
+		t.Fatalf("got %v, want ErrNoKey", err)
+	}
+	if _, err := c.Query("active &"); !errors.Is(err, ErrQuerySyntax) {
+		t.Fatalf("got %v, want ErrQuerySyntax", err)
+	}
+}
+
+func BenchmarkQuery(b *testing.B) {
+	rnd := rand.New(rand.NewSource(50))
+	bufs := map[string]*BitBuffer{}
+	for i, n := range []string{"active", "premium", "trial", "churned"} {
+		buf := NewBitBuffer(1 << 17)
+		for j := 0; j < 1<<(14+i); j++ {
+			buf.Set(uint(rnd.Intn(1 << 20)))
+		}
+		bufs[n] = buf
+	}
+	q, _ := ParseQuery("(active & premium) | (trial & !churned)")
+	resolve := func(name string) (*BitBuffer, error) { return bufs[name], nil }
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		q.Eval(resolve)
+	}
+}
@@ -0,0 +1,675 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// RedisBits gives a BitBuffer the bitmap semantics of Redis strings:
+// bits are numbered MSB first within each byte, so Redis bit 0 is the top
+// bit of byte 0, and the string grows to exactly as many bytes as needed
+// the bytes are the same as the string's, so Bytes() and LoadString() move
+// values to and from Redis as they are
+// an empty RedisBits behaves like a missing key
+type RedisBits struct {
+	bits *BitBuffer
+}
+
+// units for the ranges of BitCountRange and BitPosRange
+type RedisUnit int
+
+const (
+	KREDIS_UNIT_BYTE RedisUnit = iota
+	KREDIS_UNIT_BIT
+)
+
+// ops for BitOp
+type RedisOp int
+
+const (
+	KREDIS_OP_AND RedisOp = iota
+	KREDIS_OP_OR
+	KREDIS_OP_XOR
+	KREDIS_OP_NOT
+)
+
+// overflow handling for BITFIELD SET and INCRBY
+type RedisOverflow int
+
+const (
+	KREDIS_OVERFLOW_WRAP RedisOverflow = iota
+	KREDIS_OVERFLOW_SAT
+	KREDIS_OVERFLOW_FAIL
+)
+
+// integer type of a BITFIELD field, i1 to i64 or u1 to u63
+type RedisBitfieldType struct {
+	Signed bool
+	Bits   uint
+}
+
+const (
+	// largest bit offset Redis accepts with the default proto-max-bulk-len
+	// of 512 MiB
+	KREDIS_MAX_BIT_OFFSET = uint64(512<<20)*8 - 1
+	// RDB version written by Dump(), understood by Redis 5 and later
+	KREDIS_RDB_VERSION = uint16(9)
+)
+
+var (
+	// returned by Restore for payloads that aren't a valid string DUMP
+	ErrBadRedisDump = errors.New("mbits: not a redis string dump")
+	// returned when BitOp gets the wrong number of sources
+	ErrRedisBitOp = errors.New("mbits: BITOP NOT must be called with a single source key")
+	// returned by writes at a bit offset past KREDIS_MAX_BIT_OFFSET
+	ErrRedisOffset = errors.New("mbits: bit offset is out of range")
+)
+
+// constructs an empty RedisBits and returns pointer to instance
+func NewRedisBits() *RedisBits {
+	b := NewBitBuffer(0)
+	b.resize(0)
+	return &RedisBits{bits: b}
+}
+
+// wraps b, b keeps its bytes and length, its bits are seen MSB first
+// returns pointer to instance
+func NewRedisBitsFrom(b *BitBuffer) *RedisBits {
+	return &RedisBits{bits: b}
+}
+
+// returns the underlying buffer
+func (r *RedisBits) BitBuffer() *BitBuffer {
+	return r.bits
+}
+
+// length of the string value in bytes, STRLEN
+func (r *RedisBits) Len() uint {
+	return r.bits.LenBytes()
+}
+
+// returns a copy of the string value, GET
+func (r *RedisBits) Bytes() []byte {
+	return r.bits.Bytes()
+}
+
+// replaces the value with the string raw, SET
+// returns pointer to self
+func (r *RedisBits) LoadString(raw []byte) *RedisBits {
+	r.bits.LoadBuffer(raw)
+	if len(raw) == 0 {
+		r.bits.resize(0)
+	}
+	return r
+}
+
+// index in the BitBuffer of Redis bit offset
+func redisBitIndex(offset uint) uint {
+	return offset&^7 | (7 - offset&7)
+}
+
+// returns ErrRedisOffset if offset is past KREDIS_MAX_BIT_OFFSET, as Redis
+// does, only the offset is checked, a field starting at the limit may end
+// past it
+// takes a uint64 so offsets parsed on 32-bit platforms can be checked before
+// they're narrowed
+func RedisCheckOffset(offset uint64) error {
+	if offset > KREDIS_MAX_BIT_OFFSET {
+		return fmt.Errorf("%w: %v", ErrRedisOffset, offset)
+	}
+	return nil
+}
+
+// grows the string to hold the bits bits at offset, never rounding up
+func (r *RedisBits) growBits(offset, bits uint) {
+	// in 64 bits, the end of a field at the limit doesn't fit 32
+	r.bits.growTo(uint((uint64(offset)+uint64(bits)-1)/uint64(KBITS_PER_BYTE) + 1))
+}
+
+// sets or clears the bit at offset, growing the string as needed, SETBIT
+// returns the previous value of the bit, or ErrRedisOffset when offset is
+// past KREDIS_MAX_BIT_OFFSET, in which case nothing is written
+func (r *RedisBits) SetBit(offset uint, value bool) (bool, error) {
+	if err := RedisCheckOffset(uint64(offset)); err != nil {
+		return false, err
+	}
+	r.growBits(offset, 1)
+	i := redisBitIndex(offset)
+	old := r.bits.IsSet(i)
+	if value {
+		r.bits.Set(i)
+	} else {
+		r.bits.Clear(i)
+	}
+	return old, nil
+}
+
+// returns the bit at offset, bits past the end are 0, GETBIT
+func (r *RedisBits) GetBit(offset uint) bool {
+	return r.bits.IsSet(redisBitIndex(offset))
+}
+
+// number of set bits in the whole string, BITCOUNT key
+func (r *RedisBits) BitCount() int64 {
+	return int64(r.bits.CountBitsOn())
+}
+
+// number of set bits within [start, end] counted in unit, negative
+// indexes count from the end, BITCOUNT key start end [BYTE|BIT]
+func (r *RedisBits) BitCountRange(start, end int64, unit RedisUnit) int64 {
+	if start < 0 && end < 0 && start > end {
+		return 0
+	}
+	first, last, ok := r.bitRange(start, end, true, unit)
+	if !ok {
+		return 0
+	}
+	n := int64(0)
+	for first <= last {
+		// whole bytes at a time, bit by bit at the edges
+		if first&7 == 0 && first+7 <= last {
+			n += int64(LookupByteBitsOn[r.bits.byteAt(first/8)])
+			first += 8
+			continue
+		}
+		if r.GetBit(first) {
+			n++
+		}
+		first++
+	}
+	return n
+}
+
+// converts a BITCOUNT/BITPOS range to Redis bit offsets [first, last],
+// clamped to the string the way Redis does, ok is false for empty ranges
+func (r *RedisBits) bitRange(start, end int64, end_given bool, unit RedisUnit) (first, last uint, ok bool) {
+	totlen := int64(r.Len())
+	if unit == KREDIS_UNIT_BIT {
+		totlen <<= 3
+	}
+	if !end_given {
+		end = totlen - 1
+	}
+	if start < 0 {
+		start += totlen
+	}
+	if end < 0 {
+		end += totlen
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= totlen {
+		end = totlen - 1
+	}
+	if start > end {
+		return 0, 0, false
+	}
+	if unit == KREDIS_UNIT_BIT {
+		return uint(start), uint(end), true
+	}
+	return uint(start) * 8, uint(end)*8 + 7, true
+}
+
+// position of the first bit set to bit, BITPOS key bit
+// looking for a 0 in a string of 1s gives the first bit past the end, since
+// Redis treats the string as padded with 0s, looking for a 1 in a missing
+// key gives -1 and a 0 gives 0
+func (r *RedisBits) BitPos(bit bool) int64 {
+	if r.Len() == 0 {
+		if bit {
+			return -1
+		}
+		return 0
+	}
+	return r.bitPos(bit, 0, 0, false, KREDIS_UNIT_BYTE)
+}
+
+// same as BitPos, starting at byte start, BITPOS key bit start
+func (r *RedisBits) BitPosFrom(bit bool, start int64) int64 {
+	if r.Len() == 0 {
+		return r.BitPos(bit)
+	}
+	return r.bitPos(bit, start, 0, false, KREDIS_UNIT_BYTE)
+}
+
+// position of the first bit set to bit within [start, end] counted in
+// unit, negative indexes count from the end, -1 if there is none, the
+// padding past the end doesn't count, BITPOS key bit start end [BYTE|BIT]
+func (r *RedisBits) BitPosRange(bit bool, start, end int64, unit RedisUnit) int64 {
+	if r.Len() == 0 {
+		return r.BitPos(bit)
+	}
+	return r.bitPos(bit, start, end, true, unit)
+}
+
+func (r *RedisBits) bitPos(bit bool, start, end int64, end_given bool, unit RedisUnit) int64 {
+	first, last, ok := r.bitRange(start, end, end_given, unit)
+	if !ok {
+		return -1
+	}
+	// skip whole bytes that can't hold the bit
+	skip := byte(0xff)
+	if bit {
+		skip = 0
+	}
+	for i := first; i <= last; i++ {
+		if i&7 == 0 && i+7 <= last && r.bits.byteAt(i/8) == skip {
+			i += 7
+			continue
+		}
+		if r.GetBit(i) == bit {
+			return int64(i)
+		}
+	}
+	if !bit && !end_given {
+		return int64(last) + 1
+	}
+	return -1
+}
+
+// replaces the value with op applied to srcs, shorter sources are padded
+// with 0s and the result is as long as the longest, BITOP op dest srcs...
+// returns the length of the result
+func (r *RedisBits) BitOp(op RedisOp, srcs ...*RedisBits) (uint, error) {
+	if len(srcs) == 0 || (op == KREDIS_OP_NOT && len(srcs) != 1) {
+		return 0, ErrRedisBitOp
+	}
+	max_len := uint(0)
+	for _, s := range srcs {
+		max_len = max(max_len, s.Len())
+	}
+
+	res := srcs[0].bits.Clone()
+	res.resize(max_len)
+	for _, s := range srcs[1:] {
+		switch op {
+		case KREDIS_OP_AND:
+			res.And(s.bits)
+		case KREDIS_OP_OR:
+			res.Or(s.bits)
+		case KREDIS_OP_XOR:
+			res.Xor(s.bits)
+		}
+	}
+	if op == KREDIS_OP_NOT {
+		res.Not()
+	}
+	r.bits = res
+	return max_len, nil
+}
+
+// parses a BITFIELD type such as "i8" or "u5"
+func ParseRedisBitfieldType(s string) (RedisBitfieldType, error) {
+	err := fmt.Errorf("mbits: invalid bitfield type %q, use something like i16 u8, the maximum is i64 and u63", s)
+	if len(s) < 2 || (s[0] != 'i' && s[0] != 'u' && s[0] != 'I' && s[0] != 'U') {
+		return RedisBitfieldType{}, err
+	}
+	n, perr := strconv.ParseUint(s[1:], 10, 8)
+	t := RedisBitfieldType{Signed: s[0] == 'i' || s[0] == 'I', Bits: uint(n)}
+	if perr != nil || n < 1 || (t.Signed && n > 64) || (!t.Signed && n > 63) {
+		return RedisBitfieldType{}, err
+	}
+	return t, nil
+}
+
+// returns the field of type t at bit offset, BITFIELD GET
+func (r *RedisBits) BitfieldGet(t RedisBitfieldType, offset uint) int64 {
+	v := uint64(0)
+	for j := uint(0); j < t.Bits; j++ {
+		v <<= 1
+		if r.GetBit(offset + j) {
+			v |= 1
+		}
+	}
+	if t.Signed && t.Bits < 64 && v&(1<<(t.Bits-1)) != 0 {
+		v |= math.MaxUint64 << t.Bits
+	}
+	return int64(v)
+}
+
+// writes the low bits of v into the field
+func (r *RedisBits) bitfieldPut(t RedisBitfieldType, offset uint, v uint64) {
+	for j := uint(0); j < t.Bits; j++ {
+		i := redisBitIndex(offset + j)
+		if v&(1<<(t.Bits-1-j)) != 0 {
+			r.bits.Set(i)
+		} else {
+			r.bits.Clear(i)
+		}
+	}
+}
+
+// stores value into the field of type t at bit offset, growing the string,
+// BITFIELD SET, returns the previous value, or ok false when value doesn't
+// fit and overflow is KREDIS_OVERFLOW_FAIL, or ErrRedisOffset when offset is
+// past KREDIS_MAX_BIT_OFFSET, either way nothing is written
+func (r *RedisBits) BitfieldSet(t RedisBitfieldType, offset uint, value int64, overflow RedisOverflow) (old int64, ok bool, err error) {
+	if err := RedisCheckOffset(uint64(offset)); err != nil {
+		return 0, false, err
+	}
+	r.growBits(offset, t.Bits)
+	old = r.BitfieldGet(t, offset)
+	v, over := bitfieldOverflow(t, uint64(value), 0, overflow)
+	if over && overflow == KREDIS_OVERFLOW_FAIL {
+		return 0, false, nil
+	}
+	r.bitfieldPut(t, offset, v)
+	return old, true, nil
+}
+
+// adds incr to the field of type t at bit offset, growing the string,
+// BITFIELD INCRBY, returns the new value, or ok false when the result
+// doesn't fit and overflow is KREDIS_OVERFLOW_FAIL, or ErrRedisOffset when
+// offset is past KREDIS_MAX_BIT_OFFSET, either way nothing is written
+func (r *RedisBits) BitfieldIncrBy(t RedisBitfieldType, offset uint, incr int64, overflow RedisOverflow) (value int64, ok bool, err error) {
+	if err := RedisCheckOffset(uint64(offset)); err != nil {
+		return 0, false, err
+	}
+	r.growBits(offset, t.Bits)
+	old := r.BitfieldGet(t, offset)
+	v, over := bitfieldOverflow(t, uint64(old), incr, overflow)
+	if over && overflow == KREDIS_OVERFLOW_FAIL {
+		return 0, false, nil
+	}
+	r.bitfieldPut(t, offset, v)
+	if t.Signed {
+		return r.BitfieldGet(t, offset), true, nil
+	}
+	return int64(v), true, nil
+}
+
+// computes value+incr for a field of type t the way Redis does, over is
+// true if the result doesn't fit, the result is then wrapped or saturated
+// according to overflow, value is the field's bits for unsigned types and
+// the sign-extended value for signed ones
+func bitfieldOverflow(t RedisBitfieldType, value uint64, incr int64, overflow RedisOverflow) (res uint64, over bool) {
+	wrap := func() uint64 {
+		c := value + uint64(incr)
+		if t.Bits < 64 {
+			mask := uint64(math.MaxUint64) << t.Bits
+			if t.Signed && c&(1<<(t.Bits-1)) != 0 {
+				c |= mask
+			} else {
+				c &^= mask
+			}
+		}
+		return c
+	}
+
+	if t.Signed {
+		v := int64(value)
+		maxv := int64(math.MaxInt64)
+		if t.Bits < 64 {
+			maxv = 1<<(t.Bits-1) - 1
+		}
+		minv := -maxv - 1
+		maxincr := int64(uint64(maxv) - value)
+		minincr := minv - v
+		switch {
+		case v > maxv || (t.Bits != 64 && incr > maxincr) || (v >= 0 && incr > 0 && incr > maxincr):
+			if overflow == KREDIS_OVERFLOW_SAT {
+				return uint64(maxv), true
+			}
+		case v < minv || (t.Bits != 64 && incr < minincr) || (v < 0 && incr < 0 && incr < minincr):
+			if overflow == KREDIS_OVERFLOW_SAT {
+				return uint64(minv), true
+			}
+		default:
+			return uint64(v + incr), false
+		}
+		return wrap(), true
+	}
+
+	maxv := uint64(1)<<t.Bits - 1
+	maxincr := int64(maxv - value)
+	minincr := -int64(value)
+	switch {
+	case value > maxv || (incr > 0 && incr > maxincr):
+		if overflow == KREDIS_OVERFLOW_SAT {
+			return maxv, true
+		}
+	case incr < 0 && incr < minincr:
+		if overflow == KREDIS_OVERFLOW_SAT {
+			return 0, true
+		}
+	default:
+		return value + uint64(incr), false
+	}
+	return wrap(), true
+}
+
+// RDB encoding constants used by DUMP payloads
+const (
+	krdbTypeString = 0
+	krdbEncInt8    = 0
+	krdbEncInt16   = 1
+	krdbEncInt32   = 2
+	krdbEncLZF     = 3
+)
+
+// serializes the value the way Redis DUMP does, for use with RESTORE
+// the string is always stored uncompressed
+func (r *RedisBits) Dump() []byte {
+	raw := r.Bytes()
+	p := []byte{krdbTypeString}
+	p = appendRdbLen(p, uint64(len(raw)))
+	p = append(p, raw...)
+	p = binary.LittleEndian.AppendUint16(p, KREDIS_RDB_VERSION)
+	return binary.LittleEndian.AppendUint64(p, redisCRC64(0, p))
+}
+
+// replaces the value with the string in a Redis DUMP payload, accepts raw,
+// integer and LZF-compressed strings
+func (r *RedisBits) Restore(payload []byte) error {
+	if len(payload) < 11 {
+		return ErrBadRedisDump
+	}
+	body, footer := payload[:len(payload)-8], payload[len(payload)-8:]
+	if redisCRC64(0, body) != binary.LittleEndian.Uint64(footer) {
+		return fmt.Errorf("%w: bad checksum", ErrBadRedisDump)
+	}
+	body = body[:len(body)-2]
+	if body[0] != krdbTypeString {
+		return fmt.Errorf("%w: type %v isn't a string", ErrBadRedisDump, body[0])
+	}
+	raw, rest, err := readRdbString(body[1:])
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return fmt.Errorf("%w: trailing bytes", ErrBadRedisDump)
+	}
+	r.LoadString(raw)
+	return nil
+}
+
+// appends an RDB length
+func appendRdbLen(p []byte, n uint64) []byte {
+	switch {
+	case n < 1<<6:
+		return append(p, byte(n))
+	case n < 1<<14:
+		return append(p, byte(n>>8)|0x40, byte(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(p, 0x80), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(p, 0x81), n)
+}
+
+// reads an RDB length, encoded is true for the special string encodings,
+// in which case n is the encoding
+func readRdbLen(p []byte) (n uint64, encoded bool, rest []byte, err error) {
+	if len(p) < 1 {
+		return 0, false, nil, ErrBadRedisDump
+	}
+	switch p[0] >> 6 {
+	case 0:
+		return uint64(p[0] & 0x3f), false, p[1:], nil
+	case 1:
+		if len(p) < 2 {
+			return 0, false, nil, ErrBadRedisDump
+		}
+		return uint64(p[0]&0x3f)<<8 | uint64(p[1]), false, p[2:], nil
+	case 3:
+		return uint64(p[0] & 0x3f), true, p[1:], nil
+	}
+	switch {
+	case p[0] == 0x80 && len(p) >= 5:
+		return uint64(binary.BigEndian.Uint32(p[1:])), false, p[5:], nil
+	case p[0] == 0x81 && len(p) >= 9:
+		return binary.BigEndian.Uint64(p[1:]), false, p[9:], nil
+	}
+	return 0, false, nil, ErrBadRedisDump
+}
+
+// reads an RDB string in any of its encodings
+func readRdbString(p []byte) (raw []byte, rest []byte, err error) {
+	n, encoded, p, err := readRdbLen(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !encoded {
+		if uint64(len(p)) < n {
+			return nil, nil, ErrBadRedisDump
+		}
+		return p[:n], p[n:], nil
+	}
+	switch n {
+	case krdbEncInt8:
+		if len(p) < 1 {
+			return nil, nil, ErrBadRedisDump
+		}
+		return strconv.AppendInt(nil, int64(int8(p[0])), 10), p[1:], nil
+	case krdbEncInt16:
+		if len(p) < 2 {
+			return nil, nil, ErrBadRedisDump
+		}
+		return strconv.AppendInt(nil, int64(int16(binary.LittleEndian.Uint16(p))), 10), p[2:], nil
+	case krdbEncInt32:
+		if len(p) < 4 {
+			return nil, nil, ErrBadRedisDump
+		}
+		return strconv.AppendInt(nil, int64(int32(binary.LittleEndian.Uint32(p))), 10), p[4:], nil
+	case krdbEncLZF:
+		clen, _, p, err := readRdbLen(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		ulen, _, p, err := readRdbLen(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		if uint64(len(p)) < clen || ulen > KREDIS_MAX_BIT_OFFSET/8+1 {
+			return nil, nil, ErrBadRedisDump
+		}
+		raw, err := lzfDecompress(p[:clen], int(ulen))
+		return raw, p[clen:], err
+	}
+	return nil, nil, fmt.Errorf("%w: unknown string encoding %v", ErrBadRedisDump, n)
+}
+
+// decompresses LZF data, as used by RDB, into exactly ulen bytes
+func lzfDecompress(in []byte, ulen int) ([]byte, error) {
+	out := make([]byte, 0, ulen)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 32 {
+			// literal run of ctrl+1 bytes
+			n := ctrl + 1
+			if i+n > len(in) || len(out)+n > ulen {
+				return nil, ErrBadRedisDump
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+		// back reference
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, ErrBadRedisDump
+			}
+			n += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, ErrBadRedisDump
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		n += 2
+		if ref < 0 || len(out)+n > ulen {
+			return nil, ErrBadRedisDump
+		}
+		// the reference may overlap what is being written, copy byte by byte
+		for j := 0; j < n; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != ulen {
+		return nil, ErrBadRedisDump
+	}
+	return out, nil
+}
+
+// CRC-64 with the Jones polynomial, reflected, no inversion, as used by
+// Redis for DUMP payloads and RDB files
+var kredisCRC64Table = func() *[256]uint64 {
+	// bit-reversed 0xad93d23594c935a9
+	const poly = 0x95ac9329ac4bc9b5
+	t := new([256]uint64)
+	for i := range t {
+		c := uint64(i)
+		for j := 0; j < 8; j++ {
+			if c&1 != 0 {
+				c = c>>1 ^ poly
+			} else {
+				c >>= 1
+			}
+		}
+		t[i] = c
+	}
+	return t
+}()
+
+// continues the CRC crc over p
+func redisCRC64(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = kredisCRC64Table[byte(crc)^b] ^ crc>>8
+	}
+	return crc
+}
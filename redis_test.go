@@ -0,0 +1,355 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"bytes"
+	"errors"
+	"math/bits"
+	"testing"
+)
+
+// expected values below come from the examples in the Redis command docs
+
+func TestRedisSetBit(t *testing.T) {
+	r := NewRedisBits()
+	if old, err := r.SetBit(7, true); old || err != nil {
+		t.Fatal("SETBIT should return the old value 0")
+	}
+	if !r.GetBit(7) || r.GetBit(0) || r.GetBit(100) {
+		t.Fatal("GETBIT fail")
+	}
+	if !bytes.Equal(r.Bytes(), []byte{0x01}) {
+		t.Fatalf("Expected \\x01, found %x", r.Bytes())
+	}
+	if old, _ := r.SetBit(7, false); !old || !bytes.Equal(r.Bytes(), []byte{0x00}) {
+		t.Fatal("SETBIT clear fail")
+	}
+
+	// grows to exactly the bytes needed
+	r.SetBit(100, true)
+	if r.Len() != 13 {
+		t.Fatalf("Expected 13 bytes, found %v", r.Len())
+	}
+}
+
+func TestRedisOffsetLimit(t *testing.T) {
+	u8, _ := ParseRedisBitfieldType("u8")
+	r := NewRedisBits()
+	if RedisCheckOffset(KREDIS_MAX_BIT_OFFSET) != nil || !errors.Is(RedisCheckOffset(KREDIS_MAX_BIT_OFFSET+1), ErrRedisOffset) {
+		t.Fatal("RedisCheckOffset fail")
+	}
+	if bits.UintSize == 32 {
+		t.Skip("every uint offset is within the limit")
+	}
+	limit := KREDIS_MAX_BIT_OFFSET
+	past := uint(limit + 1)
+	if _, err := r.SetBit(past, true); !errors.Is(err, ErrRedisOffset) {
+		t.Fatalf("Expected ErrRedisOffset, found %v", err)
+	}
+	if _, _, err := r.BitfieldSet(u8, past, 1, KREDIS_OVERFLOW_WRAP); !errors.Is(err, ErrRedisOffset) {
+		t.Fatalf("Expected ErrRedisOffset, found %v", err)
+	}
+	if _, _, err := r.BitfieldIncrBy(u8, past, 1, KREDIS_OVERFLOW_WRAP); !errors.Is(err, ErrRedisOffset) {
+		t.Fatalf("Expected ErrRedisOffset, found %v", err)
+	}
+	if r.Len() != 0 {
+		t.Fatalf("Rejected writes grew the string to %v bytes", r.Len())
+	}
+}
+
+func TestRedisBitCount(t *testing.T) {
+	r := NewRedisBits().LoadString([]byte("foobar"))
+
+	cases := []struct {
+		start, end int64
+		unit       RedisUnit
+		expected   int64
+	}{
+		{0, 0, KREDIS_UNIT_BYTE, 4},
+		{1, 1, KREDIS_UNIT_BYTE, 6},
+		{5, 30, KREDIS_UNIT_BIT, 17},
+		{0, -1, KREDIS_UNIT_BYTE, 26},
+		{-2, -1, KREDIS_UNIT_BYTE, 7},
+		{-100, 100, KREDIS_UNIT_BYTE, 26},
+		{3, 1, KREDIS_UNIT_BYTE, 0},
+		{-1, -5, KREDIS_UNIT_BYTE, 0},
+		{-20, -30, KREDIS_UNIT_BYTE, 0},
+		{0, 0, KREDIS_UNIT_BIT, 0},
+		{1, 1, KREDIS_UNIT_BIT, 1},
+		{0, -1, KREDIS_UNIT_BIT, 26},
+	}
+	if r.BitCount() != 26 {
+		t.Fatalf("BITCOUNT fail, %v", r.BitCount())
+	}
+	for _, c := range cases {
+		if n := r.BitCountRange(c.start, c.end, c.unit); n != c.expected {
+			t.Fatalf("BITCOUNT %v %v %v, expected %v, found %v", c.start, c.end, c.unit, c.expected, n)
+		}
+	}
+	if NewRedisBits().BitCountRange(0, -1, KREDIS_UNIT_BYTE) != 0 {
+		t.Fatal("BITCOUNT of a missing key should be 0")
+	}
+}
+
+func TestRedisBitPos(t *testing.T) {
+	r := NewRedisBits().LoadString([]byte{0xff, 0xf0, 0x00})
+	if p := r.BitPos(false); p != 12 {
+		t.Fatalf("BITPOS 0, expected 12, found %v", p)
+	}
+
+	r.LoadString([]byte{0x00, 0xff, 0xf0})
+	cases := []struct {
+		name     string
+		found    int64
+		expected int64
+	}{
+		{"1 0", r.BitPosFrom(true, 0), 8},
+		{"1 2", r.BitPosFrom(true, 2), 16},
+		{"1 2 -1 BYTE", r.BitPosRange(true, 2, -1, KREDIS_UNIT_BYTE), 16},
+		{"1 7 15 BIT", r.BitPosRange(true, 7, 15, KREDIS_UNIT_BIT), 8},
+		{"1 7 -3 BIT", r.BitPosRange(true, 7, -3, KREDIS_UNIT_BIT), 8},
+		{"0 1 2", r.BitPosRange(false, 1, 2, KREDIS_UNIT_BYTE), 20},
+		{"1 9 7 BIT", r.BitPosRange(true, 9, 7, KREDIS_UNIT_BIT), -1},
+	}
+	for _, c := range cases {
+		if c.found != c.expected {
+			t.Fatalf("BITPOS %v, expected %v, found %v", c.name, c.expected, c.found)
+		}
+	}
+
+	// all ones: the padding counts unless an end is given
+	r.LoadString([]byte{0xff, 0xff, 0xff})
+	if p := r.BitPos(false); p != 24 {
+		t.Fatalf("BITPOS 0 on ones, expected 24, found %v", p)
+	}
+	if p := r.BitPosFrom(false, 1); p != 24 {
+		t.Fatalf("BITPOS 0 1 on ones, expected 24, found %v", p)
+	}
+	if p := r.BitPosRange(false, 0, -1, KREDIS_UNIT_BYTE); p != -1 {
+		t.Fatalf("BITPOS 0 0 -1 on ones, expected -1, found %v", p)
+	}
+
+	r.LoadString([]byte{0x00, 0x00, 0x00})
+	if p := r.BitPos(true); p != -1 {
+		t.Fatalf("BITPOS 1 on zeros, expected -1, found %v", p)
+	}
+	if p := r.BitPosRange(true, 7, -3, KREDIS_UNIT_BIT); p != -1 {
+		t.Fatalf("BITPOS 1 7 -3 BIT on zeros, expected -1, found %v", p)
+	}
+
+	missing := NewRedisBits()
+	if missing.BitPos(true) != -1 || missing.BitPos(false) != 0 || missing.BitPosRange(false, 5, 10, KREDIS_UNIT_BIT) != 0 {
+		t.Fatal("BITPOS on a missing key fail")
+	}
+}
+
+func TestRedisBitOp(t *testing.T) {
+	key1 := NewRedisBits().LoadString([]byte("foobar"))
+	key2 := NewRedisBits().LoadString([]byte("abcdef"))
+
+	dest := NewRedisBits()
+	n, err := dest.BitOp(KREDIS_OP_AND, key1, key2)
+	if err != nil || n != 6 || string(dest.Bytes()) != "`bc`ab" {
+		t.Fatalf("BITOP AND fail, %v %q", n, dest.Bytes())
+	}
+
+	// shorter sources are padded with zeros
+	short := NewRedisBits().LoadString([]byte{0xff})
+	long := NewRedisBits().LoadString([]byte{0x0f, 0xf0, 0x3c})
+	cases := []struct {
+		op       RedisOp
+		srcs     []*RedisBits
+		expected []byte
+	}{
+		{KREDIS_OP_AND, []*RedisBits{short, long}, []byte{0x0f, 0x00, 0x00}},
+		{KREDIS_OP_OR, []*RedisBits{short, long}, []byte{0xff, 0xf0, 0x3c}},
+		{KREDIS_OP_XOR, []*RedisBits{short, long}, []byte{0xf0, 0xf0, 0x3c}},
+		{KREDIS_OP_NOT, []*RedisBits{long}, []byte{0xf0, 0x0f, 0xc3}},
+		{KREDIS_OP_AND, []*RedisBits{NewRedisBits(), NewRedisBits()}, []byte{}},
+	}
+	for _, c := range cases {
+		n, err := dest.BitOp(c.op, c.srcs...)
+		if err != nil || n != uint(len(c.expected)) || !bytes.Equal(dest.Bytes(), c.expected) {
+			t.Fatalf("BITOP %v fail, %v %x", c.op, n, dest.Bytes())
+		}
+	}
+
+	if _, err := dest.BitOp(KREDIS_OP_NOT, short, long); err != ErrRedisBitOp {
+		t.Fatalf("Expected ErrRedisBitOp, found %v", err)
+	}
+}
+
+func TestRedisBitfield(t *testing.T) {
+	i5, _ := ParseRedisBitfieldType("i5")
+	u4, _ := ParseRedisBitfieldType("u4")
+	u2, _ := ParseRedisBitfieldType("u2")
+
+	// BITFIELD mykey INCRBY i5 100 1 GET u4 0
+	r := NewRedisBits()
+	if v, ok, _ := r.BitfieldIncrBy(i5, 100, 1, KREDIS_OVERFLOW_WRAP); !ok || v != 1 {
+		t.Fatalf("INCRBY i5 fail, %v", v)
+	}
+	if v := r.BitfieldGet(u4, 0); v != 0 {
+		t.Fatalf("GET u4 fail, %v", v)
+	}
+	if r.Len() != 14 {
+		t.Fatalf("Expected 14 bytes, found %v", r.Len())
+	}
+
+	// BITFIELD mykey incrby u2 100 1 OVERFLOW SAT incrby u2 102 1, four times
+	r = NewRedisBits()
+	wrapped := []int64{1, 2, 3, 0}
+	saturated := []int64{1, 2, 3, 3}
+	for i := range wrapped {
+		w, _, _ := r.BitfieldIncrBy(u2, 100, 1, KREDIS_OVERFLOW_WRAP)
+		s, _, _ := r.BitfieldIncrBy(u2, 102, 1, KREDIS_OVERFLOW_SAT)
+		if w != wrapped[i] || s != saturated[i] {
+			t.Fatalf("Round %v, expected %v %v, found %v %v", i, wrapped[i], saturated[i], w, s)
+		}
+	}
+	// OVERFLOW FAIL incrby u2 102 1
+	if _, ok, _ := r.BitfieldIncrBy(u2, 102, 1, KREDIS_OVERFLOW_FAIL); ok {
+		t.Fatal("OVERFLOW FAIL should fail")
+	}
+	if v := r.BitfieldGet(u2, 102); v != 3 {
+		t.Fatalf("FAIL modified the field, %v", v)
+	}
+}
+
+func TestRedisBitfieldSet(t *testing.T) {
+	i8, _ := ParseRedisBitfieldType("i8")
+	u8, _ := ParseRedisBitfieldType("u8")
+	i64, _ := ParseRedisBitfieldType("i64")
+
+	r := NewRedisBits()
+	if old, _, _ := r.BitfieldSet(u8, 0, 255, KREDIS_OVERFLOW_WRAP); old != 0 {
+		t.Fatalf("SET u8 fail, %v", old)
+	}
+	// the byte is 0xff, MSB first, read as i8 that's -1
+	if v := r.BitfieldGet(i8, 0); v != -1 || !bytes.Equal(r.Bytes(), []byte{0xff}) {
+		t.Fatalf("GET i8 fail, %v", v)
+	}
+
+	cases := []struct {
+		t        RedisBitfieldType
+		value    int64
+		overflow RedisOverflow
+		ok       bool
+		stored   int64
+	}{
+		{i8, 200, KREDIS_OVERFLOW_WRAP, true, -56},
+		{i8, 200, KREDIS_OVERFLOW_SAT, true, 127},
+		{i8, -200, KREDIS_OVERFLOW_SAT, true, -128},
+		{i8, 200, KREDIS_OVERFLOW_FAIL, false, -128},
+		{u8, 256, KREDIS_OVERFLOW_WRAP, true, 0},
+		{u8, -1, KREDIS_OVERFLOW_SAT, true, 255},
+		{u8, -1, KREDIS_OVERFLOW_WRAP, true, 255},
+	}
+	for _, c := range cases {
+		_, ok, _ := r.BitfieldSet(c.t, 0, c.value, c.overflow)
+		if ok != c.ok || r.BitfieldGet(c.t, 0) != c.stored {
+			t.Fatalf("SET %v %v %v, expected %v, found %v", c.t, c.value, c.overflow, c.stored, r.BitfieldGet(c.t, 0))
+		}
+	}
+
+	// 64-bit fields saturate at the int64 limits
+	r.BitfieldSet(i64, 3, 1<<63-1, KREDIS_OVERFLOW_WRAP)
+	if v, _, _ := r.BitfieldIncrBy(i64, 3, 1, KREDIS_OVERFLOW_SAT); v != 1<<63-1 {
+		t.Fatalf("INCRBY i64 SAT fail, %v", v)
+	}
+	if v, _, _ := r.BitfieldIncrBy(i64, 3, 1, KREDIS_OVERFLOW_WRAP); v != -1<<63 {
+		t.Fatalf("INCRBY i64 WRAP fail, %v", v)
+	}
+}
+
+func TestRedisBitfieldType(t *testing.T) {
+	for _, s := range []string{"i1", "i64", "u1", "u63", "I8", "U16"} {
+		if _, err := ParseRedisBitfieldType(s); err != nil {
+			t.Fatalf("%v should parse, %v", s, err)
+		}
+	}
+	for _, s := range []string{"", "i", "i0", "i65", "u64", "x8", "i-1"} {
+		if _, err := ParseRedisBitfieldType(s); err == nil {
+			t.Fatalf("%v should not parse", s)
+		}
+	}
+}
+
+func TestRedisCRC64(t *testing.T) {
+	if c := redisCRC64(0, []byte("123456789")); c != 0xe9c6d914c4b8d9ca {
+		t.Fatalf("CRC64 fail, %x", c)
+	}
+}
+
+func TestRedisDumpRestore(t *testing.T) {
+	// DUMP of SET mykey 10, from the DUMP docs, an int-encoded string
+	r := NewRedisBits()
+	if err := r.Restore([]byte("\x00\xc0\n\n\x00n\x9fWE\x0e\xaec\xbb")); err != nil {
+		t.Fatal(err)
+	}
+	if string(r.Bytes()) != "10" {
+		t.Fatalf("Restore fail, %q", r.Bytes())
+	}
+
+	r.LoadString(bytes.Repeat([]byte{0xa5, 0x00, 0x3c}, 100))
+	r.SetBit(5000, true)
+	back := NewRedisBits()
+	if err := back.Restore(r.Dump()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(back.Bytes(), r.Bytes()) {
+		t.Fatal("Dump round trip fail")
+	}
+
+	damaged := r.Dump()
+	damaged[5] ^= 0x01
+	if err := back.Restore(damaged); !errors.Is(err, ErrBadRedisDump) {
+		t.Fatalf("Expected ErrBadRedisDump, found %v", err)
+	}
+}
+
+func TestRedisRestoreLZF(t *testing.T) {
+	// "abcabcabcabcX": literal "abc", back reference of 9 bytes 3 back,
+	// literal "X", the way Redis compresses repetitive strings
+	lzf := []byte{0x02, 'a', 'b', 'c', 7 << 5, 9 - 2 - 7, 0x02, 0x00, 'X'}
+	payload := []byte{krdbTypeString, 0xc0 | krdbEncLZF, byte(len(lzf)), 13}
+	payload = append(payload, lzf...)
+	payload = append(payload, 9, 0)
+	crc := redisCRC64(0, payload)
+	for i := 0; i < 8; i++ {
+		payload = append(payload, byte(crc>>(8*i)))
+	}
+
+	r := NewRedisBits()
+	if err := r.Restore(payload); err != nil {
+		t.Fatal(err)
+	}
+	if string(r.Bytes()) != "abcabcabcabcX" {
+		t.Fatalf("LZF fail, %q", r.Bytes())
+	}
+}
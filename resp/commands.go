@@ -0,0 +1,565 @@
+package resp
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/dorind/mbits"
+)
+
+type commandFunc func(s *Server, w *replyWriter, args [][]byte)
+
+type command struct {
+	fn commandFunc
+	// as in Redis, the exact number of args including the command name, or
+	// the minimum when negative
+	arity int
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"ping":        {cmdPing, -1},
+		"echo":        {cmdEcho, 2},
+		"select":      {cmdSelect, 2},
+		"command":     {cmdCommand, -1},
+		"get":         {cmdGet, 2},
+		"set":         {cmdSet, -3},
+		"del":         {cmdDel, -2},
+		"exists":      {cmdExists, -2},
+		"strlen":      {cmdStrlen, 2},
+		"dbsize":      {cmdDbsize, 1},
+		"flushdb":     {cmdFlush, -1},
+		"flushall":    {cmdFlush, -1},
+		"setbit":      {cmdSetbit, 4},
+		"getbit":      {cmdGetbit, 3},
+		"bitcount":    {cmdBitcount, -2},
+		"bitpos":      {cmdBitpos, -3},
+		"bitop":       {cmdBitop, -4},
+		"bitfield":    {cmdBitfield, -2},
+		"bitfield_ro": {cmdBitfieldRO, -2},
+	}
+}
+
+const (
+	kerrSyntax      = "ERR syntax error"
+	kerrNotInteger  = "ERR value is not an integer or out of range"
+	kerrBitOffset   = "ERR bit offset is not an integer or out of range"
+	kerrBitValue    = "ERR bit is not an integer or out of range"
+	kerrBitfieldTyp = "ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is."
+)
+
+// runs one command, returns true when the connection should be closed
+func (s *Server) execute(w *replyWriter, args [][]byte) bool {
+	name := strings.ToLower(string(args[0]))
+	if name == "quit" {
+		w.status("OK")
+		return true
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		w.error("ERR unknown command '" + string(args[0]) + "'")
+		return false
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		w.error("ERR wrong number of arguments for '" + name + "' command")
+		return false
+	}
+	s.mu.Lock()
+	cmd.fn(s, w, args)
+	s.mu.Unlock()
+	return false
+}
+
+func parseInt(b []byte) (int64, bool) {
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	return n, err == nil
+}
+
+// parses a bit offset, bits > 0 allows the "#N" form of BITFIELD, meaning
+// N * bits
+// the range is RedisBits' to enforce, it's checked here as well so a
+// BITFIELD fails before any of its ops runs, as in Redis
+func parseBitOffset(b []byte, bits uint) (uint, bool) {
+	hash := bits > 0 && len(b) > 0 && b[0] == '#'
+	if hash {
+		b = b[1:]
+	}
+	n, err := strconv.ParseUint(string(b), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	if hash {
+		if n > math.MaxUint64/uint64(bits) {
+			return 0, false
+		}
+		n *= uint64(bits)
+	}
+	if mbits.RedisCheckOffset(n) != nil {
+		return 0, false
+	}
+	return uint(n), true
+}
+
+func parseUnit(b []byte) (mbits.RedisUnit, bool) {
+	switch {
+	case bytes.EqualFold(b, []byte("byte")):
+		return mbits.KREDIS_UNIT_BYTE, true
+	case bytes.EqualFold(b, []byte("bit")):
+		return mbits.KREDIS_UNIT_BIT, true
+	}
+	return 0, false
+}
+
+func cmdPing(s *Server, w *replyWriter, args [][]byte) {
+	switch len(args) {
+	case 1:
+		w.status("PONG")
+	case 2:
+		w.bulk(args[1])
+	default:
+		w.error("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func cmdEcho(s *Server, w *replyWriter, args [][]byte) {
+	w.bulk(args[1])
+}
+
+// there is a single database
+func cmdSelect(s *Server, w *replyWriter, args [][]byte) {
+	n, ok := parseInt(args[1])
+	switch {
+	case !ok:
+		w.error(kerrNotInteger)
+	case n != 0:
+		w.error("ERR DB index is out of range")
+	default:
+		w.status("OK")
+	}
+}
+
+// clients send COMMAND or COMMAND DOCS on connect, an empty list is enough
+func cmdCommand(s *Server, w *replyWriter, args [][]byte) {
+	w.array(0)
+}
+
+func cmdGet(s *Server, w *replyWriter, args [][]byte) {
+	r, ok := s.keys[string(args[1])]
+	if !ok {
+		w.null()
+		return
+	}
+	w.bulk(r.Bytes())
+}
+
+// SET key value [NX|XX]
+func cmdSet(s *Server, w *replyWriter, args [][]byte) {
+	nx, xx := false, false
+	for _, opt := range args[3:] {
+		switch {
+		case bytes.EqualFold(opt, []byte("nx")):
+			nx = true
+		case bytes.EqualFold(opt, []byte("xx")):
+			xx = true
+		default:
+			w.error(kerrSyntax)
+			return
+		}
+	}
+	if nx && xx {
+		w.error(kerrSyntax)
+		return
+	}
+	key := string(args[1])
+	_, exists := s.keys[key]
+	if (nx && exists) || (xx && !exists) {
+		w.null()
+		return
+	}
+	s.keys[key] = mbits.NewRedisBits().LoadString(args[2])
+	w.status("OK")
+}
+
+func cmdDel(s *Server, w *replyWriter, args [][]byte) {
+	n := int64(0)
+	for _, key := range args[1:] {
+		if _, ok := s.keys[string(key)]; ok {
+			delete(s.keys, string(key))
+			n++
+		}
+	}
+	w.integer(n)
+}
+
+func cmdExists(s *Server, w *replyWriter, args [][]byte) {
+	n := int64(0)
+	for _, key := range args[1:] {
+		if _, ok := s.keys[string(key)]; ok {
+			n++
+		}
+	}
+	w.integer(n)
+}
+
+func cmdStrlen(s *Server, w *replyWriter, args [][]byte) {
+	n := int64(0)
+	if r, ok := s.keys[string(args[1])]; ok {
+		n = int64(r.Len())
+	}
+	w.integer(n)
+}
+
+func cmdDbsize(s *Server, w *replyWriter, args [][]byte) {
+	w.integer(int64(len(s.keys)))
+}
+
+func cmdFlush(s *Server, w *replyWriter, args [][]byte) {
+	clear(s.keys)
+	w.status("OK")
+}
+
+// SETBIT key offset value
+func cmdSetbit(s *Server, w *replyWriter, args [][]byte) {
+	offset, ok := parseBitOffset(args[2], 0)
+	if !ok {
+		w.error(kerrBitOffset)
+		return
+	}
+	var value bool
+	switch string(args[3]) {
+	case "0":
+	case "1":
+		value = true
+	default:
+		w.error(kerrBitValue)
+		return
+	}
+	key := string(args[1])
+	r, exists := s.keys[key]
+	if !exists {
+		r = mbits.NewRedisBits()
+		s.keys[key] = r
+	}
+	old, err := r.SetBit(offset, value)
+	switch {
+	case err != nil:
+		w.error(kerrBitOffset)
+	case old:
+		w.integer(1)
+	default:
+		w.integer(0)
+	}
+}
+
+// GETBIT key offset
+func cmdGetbit(s *Server, w *replyWriter, args [][]byte) {
+	offset, ok := parseBitOffset(args[2], 0)
+	if !ok {
+		w.error(kerrBitOffset)
+		return
+	}
+	if r, exists := s.keys[string(args[1])]; exists && r.GetBit(offset) {
+		w.integer(1)
+		return
+	}
+	w.integer(0)
+}
+
+// BITCOUNT key [start end [BYTE|BIT]]
+func cmdBitcount(s *Server, w *replyWriter, args [][]byte) {
+	var start, end int64
+	unit := mbits.KREDIS_UNIT_BYTE
+	switch len(args) {
+	case 2:
+	case 4, 5:
+		var ok1, ok2 bool
+		start, ok1 = parseInt(args[2])
+		end, ok2 = parseInt(args[3])
+		if !ok1 || !ok2 {
+			w.error(kerrNotInteger)
+			return
+		}
+		if len(args) == 5 {
+			var ok bool
+			if unit, ok = parseUnit(args[4]); !ok {
+				w.error(kerrSyntax)
+				return
+			}
+		}
+	default:
+		w.error(kerrSyntax)
+		return
+	}
+	r, exists := s.keys[string(args[1])]
+	if !exists {
+		w.integer(0)
+		return
+	}
+	if len(args) == 2 {
+		w.integer(r.BitCount())
+		return
+	}
+	w.integer(r.BitCountRange(start, end, unit))
+}
+
+// BITPOS key bit [start [end [BYTE|BIT]]]
+func cmdBitpos(s *Server, w *replyWriter, args [][]byte) {
+	var bit bool
+	switch string(args[2]) {
+	case "0":
+	case "1":
+		bit = true
+	default:
+		w.error("ERR The bit argument must be 1 or 0.")
+		return
+	}
+	if len(args) > 6 {
+		w.error(kerrSyntax)
+		return
+	}
+	var start, end int64
+	unit := mbits.KREDIS_UNIT_BYTE
+	for i, arg := range args[3:] {
+		if i == 2 {
+			var ok bool
+			if unit, ok = parseUnit(arg); !ok {
+				w.error(kerrSyntax)
+				return
+			}
+			continue
+		}
+		n, ok := parseInt(arg)
+		if !ok {
+			w.error(kerrNotInteger)
+			return
+		}
+		if i == 0 {
+			start = n
+		} else {
+			end = n
+		}
+	}
+
+	r, exists := s.keys[string(args[1])]
+	switch {
+	case !exists:
+		w.integer(mbits.NewRedisBits().BitPos(bit))
+	case r.Len() == 0:
+		// an existing empty string has no bits to search, unlike a missing key
+		w.integer(-1)
+	case len(args) == 3:
+		w.integer(r.BitPos(bit))
+	case len(args) == 4:
+		w.integer(r.BitPosFrom(bit, start))
+	default:
+		w.integer(r.BitPosRange(bit, start, end, unit))
+	}
+}
+
+// BITOP op destkey key [key ...]
+func cmdBitop(s *Server, w *replyWriter, args [][]byte) {
+	var op mbits.RedisOp
+	switch strings.ToLower(string(args[1])) {
+	case "and":
+		op = mbits.KREDIS_OP_AND
+	case "or":
+		op = mbits.KREDIS_OP_OR
+	case "xor":
+		op = mbits.KREDIS_OP_XOR
+	case "not":
+		op = mbits.KREDIS_OP_NOT
+		if len(args) != 4 {
+			w.error("ERR BITOP NOT must be called with a single source key.")
+			return
+		}
+	default:
+		w.error(kerrSyntax)
+		return
+	}
+
+	srcs := make([]*mbits.RedisBits, 0, len(args)-3)
+	for _, key := range args[3:] {
+		r, exists := s.keys[string(key)]
+		if !exists {
+			r = mbits.NewRedisBits()
+		}
+		srcs = append(srcs, r)
+	}
+	dest := mbits.NewRedisBits()
+	n, err := dest.BitOp(op, srcs...)
+	if err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+	// as in Redis, an empty result deletes the destination
+	if n == 0 {
+		delete(s.keys, string(args[2]))
+	} else {
+		s.keys[string(args[2])] = dest
+	}
+	w.integer(int64(n))
+}
+
+type bitfieldOp struct {
+	kind     byte // 'g'et, 's'et or 'i'ncrby
+	t        mbits.RedisBitfieldType
+	offset   uint
+	value    int64
+	overflow mbits.RedisOverflow
+}
+
+// parses all BITFIELD subcommands before running any, writes the error
+// reply and returns nil on failure
+func parseBitfield(w *replyWriter, args [][]byte, read_only bool) []bitfieldOp {
+	var ops []bitfieldOp
+	overflow := mbits.KREDIS_OVERFLOW_WRAP
+	for i := 0; i < len(args); {
+		sub := strings.ToLower(string(args[i]))
+		if read_only && sub != "get" {
+			w.error("ERR BITFIELD_RO only supports the GET subcommand")
+			return nil
+		}
+		nargs := 0
+		switch sub {
+		case "get":
+			nargs = 2
+		case "set", "incrby":
+			nargs = 3
+		case "overflow":
+			nargs = 1
+		default:
+			w.error(kerrSyntax)
+			return nil
+		}
+		if i+nargs >= len(args) {
+			w.error(kerrSyntax)
+			return nil
+		}
+
+		if sub == "overflow" {
+			switch strings.ToLower(string(args[i+1])) {
+			case "wrap":
+				overflow = mbits.KREDIS_OVERFLOW_WRAP
+			case "sat":
+				overflow = mbits.KREDIS_OVERFLOW_SAT
+			case "fail":
+				overflow = mbits.KREDIS_OVERFLOW_FAIL
+			default:
+				w.error("ERR Invalid OVERFLOW type specified")
+				return nil
+			}
+			i += 2
+			continue
+		}
+
+		t, err := mbits.ParseRedisBitfieldType(string(args[i+1]))
+		if err != nil {
+			w.error(kerrBitfieldTyp)
+			return nil
+		}
+		offset, ok := parseBitOffset(args[i+2], t.Bits)
+		if !ok {
+			w.error(kerrBitOffset)
+			return nil
+		}
+		op := bitfieldOp{kind: sub[0], t: t, offset: offset, overflow: overflow}
+		if nargs == 3 {
+			if op.value, ok = parseInt(args[i+3]); !ok {
+				w.error(kerrNotInteger)
+				return nil
+			}
+		}
+		ops = append(ops, op)
+		i += nargs + 1
+	}
+	if ops == nil {
+		ops = []bitfieldOp{}
+	}
+	return ops
+}
+
+// BITFIELD key [GET type offset | SET type offset value |
+// INCRBY type offset increment | OVERFLOW WRAP|SAT|FAIL ...]
+func cmdBitfield(s *Server, w *replyWriter, args [][]byte) {
+	bitfield(s, w, args, false)
+}
+
+// BITFIELD_RO key [GET type offset ...]
+func cmdBitfieldRO(s *Server, w *replyWriter, args [][]byte) {
+	bitfield(s, w, args, true)
+}
+
+func bitfield(s *Server, w *replyWriter, args [][]byte, read_only bool) {
+	ops := parseBitfield(w, args[2:], read_only)
+	if ops == nil {
+		return
+	}
+	key := string(args[1])
+	r, exists := s.keys[key]
+	if !exists {
+		r = mbits.NewRedisBits()
+		// a missing key is only created by writes
+		for _, op := range ops {
+			if op.kind != 'g' {
+				s.keys[key] = r
+				break
+			}
+		}
+	}
+
+	w.array(len(ops))
+	for _, op := range ops {
+		switch op.kind {
+		case 'g':
+			w.integer(r.BitfieldGet(op.t, op.offset))
+		case 's':
+			old, ok, err := r.BitfieldSet(op.t, op.offset, op.value, op.overflow)
+			bitfieldReply(w, old, ok, err)
+		case 'i':
+			v, ok, err := r.BitfieldIncrBy(op.t, op.offset, op.value, op.overflow)
+			bitfieldReply(w, v, ok, err)
+		}
+	}
+}
+
+// replies to one BITFIELD write, nil when it failed on overflow
+func bitfieldReply(w *replyWriter, v int64, ok bool, err error) {
+	switch {
+	case err != nil:
+		w.error(kerrBitOffset)
+	case ok:
+		w.integer(v)
+	default:
+		w.null()
+	}
+}
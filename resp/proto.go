@@ -0,0 +1,219 @@
+package resp
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// limits on what a client may send, the same as Redis' defaults
+const (
+	KMAX_ARGS       = 1024 * 1024
+	KMAX_BULK_LEN   = 512 << 20
+	KMAX_INLINE_LEN = 64 << 10
+)
+
+// most memory reserved for a request ahead of its data arriving, larger
+// requests grow as they are read, so a header alone can't make the server
+// allocate much
+const (
+	kpreallocArgs = 1024
+	kbulkChunk    = 64 << 10
+)
+
+// a malformed request, the connection is closed after replying
+type protocolError string
+
+func (e protocolError) Error() string {
+	return "ERR Protocol error: " + string(e)
+}
+
+// reads a command, either a RESP array of bulk strings or an inline command
+// such as those typed into telnet
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r, KMAX_INLINE_LEN)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return inlineCommand(line), nil
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > KMAX_ARGS {
+		return nil, protocolError("invalid multibulk length")
+	}
+	args := make([][]byte, 0, min(max(n, 0), kpreallocArgs))
+	for i := 0; i < n; i++ {
+		line, err := readLine(r, KMAX_INLINE_LEN)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, protocolError(fmt.Sprintf("expected '$', got '%c'", firstByte(line)))
+		}
+		l, err := strconv.Atoi(string(line[1:]))
+		if err != nil || l < 0 || l > KMAX_BULK_LEN {
+			return nil, protocolError("invalid bulk length")
+		}
+		arg, err := readBulk(r, l+2)
+		if err != nil {
+			return nil, err
+		}
+		if arg[l] != '\r' || arg[l+1] != '\n' {
+			return nil, protocolError("bulk string not terminated by CRLF")
+		}
+		args = append(args, arg[:l])
+	}
+	return args, nil
+}
+
+// reads n bytes, allocating at most kbulkChunk more than has arrived
+func readBulk(r *bufio.Reader, n int) ([]byte, error) {
+	buf := make([]byte, 0, min(n, kbulkChunk))
+	for len(buf) < n {
+		chunk := min(n-len(buf), kbulkChunk)
+		buf = slices.Grow(buf, chunk)
+		if _, err := io.ReadFull(r, buf[len(buf):len(buf)+chunk]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		buf = buf[:len(buf)+chunk]
+	}
+	return buf, nil
+}
+
+func firstByte(line []byte) byte {
+	if len(line) == 0 {
+		return ' '
+	}
+	return line[0]
+}
+
+// reads a line terminated by \r\n or a bare \n, without the terminator
+func readLine(r *bufio.Reader, limit int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if len(line) > limit {
+			return nil, protocolError("too big inline request")
+		}
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+// splits an inline command on spaces, double quotes group words
+func inlineCommand(line []byte) [][]byte {
+	var args [][]byte
+	for _, f := range splitQuoted(string(line)) {
+		args = append(args, []byte(f))
+	}
+	return args
+}
+
+func splitQuoted(s string) []string {
+	var r []string
+	var cur strings.Builder
+	quoted, in := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+			in = true
+		case (c == ' ' || c == '\t') && !quoted:
+			if in {
+				r = append(r, cur.String())
+				cur.Reset()
+				in = false
+			}
+		default:
+			cur.WriteByte(c)
+			in = true
+		}
+	}
+	if in {
+		r = append(r, cur.String())
+	}
+	return r
+}
+
+// writes RESP2 replies, errors are kept until Flush
+type replyWriter struct {
+	w *bufio.Writer
+}
+
+func (w *replyWriter) status(s string) {
+	w.w.WriteString("+" + s + "\r\n")
+}
+
+func (w *replyWriter) error(s string) {
+	w.w.WriteString("-" + s + "\r\n")
+}
+
+func (w *replyWriter) integer(n int64) {
+	w.w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w *replyWriter) bulk(b []byte) {
+	w.w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.w.Write(b)
+	w.w.WriteString("\r\n")
+}
+
+func (w *replyWriter) null() {
+	w.w.WriteString("$-1\r\n")
+}
+
+func (w *replyWriter) array(n int) {
+	w.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+func (w *replyWriter) Flush() error {
+	return w.w.Flush()
+}
@@ -0,0 +1,199 @@
+// Package resp serves BitBuffers over the Redis RESP2 protocol, so existing
+// Redis clients can use them as string bitmaps, e.g. in integration tests
+package resp
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/dorind/mbits"
+)
+
+// returned by Serve once the server is closed
+var ErrServerClosed = errors.New("resp: server closed")
+
+// Server keeps a keyspace of string bitmaps, each backed by a BitBuffer, and
+// serves it to any number of connections
+// commands are executed one at a time, as in Redis
+type Server struct {
+	// guards keys
+	mu   sync.Mutex
+	keys map[string]*mbits.RedisBits
+
+	// guards listeners, conns and closed
+	cmu       sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// constructs a Server with an empty keyspace and returns pointer to instance
+func NewServer() *Server {
+	return &Server{
+		keys:      map[string]*mbits.RedisBits{},
+		listeners: map[net.Listener]struct{}{},
+		conns:     map[net.Conn]struct{}{},
+	}
+}
+
+// listens on addr and serves in the background, use "127.0.0.1:0" for a
+// random port, returns the address actually listened on
+func (s *Server) Start(addr string) (net.Addr, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go s.Serve(ln)
+	return ln.Addr(), nil
+}
+
+// listens on addr and serves until Close
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// accepts connections on ln until Close, always returns a non-nil error,
+// ErrServerClosed after Close
+func (s *Server) Serve(ln net.Listener) error {
+	s.cmu.Lock()
+	if s.closed {
+		s.cmu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.listeners[ln] = struct{}{}
+	s.cmu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.cmu.Lock()
+			closed := s.closed
+			delete(s.listeners, ln)
+			s.cmu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		s.cmu.Lock()
+		if s.closed {
+			s.cmu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.cmu.Unlock()
+
+		go s.serveConn(conn)
+	}
+}
+
+// stops all listeners, closes all connections and waits for them to finish
+// the keyspace is kept
+func (s *Server) Close() error {
+	s.cmu.Lock()
+	s.closed = true
+	var err error
+	for ln := range s.listeners {
+		if cerr := ln.Close(); err == nil {
+			err = cerr
+		}
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.cmu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// returns a copy of the bitmap under key
+func (s *Server) Bits(key string) (*mbits.BitBuffer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.keys[key]
+	if !ok {
+		return nil, false
+	}
+	return r.BitBuffer().Clone(), true
+}
+
+// stores a copy of b under key, its bytes become the string value
+func (s *Server) SetBits(key string, b *mbits.BitBuffer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[key] = mbits.NewRedisBitsFrom(b.Clone())
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.cmu.Lock()
+		delete(s.conns, conn)
+		s.cmu.Unlock()
+		s.wg.Done()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := &replyWriter{w: bufio.NewWriter(conn)}
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			var perr protocolError
+			if errors.As(err, &perr) {
+				w.error(perr.Error())
+				w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := s.execute(w, args)
+		// pipelined commands get their replies in one write
+		if r.Buffered() == 0 || quit {
+			if w.Flush() != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
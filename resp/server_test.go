@@ -0,0 +1,353 @@
+package resp
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dorind/mbits"
+)
+
+// minimal RESP2 client, replies are decoded to string, int64, nil, error
+// or []any
+type testClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, addr net.Addr) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{conn: conn, r: bufio.NewReader(conn)}
+}
+
+func startServer(t *testing.T) (*Server, net.Addr) {
+	t.Helper()
+	s := NewServer()
+	addr, err := s.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, addr
+}
+
+func (c *testClient) send(args ...string) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := c.conn.Write([]byte(sb.String())); err != nil {
+		panic(err)
+	}
+}
+
+func (c *testClient) read() any {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		panic(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-':
+		return errors.New(line[1:])
+	case ':':
+		n, _ := strconv.ParseInt(line[1:], 10, 64)
+		return n
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			panic(err)
+		}
+		return string(buf[:n])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+		r := make([]any, n)
+		for i := range r {
+			r[i] = c.read()
+		}
+		return r
+	}
+	panic("bad reply " + line)
+}
+
+func (c *testClient) do(args ...string) any {
+	c.send(args...)
+	return c.read()
+}
+
+func expect(t *testing.T, c *testClient, want any, args ...string) {
+	t.Helper()
+	got := c.do(args...)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("%v: got %v, want %v", args, got, want)
+	}
+}
+
+func expectErr(t *testing.T, c *testClient, prefix string, args ...string) {
+	t.Helper()
+	got := c.do(args...)
+	err, ok := got.(error)
+	if !ok || !strings.HasPrefix(err.Error(), prefix) {
+		t.Errorf("%v: got %v, want error %q", args, got, prefix)
+	}
+}
+
+func TestServerStrings(t *testing.T) {
+	_, addr := startServer(t)
+	c := dial(t, addr)
+
+	expect(t, c, "PONG", "PING")
+	expect(t, c, "hi", "ECHO", "hi")
+	expect(t, c, nil, "GET", "k")
+	expect(t, c, "OK", "SET", "k", "foobar")
+	expect(t, c, "foobar", "GET", "k")
+	expect(t, c, nil, "SET", "k", "x", "NX")
+	expect(t, c, "OK", "SET", "k", "foo", "XX")
+	expect(t, c, int64(3), "STRLEN", "k")
+	expect(t, c, int64(1), "EXISTS", "k")
+	expect(t, c, int64(1), "DEL", "k", "missing")
+	expect(t, c, int64(0), "EXISTS", "k")
+	expect(t, c, "OK", "SELECT", "0")
+	expectErr(t, c, "ERR unknown command", "NOPE")
+	expectErr(t, c, "ERR wrong number of arguments for 'get'", "GET")
+	expectErr(t, c, "ERR syntax error", "SET", "k", "v", "EX")
+}
+
+func TestServerBitCommands(t *testing.T) {
+	_, addr := startServer(t)
+	c := dial(t, addr)
+
+	// examples from the Redis documentation
+	expect(t, c, int64(0), "SETBIT", "mykey", "7", "1")
+	expect(t, c, int64(1), "SETBIT", "mykey", "7", "0")
+	expect(t, c, "\x00", "GET", "mykey")
+	expect(t, c, int64(0), "GETBIT", "mykey", "0")
+	expect(t, c, int64(0), "GETBIT", "missing", "100")
+	expectErr(t, c, "ERR bit offset", "SETBIT", "k", "-1", "1")
+	expectErr(t, c, "ERR bit offset", "SETBIT", "k", "4294967296", "1")
+	expectErr(t, c, "ERR bit is not", "SETBIT", "k", "1", "2")
+
+	expect(t, c, "OK", "SET", "mykey", "foobar")
+	expect(t, c, int64(26), "BITCOUNT", "mykey")
+	expect(t, c, int64(4), "BITCOUNT", "mykey", "0", "0")
+	expect(t, c, int64(6), "BITCOUNT", "mykey", "1", "1")
+	expect(t, c, int64(6), "BITCOUNT", "mykey", "1", "1", "BYTE")
+	expect(t, c, int64(17), "BITCOUNT", "mykey", "5", "30", "BIT")
+	expect(t, c, int64(0), "BITCOUNT", "missing")
+
+	expect(t, c, "OK", "SET", "mykey", "\xff\xf0\x00")
+	expect(t, c, int64(12), "BITPOS", "mykey", "0")
+	expect(t, c, "OK", "SET", "mykey", "\x00\xff\xf0")
+	expect(t, c, int64(8), "BITPOS", "mykey", "1", "0")
+	expect(t, c, int64(16), "BITPOS", "mykey", "1", "2")
+	expect(t, c, int64(16), "BITPOS", "mykey", "1", "2", "-1", "BYTE")
+	expect(t, c, int64(8), "BITPOS", "mykey", "1", "7", "15", "BIT")
+	expect(t, c, int64(-1), "BITPOS", "mykey", "1", "20", "-3", "BIT")
+	expect(t, c, "OK", "SET", "mykey", "\x00\x00\x00")
+	expect(t, c, int64(-1), "BITPOS", "mykey", "1")
+	expect(t, c, int64(0), "BITPOS", "missing", "0")
+	expectErr(t, c, "ERR The bit argument", "BITPOS", "mykey", "2")
+
+	expect(t, c, "OK", "SET", "key1", "foobar")
+	expect(t, c, "OK", "SET", "key2", "abcdef")
+	expect(t, c, int64(6), "BITOP", "AND", "dest", "key1", "key2")
+	expect(t, c, "`bc`ab", "GET", "dest")
+	expect(t, c, int64(0), "BITOP", "OR", "dest", "missing")
+	expect(t, c, int64(0), "EXISTS", "dest")
+	expectErr(t, c, "ERR BITOP NOT", "BITOP", "NOT", "dest", "key1", "key2")
+}
+
+func TestServerBitfield(t *testing.T) {
+	_, addr := startServer(t)
+	c := dial(t, addr)
+
+	expect(t, c, []any{int64(1), int64(0)}, "BITFIELD", "mykey", "INCRBY", "i5", "100", "1", "GET", "u4", "0")
+	expect(t, c, []any{int64(0)}, "BITFIELD_RO", "missing", "GET", "i8", "0")
+	expect(t, c, int64(0), "EXISTS", "missing")
+	expect(t, c, []any{int64(0), int64(0)}, "BITFIELD", "k", "SET", "u8", "#1", "255", "GET", "u8", "0")
+	expect(t, c, "\x00\xff", "GET", "k")
+	expect(t, c, []any{int64(255), nil}, "BITFIELD", "k", "GET", "u8", "#1", "OVERFLOW", "FAIL", "INCRBY", "u8", "8", "1")
+	expect(t, c, []any{int64(255)}, "BITFIELD", "k", "OVERFLOW", "SAT", "INCRBY", "u8", "8", "10")
+	expectErr(t, c, "ERR Invalid bitfield type", "BITFIELD", "k", "GET", "u64", "0")
+	expectErr(t, c, "ERR syntax error", "BITFIELD", "k", "GET", "u8")
+	expectErr(t, c, "ERR BITFIELD_RO only supports", "BITFIELD_RO", "k", "SET", "u8", "0", "1")
+}
+
+func TestServerPipelineAndInline(t *testing.T) {
+	_, addr := startServer(t)
+	c := dial(t, addr)
+
+	for i := range 100 {
+		c.send("SETBIT", "p", strconv.Itoa(i*3), "1")
+	}
+	for range 100 {
+		if got := c.read(); got != int64(0) {
+			t.Fatalf("got %v", got)
+		}
+	}
+	expect(t, c, int64(100), "BITCOUNT", "p")
+
+	if _, err := c.conn.Write([]byte("SET \"in line\" \"a b\"\r\nGET \"in line\"\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.read(); got != "OK" {
+		t.Errorf("got %v", got)
+	}
+	if got := c.read(); got != "a b" {
+		t.Errorf("got %v", got)
+	}
+
+	c.send("QUIT")
+	if got := c.read(); got != "OK" {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestServerProtocolError(t *testing.T) {
+	_, addr := startServer(t)
+	c := dial(t, addr)
+
+	if _, err := c.conn.Write([]byte("*1\r\n:1\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err, ok := c.read().(error); !ok || !strings.HasPrefix(err.Error(), "ERR Protocol error") {
+		t.Errorf("got %v", err)
+	}
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Error("connection still open after a protocol error")
+	}
+}
+
+func TestReadCommandAllocatesAsDataArrives(t *testing.T) {
+	// headers declaring the largest allowed command, then a few bytes
+	for _, req := range []string{
+		"*1048576\r\n$3\r\nabc\r\n",
+		"*1\r\n$536870912\r\nabc",
+	} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := readCommand(bufio.NewReader(strings.NewReader(req)))
+		runtime.ReadMemStats(&after)
+		if !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			t.Fatalf("%q: got %v", req, err)
+		}
+		if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+			t.Errorf("%q: allocated %v bytes", req, n)
+		}
+	}
+
+	// large bulk strings still arrive whole
+	big := strings.Repeat("x", 3*kbulkChunk+5)
+	args, err := readCommand(bufio.NewReader(strings.NewReader(fmt.Sprintf("*2\r\n$3\r\nSET\r\n$%v\r\n%v\r\n", len(big), big))))
+	if err != nil || len(args) != 2 || string(args[1]) != big {
+		t.Fatalf("got %v args, %v", len(args), err)
+	}
+}
+
+func TestServerEmptyValues(t *testing.T) {
+	s, addr := startServer(t)
+	c := dial(t, addr)
+
+	expect(t, c, "OK", "SET", "k", "")
+	got, ok := s.Bits("k")
+	if !ok || got.LenBytes() != 0 {
+		t.Fatalf("Bits() of an empty string, %v bytes", got.LenBytes())
+	}
+
+	s.SetBits("e", &mbits.BitBuffer{})
+	expect(t, c, "", "GET", "e")
+	expect(t, c, int64(0), "STRLEN", "e")
+	s.SetBits("e", got)
+	expect(t, c, int64(0), "STRLEN", "e")
+	expect(t, c, int64(0), "BITCOUNT", "e")
+}
+
+func TestServerKeysAndClose(t *testing.T) {
+	s, addr := startServer(t)
+
+	b := mbits.NewBitBuffer(16)
+	b.Set(0)
+	s.SetBits("k", b)
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := dial(t, addr)
+			for j := range 50 {
+				c.do("SETBIT", "k", strconv.Itoa(8+i*50+j), "1")
+			}
+		}()
+	}
+	wg.Wait()
+
+	got, ok := s.Bits("k")
+	if !ok {
+		t.Fatal("missing key")
+	}
+	if n := got.CountBitsOn(); n != 401 {
+		t.Errorf("CountBitsOn() = %d, want 401", n)
+	}
+	// Redis bit 7 is canonical bit 0
+	c := dial(t, addr)
+	expect(t, c, int64(1), "GETBIT", "k", "7")
+
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Error("connection still open after Close")
+	}
+	if _, err := net.Dial("tcp", addr.String()); err == nil {
+		t.Error("still listening after Close")
+	}
+}
@@ -0,0 +1,124 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"hash/fnv"
+	"iter"
+	"math"
+)
+
+// Hash64 hashes a feature token to 64 bits, SimHash signatures are only
+// comparable when made with the same hash
+type Hash64 func(token string) uint64
+
+// FNV-1a, the hash SimHash uses unless told otherwise, fixed by its
+// specification so signatures don't change across platforms or releases
+func FNV1a64(token string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(token))
+	return h.Sum64()
+}
+
+// the splitmix64 finalizer, derives the hash of every further 64 bits of
+// signature from the previous one
+func chainHash(h uint64) uint64 {
+	h += 0x9e3779b97f4a7c15
+	h = (h ^ h>>30) * 0xbf58476d1ce4e5b9
+	h = (h ^ h>>27) * 0x94d049bb133111eb
+	return h ^ h>>31
+}
+
+// returns the nbits-bit SimHash of the weighted features, hashing tokens
+// with FNV1a64, near-duplicate feature sets give signatures a small
+// HammingDistance apart
+func SimHash(features iter.Seq2[string, float64], nbits uint) *BitBuffer {
+	return SimHashWith(features, nbits, FNV1a64)
+}
+
+// weights are summed in fixed point with KSIMHASH_WEIGHT_BITS fractional
+// bits, weights whose magnitude rounds to 0 count for nothing and those past
+// KSIMHASH_MAX_WEIGHT count as it
+const (
+	KSIMHASH_WEIGHT_BITS = 24
+	KSIMHASH_MAX_WEIGHT  = float64(1 << 38)
+)
+
+// returns the nbits-bit SimHash of the weighted features, hashing tokens
+// with hash
+// panics if nbits is 0
+//
+// bit i of the signature is on when the weights of the features whose hash
+// has bit i on outweigh those whose hash has it off, past the first 64
+// bits every further 64 bits of a feature's hash are chained from the
+// previous ones, so widening a signature keeps its first bits
+//
+// tokens may repeat, their weights add up, NaN weights are skipped
+// weights are rounded to fixed point and summed as integers, which wrap
+// rather than round, so the order of features doesn't matter, iterating a
+// map gives the same signature every time
+func SimHashWith(features iter.Seq2[string, float64], nbits uint, hash Hash64) *BitBuffer {
+	if nbits == 0 {
+		panic("mbits: SimHash needs at least 1 bit")
+	}
+	sums := make([]int64, nbits)
+	for token, weight := range features {
+		w := simHashWeight(weight)
+		if w == 0 {
+			continue
+		}
+		h := hash(token)
+		for i := uint(0); i < nbits; i++ {
+			if i > 0 && i%64 == 0 {
+				h = chainHash(h)
+			}
+			if h>>(i%64)&1 != 0 {
+				sums[i] += w
+			} else {
+				sums[i] -= w
+			}
+		}
+	}
+
+	r := NewBitBuffer((nbits + KBITS_PER_BYTE - 1) / KBITS_PER_BYTE)
+	for i, s := range sums {
+		if s > 0 {
+			r.Set(uint(i))
+		}
+	}
+	return r
+}
+
+// returns weight in fixed point, clamped to KSIMHASH_MAX_WEIGHT so the
+// conversion is the same on every platform
+func simHashWeight(weight float64) int64 {
+	if math.IsNaN(weight) {
+		return 0
+	}
+	weight = max(min(weight, KSIMHASH_MAX_WEIGHT), -KSIMHASH_MAX_WEIGHT)
+	return int64(math.Round(math.Ldexp(weight, KSIMHASH_WEIGHT_BITS)))
+}
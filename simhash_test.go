@@ -0,0 +1,168 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"fmt"
+	"iter"
+	"maps"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// weight 1 per word
+func wordFeatures(text string) map[string]float64 {
+	r := map[string]float64{}
+	for _, w := range strings.Fields(text) {
+		r[w]++
+	}
+	return r
+}
+
+func TestSimHashStable(t *testing.T) {
+	// fixed signatures, these must never change
+	f := wordFeatures("the quick brown fox jumps over the lazy dog")
+	for _, tc := range []struct {
+		nbits uint
+		want  string
+	}{
+		{64, "eeed75541c99b7ca"},
+		{128, "eeed75541c99b7cab1036766453fdbff"},
+	} {
+		got := fmt.Sprintf("%x", SimHash(maps.All(f), tc.nbits).Bytes())
+		if got != tc.want {
+			t.Errorf("SimHash %v bits = %v, want %v", tc.nbits, got, tc.want)
+		}
+	}
+	if h := FNV1a64("a"); h != 0xaf63dc4c8601ec8c {
+		t.Errorf("FNV1a64(a) = %x", h)
+	}
+}
+
+func TestSimHash(t *testing.T) {
+	rnd := rand.New(rand.NewSource(45))
+	base := map[string]float64{}
+	for i := 0; i < 200; i++ {
+		base[fmt.Sprint("token", i)] = 1 + rnd.Float64()
+	}
+	near := maps.Clone(base)
+	for i := 0; i < 5; i++ {
+		delete(near, fmt.Sprint("token", i))
+		near[fmt.Sprint("other", i)] = 1
+	}
+	far := map[string]float64{}
+	for i := 0; i < 200; i++ {
+		far[fmt.Sprint("unrelated", i)] = 1
+	}
+
+	for _, nbits := range []uint{64, 256, 1000} {
+		a := SimHash(maps.All(base), nbits)
+		if a.LenBits() != (nbits+7)/8*8 {
+			t.Fatalf("%v bits: signature of %v bits", nbits, a.LenBits())
+		}
+		for i := nbits; i < a.LenBits(); i++ {
+			if a.IsSet(i) {
+				t.Fatalf("%v bits: bit %v set past the width", nbits, i)
+			}
+		}
+		// map iteration order varies, the signature must not
+		if HammingDistance(a, SimHash(maps.All(base), nbits)) != 0 {
+			t.Fatalf("%v bits: signature depends on feature order", nbits)
+		}
+		dn := HammingDistance(a, SimHash(maps.All(near), nbits))
+		df := HammingDistance(a, SimHash(maps.All(far), nbits))
+		if dn*4 > nbits/2 || df*4 < nbits {
+			t.Fatalf("%v bits: near distance %v, far distance %v", nbits, dn, df)
+		}
+		// widening keeps the first bits
+		w := SimHash(maps.All(base), nbits+64)
+		for i := uint(0); i < nbits; i++ {
+			if w.IsSet(i) != a.IsSet(i) {
+				t.Fatalf("%v bits: widening changed bit %v", nbits, i)
+			}
+		}
+	}
+}
+
+func TestSimHashWith(t *testing.T) {
+	constant := func(string) uint64 { return 0xff00 }
+	f := map[string]float64{"a": 1, "b": 2, "c": -5}
+	// c outweighs a and b, so only bits off in the hash are on
+	r := SimHashWith(maps.All(f), 64, constant)
+	if on, _ := r.CountBits(); on != 56 || r.IsSet(8) || r.IsSet(15) || !r.IsSet(0) {
+		t.Fatalf("got %v", r)
+	}
+	f["c"] = 0
+	r = SimHashWith(maps.All(f), 64, constant)
+	if on, _ := r.CountBits(); on != 8 || !r.IsSet(8) || !r.IsSet(15) {
+		t.Fatalf("got %v", r)
+	}
+	if on, _ := SimHash(maps.All(map[string]float64{}), 100).CountBits(); on != 0 {
+		t.Fatal("empty feature set has bits set")
+	}
+}
+
+func TestSimHashOrder(t *testing.T) {
+	// weights of very different magnitudes, which float sums round
+	// differently depending on order
+	rnd := rand.New(rand.NewSource(7))
+	type feature struct {
+		token  string
+		weight float64
+	}
+	var features []feature
+	for i := 0; i < 500; i++ {
+		features = append(features, feature{fmt.Sprint("t", i), (rnd.Float64() - 0.5) * math.Pow(10, float64(rnd.Intn(7)-6))})
+	}
+	// cancelling out, unless smaller ones are added in between
+	features = append(features, feature{"big", 1e16}, feature{"big", -1e16})
+	seq := func(fs []feature) iter.Seq2[string, float64] {
+		return func(yield func(string, float64) bool) {
+			for _, f := range fs {
+				if !yield(f.token, f.weight) {
+					return
+				}
+			}
+		}
+	}
+	want := SimHash(seq(features), 256)
+	for i := 0; i < 20; i++ {
+		rnd.Shuffle(len(features), func(a, b int) { features[a], features[b] = features[b], features[a] })
+		if got := SimHash(seq(features), 256); HammingDistance(got, want) != 0 {
+			t.Fatalf("shuffle %v: signature depends on feature order", i)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("0 bits should panic")
+		}
+	}()
+	SimHash(seq(features), 0)
+}
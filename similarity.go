@@ -0,0 +1,142 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"math"
+	"math/bits"
+)
+
+// similarity metrics between buffers, each computed in a single pass over
+// the words without allocating
+// buffers of different lengths compare as if the shorter one was padded
+// with off bits, the same as Or() and Xor() treat them
+
+// number of bits set in both a and b, in a, and in b
+func andCounts[W Word](a, b *Bits[W]) (both, na, nb uint) {
+	l := min(len(a.buff), len(b.buff))
+	for i := 0; i < l; i++ {
+		x, y := uint64(a.buff[i]), uint64(b.buff[i])
+		both += uint(bits.OnesCount64(x & y))
+		na += uint(bits.OnesCount64(x))
+		nb += uint(bits.OnesCount64(y))
+	}
+	for _, w := range a.buff[l:] {
+		na += uint(bits.OnesCount64(uint64(w)))
+	}
+	for _, w := range b.buff[l:] {
+		nb += uint(bits.OnesCount64(uint64(w)))
+	}
+	return
+}
+
+// number of bits that differ between a and b, same as XorCount
+func HammingDistance[W Word](a, b *Bits[W]) uint {
+	return XorCount(a, b)
+}
+
+// number of bits set in a AND b
+func AndCount[W Word](a, b *Bits[W]) uint {
+	l := min(len(a.buff), len(b.buff))
+	n := 0
+	for i := 0; i < l; i++ {
+		n += bits.OnesCount64(uint64(a.buff[i] & b.buff[i]))
+	}
+	return uint(n)
+}
+
+// number of bits set in a OR b
+func OrCount[W Word](a, b *Bits[W]) uint {
+	both, na, nb := andCounts(a, b)
+	return na + nb - both
+}
+
+// number of bits set in a XOR b
+func XorCount[W Word](a, b *Bits[W]) uint {
+	long, short := a.buff, b.buff
+	if len(long) < len(short) {
+		long, short = short, long
+	}
+	n := 0
+	for i, w := range short {
+		n += bits.OnesCount64(uint64(long[i] ^ w))
+	}
+	for _, w := range long[len(short):] {
+		n += bits.OnesCount64(uint64(w))
+	}
+	return uint(n)
+}
+
+// number of bits set in a AND NOT b
+func AndNotCount[W Word](a, b *Bits[W]) uint {
+	l := min(len(a.buff), len(b.buff))
+	n := 0
+	for i := 0; i < l; i++ {
+		n += bits.OnesCount64(uint64(a.buff[i] &^ b.buff[i]))
+	}
+	for _, w := range a.buff[l:] {
+		n += bits.OnesCount64(uint64(w))
+	}
+	return uint(n)
+}
+
+// Jaccard index |a AND b| / |a OR b|, 1 when both are empty
+func Jaccard[W Word](a, b *Bits[W]) float64 {
+	both, na, nb := andCounts(a, b)
+	if na+nb == 0 {
+		return 1
+	}
+	return float64(both) / float64(na+nb-both)
+}
+
+// Sørensen-Dice coefficient 2|a AND b| / (|a| + |b|), 1 when both are empty
+func Dice[W Word](a, b *Bits[W]) float64 {
+	both, na, nb := andCounts(a, b)
+	if na+nb == 0 {
+		return 1
+	}
+	return 2 * float64(both) / float64(na+nb)
+}
+
+// Tanimoto coefficient |a AND b| / (|a| + |b| - |a AND b|), which for bit
+// vectors is the same as the Jaccard index, 1 when both are empty
+func Tanimoto[W Word](a, b *Bits[W]) float64 {
+	return Jaccard(a, b)
+}
+
+// cosine similarity |a AND b| / sqrt(|a| |b|), 1 when both are empty and 0
+// when only one is
+func Cosine[W Word](a, b *Bits[W]) float64 {
+	both, na, nb := andCounts(a, b)
+	switch {
+	case na+nb == 0:
+		return 1
+	case na == 0 || nb == 0:
+		return 0
+	}
+	return float64(both) / math.Sqrt(float64(na)*float64(nb))
+}
@@ -0,0 +1,154 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func naiveCounts(a, b *BitBuffer) (and, or, xor, andnot, na, nb uint) {
+	n := max(a.LenBits(), b.LenBits())
+	for i := uint(0); i < n; i++ {
+		x := i < a.LenBits() && a.IsSet(i)
+		y := i < b.LenBits() && b.IsSet(i)
+		if x && y {
+			and++
+		}
+		if x || y {
+			or++
+		}
+		if x != y {
+			xor++
+		}
+		if x && !y {
+			andnot++
+		}
+		if x {
+			na++
+		}
+		if y {
+			nb++
+		}
+	}
+	return
+}
+
+func TestSimilarityCounts(t *testing.T) {
+	rng := rand.New(rand.NewSource(60))
+	for _, lens := range [][2]uint{{8, 8}, {3, 17}, {24, 9}, {1, 1}} {
+		a, b := NewBitBuffer(lens[0]), NewBitBuffer(lens[1])
+		for i := uint(0); i < a.LenBits(); i++ {
+			if rng.Intn(3) == 0 {
+				a.Set(i)
+			}
+		}
+		for i := uint(0); i < b.LenBits(); i++ {
+			if rng.Intn(2) == 0 {
+				b.Set(i)
+			}
+		}
+		and, or, xor, andnot, na, nb := naiveCounts(a, b)
+		if got := AndCount(a, b); got != and {
+			t.Errorf("%v: AndCount = %v, want %v", lens, got, and)
+		}
+		if got := OrCount(a, b); got != or {
+			t.Errorf("%v: OrCount = %v, want %v", lens, got, or)
+		}
+		if got, got2 := XorCount(a, b), HammingDistance(b, a); got != xor || got2 != xor {
+			t.Errorf("%v: XorCount = %v, HammingDistance = %v, want %v", lens, got, got2, xor)
+		}
+		if got := AndNotCount(a, b); got != andnot {
+			t.Errorf("%v: AndNotCount = %v, want %v", lens, got, andnot)
+		}
+
+		near := func(name string, got, want float64) {
+			if math.Abs(got-want) > 1e-12 {
+				t.Errorf("%v: %s = %v, want %v", lens, name, got, want)
+			}
+		}
+		near("Jaccard", Jaccard(a, b), float64(and)/float64(or))
+		near("Tanimoto", Tanimoto(a, b), float64(and)/float64(na+nb-and))
+		near("Dice", Dice(a, b), 2*float64(and)/float64(na+nb))
+		near("Cosine", Cosine(a, b), float64(and)/math.Sqrt(float64(na*nb)))
+
+		// the counts agree with materialising the intermediate buffer
+		if a.Clone().Xor(b).CountBitsOn() != xor || a.Clone().AndNot(b).CountBitsOn() != andnot {
+			t.Errorf("%v: counts disagree with Xor() and AndNot()", lens)
+		}
+	}
+}
+
+func TestSimilarityEdgeCases(t *testing.T) {
+	empty, other := NewBitBuffer(8), NewBitBuffer(2)
+	other.Set(3)
+	for _, tc := range []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"Jaccard(empty, empty)", Jaccard(empty, empty), 1},
+		{"Dice(empty, empty)", Dice(empty, empty), 1},
+		{"Cosine(empty, empty)", Cosine(empty, empty), 1},
+		{"Jaccard(empty, other)", Jaccard(empty, other), 0},
+		{"Cosine(empty, other)", Cosine(empty, other), 0},
+		{"Cosine(other, other)", Cosine(other, other), 1},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%s = %v, want %v", tc.name, tc.got, tc.want)
+		}
+	}
+
+	// generic over the word width
+	a, b := NewBits[uint8](3), NewBits[uint8](1)
+	a.Set(0).Set(20)
+	b.Set(0).Set(1)
+	if HammingDistance(a, b) != 2 || AndCount(a, b) != 1 {
+		t.Errorf("uint8 words: %v %v", HammingDistance(a, b), AndCount(a, b))
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		HammingDistance(a, b)
+		OrCount(a, b)
+		AndNotCount(a, b)
+		Jaccard(a, b)
+		Cosine(a, b)
+	})
+	if allocs != 0 {
+		t.Errorf("%v allocations per run", allocs)
+	}
+}
+
+func BenchmarkHammingDistance(b *testing.B) {
+	x, y := NewBitBuffer(1<<12), NewBitBuffer(1<<12)
+	x.SetRange(0, 1<<14)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		HammingDistance(x, y)
+	}
+}
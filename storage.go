@@ -0,0 +1,88 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"errors"
+	"slices"
+)
+
+var (
+	// returned when growing storage that was opened read-only
+	ErrReadOnly = errors.New("mbits: storage is read-only")
+	// returned when words can't be shared with a file in canonical layout
+	ErrNotLittleEndian = errors.New("mbits: file storage requires a little-endian host")
+	// returned by file storage on platforms without mmap support
+	ErrUnsupported = errors.New("mbits: file storage is not supported on this platform")
+	// returned when using storage after Close
+	ErrClosed = errors.New("mbits: storage is closed")
+)
+
+// Storage holds the words a Bits sits on
+type Storage[W Word] interface {
+	// returns all the words, the slice is valid until the next Grow
+	Words() []W
+	// number of words
+	Len() uint
+	// grows to nwords words, new words are zero
+	Grow(nwords uint) error
+	// flushes the words to the backing medium, if any
+	Sync() error
+}
+
+// HeapStorage keeps the words in a Go slice
+type HeapStorage[W Word] struct {
+	words []W
+}
+
+// constructs a HeapStorage holding nwords zero words and returns pointer to instance
+func NewHeapStorage[W Word](nwords uint) *HeapStorage[W] {
+	return &HeapStorage[W]{words: make([]W, nwords)}
+}
+
+func (s *HeapStorage[W]) Words() []W {
+	return s.words
+}
+
+func (s *HeapStorage[W]) Len() uint {
+	return uint(len(s.words))
+}
+
+// grows with the usual amortized slice growth, so setting bits one after
+// another past the end doesn't copy the whole buffer every time
+func (s *HeapStorage[W]) Grow(nwords uint) error {
+	l := uint(len(s.words))
+	if nwords > l {
+		s.words = slices.Grow(s.words, int(nwords-l))[:nwords]
+	}
+	return nil
+}
+
+// nothing to flush, always succeeds
+func (s *HeapStorage[W]) Sync() error {
+	return nil
+}
@@ -0,0 +1,290 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// mremap flags, from linux/mman.h
+const (
+	kmremapMaymove = 1
+	kmremapFixed   = 2
+)
+
+// FileStorage keeps the words in a memory-mapped file, the OS pages them in
+// and out as needed so the file can be much larger than RAM
+// the words are stored in the file in canonical layout, so the file can be
+// read back as raw bytes with LoadBuffer()
+// growing extends the file and the mapping geometrically, Sync() and Close()
+// trim the file back to the words in use
+type FileStorage[W Word] struct {
+	file *os.File
+	// bytes reserved at the start of the file, ahead of the words
+	off uint
+	// the whole mapping, reserved bytes included
+	data []byte
+	// all the words the mapping holds, Len() of them are in use
+	words  []W
+	nwords uint
+	// the file size, and the size it has with nwords words or as opened
+	file_size, size uint
+	writable        bool
+}
+
+// maps the file at path, creating it if writable and missing
+// the file size is rounded down to whole words
+func OpenFileStorage[W Word](path string, writable bool) (*FileStorage[W], error) {
+	flag := os.O_RDONLY
+	if writable {
+		flag = os.O_RDWR | os.O_CREATE
+	}
+	f, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newFileStorage[W](f, 0, writable)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// maps f, the words start off bytes into the file
+// off must be a multiple of the word size
+func newFileStorage[W Word](f *os.File, off uint, writable bool) (*FileStorage[W], error) {
+	if !nativeLittleEndian && wordBytesOf[W]() > 1 {
+		return nil, ErrNotLittleEndian
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := uint(fi.Size())
+	if size < off {
+		return nil, fmt.Errorf("mbits: file %v is shorter than %v bytes", f.Name(), off)
+	}
+	s := &FileStorage[W]{file: f, off: off, writable: writable, file_size: size, size: size}
+	if err := s.mmap(size); err != nil {
+		return nil, err
+	}
+	s.nwords = uint(len(s.words))
+	return s, nil
+}
+
+// maps size bytes of the file, replacing the current mapping
+func (s *FileStorage[W]) mmap(size uint) error {
+	data, err := s.mapFile(size)
+	if err != nil {
+		return err
+	}
+	s.adopt(data)
+	return nil
+}
+
+// returns a new mapping of size bytes of the file, the current one is left
+// as it is
+func (s *FileStorage[W]) mapFile(size uint) ([]byte, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	prot := syscall.PROT_READ
+	if s.writable {
+		prot |= syscall.PROT_WRITE
+	}
+	data, err := syscall.Mmap(int(s.file.Fd()), 0, int(size), prot, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("mbits: mmap %v: %w", s.file.Name(), err)
+	}
+	return data, nil
+}
+
+// makes data the current mapping
+func (s *FileStorage[W]) adopt(data []byte) {
+	s.data, s.words = data, nil
+	if data == nil {
+		return
+	}
+	nwords := (uint(len(data)) - s.off) / wordBytesOf[W]()
+	if nwords > 0 {
+		s.words = unsafe.Slice((*W)(unsafe.Pointer(&data[s.off])), nwords)
+	}
+}
+
+// unmaps the file, outstanding Words() slices must not be used afterwards
+func (s *FileStorage[W]) munmap() error {
+	if s.data == nil {
+		return nil
+	}
+	err := syscall.Munmap(s.data)
+	s.data, s.words, s.nwords = nil, nil, 0
+	return err
+}
+
+// replaces the mapping with anonymous zero pages at the same address, so
+// outstanding Words() slices read zeros and their writes go nowhere instead
+// of faulting
+// the zero pages are moved over the old range with mremap, which discards
+// the file pages in the same step, and are never released: their address
+// range stays reserved for as long as the process lives, a small price
+// next to a fault
+func (s *FileStorage[W]) invalidate() error {
+	if s.data == nil {
+		return nil
+	}
+	zeros, err := syscall.Mmap(-1, 0, len(s.data), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return fmt.Errorf("mbits: remap %v: %w", s.file.Name(), err)
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_MREMAP, uintptr(unsafe.Pointer(&zeros[0])), uintptr(len(zeros)),
+		uintptr(len(s.data)), kmremapMaymove|kmremapFixed, uintptr(unsafe.Pointer(&s.data[0])), 0)
+	if errno != 0 {
+		syscall.Munmap(zeros)
+		return fmt.Errorf("mbits: remap %v: %w", s.file.Name(), errno)
+	}
+	s.data, s.words, s.nwords = nil, nil, 0
+	return nil
+}
+
+func (s *FileStorage[W]) Words() []W {
+	return s.words[:s.nwords]
+}
+
+func (s *FileStorage[W]) Len() uint {
+	return s.nwords
+}
+
+// returns true if the file was opened read-only
+func (s *FileStorage[W]) ReadOnly() bool {
+	return !s.writable
+}
+
+// extends the file with ftruncate and maps it again
+// grows to at least twice the current size, rounded up to whole pages, so
+// setting bits one after another past the end remaps O(log n) times, the
+// words past nwords are zero and trimmed off again by Sync() and Close()
+// the new size is mapped before the old mapping is released, on failure
+// the storage is left as it was
+// slices returned by Words() before the call must not be used afterwards
+func (s *FileStorage[W]) Grow(nwords uint) error {
+	if s.file == nil {
+		return ErrClosed
+	}
+	if !s.writable {
+		return ErrReadOnly
+	}
+	if nwords <= s.nwords {
+		return nil
+	}
+	need := s.off + nwords*wordBytesOf[W]()
+	if nwords <= uint(len(s.words)) {
+		// mapped already, the file may have been trimmed below it
+		if need > s.file_size {
+			if err := s.file.Truncate(int64(len(s.data))); err != nil {
+				return err
+			}
+			s.file_size = uint(len(s.data))
+		}
+		s.nwords, s.size = nwords, max(s.size, need)
+		return nil
+	}
+
+	old_size := uint(len(s.data))
+	size := max(need, 2*old_size)
+	// whole pages that hold whole words
+	page := uint(os.Getpagesize())
+	size = (size + page - 1) / page * page
+	size -= (size - s.off) % wordBytesOf[W]()
+
+	if err := s.file.Truncate(int64(size)); err != nil {
+		return err
+	}
+	data, err := s.mapFile(size)
+	if err != nil {
+		// best effort, the extra bytes are zeros either way
+		s.file.Truncate(int64(s.file_size))
+		return err
+	}
+	if err := s.munmap(); err != nil {
+		syscall.Munmap(data)
+		return err
+	}
+	s.adopt(data)
+	s.file_size = size
+	s.nwords, s.size = nwords, max(s.size, need)
+	return nil
+}
+
+// truncates the file to the words in use, the mapping stays as it is, the
+// words past them are never touched until Grow extends the file again
+func (s *FileStorage[W]) trim() error {
+	if !s.writable || s.file_size <= s.size {
+		return nil
+	}
+	if err := s.file.Truncate(int64(s.size)); err != nil {
+		return err
+	}
+	s.file_size = s.size
+	return nil
+}
+
+// writes dirty pages back to the file with msync and waits for completion
+func (s *FileStorage[W]) Sync() error {
+	if s.file == nil {
+		return ErrClosed
+	}
+	if s.data == nil || !s.writable {
+		return nil
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&s.data[0])), uintptr(min(s.size, s.file_size)), syscall.MS_SYNC)
+	if errno != 0 {
+		return fmt.Errorf("mbits: msync %v: %w", s.file.Name(), errno)
+	}
+	return s.trim()
+}
+
+// unmaps and closes the file, the storage can't be used afterwards
+// doesn't sync, the OS still writes dirty pages back eventually, but trims
+// the file to the words in use
+func (s *FileStorage[W]) Close() error {
+	if s.file == nil {
+		return ErrClosed
+	}
+	err := s.trim()
+	if merr := s.munmap(); err == nil {
+		err = merr
+	}
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	s.file = nil
+	return err
+}
@@ -0,0 +1,183 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStorageGrowAndReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bits")
+
+	s, err := OpenFileStorage[uint64](path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBitsWithStorage[uint64](s)
+	if b.LenBytes() != 0 || b.IsSet(0) {
+		t.Fatal("New file should be empty")
+	}
+
+	b.Set(3).
+		Set(70).
+		Set(1000)
+	on := b.CountBitsOn()
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// grown a page at a time, trimmed to the words in use
+	if len(raw) != 128 || raw[0] != 0x08 || raw[8] != 0x40 || raw[125] != 0x01 {
+		t.Fatalf("File not in canonical layout, %x", raw)
+	}
+
+	s, err = OpenFileStorage[uint64](path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	b = NewBitsWithStorage[uint64](s)
+	if b.CountBitsOn() != on || !b.IsSet(1000) {
+		t.Fatalf("Reopen fail, %v bits on", b.CountBitsOn())
+	}
+	if !bytes.Equal(b.Bytes(), raw) {
+		t.Fatal("Bytes differ from file")
+	}
+	if err := s.Grow(100); err != ErrReadOnly {
+		t.Fatalf("Expected ErrReadOnly, found %v", err)
+	}
+}
+
+func TestFileStorageGrowsGeometrically(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bits")
+	s, err := OpenFileStorage[uint64](path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	b := NewBitsWithStorage[uint64](s)
+
+	// setting bits one after another past the end remaps O(log n) times
+	// short of a power of two, so the mapping has words to spare
+	const nbits = 1<<24 - 1000
+	remaps, size := 0, 0
+	for i := uint(0); i < nbits; i += 7 {
+		b.Set(i)
+		if len(s.data) != size {
+			remaps++
+			size = len(s.data)
+		}
+	}
+	if remaps > 16 {
+		t.Fatalf("%v remaps growing to %v bytes", remaps, size)
+	}
+	if on := b.CountBitsOn(); on != (nbits+6)/7 {
+		t.Fatalf("%v bits on", on)
+	}
+
+	// Sync() trims the file to the raw bytes, growing again within the
+	// mapping extends it back
+	fileLen := func() uint {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return uint(fi.Size())
+	}
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if fileLen() != b.LenBytes() {
+		t.Fatalf("File is %v bytes, expected %v", fileLen(), b.LenBytes())
+	}
+	last := b.LenBytes()*KBITS_PER_BYTE + 100
+	b.Set(last)
+	if len(s.data) != size {
+		t.Fatal("Growing within the mapping remapped")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewBitBuffer(0).LoadBuffer(raw)
+	if uint(len(raw)) != b.LenBytes() || !loaded.IsSet(last) || loaded.CountBitsOn() != (nbits+6)/7+1 {
+		t.Fatalf("Reread %v bytes, expected %v", len(raw), b.LenBytes())
+	}
+}
+
+func TestFileStorageSparse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sparse")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 64 MiB of holes, nothing is read into memory until touched
+	if err := f.Truncate(64 << 20); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	s, err := OpenFileStorage[uint64](path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	b := NewBitsWithStorage[uint64](s)
+	last := b.LenBits() - 1
+	b.Set(0).Set(last)
+	if !b.IsSet(last) || b.CountBitsOn() != 2 {
+		t.Fatalf("Sparse fail, %v bits on", b.CountBitsOn())
+	}
+}
+
+func TestFileStorageClosed(t *testing.T) {
+	s, err := OpenFileStorage[uint32](filepath.Join(t.TempDir(), "closed"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if err := s.Grow(4); err != ErrClosed {
+		t.Fatalf("Expected ErrClosed, found %v", err)
+	}
+	if err := s.Close(); err != ErrClosed {
+		t.Fatalf("Expected ErrClosed, found %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+//go:build !linux
+
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// FileStorage keeps the words in a memory-mapped file, only available on linux
+type FileStorage[W Word] struct{}
+
+// always fails with ErrUnsupported
+func OpenFileStorage[W Word](path string, writable bool) (*FileStorage[W], error) {
+	return nil, ErrUnsupported
+}
+
+func (s *FileStorage[W]) Words() []W {
+	return nil
+}
+
+func (s *FileStorage[W]) Len() uint {
+	return 0
+}
+
+func (s *FileStorage[W]) ReadOnly() bool {
+	return true
+}
+
+func (s *FileStorage[W]) Grow(nwords uint) error {
+	return ErrUnsupported
+}
+
+func (s *FileStorage[W]) Sync() error {
+	return ErrUnsupported
+}
+
+func (s *FileStorage[W]) Close() error {
+	return ErrUnsupported
+}
@@ -0,0 +1,71 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHeapStorage(t *testing.T) {
+	s := NewHeapStorage[uint32](2)
+	s.Words()[1] = 0x80000001
+
+	b := NewBitsWithStorage[uint32](s)
+	if b.LenBytes() != 8 || !b.IsSet(32) || !b.IsSet(63) {
+		t.Fatalf("Adopt fail, %v bytes, %v", b.LenBytes(), b.String())
+	}
+
+	b.Set(100)
+	if s.Len() != 4 || s.Words()[3] != 1<<4 {
+		t.Fatalf("Grow fail, %v words, %x", s.Len(), s.Words())
+	}
+
+	if err := b.Sync(); err != nil {
+		t.Fatalf("Sync fail, %v", err)
+	}
+}
+
+func TestStorageShrinkKeepsZeroTail(t *testing.T) {
+	b := NewBitBuffer(32)
+	b.SetOnAll()
+	b.SetBufferLen(4)
+	b.Set(200)
+
+	expected := make([]byte, 32)
+	expected[25] = 0x01
+	if !bytes.Equal(b.Bytes(), expected) {
+		t.Fatalf("Stale words after shrink, %x", b.Bytes())
+	}
+}
+
+func TestIsSetDoesNotGrow(t *testing.T) {
+	b := NewBitBuffer(1)
+	if b.IsSet(1000) || b.LenBytes() != 1 {
+		t.Fatalf("IsSet grew the buffer to %v bytes", b.LenBytes())
+	}
+}
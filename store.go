@@ -0,0 +1,428 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// StoreFlags control how OpenBitmapStore opens a store
+type StoreFlags uint
+
+const (
+	// don't fsync the log after every entry, only on Sync(), Checkpoint()
+	// and Close(), entries written since may be lost on power failure
+	KSTORE_NO_SYNC StoreFlags = 1 << iota
+)
+
+const (
+	// size of a log entry:
+	//
+	//	[0]     op
+	//	[1:9)   first bit, little-endian
+	//	[9:17)  one past the last bit, little-endian
+	//	[17:21) CRC-32C of [0:17), little-endian
+	KWAL_RECORD_BYTES = uint(21)
+	// bits a store holds at most, 512 MiB worth as in a Redis string,
+	// mutations past it are refused rather than logged
+	KSTORE_MAX_BITS = uint(math.MaxUint32)
+)
+
+// log entry ops, all of them assign bits rather than flip them, so replaying
+// a log on top of a checkpoint that already holds some of it is harmless
+const (
+	walOpSet byte = iota + 1
+	walOpClear
+	walOpSetRange
+	walOpClearRange
+)
+
+// the log file, *os.File but for tests
+type walFile interface {
+	io.ReadWriteCloser
+	Truncate(size int64) error
+	Sync() error
+}
+
+// file names inside the store directory
+const (
+	kstoreCheckpoint    = "checkpoint"
+	kstoreCheckpointTmp = "checkpoint.tmp"
+	kstoreLog           = "wal"
+)
+
+// returned when a store's checkpoint or log is damaged beyond a torn last entry
+var ErrCorrupt = errors.New("mbits: store is corrupt")
+
+// returned by every mutation after writing or syncing the log failed, the
+// log may then hold an entry the buffer doesn't, reopen the store to recover
+// what made it to disk
+var ErrStoreFailed = errors.New("mbits: store failed, reopen it")
+
+// returned by mutations outside [0, KSTORE_MAX_BITS), nothing is logged
+var ErrStoreRange = errors.New("mbits: bit index out of range for a store")
+
+// CRC-32C, used by the on-disk formats
+var kcrc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// BitmapStore is a durable BitBuffer: every mutation is appended to a
+// write-ahead log before it is applied, and the whole buffer is written to a
+// checkpoint every so often, after which the log starts over
+//
+// a mutation is applied only once its entry is written and synced, if that
+// fails the store stops taking mutations, see ErrStoreFailed, since after a
+// failed fsync there is no telling what the log holds
+type BitmapStore struct {
+	dir   string
+	bits  *BitBuffer
+	wal   walFile
+	flags StoreFlags
+	// set once the log can't be trusted to match the buffer
+	failed error
+	// size of the log up to the last complete entry
+	wal_size int64
+	// checkpoint after this many log entries, 0 means only when asked
+	checkpoint_every uint
+	// log entries since the last checkpoint
+	entries uint
+}
+
+// opens the store in dir, creating it if needed, and recovers its state from
+// the last checkpoint and the log, a torn last log entry is dropped
+// checkpoints are taken every checkpoint_every entries, 0 means only when
+// Checkpoint() is called
+func OpenBitmapStore(dir string, checkpoint_every uint, flags StoreFlags) (*BitmapStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	// a checkpoint that didn't make it to the rename is of no use
+	if err := os.Remove(filepath.Join(dir, kstoreCheckpointTmp)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	bits, err := loadCheckpoint(filepath.Join(dir, kstoreCheckpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, kstoreLog), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &BitmapStore{
+		dir:              dir,
+		bits:             bits,
+		wal:              wal,
+		flags:            flags,
+		checkpoint_every: checkpoint_every,
+	}
+	if err := s.replay(); err != nil {
+		wal.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// reads a checkpoint, a missing one means an empty buffer
+func loadCheckpoint(path string) (*BitBuffer, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return NewBitBuffer(0), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 4 {
+		return nil, ErrCorrupt
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(body, kcrc32c) != sum {
+		return nil, ErrCorrupt
+	}
+	r := &BitBuffer{}
+	if err := r.UnmarshalBinary(body); err != nil {
+		return nil, errors.Join(ErrCorrupt, err)
+	}
+	return r, nil
+}
+
+// applies the log to the buffer, cutting off a torn last entry
+func (s *BitmapStore) replay() error {
+	data, err := io.ReadAll(s.wal)
+	if err != nil {
+		return err
+	}
+	good := uint(0)
+	for good+KWAL_RECORD_BYTES <= uint(len(data)) {
+		rec := data[good : good+KWAL_RECORD_BYTES]
+		op, from, to, ok := decodeWalRecord(rec)
+		if !ok {
+			if good+KWAL_RECORD_BYTES < uint(len(data)) {
+				// damage before the last entry isn't a torn write
+				return ErrCorrupt
+			}
+			break
+		}
+		s.apply(op, from, to)
+		s.entries++
+		good += KWAL_RECORD_BYTES
+	}
+	s.wal_size = int64(good)
+	if good < uint(len(data)) {
+		if err := s.wal.Truncate(s.wal_size); err != nil {
+			return err
+		}
+		return s.wal.Sync()
+	}
+	return nil
+}
+
+// encodes a log entry into rec
+func encodeWalRecord(rec []byte, op byte, from, to uint) {
+	rec[0] = op
+	binary.LittleEndian.PutUint64(rec[1:], uint64(from))
+	binary.LittleEndian.PutUint64(rec[9:], uint64(to))
+	binary.LittleEndian.PutUint32(rec[17:], crc32.Checksum(rec[:17], kcrc32c))
+}
+
+// decodes a log entry, ok is false if it's damaged
+func decodeWalRecord(rec []byte) (op byte, from, to uint, ok bool) {
+	if crc32.Checksum(rec[:17], kcrc32c) != binary.LittleEndian.Uint32(rec[17:]) {
+		return
+	}
+	op = rec[0]
+	from64, to64 := binary.LittleEndian.Uint64(rec[1:]), binary.LittleEndian.Uint64(rec[9:])
+	// checked before narrowing to uint
+	if to64 > uint64(KSTORE_MAX_BITS) {
+		return
+	}
+	from, to = uint(from64), uint(to64)
+	ok = op >= walOpSet && op <= walOpClearRange && from < to
+	return
+}
+
+// applies a log entry to the buffer
+func (s *BitmapStore) apply(op byte, from, to uint) {
+	switch op {
+	case walOpSet:
+		s.bits.Set(from)
+	case walOpClear:
+		s.bits.Clear(from)
+	case walOpSetRange:
+		s.bits.SetRange(from, to)
+	case walOpClearRange:
+		s.bits.ClearRange(from, to)
+	}
+}
+
+// returns the error that stops mutations, if any
+func (s *BitmapStore) usable() error {
+	if s.wal == nil {
+		return ErrClosed
+	}
+	return s.failed
+}
+
+// stops further mutations, returns the error they will get
+func (s *BitmapStore) fail(err error) error {
+	s.failed = errors.Join(ErrStoreFailed, err)
+	return s.failed
+}
+
+// logs an entry, then applies it
+func (s *BitmapStore) append(op byte, from, to uint) error {
+	if err := s.usable(); err != nil {
+		return err
+	}
+	// replay refuses what it couldn't apply, so it's never logged
+	if from >= to || to > KSTORE_MAX_BITS {
+		return fmt.Errorf("%w: [%v, %v)", ErrStoreRange, from, to)
+	}
+	var rec [KWAL_RECORD_BYTES]byte
+	encodeWalRecord(rec[:], op, from, to)
+	if _, err := s.wal.Write(rec[:]); err != nil {
+		// don't leave half an entry for the next one to land behind
+		if terr := s.wal.Truncate(s.wal_size); terr != nil {
+			return s.fail(errors.Join(err, terr))
+		}
+		return err
+	}
+	s.wal_size += int64(KWAL_RECORD_BYTES)
+	if s.flags&KSTORE_NO_SYNC == 0 {
+		if err := s.wal.Sync(); err != nil {
+			// the entry may or may not be on disk, so it isn't applied
+			return s.fail(err)
+		}
+	}
+	s.apply(op, from, to)
+	s.entries++
+	if s.checkpoint_every > 0 && s.entries >= s.checkpoint_every {
+		return s.Checkpoint()
+	}
+	return nil
+}
+
+// turn bit on at index, durably
+func (s *BitmapStore) Set(bitIndex uint) error {
+	return s.append(walOpSet, bitIndex, bitIndex+1)
+}
+
+// set bit off at index, durably
+func (s *BitmapStore) Clear(bitIndex uint) error {
+	return s.append(walOpClear, bitIndex, bitIndex+1)
+}
+
+// turn bits on in range [from, to), durably
+func (s *BitmapStore) SetRange(from, to uint) error {
+	if from >= to {
+		return nil
+	}
+	return s.append(walOpSetRange, from, to)
+}
+
+// turn bits off in range [from, to), durably
+func (s *BitmapStore) ClearRange(from, to uint) error {
+	if from >= to {
+		return nil
+	}
+	return s.append(walOpClearRange, from, to)
+}
+
+// returns true if bit at index is set
+func (s *BitmapStore) IsSet(bitIndex uint) bool {
+	return s.bits.IsSet(bitIndex)
+}
+
+// returns the count of on and off bits
+func (s *BitmapStore) CountBits() (on uint, off uint) {
+	return s.bits.CountBits()
+}
+
+// length of the buffer in bits
+func (s *BitmapStore) LenBits() uint {
+	return s.bits.LenBits()
+}
+
+// returns a copy of the current state
+func (s *BitmapStore) Bits() *BitBuffer {
+	return s.bits.Clone()
+}
+
+// number of log entries since the last checkpoint
+func (s *BitmapStore) LogEntries() uint {
+	return s.entries
+}
+
+// writes the whole buffer to a new checkpoint and empties the log
+// the checkpoint is written to a temporary file and renamed over the old
+// one, so a crash leaves either the old checkpoint and full log, or the new
+// checkpoint with a log it already contains
+func (s *BitmapStore) Checkpoint() error {
+	if err := s.usable(); err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, kstoreCheckpointTmp)
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	h := crc32.New(kcrc32c)
+	_, err = s.bits.WriteTo(io.MultiWriter(f, h))
+	if err == nil {
+		_, err = f.Write(binary.LittleEndian.AppendUint32(nil, h.Sum32()))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(s.dir, kstoreCheckpoint))
+	}
+	if err == nil {
+		err = syncDir(s.dir)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := s.wal.Truncate(0); err != nil {
+		return s.fail(err)
+	}
+	s.wal_size = 0
+	s.entries = 0
+	if err := s.wal.Sync(); err != nil {
+		return s.fail(err)
+	}
+	return nil
+}
+
+// flushes the log to disk
+func (s *BitmapStore) Sync() error {
+	if err := s.usable(); err != nil {
+		return err
+	}
+	if err := s.wal.Sync(); err != nil {
+		return s.fail(err)
+	}
+	return nil
+}
+
+// flushes and closes the log, the store can't be used afterwards
+func (s *BitmapStore) Close() error {
+	if s.wal == nil {
+		return ErrClosed
+	}
+	err := s.wal.Sync()
+	if cerr := s.wal.Close(); err == nil {
+		err = cerr
+	}
+	s.wal = nil
+	return err
+}
+
+// makes a rename in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
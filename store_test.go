@@ -0,0 +1,373 @@
+package mbits
+
+// Copyright(c) Dorin Duminica. All rights reserved.
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//   1. Redistributions of source code must retain the above copyright notice,
+// 	 this list of conditions and the following disclaimer.
+//
+//   2. Redistributions in binary form must reproduce the above copyright notice,
+// 	 this list of conditions and the following disclaimer in the documentation
+// 	 and/or other materials provided with the distribution.
+//
+//   3. Neither the name of the copyright holder nor the names of its
+// 	 contributors may be used to endorse or promote products derived from this
+// 	 software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// a store op, mirrored on a plain BitBuffer to know what to expect
+type storeOp struct {
+	op       byte
+	from, to uint
+}
+
+var storeOps = []storeOp{
+	{walOpSet, 3, 4},
+	{walOpSetRange, 10, 200},
+	{walOpClear, 50, 51},
+	{walOpSet, 1000, 1001},
+	{walOpClearRange, 100, 150},
+	{walOpSet, 50, 51},
+	{walOpSetRange, 2000, 2003},
+	{walOpClear, 3, 4},
+}
+
+func runStoreOp(t *testing.T, s *BitmapStore, o storeOp) {
+	var err error
+	switch o.op {
+	case walOpSet:
+		err = s.Set(o.from)
+	case walOpClear:
+		err = s.Clear(o.from)
+	case walOpSetRange:
+		err = s.SetRange(o.from, o.to)
+	case walOpClearRange:
+		err = s.ClearRange(o.from, o.to)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// the state after the first n ops
+func expectedState(n int) *BitBuffer {
+	s := &BitmapStore{bits: NewBitBuffer(0)}
+	for _, o := range storeOps[:n] {
+		s.apply(o.op, o.from, o.to)
+	}
+	return s.bits
+}
+
+func TestBitmapStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenBitmapStore(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range storeOps {
+		runStoreOp(t, s, o)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(1); err != ErrClosed {
+		t.Fatalf("Expected ErrClosed, found %v", err)
+	}
+
+	s, err = OpenBitmapStore(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Bits().CmpWith(expectedState(len(storeOps))) != 0 {
+		t.Fatalf("Replay fail,\n%v", s.Bits())
+	}
+	if s.LogEntries() != uint(len(storeOps)) {
+		t.Fatalf("Expected %v entries, found %v", len(storeOps), s.LogEntries())
+	}
+}
+
+func TestBitmapStoreCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenBitmapStore(dir, 3, KSTORE_NO_SYNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range storeOps {
+		runStoreOp(t, s, o)
+	}
+	// 8 ops, checkpoints after the 3rd and the 6th
+	if s.LogEntries() != 2 {
+		t.Fatalf("Expected 2 entries, found %v", s.LogEntries())
+	}
+	fi, err := os.Stat(filepath.Join(dir, kstoreLog))
+	if err != nil || uint(fi.Size()) != 2*KWAL_RECORD_BYTES {
+		t.Fatalf("Log not truncated, %v", fi.Size())
+	}
+	s.Close()
+
+	s, err = OpenBitmapStore(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Bits().CmpWith(expectedState(len(storeOps))) != 0 {
+		t.Fatal("Checkpoint and replay fail")
+	}
+}
+
+// builds a store holding a checkpoint of the first ops and a log of the rest,
+// returns the raw checkpoint and log files
+func storeFiles(t *testing.T, checkpointed int) ([]byte, []byte) {
+	dir := t.TempDir()
+	s, err := OpenBitmapStore(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, o := range storeOps {
+		if i == checkpointed {
+			if err := s.Checkpoint(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		runStoreOp(t, s, o)
+	}
+	s.Close()
+	checkpoint, _ := os.ReadFile(filepath.Join(dir, kstoreCheckpoint))
+	wal, err := os.ReadFile(filepath.Join(dir, kstoreLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return checkpoint, wal
+}
+
+// writes a store directory as a crash could have left it
+func writeStoreFiles(t *testing.T, checkpoint, wal []byte) string {
+	dir := t.TempDir()
+	if checkpoint != nil {
+		if err := os.WriteFile(filepath.Join(dir, kstoreCheckpoint), checkpoint, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, kstoreLog), wal, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestBitmapStoreTornLog(t *testing.T) {
+	for _, checkpointed := range []int{0, 4} {
+		checkpoint, wal := storeFiles(t, checkpointed)
+
+		// a crash can stop the log at any byte
+		for l := 0; l <= len(wal); l++ {
+			dir := writeStoreFiles(t, checkpoint, wal[:l])
+			s, err := OpenBitmapStore(dir, 0, 0)
+			if err != nil {
+				t.Fatalf("Recovery at %v bytes fail, %v", l, err)
+			}
+			complete := l / int(KWAL_RECORD_BYTES)
+			if s.Bits().CmpWith(expectedState(checkpointed+complete)) != 0 {
+				t.Fatalf("Recovery at %v bytes, wrong state", l)
+			}
+
+			// the torn entry is gone, new entries land after the good ones
+			if err := s.Set(5000); err != nil {
+				t.Fatal(err)
+			}
+			s.Close()
+			s, err = OpenBitmapStore(dir, 0, 0)
+			if err != nil {
+				t.Fatalf("Reopen after recovery at %v bytes fail, %v", l, err)
+			}
+			if !s.IsSet(5000) || s.LogEntries() != uint(complete+1) {
+				t.Fatalf("Append after recovery at %v bytes fail", l)
+			}
+			s.Close()
+		}
+	}
+}
+
+func TestBitmapStoreCheckpointCrash(t *testing.T) {
+	old_checkpoint, wal := storeFiles(t, 0)
+	new_checkpoint, _ := storeFiles(t, len(storeOps))
+	expected := expectedState(len(storeOps))
+
+	cases := []struct {
+		name       string
+		checkpoint []byte
+		tmp        []byte
+	}{
+		// died while writing the temporary checkpoint
+		{"torn tmp", old_checkpoint, new_checkpoint[:len(new_checkpoint)/2]},
+		// died before the rename
+		{"complete tmp", old_checkpoint, new_checkpoint},
+		// died after the rename, before the log was truncated
+		{"renamed", new_checkpoint, nil},
+	}
+	for _, c := range cases {
+		dir := writeStoreFiles(t, c.checkpoint, wal)
+		if c.tmp != nil {
+			os.WriteFile(filepath.Join(dir, kstoreCheckpointTmp), c.tmp, 0644)
+		}
+		s, err := OpenBitmapStore(dir, 0, 0)
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		if s.Bits().CmpWith(expected) != 0 {
+			t.Fatalf("%v: wrong state", c.name)
+		}
+		if _, err := os.Stat(filepath.Join(dir, kstoreCheckpointTmp)); !os.IsNotExist(err) {
+			t.Fatalf("%v: temporary checkpoint left behind", c.name)
+		}
+		s.Close()
+	}
+}
+
+func TestBitmapStoreCorrupt(t *testing.T) {
+	checkpoint, wal := storeFiles(t, 4)
+
+	damaged := append([]byte{}, wal...)
+	damaged[KWAL_RECORD_BYTES+3] ^= 0xff
+	if _, err := OpenBitmapStore(writeStoreFiles(t, checkpoint, damaged), 0, 0); err != ErrCorrupt {
+		t.Fatalf("Expected ErrCorrupt for the log, found %v", err)
+	}
+
+	damaged = append([]byte{}, checkpoint...)
+	damaged[len(damaged)-5] ^= 0x01
+	if _, err := OpenBitmapStore(writeStoreFiles(t, damaged, wal), 0, 0); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Expected ErrCorrupt for the checkpoint, found %v", err)
+	}
+}
+
+// a log whose fsync fails, the way a full or dying disk reports it
+type failingSyncFile struct {
+	*os.File
+}
+
+func (f failingSyncFile) Sync() error {
+	return errors.New("sync failed")
+}
+
+func TestBitmapStoreSyncFailure(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenBitmapStore(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runStoreOp(t, s, storeOps[0])
+	file := s.wal.(*os.File)
+	s.wal = failingSyncFile{file}
+
+	// the entry is written but not synced, so not applied
+	if err := s.Set(7); !errors.Is(err, ErrStoreFailed) {
+		t.Fatalf("Expected ErrStoreFailed, found %v", err)
+	}
+	if s.IsSet(7) || s.Bits().CmpWith(expectedState(1)) != 0 {
+		t.Fatal("Unsynced entry applied")
+	}
+
+	// and the store takes no more, even with a working disk
+	s.wal = file
+	for _, err := range []error{s.Set(8), s.ClearRange(0, 10), s.Sync(), s.Checkpoint()} {
+		if !errors.Is(err, ErrStoreFailed) {
+			t.Fatalf("Expected ErrStoreFailed, found %v", err)
+		}
+	}
+	fi, _ := file.Stat()
+	if uint(fi.Size()) != 2*KWAL_RECORD_BYTES {
+		t.Fatalf("Log written after failure, %v bytes", fi.Size())
+	}
+	s.Close()
+
+	// reopening recovers what made it to the log
+	s, err = OpenBitmapStore(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if !s.IsSet(7) || s.IsSet(8) || !s.IsSet(3) {
+		t.Fatalf("Recovery fail,\n%v", s.Bits())
+	}
+	if err := s.Set(8); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBitmapStoreRange(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenBitmapStore(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runStoreOp(t, s, storeOps[0])
+
+	// to overflows to 0, or lands past the limit
+	refused := []error{s.Set(^uint(0)), s.Clear(^uint(0)), s.Set(KSTORE_MAX_BITS)}
+	if bits.UintSize == 64 {
+		huge := uint(1) << (bits.UintSize - 2)
+		refused = append(refused, s.Set(huge), s.SetRange(0, huge), s.ClearRange(huge-1, huge))
+	}
+	for i, err := range refused {
+		if !errors.Is(err, ErrStoreRange) {
+			t.Fatalf("%v: expected ErrStoreRange, found %v", i, err)
+		}
+	}
+	s.Close()
+
+	s, err = OpenBitmapStore(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.LogEntries() != 1 || !s.IsSet(3) {
+		t.Fatalf("Refused mutations logged, %v entries", s.LogEntries())
+	}
+}
+
+func TestBitmapStoreOutOfRangeRecord(t *testing.T) {
+	// as logged before the range was checked
+	_, wal := storeFiles(t, 0)
+	var rec [KWAL_RECORD_BYTES]byte
+	encodeWalRecord(rec[:], walOpSet, 0, 1)
+	binary.LittleEndian.PutUint64(rec[9:], 1<<62)
+	binary.LittleEndian.PutUint32(rec[17:], crc32.Checksum(rec[:17], kcrc32c))
+
+	// not applied, last it's taken for a torn write, otherwise it's damage
+	dir := writeStoreFiles(t, nil, append(slices.Clone(wal), rec[:]...))
+	s, err := OpenBitmapStore(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Bits().CmpWith(expectedState(len(storeOps))) != 0 {
+		t.Fatal("Recovery fail")
+	}
+	s.Close()
+
+	dir = writeStoreFiles(t, nil, append(rec[:], wal...))
+	if _, err := OpenBitmapStore(dir, 0, 0); err != ErrCorrupt {
+		t.Fatalf("Expected ErrCorrupt, found %v", err)
+	}
+}